@@ -38,6 +38,8 @@ Version:
 Commands:
   start     Start the briefmail server
   shell     Start an interactive administration shell
+  queue     Run a queue administration command without the shell,
+            e.g. "queue list" or "queue retry [id]"
 
 Options:
 `
@@ -66,7 +68,7 @@ func main() {
 	flag.Parse()
 
 	switch commandName := flag.Arg(0); commandName {
-	case "start", "shell":
+	case "start", "shell", "queue":
 		setupConfig(configFilename)
 		setupLogger()
 		runCommand(commandName)
@@ -90,6 +92,11 @@ func runCommand(commandName string) {
 		cmd, err = newStartCommand()
 	case "shell":
 		cmd, err = newShellCommand()
+	case "queue":
+		var shell *shellCommand
+		if shell, err = newShellCommand(); err == nil {
+			cmd = &batchCommand{shell: shell, args: flag.Args()}
+		}
 	}
 
 	if err != nil {
@@ -4,14 +4,27 @@ import (
 	"database/sql"
 	"errors"
 	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/abiosoft/ishell"
 
+	"github.com/lukasdietrich/briefmail/internal/bayes"
+	"github.com/lukasdietrich/briefmail/internal/delivery"
+	"github.com/lukasdietrich/briefmail/internal/model"
+	"github.com/lukasdietrich/briefmail/internal/normalize"
+	"github.com/lukasdietrich/briefmail/internal/sieve"
 	"github.com/lukasdietrich/briefmail/internal/storage"
 )
 
 type shellCommand struct {
-	DB *storage.DB
+	DB    *storage.DB
+	Blobs *storage.Blobs
+	Queue *delivery.QueueWorker
 }
 
 func (s *shellCommand) run() error {
@@ -22,6 +35,22 @@ func (s *shellCommand) run() error {
 	return nil
 }
 
+// batchCommand runs a single shell command non-interactively, e.g.
+// `briefmail queue list`. Errors of the command are returned, so the process
+// exits with a non-zero code. Commands only change the database, the queue
+// worker of the running server picks up the changes.
+type batchCommand struct {
+	shell *shellCommand
+	args  []string
+}
+
+func (b *batchCommand) run() error {
+	shell := ishell.New()
+	b.shell.setupShell(shell)
+
+	return shell.Process(b.args...)
+}
+
 func (s *shellCommand) setupShell(shell *ishell.Shell) {
 	mailbox := ishell.Cmd{
 		Name: "mailbox",
@@ -40,7 +69,299 @@ func (s *shellCommand) setupShell(shell *ishell.Shell) {
 		Func: wrapShellFunc(s.changeMailboxPassword),
 	})
 
+	mailbox.AddCmd(&ishell.Cmd{
+		Name: "apop",
+		Help: "update or disable (empty secret) the pop3 apop secret",
+		Func: wrapShellFunc(s.changeMailboxAPOPSecret),
+	})
+
+	mailbox.AddCmd(&ishell.Cmd{
+		Name: "retention",
+		Help: "show or update how long mails are retained (0 days retains forever)",
+		Func: wrapShellFunc(s.mailboxRetention),
+	})
+
+	mailbox.AddCmd(&ishell.Cmd{
+		Name: "quota",
+		Help: "show quota usage or update the quota (0 is unlimited)",
+		Func: wrapShellFunc(s.mailboxQuota),
+	})
+
 	shell.AddCmd(&mailbox)
+
+	list := ishell.Cmd{
+		Name: "list",
+		Help: "manage mailing list subscribers",
+	}
+
+	list.AddCmd(&ishell.Cmd{
+		Name: "members",
+		Help: "list all subscribers of a mailing list",
+		Func: wrapShellFunc(s.listMembers),
+	})
+
+	list.AddCmd(&ishell.Cmd{
+		Name: "subscribe",
+		Help: "subscribe an address without confirmation",
+		Func: wrapShellFunc(s.subscribeList),
+	})
+
+	list.AddCmd(&ishell.Cmd{
+		Name: "unsubscribe",
+		Help: "unsubscribe an address without confirmation",
+		Func: wrapShellFunc(s.unsubscribeList),
+	})
+
+	shell.AddCmd(&list)
+
+	address := ishell.Cmd{
+		Name: "address",
+		Help: "manage addresses of mailboxes",
+	}
+
+	address.AddCmd(&ishell.Cmd{
+		Name: "list",
+		Help: "list all addresses and aliases",
+		Func: wrapShellFunc(s.listAddresses),
+	})
+
+	address.AddCmd(&ishell.Cmd{
+		Name: "add",
+		Help: "assign an address to a mailbox",
+		Func: wrapShellFunc(s.addAddress),
+	})
+
+	address.AddCmd(&ishell.Cmd{
+		Name: "remove",
+		Help: "remove an address",
+		Func: wrapShellFunc(s.removeAddress("address")),
+	})
+
+	shell.AddCmd(&address)
+
+	alias := ishell.Cmd{
+		Name: "alias",
+		Help: "manage aliases of addresses",
+	}
+
+	alias.AddCmd(&ishell.Cmd{
+		Name: "add",
+		Help: "make an address an alias of another address",
+		Func: wrapShellFunc(s.addAlias),
+	})
+
+	alias.AddCmd(&ishell.Cmd{
+		Name: "remove",
+		Help: "remove an alias",
+		Func: wrapShellFunc(s.removeAddress("alias")),
+	})
+
+	shell.AddCmd(&alias)
+
+	sendAs := ishell.Cmd{
+		Name: "sendas",
+		Help: "manage addresses mailboxes may send as",
+	}
+
+	sendAs.AddCmd(&ishell.Cmd{
+		Name: "list",
+		Help: "list the addresses a mailbox was granted to send as",
+		Func: wrapShellFunc(s.listSendAs),
+	})
+
+	sendAs.AddCmd(&ishell.Cmd{
+		Name: "grant",
+		Help: "allow a mailbox to send as an address or any address of a domain (*@domain)",
+		Func: wrapShellFunc(s.grantSendAs),
+	})
+
+	sendAs.AddCmd(&ishell.Cmd{
+		Name: "revoke",
+		Help: "disallow a mailbox to send as an address",
+		Func: wrapShellFunc(s.revokeSendAs),
+	})
+
+	shell.AddCmd(&sendAs)
+
+	sieveCmd := ishell.Cmd{
+		Name: "sieve",
+		Help: "manage sieve scripts filtering mails of mailboxes",
+	}
+
+	sieveCmd.AddCmd(&ishell.Cmd{
+		Name: "list",
+		Help: "list the scripts of a mailbox",
+		Func: wrapShellFunc(s.listScripts),
+	})
+
+	sieveCmd.AddCmd(&ishell.Cmd{
+		Name: "put",
+		Help: "create or replace a script from a file",
+		Func: wrapShellFunc(s.putScript),
+	})
+
+	sieveCmd.AddCmd(&ishell.Cmd{
+		Name: "show",
+		Help: "show a script",
+		Func: wrapShellFunc(s.showScript),
+	})
+
+	sieveCmd.AddCmd(&ishell.Cmd{
+		Name: "activate",
+		Help: "activate a script or deactivate all scripts if no script is given",
+		Func: wrapShellFunc(s.activateScript),
+	})
+
+	sieveCmd.AddCmd(&ishell.Cmd{
+		Name: "delete",
+		Help: "delete a script",
+		Func: wrapShellFunc(s.deleteScript),
+	})
+
+	shell.AddCmd(&sieveCmd)
+
+	vacation := ishell.Cmd{
+		Name: "vacation",
+		Help: "manage out of office replies of mailboxes",
+	}
+
+	vacation.AddCmd(&ishell.Cmd{
+		Name: "show",
+		Help: "show the out of office settings of a mailbox",
+		Func: wrapShellFunc(s.showVacation),
+	})
+
+	vacation.AddCmd(&ishell.Cmd{
+		Name: "set",
+		Help: "update a setting (subject, body, start, end, days or addresses)",
+		Func: wrapShellFunc(s.setVacation),
+	})
+
+	vacation.AddCmd(&ishell.Cmd{
+		Name: "enable",
+		Help: "start sending out of office replies",
+		Func: wrapShellFunc(s.enableVacation(true)),
+	})
+
+	vacation.AddCmd(&ishell.Cmd{
+		Name: "disable",
+		Help: "stop sending out of office replies, but keep the settings",
+		Func: wrapShellFunc(s.enableVacation(false)),
+	})
+
+	vacation.AddCmd(&ishell.Cmd{
+		Name: "remove",
+		Help: "remove the out of office settings of a mailbox",
+		Func: wrapShellFunc(s.removeVacation),
+	})
+
+	shell.AddCmd(&vacation)
+
+	bayesCmd := ishell.Cmd{
+		Name: "bayes",
+		Help: "train the bayesian spam classifier",
+	}
+
+	bayesCmd.AddCmd(&ishell.Cmd{
+		Name: "status",
+		Help: "show the number of trained mails",
+		Func: wrapShellFunc(s.bayesStatus),
+	})
+
+	bayesCmd.AddCmd(&ishell.Cmd{
+		Name: "train",
+		Help: "train the mails in a folder of a mailbox as spam or ham",
+		Func: wrapShellFunc(s.bayesTrain),
+	})
+
+	bayesCmd.AddCmd(&ishell.Cmd{
+		Name: "import",
+		Help: "train the mails of an mbox file as spam or ham",
+		Func: wrapShellFunc(s.bayesImport),
+	})
+
+	shell.AddCmd(&bayesCmd)
+
+	domain := ishell.Cmd{
+		Name: "domain",
+		Help: "manage domains accepting mails",
+	}
+
+	domain.AddCmd(&ishell.Cmd{
+		Name: "list",
+		Help: "list all domains added with the shell",
+		Func: wrapShellFunc(s.listDomains),
+	})
+
+	domain.AddCmd(&ishell.Cmd{
+		Name: "add",
+		Help: "accept mails to a domain",
+		Func: wrapShellFunc(s.addDomain),
+	})
+
+	domain.AddCmd(&ishell.Cmd{
+		Name: "remove",
+		Help: "stop accepting mails to a domain",
+		Func: wrapShellFunc(s.removeDomain),
+	})
+
+	domain.AddCmd(&ishell.Cmd{
+		Name: "set",
+		Help: "update a setting (catchall, dkim, cert, maxsize or mx) of a domain",
+		Func: wrapShellFunc(s.setDomain),
+	})
+
+	shell.AddCmd(&domain)
+
+	queue := ishell.Cmd{
+		Name: "queue",
+		Help: "manage the outbound queue (the server picks up changes on its next delivery.queue.poll)",
+		Func: wrapShellFunc(s.usageQueue),
+	}
+
+	queue.AddCmd(&ishell.Cmd{
+		Name: "list",
+		Help: "list queued mails",
+		Func: wrapShellFunc(s.listQueue),
+	})
+
+	queue.AddCmd(&ishell.Cmd{
+		Name: "show",
+		Help: "show a queued mail",
+		Func: wrapShellFunc(s.showQueue),
+	})
+
+	queue.AddCmd(&ishell.Cmd{
+		Name: "retry",
+		Help: "schedule delivery of a queued mail on the next delivery.queue.poll",
+		Func: wrapShellFunc(s.retryQueue),
+	})
+
+	queue.AddCmd(&ishell.Cmd{
+		Name: "hold",
+		Help: "exclude a queued mail from delivery",
+		Func: wrapShellFunc(s.holdQueue),
+	})
+
+	queue.AddCmd(&ishell.Cmd{
+		Name: "release",
+		Help: "include a held mail in delivery again on the next delivery.queue.poll",
+		Func: wrapShellFunc(s.releaseQueue),
+	})
+
+	queue.AddCmd(&ishell.Cmd{
+		Name: "delete",
+		Help: "remove a mail from the queue",
+		Func: wrapShellFunc(s.deleteQueue),
+	})
+
+	queue.AddCmd(&ishell.Cmd{
+		Name: "requeue",
+		Help: "queue a mail for a different recipient on the next delivery.queue.poll",
+		Func: wrapShellFunc(s.requeueQueue),
+	})
+
+	shell.AddCmd(&queue)
 }
 
 func (s *shellCommand) addMailbox(ctx *ishell.Context) error {
@@ -108,6 +429,1199 @@ func (s *shellCommand) changeMailboxPassword(ctx *ishell.Context) error {
 	return nil
 }
 
+func (s *shellCommand) changeMailboxAPOPSecret(ctx *ishell.Context) error {
+	if len(ctx.Args) != 1 {
+		return errors.New("Usage: mailbox apop [name]")
+	}
+
+	ctx.Print("Secret: ")
+	secret, err := ctx.ReadPasswordErr()
+	if err != nil {
+		return err
+	}
+
+	if err := s.DB.SetAPOPSecret(ctx.Args[0], secret); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return errors.New("mailbox does not exist")
+		}
+
+		return fmt.Errorf("could not update apop secret: %w", err)
+	}
+
+	if secret == "" {
+		ctx.Printf("apop of %s disabled\n", ctx.Args[0])
+	} else {
+		ctx.Printf("apop secret of %s changed\n", ctx.Args[0])
+	}
+
+	return nil
+}
+
+func (s *shellCommand) mailboxRetention(ctx *ishell.Context) error {
+	if len(ctx.Args) < 1 || len(ctx.Args) > 3 {
+		return errors.New("Usage: mailbox retention [name] [[days] [received|retrieved]]")
+	}
+
+	id, err := s.DB.Mailbox(ctx.Args[0])
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return errors.New("mailbox does not exist")
+		}
+
+		return err
+	}
+
+	if len(ctx.Args) > 1 {
+		days, err := strconv.Atoi(ctx.Args[1])
+		if err != nil || days < 0 {
+			return errors.New("days must be a positive number")
+		}
+
+		retention := storage.Retention{Days: days, Expiry: storage.ExpireReceived}
+		if len(ctx.Args) > 2 {
+			retention.Expiry = ctx.Args[2]
+		}
+
+		if err := s.DB.SetRetention(ctx.Args[0], &retention); err != nil {
+			return fmt.Errorf("could not update retention: %w", err)
+		}
+	}
+
+	retention, err := s.DB.Retention(id)
+	if err != nil {
+		return err
+	}
+
+	if retention.Days == 0 {
+		ctx.Printf("mails of %s are retained forever\n", ctx.Args[0])
+	} else {
+		ctx.Printf("mails of %s are deleted %d days after they were %s\n",
+			ctx.Args[0], retention.Days, retention.Expiry)
+	}
+
+	return nil
+}
+
+func (s *shellCommand) mailboxQuota(ctx *ishell.Context) error {
+	if len(ctx.Args) != 1 && len(ctx.Args) != 3 {
+		return errors.New("Usage: mailbox quota [name] [[size] [messages]]")
+	}
+
+	id, err := s.DB.Mailbox(ctx.Args[0])
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return errors.New("mailbox does not exist")
+		}
+
+		return err
+	}
+
+	if len(ctx.Args) == 3 {
+		size, err := parseSize(ctx.Args[1])
+		if err != nil {
+			return err
+		}
+
+		messages, err := strconv.ParseInt(ctx.Args[2], 10, 64)
+		if err != nil || messages < 0 {
+			return errors.New("messages must be a positive number")
+		}
+
+		quota := storage.Quota{Size: size, Messages: messages}
+		if err := s.DB.SetQuota(ctx.Args[0], &quota); err != nil {
+			return fmt.Errorf("could not update quota: %w", err)
+		}
+	}
+
+	quota, usage, err := s.DB.Quota(id)
+	if err != nil {
+		return err
+	}
+
+	ctx.Printf("%-10s %s\n", "Size:", formatUsage(usage.Size, quota.Size))
+	ctx.Printf("%-10s %s\n", "Messages:", formatUsage(usage.Messages, quota.Messages))
+
+	if usage.Warned {
+		ctx.Println("the owner was warned about reaching the quota")
+	}
+
+	return nil
+}
+
+// parseSize parses a number of bytes with an optional K, M or G suffix.
+func parseSize(raw string) (int64, error) {
+	var (
+		upper = strings.ToUpper(raw)
+		unit  = int64(1)
+	)
+
+	for suffix, factor := range map[string]int64{"K": 1 << 10, "M": 1 << 20, "G": 1 << 30} {
+		if strings.HasSuffix(upper, suffix) {
+			upper = strings.TrimSuffix(upper, suffix)
+			unit = factor
+		}
+	}
+
+	size, err := strconv.ParseInt(upper, 10, 64)
+	if err != nil || size < 0 {
+		return 0, fmt.Errorf("invalid size %q", raw)
+	}
+
+	return size * unit, nil
+}
+
+func formatUsage(used, limit int64) string {
+	if limit == 0 {
+		return fmt.Sprintf("%d (unlimited)", used)
+	}
+
+	return fmt.Sprintf("%d of %d (%d%%)", used, limit, used*100/limit)
+}
+
+func (s *shellCommand) listMembers(ctx *ishell.Context) error {
+	if len(ctx.Args) != 1 {
+		return errors.New("Usage: list members [list]")
+	}
+
+	list, err := model.ParseAddress(ctx.Args[0])
+	if err != nil {
+		return err
+	}
+
+	subscribers, err := s.DB.Subscribers(list)
+	if err != nil {
+		return err
+	}
+
+	for _, subscriber := range subscribers {
+		ctx.Println(subscriber)
+	}
+
+	ctx.Printf("%d subscribers\n", len(subscribers))
+	return nil
+}
+
+func (s *shellCommand) subscribeList(ctx *ishell.Context) error {
+	list, addr, err := parseListArgs(ctx, "subscribe")
+	if err != nil {
+		return err
+	}
+
+	if err := s.DB.Subscribe(list, addr); err != nil {
+		return fmt.Errorf("could not subscribe: %w", err)
+	}
+
+	ctx.Printf("%s subscribed to %s\n", addr, list)
+	return nil
+}
+
+func (s *shellCommand) unsubscribeList(ctx *ishell.Context) error {
+	list, addr, err := parseListArgs(ctx, "unsubscribe")
+	if err != nil {
+		return err
+	}
+
+	if err := s.DB.Unsubscribe(list, addr); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return errors.New("address is not subscribed")
+		}
+
+		return fmt.Errorf("could not unsubscribe: %w", err)
+	}
+
+	ctx.Printf("%s unsubscribed from %s\n", addr, list)
+	return nil
+}
+
+func parseListArgs(ctx *ishell.Context, command string) (*model.Address, *model.Address, error) {
+	if len(ctx.Args) != 2 {
+		return nil, nil, fmt.Errorf("Usage: list %s [list] [address]", command)
+	}
+
+	list, err := model.ParseAddress(ctx.Args[0])
+	if err != nil {
+		return nil, nil, err
+	}
+
+	addr, err := model.ParseAddress(ctx.Args[1])
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return list, addr, nil
+}
+
+func (s *shellCommand) listAddresses(ctx *ishell.Context) error {
+	entries, err := s.DB.Addresses()
+	if err != nil {
+		return err
+	}
+
+	for _, entry := range entries {
+		if entry.Mailbox != nil {
+			ctx.Printf("%s@%s => mailbox %s\n", entry.User, entry.Domain, entry.MailboxName)
+		} else {
+			ctx.Printf("%s@%s => alias of %s\n", entry.User, entry.Domain, entry.Target)
+		}
+	}
+
+	ctx.Printf("%d addresses\n", len(entries))
+	return nil
+}
+
+func (s *shellCommand) addAddress(ctx *ishell.Context) error {
+	if len(ctx.Args) != 2 {
+		return errors.New("Usage: address add [address] [mailbox]")
+	}
+
+	addr, err := model.ParseAddress(ctx.Args[0])
+	if err != nil {
+		return err
+	}
+
+	if err := s.DB.AddAddress(addr, ctx.Args[1]); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return errors.New("mailbox does not exist")
+		}
+
+		return fmt.Errorf("could not add address: %w", err)
+	}
+
+	ctx.Printf("%s assigned to %s\n", addr, ctx.Args[1])
+	return nil
+}
+
+func (s *shellCommand) addAlias(ctx *ishell.Context) error {
+	if len(ctx.Args) != 2 {
+		return errors.New("Usage: alias add [address] [target]")
+	}
+
+	addr, err := model.ParseAddress(ctx.Args[0])
+	if err != nil {
+		return err
+	}
+
+	target, err := model.ParseAddress(ctx.Args[1])
+	if err != nil {
+		return err
+	}
+
+	if err := s.DB.AddAlias(addr, target); err != nil {
+		return fmt.Errorf("could not add alias: %w", err)
+	}
+
+	ctx.Printf("%s is an alias of %s\n", addr, target)
+	return nil
+}
+
+func (s *shellCommand) removeAddress(command string) func(*ishell.Context) error {
+	return func(ctx *ishell.Context) error {
+		if len(ctx.Args) != 1 {
+			return fmt.Errorf("Usage: %s remove [address]", command)
+		}
+
+		addr, err := model.ParseAddress(ctx.Args[0])
+		if err != nil {
+			return err
+		}
+
+		if err := s.DB.DeleteAddress(addr); err != nil {
+			if errors.Is(err, sql.ErrNoRows) {
+				return fmt.Errorf("%s does not exist", command)
+			}
+
+			return fmt.Errorf("could not remove %s: %w", command, err)
+		}
+
+		ctx.Printf("%s removed\n", addr)
+		return nil
+	}
+}
+
+func (s *shellCommand) listSendAs(ctx *ishell.Context) error {
+	if len(ctx.Args) != 1 {
+		return errors.New("Usage: sendas list [mailbox]")
+	}
+
+	patterns, err := s.DB.SendAs(ctx.Args[0])
+	if err != nil {
+		return err
+	}
+
+	for _, pattern := range patterns {
+		ctx.Println(pattern)
+	}
+
+	ctx.Printf("%d grants\n", len(patterns))
+	return nil
+}
+
+func (s *shellCommand) grantSendAs(ctx *ishell.Context) error {
+	if len(ctx.Args) != 2 {
+		return errors.New("Usage: sendas grant [mailbox] [address]")
+	}
+
+	pattern, err := model.ParseAddress(ctx.Args[1])
+	if err != nil {
+		return err
+	}
+
+	if err := s.DB.GrantSendAs(ctx.Args[0], pattern); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return errors.New("mailbox does not exist")
+		}
+
+		return fmt.Errorf("could not grant: %w", err)
+	}
+
+	ctx.Printf("%s may send as %s\n", ctx.Args[0], pattern)
+	return nil
+}
+
+func (s *shellCommand) revokeSendAs(ctx *ishell.Context) error {
+	if len(ctx.Args) != 2 {
+		return errors.New("Usage: sendas revoke [mailbox] [address]")
+	}
+
+	pattern, err := model.ParseAddress(ctx.Args[1])
+	if err != nil {
+		return err
+	}
+
+	if err := s.DB.RevokeSendAs(ctx.Args[0], pattern); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return errors.New("mailbox was not granted that address")
+		}
+
+		return fmt.Errorf("could not revoke: %w", err)
+	}
+
+	ctx.Printf("%s may no longer send as %s\n", ctx.Args[0], pattern)
+	return nil
+}
+
+func (s *shellCommand) listScripts(ctx *ishell.Context) error {
+	if len(ctx.Args) != 1 {
+		return errors.New("Usage: sieve list [mailbox]")
+	}
+
+	mailbox, err := s.findMailbox(ctx.Args[0])
+	if err != nil {
+		return err
+	}
+
+	scripts, err := s.DB.Scripts(mailbox)
+	if err != nil {
+		return err
+	}
+
+	for _, script := range scripts {
+		if script.Active {
+			ctx.Printf("%s (active)\n", script.Name)
+		} else {
+			ctx.Println(script.Name)
+		}
+	}
+
+	ctx.Printf("%d scripts\n", len(scripts))
+	return nil
+}
+
+func (s *shellCommand) putScript(ctx *ishell.Context) error {
+	if len(ctx.Args) != 3 {
+		return errors.New("Usage: sieve put [mailbox] [name] [file]")
+	}
+
+	mailbox, err := s.findMailbox(ctx.Args[0])
+	if err != nil {
+		return err
+	}
+
+	src, err := ioutil.ReadFile(ctx.Args[2])
+	if err != nil {
+		return err
+	}
+
+	if _, err := sieve.Parse(string(src)); err != nil {
+		return fmt.Errorf("invalid script: %w", err)
+	}
+
+	if err := s.DB.PutScript(mailbox, ctx.Args[1], string(src)); err != nil {
+		return fmt.Errorf("could not save script: %w", err)
+	}
+
+	ctx.Printf("script %s saved\n", ctx.Args[1])
+	return nil
+}
+
+func (s *shellCommand) showScript(ctx *ishell.Context) error {
+	if len(ctx.Args) != 2 {
+		return errors.New("Usage: sieve show [mailbox] [name]")
+	}
+
+	mailbox, err := s.findMailbox(ctx.Args[0])
+	if err != nil {
+		return err
+	}
+
+	src, err := s.DB.Script(mailbox, ctx.Args[1])
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return errors.New("script does not exist")
+		}
+
+		return err
+	}
+
+	ctx.Println(src)
+	return nil
+}
+
+func (s *shellCommand) activateScript(ctx *ishell.Context) error {
+	if len(ctx.Args) < 1 || len(ctx.Args) > 2 {
+		return errors.New("Usage: sieve activate [mailbox] [[name]]")
+	}
+
+	mailbox, err := s.findMailbox(ctx.Args[0])
+	if err != nil {
+		return err
+	}
+
+	var name string
+	if len(ctx.Args) == 2 {
+		name = ctx.Args[1]
+	}
+
+	if err := s.DB.SetActiveScript(mailbox, name); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return errors.New("script does not exist")
+		}
+
+		return fmt.Errorf("could not activate script: %w", err)
+	}
+
+	if name == "" {
+		ctx.Println("all scripts deactivated")
+	} else {
+		ctx.Printf("script %s activated\n", name)
+	}
+
+	return nil
+}
+
+func (s *shellCommand) deleteScript(ctx *ishell.Context) error {
+	if len(ctx.Args) != 2 {
+		return errors.New("Usage: sieve delete [mailbox] [name]")
+	}
+
+	mailbox, err := s.findMailbox(ctx.Args[0])
+	if err != nil {
+		return err
+	}
+
+	if err := s.DB.DeleteScript(mailbox, ctx.Args[1]); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return errors.New("script does not exist")
+		}
+
+		return fmt.Errorf("could not delete script: %w", err)
+	}
+
+	ctx.Printf("script %s deleted\n", ctx.Args[1])
+	return nil
+}
+
+// vacationDate is the format of dates limiting the out of office period.
+const vacationDate = "2006-01-02"
+
+func (s *shellCommand) showVacation(ctx *ishell.Context) error {
+	if len(ctx.Args) != 1 {
+		return errors.New("Usage: vacation show [mailbox]")
+	}
+
+	mailbox, err := s.findMailbox(ctx.Args[0])
+	if err != nil {
+		return err
+	}
+
+	vacation, err := s.DB.Vacation(mailbox)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return errors.New("no out of office settings")
+		}
+
+		return err
+	}
+
+	printVacation(ctx, vacation)
+	return nil
+}
+
+func printVacation(ctx *ishell.Context, vacation *storage.Vacation) {
+	formatDate := func(t time.Time) string {
+		if t.IsZero() {
+			return "-"
+		}
+
+		return t.Format(vacationDate)
+	}
+
+	ctx.Printf("%-10s %t (active now: %t)\n", "Enabled:", vacation.Enabled, vacation.Active(time.Now()))
+	ctx.Printf("%-10s %s\n", "Start:", formatDate(vacation.Start))
+	ctx.Printf("%-10s %s\n", "End:", formatDate(vacation.End))
+	ctx.Printf("%-10s %d\n", "Days:", vacation.Days)
+	ctx.Printf("%-10s %s\n", "Addresses:", strings.Join(vacation.Addresses, " "))
+	ctx.Printf("%-10s %s\n", "Subject:", vacation.Subject)
+	ctx.Printf("\n%s\n", vacation.Body)
+}
+
+// vacationSettings returns the out of office settings of a mailbox or the
+// defaults, if none were set yet.
+func (s *shellCommand) vacationSettings(mailbox int64) (*storage.Vacation, error) {
+	vacation, err := s.DB.Vacation(mailbox)
+	if errors.Is(err, sql.ErrNoRows) {
+		return &storage.Vacation{Days: 7}, nil
+	}
+
+	return vacation, err
+}
+
+func (s *shellCommand) setVacation(ctx *ishell.Context) error {
+	if len(ctx.Args) < 2 {
+		return errors.New("Usage: vacation set [mailbox] [subject|body|start|end|days|addresses] [value...]")
+	}
+
+	mailbox, err := s.findMailbox(ctx.Args[0])
+	if err != nil {
+		return err
+	}
+
+	vacation, err := s.vacationSettings(mailbox)
+	if err != nil {
+		return err
+	}
+
+	var (
+		option = ctx.Args[1]
+		values = ctx.Args[2:]
+	)
+
+	switch option {
+	case "subject":
+		vacation.Subject = strings.Join(values, " ")
+
+	case "body":
+		if len(values) != 1 {
+			return errors.New("Usage: vacation set [mailbox] body [file]")
+		}
+
+		body, err := ioutil.ReadFile(values[0])
+		if err != nil {
+			return err
+		}
+
+		vacation.Body = string(body)
+
+	case "start", "end":
+		if len(values) > 1 {
+			return fmt.Errorf("Usage: vacation set [mailbox] %s [[yyyy-mm-dd]]", option)
+		}
+
+		var date time.Time
+
+		if len(values) == 1 {
+			if date, err = time.ParseInLocation(vacationDate, values[0], time.Local); err != nil {
+				return fmt.Errorf("invalid date %q", values[0])
+			}
+		}
+
+		if option == "start" {
+			vacation.Start = date
+		} else {
+			vacation.End = date
+		}
+
+	case "days":
+		if len(values) != 1 {
+			return errors.New("Usage: vacation set [mailbox] days [days]")
+		}
+
+		days, err := strconv.ParseInt(values[0], 10, 64)
+		if err != nil || days < 1 {
+			return fmt.Errorf("invalid number of days %q", values[0])
+		}
+
+		vacation.Days = days
+
+	case "addresses":
+		for _, value := range values {
+			if _, err := model.ParseAddress(value); err != nil {
+				return fmt.Errorf("invalid address %q", value)
+			}
+		}
+
+		vacation.Addresses = values
+
+	default:
+		return fmt.Errorf("unknown setting %q", option)
+	}
+
+	if err := s.DB.SetVacation(mailbox, vacation); err != nil {
+		return fmt.Errorf("could not update settings: %w", err)
+	}
+
+	printVacation(ctx, vacation)
+	return nil
+}
+
+func (s *shellCommand) enableVacation(enabled bool) func(*ishell.Context) error {
+	command := "disable"
+	if enabled {
+		command = "enable"
+	}
+
+	return func(ctx *ishell.Context) error {
+		if len(ctx.Args) != 1 {
+			return fmt.Errorf("Usage: vacation %s [mailbox]", command)
+		}
+
+		mailbox, err := s.findMailbox(ctx.Args[0])
+		if err != nil {
+			return err
+		}
+
+		vacation, err := s.vacationSettings(mailbox)
+		if err != nil {
+			return err
+		}
+
+		if enabled && strings.TrimSpace(vacation.Body) == "" {
+			return errors.New("set a body first")
+		}
+
+		vacation.Enabled = enabled
+
+		if err := s.DB.SetVacation(mailbox, vacation); err != nil {
+			return fmt.Errorf("could not update settings: %w", err)
+		}
+
+		ctx.Printf("out of office replies %sd\n", command)
+		return nil
+	}
+}
+
+func (s *shellCommand) removeVacation(ctx *ishell.Context) error {
+	if len(ctx.Args) != 1 {
+		return errors.New("Usage: vacation remove [mailbox]")
+	}
+
+	mailbox, err := s.findMailbox(ctx.Args[0])
+	if err != nil {
+		return err
+	}
+
+	if err := s.DB.DeleteVacation(mailbox); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return errors.New("no out of office settings")
+		}
+
+		return err
+	}
+
+	ctx.Println("out of office settings removed")
+	return nil
+}
+
+func (s *shellCommand) bayesStatus(ctx *ishell.Context) error {
+	totals, err := s.DB.BayesTotals()
+	if err != nil {
+		return err
+	}
+
+	ctx.Printf("%d spam and %d ham mails trained\n", totals.Spam, totals.Ham)
+	return nil
+}
+
+func (s *shellCommand) bayesTrain(ctx *ishell.Context) error {
+	if len(ctx.Args) != 3 {
+		return errors.New("Usage: bayes train [spam|ham] [mailbox] [folder]")
+	}
+
+	spam, err := parseBayesClass(ctx.Args[0])
+	if err != nil {
+		return err
+	}
+
+	mailbox, err := s.findMailbox(ctx.Args[1])
+	if err != nil {
+		return err
+	}
+
+	entries, err := s.DB.FolderEntries(mailbox, ctx.Args[2])
+	if err != nil {
+		return err
+	}
+
+	var (
+		classifier = bayes.New(s.DB)
+		count      int
+	)
+
+	for _, entry := range entries {
+		r, err := s.Blobs.Read(entry.MailID)
+		if err != nil {
+			return err
+		}
+
+		trained, err := classifier.Train(r, spam)
+		r.Close()
+
+		if err != nil {
+			return err
+		}
+
+		if trained {
+			count++
+		}
+	}
+
+	ctx.Printf("%d of %d mails trained as %s\n", count, len(entries), ctx.Args[0])
+	return nil
+}
+
+func (s *shellCommand) bayesImport(ctx *ishell.Context) error {
+	if len(ctx.Args) != 2 {
+		return errors.New("Usage: bayes import [spam|ham] [file]")
+	}
+
+	spam, err := parseBayesClass(ctx.Args[0])
+	if err != nil {
+		return err
+	}
+
+	f, err := os.Open(ctx.Args[1])
+	if err != nil {
+		return err
+	}
+
+	defer f.Close()
+
+	var (
+		classifier   = bayes.New(s.DB)
+		count, total int
+	)
+
+	err = bayes.ReadMbox(f, func(r io.Reader) error {
+		trained, err := classifier.Train(r, spam)
+		if trained {
+			count++
+		}
+
+		total++
+		return err
+	})
+
+	if err != nil {
+		return err
+	}
+
+	ctx.Printf("%d of %d mails trained as %s\n", count, total, ctx.Args[0])
+	return nil
+}
+
+func parseBayesClass(class string) (bool, error) {
+	switch class {
+	case "spam":
+		return true, nil
+	case "ham":
+		return false, nil
+	default:
+		return false, errors.New("class must be spam or ham")
+	}
+}
+
+func (s *shellCommand) findMailbox(name string) (int64, error) {
+	mailbox, err := s.DB.Mailbox(name)
+	if errors.Is(err, sql.ErrNoRows) {
+		return 0, errors.New("mailbox does not exist")
+	}
+
+	return mailbox, err
+}
+
+func (s *shellCommand) listDomains(ctx *ishell.Context) error {
+	domains, err := s.DB.Domains()
+	if err != nil {
+		return err
+	}
+
+	for _, domain := range domains {
+		ctx.Println(domain.Name)
+		printDomainSettings(ctx, domain)
+	}
+
+	ctx.Printf("%d domains\n", len(domains))
+	return nil
+}
+
+func printDomainSettings(ctx *ishell.Context, domain *storage.Domain) {
+	mx := "primary"
+	if domain.Backup {
+		mx = "backup"
+	}
+
+	ctx.Printf("  mx:       %s\n", mx)
+
+	if domain.CatchAll != nil {
+		ctx.Printf("  catchall: %s\n", domain.CatchAll)
+	}
+
+	if domain.DKIMSelector != "" {
+		ctx.Printf("  dkim:     %s (reserved, not used for signing yet)\n", domain.DKIMSelector)
+	}
+
+	if domain.TLSCertificate != "" {
+		ctx.Printf("  cert:     %s %s\n", domain.TLSCertificate, domain.TLSKey)
+	}
+
+	if domain.MaxSize > 0 {
+		ctx.Printf("  maxsize:  %d\n", domain.MaxSize)
+	}
+}
+
+func (s *shellCommand) addDomain(ctx *ishell.Context) error {
+	if len(ctx.Args) != 1 {
+		return errors.New("Usage: domain add [domain]")
+	}
+
+	domain, err := normalize.Domain(ctx.Args[0])
+	if err != nil {
+		return err
+	}
+
+	if err := s.DB.AddDomain(domain); err != nil {
+		return fmt.Errorf("could not add domain: %w", err)
+	}
+
+	ctx.Printf("domain %s added\n", domain)
+	return nil
+}
+
+func (s *shellCommand) setDomain(ctx *ishell.Context) error {
+	if len(ctx.Args) < 2 {
+		return errors.New("Usage: domain set [domain] [catchall|dkim|cert|maxsize|mx] [value...]")
+	}
+
+	name, err := normalize.Domain(ctx.Args[0])
+	if err != nil {
+		return err
+	}
+
+	domain, err := s.DB.Domain(name)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return errors.New("domain does not exist")
+		}
+
+		return err
+	}
+
+	var (
+		option = ctx.Args[1]
+		values = ctx.Args[2:]
+	)
+
+	switch option {
+	case "catchall":
+		if len(values) > 1 {
+			return errors.New("Usage: domain set [domain] catchall [[address]]")
+		}
+
+		domain.CatchAll = nil
+
+		if len(values) == 1 {
+			if domain.CatchAll, err = model.ParseAddress(values[0]); err != nil {
+				return err
+			}
+		}
+
+	case "dkim":
+		if len(values) > 1 {
+			return errors.New("Usage: domain set [domain] dkim [[selector]]")
+		}
+
+		domain.DKIMSelector = strings.Join(values, "")
+
+	case "cert":
+		switch len(values) {
+		case 0:
+			domain.TLSCertificate, domain.TLSKey = "", ""
+		case 2:
+			domain.TLSCertificate, domain.TLSKey = values[0], values[1]
+		default:
+			return errors.New("Usage: domain set [domain] cert [[crt] [key]]")
+		}
+
+	case "maxsize":
+		if len(values) != 1 {
+			return errors.New("Usage: domain set [domain] maxsize [size]")
+		}
+
+		if domain.MaxSize, err = parseSize(values[0]); err != nil {
+			return err
+		}
+
+	case "mx":
+		if len(values) != 1 || (values[0] != "primary" && values[0] != "backup") {
+			return errors.New("Usage: domain set [domain] mx [primary|backup]")
+		}
+
+		domain.Backup = values[0] == "backup"
+
+	default:
+		return fmt.Errorf("unknown setting %q", option)
+	}
+
+	if err := s.DB.UpdateDomain(domain); err != nil {
+		return fmt.Errorf("could not update domain: %w", err)
+	}
+
+	ctx.Println(domain.Name)
+	printDomainSettings(ctx, domain)
+	return nil
+}
+
+func (s *shellCommand) removeDomain(ctx *ishell.Context) error {
+	if len(ctx.Args) != 1 {
+		return errors.New("Usage: domain remove [domain]")
+	}
+
+	domain, err := normalize.Domain(ctx.Args[0])
+	if err != nil {
+		return err
+	}
+
+	if err := s.DB.DeleteDomain(domain); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return errors.New("domain does not exist")
+		}
+
+		return fmt.Errorf("could not remove domain: %w", err)
+	}
+
+	ctx.Printf("domain %s removed\n", domain)
+	return nil
+}
+
+// usageQueue handles "queue" without a known subcommand. It fails instead of
+// printing the help, so that `briefmail queue` exits with a non-zero code.
+func (s *shellCommand) usageQueue(ctx *ishell.Context) error {
+	return errors.New("Usage: queue [list|show|retry|hold|release|delete|requeue]")
+}
+
+func (s *shellCommand) listQueue(ctx *ishell.Context) error {
+	if len(ctx.Args) != 0 {
+		return errors.New("Usage: queue list")
+	}
+
+	list, err := s.DB.Queue()
+	if err != nil {
+		return err
+	}
+
+	if len(list) == 0 {
+		ctx.Println("the queue is empty")
+		return nil
+	}
+
+	for _, elem := range list {
+		printQueueElement(ctx, elem)
+	}
+
+	return nil
+}
+
+func (s *shellCommand) showQueue(ctx *ishell.Context) error {
+	if len(ctx.Args) != 1 {
+		return errors.New("Usage: queue show [id]")
+	}
+
+	elem, err := s.findQueueElement(ctx.Args[0])
+	if err != nil {
+		return err
+	}
+
+	mail, err := s.DB.Mail(elem.MailID)
+	if err != nil {
+		return err
+	}
+
+	ctx.Printf("from:     <%s>\n", mail.From)
+	ctx.Printf("arrived:  %s\n", mail.Date.Format(time.RFC1123Z))
+	ctx.Printf("size:     %d\n", mail.Size)
+	printQueueElement(ctx, elem)
+
+	return nil
+}
+
+func (s *shellCommand) retryQueue(ctx *ishell.Context) error {
+	if len(ctx.Args) != 1 {
+		return errors.New("Usage: queue retry [id]")
+	}
+
+	elem, err := s.findQueueElement(ctx.Args[0])
+	if err != nil {
+		return err
+	}
+
+	if elem.Held {
+		return errors.New("mail is held. release it first")
+	}
+
+	if err := s.Queue.Retry(elem.MailID); err != nil {
+		return fmt.Errorf("could not retry delivery: %w", err)
+	}
+
+	ctx.Printf("mail %s is scheduled for delivery on the next queue poll\n", elem.MailID)
+	return nil
+}
+
+func (s *shellCommand) holdQueue(ctx *ishell.Context) error {
+	if len(ctx.Args) != 1 {
+		return errors.New("Usage: queue hold [id]")
+	}
+
+	elem, err := s.findQueueElement(ctx.Args[0])
+	if err != nil {
+		return err
+	}
+
+	if err := s.Queue.Hold(elem.MailID); err != nil {
+		return fmt.Errorf("could not hold mail: %w", err)
+	}
+
+	ctx.Printf("mail %s is held\n", elem.MailID)
+	return nil
+}
+
+func (s *shellCommand) releaseQueue(ctx *ishell.Context) error {
+	if len(ctx.Args) != 1 {
+		return errors.New("Usage: queue release [id]")
+	}
+
+	elem, err := s.findQueueElement(ctx.Args[0])
+	if err != nil {
+		return err
+	}
+
+	if err := s.Queue.Release(elem.MailID); err != nil {
+		return fmt.Errorf("could not release mail: %w", err)
+	}
+
+	ctx.Printf("mail %s is released\n", elem.MailID)
+	return nil
+}
+
+func (s *shellCommand) deleteQueue(ctx *ishell.Context) error {
+	var bounce bool
+
+	args := ctx.Args
+	if len(args) == 2 && args[1] == "--bounce" {
+		bounce = true
+		args = args[:1]
+	}
+
+	if len(args) != 1 {
+		return errors.New("Usage: queue delete [id] [--bounce]")
+	}
+
+	elem, err := s.findQueueElement(args[0])
+	if err != nil {
+		return err
+	}
+
+	if err := s.Queue.Delete(elem.MailID, bounce); err != nil {
+		return fmt.Errorf("could not delete mail: %w", err)
+	}
+
+	ctx.Printf("mail %s deleted from the queue\n", elem.MailID)
+	return nil
+}
+
+func (s *shellCommand) requeueQueue(ctx *ishell.Context) error {
+	if len(ctx.Args) != 2 {
+		return errors.New("Usage: queue requeue [id] [address]")
+	}
+
+	elem, err := s.findQueueElement(ctx.Args[0])
+	if err != nil {
+		return err
+	}
+
+	to, err := model.ParseAddress(ctx.Args[1])
+	if err != nil {
+		return err
+	}
+
+	if err := s.Queue.Requeue(elem.MailID, to); err != nil {
+		return fmt.Errorf("could not requeue mail: %w", err)
+	}
+
+	ctx.Printf("mail %s requeued for %s\n", elem.MailID, to)
+	return nil
+}
+
+// findQueueElement finds a queued mail by a unique prefix of its id.
+func (s *shellCommand) findQueueElement(prefix string) (*storage.QueueElement, error) {
+	list, err := s.DB.Queue()
+	if err != nil {
+		return nil, err
+	}
+
+	var found *storage.QueueElement
+
+	for _, elem := range list {
+		if strings.HasPrefix(elem.MailID.String(), strings.ToLower(prefix)) {
+			if found != nil {
+				return nil, errors.New("id is ambiguous")
+			}
+
+			found = elem
+		}
+	}
+
+	if found == nil {
+		return nil, errors.New("mail is not queued")
+	}
+
+	return found, nil
+}
+
+func printQueueElement(ctx *ishell.Context, elem *storage.QueueElement) {
+	status := "queued"
+
+	switch {
+	case elem.Held:
+		status = "held"
+	case elem.Lease.After(time.Now()):
+		status = "delivering"
+	}
+
+	ctx.Printf("%s  %s  next=%s  attempts=%d\n",
+		elem.MailID,
+		status,
+		elem.Date.Format(time.RFC3339),
+		elem.Attempts)
+
+	for _, addr := range elem.To {
+		if reason := elem.Errors[addr.String()]; reason != "" {
+			ctx.Printf("    <%s>: %s\n", addr, reason)
+		} else {
+			ctx.Printf("    <%s>\n", addr)
+		}
+	}
+}
+
 func wrapShellFunc(fn func(*ishell.Context) error) func(*ishell.Context) {
 	return func(ctx *ishell.Context) {
 		if err := fn(ctx); err != nil {
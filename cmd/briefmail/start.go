@@ -29,13 +29,18 @@ import (
 	"github.com/sirupsen/logrus"
 	"github.com/spf13/viper"
 
+	"github.com/lukasdietrich/briefmail/internal/delivery"
+	"github.com/lukasdietrich/briefmail/internal/managesieve"
 	"github.com/lukasdietrich/briefmail/internal/pop3"
+	"github.com/lukasdietrich/briefmail/internal/retention"
 	"github.com/lukasdietrich/briefmail/internal/smtp"
 	"github.com/lukasdietrich/briefmail/internal/textproto"
+	"github.com/lukasdietrich/briefmail/internal/unsubscribe"
 )
 
 type serverConfig struct {
-	// Address is the port and optional host to bind a server to.
+	// Address is the port and optional host to bind a server to, or the path
+	// of a unix domain socket prefixed with "unix:".
 	Address string
 	// TLS is a flag to indicate if the server should require a tls handshake
 	// on inbound connections. If set to false, the client can still initiate
@@ -48,18 +53,35 @@ type serverConfig struct {
 type startCommand struct {
 	// SMTPProto is the protocol implementation for an smtp server.
 	SMTPProto *smtp.Proto
+	// LMTPProto is the protocol implementation for an lmtp server.
+	LMTPProto *smtp.LMTPProto
 	// POP3Proto is the protocol implementation for a pop3 server.
 	POP3Proto *pop3.Proto
+	// ManageSieveProto is the protocol implementation for a managesieve
+	// server.
+	ManageSieveProto *managesieve.Proto
 	// TLSConfig is either nil or wraps the configured tls certificate source.
 	TLSConfig *tls.Config
+	// Queue is the worker for outbound delivery.
+	Queue *delivery.QueueWorker
+	// Expirer enforces the retention policies of mailboxes.
+	Expirer *retention.Expirer
+	// Unsubscribe serves the one-click unsubscribe links of mailing lists.
+	Unsubscribe *unsubscribe.Server
 }
 
-// run starts smtp and pop3 servers on all configured ports.
+// run starts smtp, lmtp, pop3 and managesieve servers on all configured
+// ports.
 func (s *startCommand) run() error {
 	servers := instanceManager{
-		smtpProto: s.SMTPProto,
-		pop3Proto: s.POP3Proto,
-		tlsConfig: s.TLSConfig,
+		smtpProto:        s.SMTPProto,
+		lmtpProto:        s.LMTPProto,
+		pop3Proto:        s.POP3Proto,
+		manageSieveProto: s.ManageSieveProto,
+		tlsConfig:        s.TLSConfig,
+		queue:            s.Queue,
+		expirer:          s.Expirer,
+		unsubscribe:      s.Unsubscribe,
 	}
 
 	if err := servers.start(); err != nil {
@@ -71,8 +93,8 @@ func (s *startCommand) run() error {
 }
 
 // handleSignals waits for SIGINT or SIGTERM and then tries to gracefully
-// shutdown all servers. If another signal is captured, the shutdown will be
-// forced immediately.
+// shutdown all servers and background workers. If another signal is captured,
+// the shutdown will be forced immediately.
 func (s *startCommand) handleSignals(servers *instanceManager) {
 	const timeout = time.Second * 30
 
@@ -96,38 +118,71 @@ func (s *startCommand) handleSignals(servers *instanceManager) {
 	}
 }
 
-// instanceManager is a container for all configured server instances.
-// It also keeps track of how many servers are still running.
+// instanceManager is a container for all configured server instances and
+// background workers. It also keeps track of how many of them are still
+// running.
 type instanceManager struct {
-	smtpProto textproto.Protocol
-	pop3Proto textproto.Protocol
-	tlsConfig *tls.Config
-	servers   []textproto.Server
-	wg        sync.WaitGroup
+	smtpProto        textproto.Protocol
+	lmtpProto        textproto.Protocol
+	pop3Proto        textproto.Protocol
+	manageSieveProto textproto.Protocol
+	tlsConfig        *tls.Config
+	queue            *delivery.QueueWorker
+	expirer          *retention.Expirer
+	unsubscribe      *unsubscribe.Server
+	servers          []textproto.Server
+	wg               sync.WaitGroup
 }
 
-// shutdown tries to gracefully shutdown all started server instances.
+// shutdown tries to gracefully shutdown all started server instances and
+// background workers.
 func (i *instanceManager) shutdown(ctx context.Context, cancelFunc context.CancelFunc) {
 	for _, server := range i.servers {
 		go i.shutdownInstance(ctx, server)
 	}
 
+	go i.shutdownQueue(ctx)
+	go i.shutdownExpirer(ctx)
+	go i.shutdownUnsubscribe(ctx)
+
 	i.wg.Wait()
 	logrus.Info("all servers stopped gracefully")
 	cancelFunc()
 }
 
+// shutdownQueue tries to gracefully shutdown the queue worker, waiting for
+// deliveries in progress until the context is canceled.
+func (i *instanceManager) shutdownQueue(ctx context.Context) {
+	i.queue.Shutdown(ctx)
+	i.wg.Done()
+}
+
+// shutdownExpirer stops enforcing retention policies.
+func (i *instanceManager) shutdownExpirer(ctx context.Context) {
+	i.expirer.Shutdown(ctx)
+	i.wg.Done()
+}
+
+// shutdownUnsubscribe stops serving unsubscribe links.
+func (i *instanceManager) shutdownUnsubscribe(ctx context.Context) {
+	i.unsubscribe.Shutdown(ctx)
+	i.wg.Done()
+}
+
 // shutdownInstance tries to gracefully shutdown a single server instance.
 func (i *instanceManager) shutdownInstance(ctx context.Context, server textproto.Server) {
 	server.Shutdown(ctx)
 	i.wg.Done()
 }
 
-// start reads all configured smtp and pop3 servers and then starts all of them.
+// start reads all configured smtp, lmtp, pop3 and managesieve servers and
+// then starts all of them as well as the background workers.
 func (i *instanceManager) start() error {
 	for protoName, proto := range map[string]textproto.Protocol{
-		"smtp": i.smtpProto,
-		"pop3": i.pop3Proto,
+		"smtp":        i.smtpProto,
+		"lmtp":        i.lmtpProto,
+		"pop3":        i.pop3Proto,
+		"managesieve": i.manageSieveProto,
 	} {
 		configSlice, err := unmarshalServerConfigs(protoName)
 		if err != nil {
@@ -155,7 +210,12 @@ func (i *instanceManager) start() error {
 		}
 	}
 
-	i.wg.Add(len(i.servers))
+	// resume delivery of mails queued before the last shutdown
+	i.queue.Start()
+	i.expirer.Start()
+	i.unsubscribe.Start()
+
+	i.wg.Add(len(i.servers) + 3)
 	return nil
 }
 
@@ -171,8 +231,8 @@ func (i *instanceManager) startInstance(server textproto.Server, addr string) {
 	logrus.Infof("server %s stopped", addr)
 }
 
-// unmarshalServerConfigs reads the config for either "pop3" or "smtp" and
-// unmarshals it into a slice of serverConfig.
+// unmarshalServerConfigs reads the config for "smtp", "lmtp", "pop3" or
+// "managesieve" and unmarshals it into a slice of serverConfig.
 func unmarshalServerConfigs(protoName string) ([]serverConfig, error) {
 	logrus.Debugf("reading %s configuration", protoName)
 
@@ -8,10 +8,14 @@ import (
 	"github.com/lukasdietrich/briefmail/internal/addressbook"
 	"github.com/lukasdietrich/briefmail/internal/certs"
 	"github.com/lukasdietrich/briefmail/internal/delivery"
+	"github.com/lukasdietrich/briefmail/internal/managesieve"
 	"github.com/lukasdietrich/briefmail/internal/pop3"
+	"github.com/lukasdietrich/briefmail/internal/retention"
 	"github.com/lukasdietrich/briefmail/internal/smtp"
 	"github.com/lukasdietrich/briefmail/internal/smtp/hook"
+	"github.com/lukasdietrich/briefmail/internal/srs"
 	"github.com/lukasdietrich/briefmail/internal/storage"
+	"github.com/lukasdietrich/briefmail/internal/unsubscribe"
 )
 
 var wireSet = wire.NewSet(
@@ -23,8 +27,12 @@ var wireSet = wire.NewSet(
 	hook.WireSet,
 	smtp.WireSet,
 	pop3.WireSet,
+	managesieve.WireSet,
 	delivery.WireSet,
 	addressbook.WireSet,
+	srs.WireSet,
+	retention.WireSet,
+	unsubscribe.WireSet,
 )
 
 func newStartCommand() (*startCommand, error) {
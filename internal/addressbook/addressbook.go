@@ -17,9 +17,11 @@ package addressbook
 
 import (
 	"fmt"
+	"strings"
 
 	"github.com/lukasdietrich/briefmail/internal/model"
-	"github.com/lukasdietrich/briefmail/internal/normalize"
+	"github.com/lukasdietrich/briefmail/internal/srs"
+	"github.com/lukasdietrich/briefmail/internal/storage"
 )
 
 type EntryKind int
@@ -28,13 +30,54 @@ const (
 	Local EntryKind = iota
 	Forward
 	Remote
+	List
+	Relay
 )
 
+// Commands of mailing list entries. Besides posting to the list address
+// itself, each list has the addresses "<list>-subscribe", "<list>-unsubscribe",
+// "<list>-confirm-<token>" and "<list>-bounces".
+const (
+	ListPost        = "post"
+	ListSubscribe   = "subscribe"
+	ListUnsubscribe = "unsubscribe"
+	ListConfirm     = "confirm"
+	ListBounces     = "bounces"
+)
+
+// MailingList is a list, which expands to its subscribers.
+type MailingList struct {
+	Address *model.Address
+	// Name is a human readable description used in the List-Id header.
+	Name string
+	// MembersOnly restricts posting to subscribers.
+	MembersOnly bool
+}
+
+// CommandAddress returns the address of a list command.
+func (l *MailingList) CommandAddress(command string) *model.Address {
+	addr, _ := model.ParseAddress(fmt.Sprintf("%s-%s@%s",
+		l.Address.User, command, l.Address.Domain))
+
+	return addr
+}
+
 type Entry struct {
 	Kind EntryKind
 
 	Mailbox *int64
 	Address *model.Address
+
+	// Detail is the subaddress of a recipient, e.g. "newsletter" for
+	// "alice+newsletter@example.com". It is empty, if the recipient matched
+	// without a subaddress or the subaddress is empty.
+	Detail string
+
+	// List and Command are set for mailing list entries. Token is only set
+	// for the ListConfirm command.
+	List    *MailingList
+	Command string
+	Token   string
 }
 
 func (e *Entry) String() string {
@@ -45,6 +88,10 @@ func (e *Entry) String() string {
 		return fmt.Sprintf("forward(address=%s)", e.Address)
 	case Remote:
 		return fmt.Sprintf("remote(address=%s)", e.Address)
+	case List:
+		return fmt.Sprintf("list(address=%s, command=%s)", e.List.Address, e.Command)
+	case Relay:
+		return fmt.Sprintf("relay(address=%s)", e.Address)
 	}
 
 	return ""
@@ -54,34 +101,184 @@ type Addressbook interface {
 	Lookup(*model.Address) *Entry
 }
 
+// source provides the domains, entries and mailing lists of an addressbook.
+// Entries are looked up by the normalized domain and user, both of which may
+// be "*" for catch-all entries. Unknown domains are nil.
+type source interface {
+	domain(name string) *storage.Domain
+	entry(domain, user string) *Entry
+	mailingLists() []*MailingList
+}
+
 type addressbook struct {
-	domains *normalize.Set
-	entries map[string]map[string]*Entry
+	sources    []source
+	srs        *srs.SRS
+	separators string
 }
 
 func (b *addressbook) Lookup(addr *model.Address) *Entry {
-	if !b.domains.Contains(addr.Domain) {
+	domain := b.domain(addr.Domain)
+	if domain == nil {
 		return &Entry{
 			Kind:    Remote,
 			Address: addr,
 		}
 	}
 
-	if entry := lookupInDomain(b.entries[addr.Domain], addr); entry != nil {
+	if domain.Backup {
+		return &Entry{
+			Kind:    Relay,
+			Address: addr,
+		}
+	}
+
+	if b.srs != nil && srs.IsSRS(addr) {
+		return b.lookupSRS(addr)
+	}
+
+	if entry := b.lookupListCommand(addr); entry != nil {
+		return entry
+	}
+
+	user, detail := splitDetail(addr.User, b.separators)
+
+	if entry := b.lookupInDomain(addr.Domain, addr.User, user, detail); entry != nil {
+		return entry
+	}
+
+	// the user in any domain is more specific than the catch-all of the
+	// domain, while the catch-all of any domain is less specific.
+	if entry := b.lookupUser("*", addr.User, user, detail); entry != nil {
 		return entry
 	}
 
-	return lookupInDomain(b.entries["*"], addr)
+	if domain.CatchAll != nil {
+		return &Entry{
+			Kind:    Forward,
+			Address: domain.CatchAll,
+		}
+	}
+
+	return b.entry("*", "*")
 }
 
-func lookupInDomain(domain map[string]*Entry, addr *model.Address) *Entry {
-	if domain == nil {
+// domain returns the domain of the first source knowing it.
+func (b *addressbook) domain(name string) *storage.Domain {
+	for _, source := range b.sources {
+		if domain := source.domain(name); domain != nil {
+			return domain
+		}
+	}
+
+	return nil
+}
+
+// entry returns the entry of the first source knowing the user.
+func (b *addressbook) entry(domain, user string) *Entry {
+	for _, source := range b.sources {
+		if entry := source.entry(domain, user); entry != nil {
+			return entry
+		}
+	}
+
+	return nil
+}
+
+// lookupListCommand resolves the command addresses of mailing lists.
+func (b *addressbook) lookupListCommand(addr *model.Address) *Entry {
+	for _, source := range b.sources {
+		if entry := lookupListCommand(source.mailingLists(), addr); entry != nil {
+			return entry
+		}
+	}
+
+	return nil
+}
+
+func lookupListCommand(lists []*MailingList, addr *model.Address) *Entry {
+	for _, list := range lists {
+		prefix := list.Address.User + "-"
+
+		if list.Address.Domain != addr.Domain || !strings.HasPrefix(addr.User, prefix) {
+			continue
+		}
+
+		entry := Entry{
+			Kind:    List,
+			List:    list,
+			Command: strings.TrimPrefix(addr.User, prefix),
+		}
+
+		switch entry.Command {
+		case ListSubscribe, ListUnsubscribe, ListBounces:
+			return &entry
+		}
+
+		if token := strings.TrimPrefix(entry.Command, ListConfirm+"-"); token != entry.Command {
+			entry.Command = ListConfirm
+			entry.Token = token
+
+			return &entry
+		}
+	}
+
+	return nil
+}
+
+// splitDetail splits a user at the first of the separators into the base
+// user and the detail as specified in RFC#5233. If the user contains none of
+// the separators, the detail is empty.
+func splitDetail(user, separators string) (string, string) {
+	if separators == "" {
+		return user, ""
+	}
+
+	if i := strings.IndexAny(user, separators); i > 0 {
+		return user[:i], user[i+1:]
+	}
+
+	return user, ""
+}
+
+// lookupSRS resolves a rewritten address to a forward entry to the original
+// sender. Rewritten addresses with invalid hashes or of expired age are
+// treated as unknown addresses.
+func (b *addressbook) lookupSRS(addr *model.Address) *Entry {
+	original, err := b.srs.Reverse(addr)
+	if err != nil {
 		return nil
 	}
 
-	if entry := domain[addr.User]; entry != nil {
+	return &Entry{
+		Kind:    Forward,
+		Address: original,
+	}
+}
+
+// lookupInDomain prefers an exact match of the full user over the base user
+// and the catch-all of any source.
+func (b *addressbook) lookupInDomain(domain, full, user, detail string) *Entry {
+	if entry := b.lookupUser(domain, full, user, detail); entry != nil {
 		return entry
 	}
 
-	return domain["*"]
+	return b.entry(domain, "*")
+}
+
+// lookupUser prefers an exact match of the full user over the base user.
+func (b *addressbook) lookupUser(domain, full, user, detail string) *Entry {
+	if entry := b.entry(domain, full); entry != nil {
+		return entry
+	}
+
+	if user != full {
+		if entry := b.entry(domain, user); entry != nil {
+			withDetail := *entry
+			withDetail.Detail = detail
+
+			return &withDetail
+		}
+	}
+
+	return nil
 }
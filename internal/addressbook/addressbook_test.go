@@ -22,6 +22,8 @@ import (
 
 	"github.com/lukasdietrich/briefmail/internal/model"
 	"github.com/lukasdietrich/briefmail/internal/normalize"
+	"github.com/lukasdietrich/briefmail/internal/srs"
+	"github.com/lukasdietrich/briefmail/internal/storage"
 )
 
 func TestSimple(t *testing.T) {
@@ -36,15 +38,19 @@ func TestSimple(t *testing.T) {
 	assert.Nil(t, err)
 
 	addressbook := addressbook{
-		domains: domains,
-		entries: map[string]map[string]*Entry{
-			"host1": {
-				"user1": user1AtHost1,
-				"user2": user2AtHost1,
-			},
-			"host2": {
-				"user1": user1AtHost2,
-				"user2": user2AtHost2,
+		sources: []source{
+			&table{
+				domains: domains,
+				entries: map[string]map[string]*Entry{
+					"host1": {
+						"user1": user1AtHost1,
+						"user2": user2AtHost1,
+					},
+					"host2": {
+						"user1": user1AtHost2,
+						"user2": user2AtHost2,
+					},
+				},
 			},
 		},
 	}
@@ -79,15 +85,19 @@ func TestWildcard(t *testing.T) {
 	assert.Nil(t, err)
 
 	addressbook := addressbook{
-		domains: domains,
-		entries: map[string]map[string]*Entry{
-			"host1": {
-				"user1": user1AtHost1,
-				"*":     anyAtHost1,
-			},
-			"*": {
-				"user1": user1AtAny,
-				"*":     anyAtAny,
+		sources: []source{
+			&table{
+				domains: domains,
+				entries: map[string]map[string]*Entry{
+					"host1": {
+						"user1": user1AtHost1,
+						"*":     anyAtHost1,
+					},
+					"*": {
+						"user1": user1AtAny,
+						"*":     anyAtAny,
+					},
+				},
 			},
 		},
 	}
@@ -105,6 +115,178 @@ func TestWildcard(t *testing.T) {
 	}
 }
 
+func TestSRS(t *testing.T) {
+	domains, err := normalize.NewSet([]string{"host1"}, normalize.Domain)
+	assert.Nil(t, err)
+
+	rewriter, err := srs.New("host1", []string{"secret"}, 21)
+	assert.Nil(t, err)
+
+	addressbook := addressbook{
+		sources: []source{
+			&table{
+				domains: domains,
+				entries: map[string]map[string]*Entry{
+					"host1": {
+						"*": makeEntry(0),
+					},
+				},
+			},
+		},
+		srs: rewriter,
+	}
+
+	rewritten, err := rewriter.Forward(mustAddress("user1@host2"))
+	assert.Nil(t, err)
+
+	assert.Equal(t, &Entry{
+		Kind:    Forward,
+		Address: mustAddress("user1@host2"),
+	}, addressbook.Lookup(rewritten))
+
+	assert.Nil(t, addressbook.Lookup(mustAddress("SRS0=AAAA=AA=host2=user1@host1")))
+}
+
+func TestSubaddress(t *testing.T) {
+	var (
+		user1AtHost1     = makeEntry(0)
+		user1NewsAtHost1 = makeEntry(1)
+		anyAtHost1       = makeEntry(2)
+	)
+
+	domains, err := normalize.NewSet([]string{"host1"}, normalize.Domain)
+	assert.Nil(t, err)
+
+	addressbook := addressbook{
+		sources: []source{
+			&table{
+				domains: domains,
+				entries: map[string]map[string]*Entry{
+					"host1": {
+						"user1":      user1AtHost1,
+						"user1+news": user1NewsAtHost1,
+						"*":          anyAtHost1,
+					},
+				},
+			},
+		},
+		separators: "+-",
+	}
+
+	for addr, entry := range map[string]*Entry{
+		"user1@host1":        user1AtHost1,
+		"user1+news@host1":   user1NewsAtHost1,
+		"user1+shop@host1":   {Mailbox: user1AtHost1.Mailbox, Detail: "shop"},
+		"user1-shop+x@host1": {Mailbox: user1AtHost1.Mailbox, Detail: "shop+x"},
+		"user1+@host1":       user1AtHost1,
+		"user2+shop@host1":   anyAtHost1,
+		"+user1@host1":       anyAtHost1,
+	} {
+		t.Run(addr, func(t *testing.T) {
+			actual := addressbook.Lookup(mustAddress(addr))
+			assert.Equal(t, entry, actual)
+		})
+	}
+}
+
+func TestListCommands(t *testing.T) {
+	domains, err := normalize.NewSet([]string{"host1"}, normalize.Domain)
+	assert.Nil(t, err)
+
+	var (
+		list     = &MailingList{Address: mustAddress("dev@host1")}
+		post     = &Entry{Kind: List, List: list, Command: ListPost}
+		anyEntry = makeEntry(0)
+	)
+
+	addressbook := addressbook{
+		sources: []source{
+			&table{
+				domains: domains,
+				entries: map[string]map[string]*Entry{
+					"host1": {
+						"dev": post,
+						"*":   anyEntry,
+					},
+				},
+				lists: []*MailingList{list},
+			},
+		},
+	}
+
+	for addr, entry := range map[string]*Entry{
+		"dev@host1":               post,
+		"dev-subscribe@host1":     {Kind: List, List: list, Command: ListSubscribe},
+		"dev-unsubscribe@host1":   {Kind: List, List: list, Command: ListUnsubscribe},
+		"dev-bounces@host1":       {Kind: List, List: list, Command: ListBounces},
+		"dev-confirm-abc12@host1": {Kind: List, List: list, Command: ListConfirm, Token: "abc12"},
+		"dev-other@host1":         anyEntry,
+	} {
+		t.Run(addr, func(t *testing.T) {
+			actual := addressbook.Lookup(mustAddress(addr))
+			assert.Equal(t, entry, actual)
+		})
+	}
+
+	assert.Equal(t, "dev-bounces@host1", list.CommandAddress(ListBounces).String())
+}
+
+func TestDomainSettings(t *testing.T) {
+	domains, err := normalize.NewSet(nil, normalize.Domain)
+	assert.Nil(t, err)
+
+	user1AtHost1 := makeEntry(0)
+	adminAtAny := makeEntry(1)
+
+	addressbook := addressbook{
+		sources: []source{
+			&table{
+				domains: domains,
+				entries: map[string]map[string]*Entry{
+					"host1": {
+						"user1": user1AtHost1,
+					},
+					"*": {
+						"admin": adminAtAny,
+					},
+				},
+			},
+			domainSource{
+				"host1": {Name: "host1", CatchAll: mustAddress("postmaster@host1")},
+				"host2": {Name: "host2", Backup: true},
+			},
+		},
+	}
+
+	for addr, entry := range map[string]*Entry{
+		"user1@host1": user1AtHost1,
+		"user2@host1": {Kind: Forward, Address: mustAddress("postmaster@host1")},
+		"admin@host1": adminAtAny,
+		"user1@host2": {Kind: Relay, Address: mustAddress("user1@host2")},
+		"user1@host3": {Kind: Remote, Address: mustAddress("user1@host3")},
+	} {
+		t.Run(addr, func(t *testing.T) {
+			actual := addressbook.Lookup(mustAddress(addr))
+			assert.Equal(t, entry, actual)
+		})
+	}
+}
+
+// domainSource is a source of domains without any entries.
+type domainSource map[string]*storage.Domain
+
+func (s domainSource) domain(name string) *storage.Domain {
+	return s[name]
+}
+
+func (domainSource) entry(string, string) *Entry {
+	return nil
+}
+
+func (domainSource) mailingLists() []*MailingList {
+	return nil
+}
+
 func mustAddress(raw string) *model.Address {
 	addr, err := model.ParseAddress(raw)
 	if err != nil {
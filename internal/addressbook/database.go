@@ -0,0 +1,83 @@
+// Copyright (C) 2020  Lukas Dietrich <lukas@lukasdietrich.com>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package addressbook
+
+import (
+	"database/sql"
+
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+
+	"github.com/lukasdietrich/briefmail/internal/srs"
+	"github.com/lukasdietrich/briefmail/internal/storage"
+)
+
+// database is a source backed by the addresses and domains managed in the
+// database. Changes take effect immediately, since every lookup queries the
+// database.
+type database struct {
+	db *storage.DB
+}
+
+// FromDatabase returns an addressbook, which only consists of the addresses
+// and domains managed in the database.
+func FromDatabase(db *storage.DB, rewriter *srs.SRS) Addressbook {
+	return &addressbook{
+		sources:    []source{&database{db: db}},
+		srs:        rewriter,
+		separators: viper.GetString("addressbook.separator"),
+	}
+}
+
+func (d *database) domain(name string) *storage.Domain {
+	domain, err := d.db.Domain(name)
+	if err != nil {
+		if err != sql.ErrNoRows {
+			logrus.Errorf("addressbook: could not lookup domain %q: %v", name, err)
+		}
+
+		return nil
+	}
+
+	return domain
+}
+
+func (d *database) entry(domain, user string) *Entry {
+	address, err := d.db.AddressEntry(domain, user)
+	if err != nil {
+		if err != sql.ErrNoRows {
+			logrus.Errorf("addressbook: could not lookup %q at %q: %v", user, domain, err)
+		}
+
+		return nil
+	}
+
+	if address.Mailbox != nil {
+		return &Entry{
+			Kind:    Local,
+			Mailbox: address.Mailbox,
+		}
+	}
+
+	return &Entry{
+		Kind:    Forward,
+		Address: address.Target,
+	}
+}
+
+func (d *database) mailingLists() []*MailingList {
+	return nil
+}
@@ -17,50 +17,192 @@ package addressbook
 
 import (
 	"fmt"
+	"path/filepath"
+	"sync/atomic"
+	"time"
 
 	"github.com/BurntSushi/toml"
+	"github.com/fsnotify/fsnotify"
 	"github.com/sirupsen/logrus"
 	"github.com/spf13/viper"
 
 	"github.com/lukasdietrich/briefmail/internal/model"
 	"github.com/lukasdietrich/briefmail/internal/normalize"
+	"github.com/lukasdietrich/briefmail/internal/srs"
 	"github.com/lukasdietrich/briefmail/internal/storage"
 )
 
 func init() {
 	viper.SetDefault("general.domains", []string{"localhost"})
 	viper.SetDefault("addressbook.filename", "_example/addressbook.toml")
+	viper.SetDefault("addressbook.separator", "+")
+	viper.SetDefault("addressbook.watch", true)
 }
 
+// reloadDelay is the time to wait for further changes of the addressbook file
+// before reloading it.
+const reloadDelay = 500 * time.Millisecond
+
 // [mailboxes]
 //   "name" = [ "address1@domain1", "address2@domain1" ]
+//
+// [forwards]
+//   "address3@domain1" = "someone@domain2"
+//
+// [lists]
+//   "list@domain1" = { name = "Some list", membersOnly = true }
 
 type fileFormat struct {
 	Mailboxes map[string][]string
+	Forwards  map[string]string
+	Lists     map[string]listFormat
+}
+
+type listFormat struct {
+	Name        string
+	MembersOnly bool
 }
 
 func makeDomainSet() (*normalize.Set, error) {
 	return normalize.NewSet(viper.GetStringSlice("general.domains"), normalize.Domain)
 }
 
-func Parse(db *storage.DB) (Addressbook, error) {
+// Parse returns an addressbook consisting of the addressbook file and the
+// addresses managed in the database. Entries of the file take precedence. If
+// enabled, the file is watched and reloaded, whenever it changes. Without a
+// file only the database is used.
+func Parse(db *storage.DB, rewriter *srs.SRS) (Addressbook, error) {
+	fileName := viper.GetString("addressbook.filename")
+	if fileName == "" {
+		return FromDatabase(db, rewriter), nil
+	}
+
+	file := file{
+		db:       db,
+		fileName: filepath.Clean(fileName),
+	}
+
+	if err := file.reload(); err != nil {
+		return nil, err
+	}
+
+	if viper.GetBool("addressbook.watch") {
+		if err := file.watch(); err != nil {
+			return nil, err
+		}
+	}
+
+	return &addressbook{
+		sources:    []source{&file, &database{db: db}},
+		srs:        rewriter,
+		separators: viper.GetString("addressbook.separator"),
+	}, nil
+}
+
+// file is a source backed by the addressbook file. The parsed file is
+// replaced as a whole on reload, so lookups never see a partially loaded
+// file.
+type file struct {
+	db       *storage.DB
+	fileName string
+	current  atomic.Value
+}
+
+func (f *file) table() *table {
+	return f.current.Load().(*table)
+}
+
+func (f *file) domain(name string) *storage.Domain {
+	return f.table().domain(name)
+}
+
+func (f *file) entry(domain, user string) *Entry {
+	return f.table().entry(domain, user)
+}
+
+func (f *file) mailingLists() []*MailingList {
+	return f.table().mailingLists()
+}
+
+// reload parses the file and replaces the current table. If the file cannot
+// be parsed, the current table is kept.
+func (f *file) reload() error {
+	t, err := parseFile(f.db, f.fileName)
+	if err != nil {
+		return err
+	}
+
+	f.current.Store(t)
+	return nil
+}
+
+// watch reloads the file after it changed. The directory is watched instead
+// of the file itself, because editors tend to replace files rather than
+// writing to them. Bursts of events are collapsed into a single reload.
+func (f *file) watch() error {
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return err
+	}
+
+	if err := watcher.Add(filepath.Dir(f.fileName)); err != nil {
+		watcher.Close() // nolint:errcheck
+		return err
+	}
+
+	go func() {
+		var pending <-chan time.Time
+
+		for {
+			select {
+			case event, ok := <-watcher.Events:
+				if !ok {
+					return
+				}
+
+				if filepath.Clean(event.Name) == f.fileName {
+					pending = time.After(reloadDelay)
+				}
+
+			case err, ok := <-watcher.Errors:
+				if !ok {
+					return
+				}
+
+				logrus.Warnf("addressbook: could not watch %s: %v", f.fileName, err)
+
+			case <-pending:
+				pending = nil
+
+				if err := f.reload(); err != nil {
+					logrus.Errorf("addressbook: could not reload %s, keeping the previous one: %v",
+						f.fileName, err)
+				} else {
+					logrus.Infof("addressbook: reloaded %s", f.fileName)
+				}
+			}
+		}
+	}()
+
+	return nil
+}
+
+func parseFile(db *storage.DB, fileName string) (*table, error) {
 	domains, err := makeDomainSet()
 	if err != nil {
 		return nil, err
 	}
 
-	var (
-		fileName    = viper.GetString("addressbook.filename")
-		data        fileFormat
-		addressbook addressbook
-	)
+	var data fileFormat
 
 	if _, err := toml.DecodeFile(fileName, &data); err != nil {
 		return nil, err
 	}
 
-	addressbook.entries = make(map[string]map[string]*Entry)
-	addressbook.domains = domains
+	t := table{
+		domains: domains,
+		entries: make(map[string]map[string]*Entry),
+	}
 
 	for name, addresses := range data.Mailboxes {
 		mailbox, err := db.Mailbox(name)
@@ -74,19 +216,53 @@ func Parse(db *storage.DB) (Addressbook, error) {
 				return nil, err
 			}
 
-			if _, ok := addressbook.entries[addr.Domain]; !ok {
-				addressbook.entries[addr.Domain] = make(map[string]*Entry)
-			}
-
-			addressbook.entries[addr.Domain][addr.User] = &Entry{
+			t.add(addr, &Entry{
 				Kind:    Local,
 				Mailbox: &mailbox,
-			}
+			})
+		}
+	}
+
+	for address, target := range data.Forwards {
+		addr, err := model.ParseAddress(address)
+		if err != nil {
+			return nil, err
 		}
+
+		targetAddr, err := model.ParseAddress(target)
+		if err != nil {
+			return nil, err
+		}
+
+		t.add(addr, &Entry{
+			Kind:    Forward,
+			Address: targetAddr,
+		})
+	}
+
+	for address, settings := range data.Lists {
+		addr, err := model.ParseAddress(address)
+		if err != nil {
+			return nil, err
+		}
+
+		list := MailingList{
+			Address:     addr,
+			Name:        settings.Name,
+			MembersOnly: settings.MembersOnly,
+		}
+
+		t.add(addr, &Entry{
+			Kind:    List,
+			List:    &list,
+			Command: ListPost,
+		})
+
+		t.lists = append(t.lists, &list)
 	}
 
 	logrus.Debug("addressbook:")
-	for domain, entries := range addressbook.entries {
+	for domain, entries := range t.entries {
 		logrus.Debugf("- domain: \"%s\"", domain)
 
 		for user, entry := range entries {
@@ -94,5 +270,5 @@ func Parse(db *storage.DB) (Addressbook, error) {
 		}
 	}
 
-	return &addressbook, nil
+	return &t, nil
 }
@@ -0,0 +1,67 @@
+// Copyright (C) 2020  Lukas Dietrich <lukas@lukasdietrich.com>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package addressbook
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestReload(t *testing.T) {
+	dir, err := ioutil.TempDir("", "briefmail")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	f := file{fileName: filepath.Join(dir, "addressbook.toml")}
+
+	write := func(content string) {
+		assert.Nil(t, ioutil.WriteFile(f.fileName, []byte(content), 0600))
+	}
+
+	write(`
+[forwards]
+"user1@localhost" = "user1@host2"
+`)
+
+	assert.Nil(t, f.reload())
+	assert.NotNil(t, f.domain("localhost"))
+	assert.Equal(t, &Entry{
+		Kind:    Forward,
+		Address: mustAddress("user1@host2"),
+	}, f.entry("localhost", "user1"))
+
+	write(`
+[forwards
+"user2@localhost" = "user2@host2"
+`)
+
+	assert.NotNil(t, f.reload())
+	assert.NotNil(t, f.entry("localhost", "user1"))
+	assert.Nil(t, f.entry("localhost", "user2"))
+
+	write(`
+[forwards]
+"user2@localhost" = "user2@host2"
+`)
+
+	assert.Nil(t, f.reload())
+	assert.Nil(t, f.entry("localhost", "user1"))
+	assert.NotNil(t, f.entry("localhost", "user2"))
+}
@@ -0,0 +1,54 @@
+// Copyright (C) 2020  Lukas Dietrich <lukas@lukasdietrich.com>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package addressbook
+
+import (
+	"github.com/lukasdietrich/briefmail/internal/model"
+	"github.com/lukasdietrich/briefmail/internal/normalize"
+	"github.com/lukasdietrich/briefmail/internal/storage"
+)
+
+// table is an immutable source held in memory.
+type table struct {
+	domains *normalize.Set
+	entries map[string]map[string]*Entry
+	lists   []*MailingList
+}
+
+// domain returns domains of the configuration without any settings.
+func (t *table) domain(name string) *storage.Domain {
+	if !t.domains.Contains(name) {
+		return nil
+	}
+
+	return &storage.Domain{Name: name}
+}
+
+func (t *table) entry(domain, user string) *Entry {
+	return t.entries[domain][user]
+}
+
+func (t *table) mailingLists() []*MailingList {
+	return t.lists
+}
+
+func (t *table) add(addr *model.Address, entry *Entry) {
+	if _, ok := t.entries[addr.Domain]; !ok {
+		t.entries[addr.Domain] = make(map[string]*Entry)
+	}
+
+	t.entries[addr.Domain][addr.User] = entry
+}
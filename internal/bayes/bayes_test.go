@@ -0,0 +1,164 @@
+// Copyright (C) 2020  Lukas Dietrich <lukas@lukasdietrich.com>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package bayes
+
+import (
+	"io"
+	"io/ioutil"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/lukasdietrich/briefmail/internal/storage"
+)
+
+type memoryStore struct {
+	tokens  map[string]storage.BayesCount
+	trained map[string]bool
+}
+
+func (m *memoryStore) BayesTotals() (*storage.BayesCount, error) {
+	var totals storage.BayesCount
+
+	for _, spam := range m.trained {
+		if spam {
+			totals.Spam++
+		} else {
+			totals.Ham++
+		}
+	}
+
+	return &totals, nil
+}
+
+func (m *memoryStore) BayesTokens(tokens []string) (map[string]storage.BayesCount, error) {
+	return m.tokens, nil
+}
+
+func (m *memoryStore) TrainBayes(key string, tokens []string, spam bool) (bool, error) {
+	if _, ok := m.trained[key]; ok {
+		return false, nil
+	}
+
+	m.trained[key] = spam
+
+	for _, token := range tokens {
+		count := m.tokens[token]
+		if spam {
+			count.Spam++
+		} else {
+			count.Ham++
+		}
+
+		m.tokens[token] = count
+	}
+
+	return true, nil
+}
+
+func TestRead(t *testing.T) {
+	doc, err := Read(strings.NewReader(
+		"From: Alice <Alice@Example.com>\r\n" +
+			"Subject: =?utf-8?q?Cheap_pills?=\r\n" +
+			"Message-ID: <1@example.com>\r\n" +
+			"Content-Type: multipart/alternative; boundary=b\r\n" +
+			"\r\n" +
+			"--b\r\n" +
+			"Content-Type: text/plain\r\n" +
+			"Content-Transfer-Encoding: base64\r\n" +
+			"\r\n" +
+			"QnV5IG5vdyEgb2s=\r\n" +
+			"--b\r\n" +
+			"Content-Type: text/html\r\n" +
+			"\r\n" +
+			"<p class=\"x\">Don't wait</p>\r\n" +
+			"--b\r\n" +
+			"Content-Type: image/png\r\n" +
+			"\r\n" +
+			"xyz\r\n" +
+			"--b--\r\n"))
+
+	assert.Nil(t, err)
+	assert.Equal(t, "<1@example.com>", doc.Key)
+	assert.Equal(t, []string{
+		"subject:cheap",
+		"subject:pills",
+		"from:alice@example.com",
+		"from:@example.com",
+		"buy",
+		"now!",
+		"don't",
+		"wait",
+		"type:image/png",
+	}, doc.Tokens)
+}
+
+func TestClassify(t *testing.T) {
+	classifier := New(&memoryStore{
+		tokens:  make(map[string]storage.BayesCount),
+		trained: make(map[string]bool),
+	})
+	classifier.MinMails = 2
+
+	train := func(body string, spam bool) {
+		trained, err := classifier.Train(strings.NewReader(body), spam)
+		assert.Nil(t, err)
+		assert.True(t, trained)
+	}
+
+	train("Subject: cheap pills\r\n\r\nbuy cheap pills now\r\n", true)
+
+	_, err := classifier.Classify(strings.NewReader("Subject: hello\r\n\r\n"))
+	assert.Equal(t, ErrUntrained, err)
+
+	train("Subject: viagra\r\n\r\ncheap viagra pills online\r\n", true)
+	train("Subject: meeting\r\n\r\nthe meeting is moved to monday\r\n", false)
+	train("Subject: lunch\r\n\r\nlunch on monday after the meeting?\r\n", false)
+
+	spam, err := classifier.Classify(strings.NewReader("Subject: pills\r\n\r\ncheap pills online\r\n"))
+	assert.Nil(t, err)
+	assert.True(t, spam > 0.9, spam)
+
+	ham, err := classifier.Classify(strings.NewReader("Subject: monday\r\n\r\nmeeting on monday\r\n"))
+	assert.Nil(t, err)
+	assert.True(t, ham < 0.1, ham)
+
+	neutral, err := classifier.Classify(strings.NewReader("Subject: unknown\r\n\r\nnothing known\r\n"))
+	assert.Nil(t, err)
+	assert.Equal(t, 0.5, neutral)
+}
+
+func TestReadMbox(t *testing.T) {
+	var mails []string
+
+	err := ReadMbox(strings.NewReader(
+		"From alice@example.com Mon Jan  1 00:00:00 2020\n"+
+			"Subject: one\n\n>From here\n>>From there\n"+
+			"From bob@example.com Mon Jan  1 00:00:00 2020\n"+
+			"Subject: two\n\nbody"),
+		func(r io.Reader) error {
+			b, err := ioutil.ReadAll(r)
+			mails = append(mails, string(b))
+			return err
+		})
+
+	assert.Nil(t, err)
+	assert.Equal(t, []string{
+		"Subject: one\n\nFrom here\n>From there\n",
+		"Subject: two\n\nbody",
+	}, mails)
+}
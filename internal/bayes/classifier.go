@@ -0,0 +1,179 @@
+// Copyright (C) 2020  Lukas Dietrich <lukas@lukasdietrich.com>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+// Package bayes implements a token based naive bayes spam classifier. Tokens
+// are combined using Fisher's method as proposed by Gary Robinson.
+//
+// see <https://www.linuxjournal.com/article/6467>
+package bayes
+
+import (
+	"errors"
+	"io"
+	"math"
+	"sort"
+
+	"github.com/lukasdietrich/briefmail/internal/storage"
+)
+
+const (
+	// strength and assumed are the weight and probability of a token, which
+	// was never seen before.
+	strength = 0.45
+	assumed  = 0.5
+
+	// minDeviation ignores tokens with a probability close to neutral.
+	minDeviation = 0.1
+	// maxTokens limits the tokens combined into a score.
+	maxTokens = 150
+)
+
+// ErrUntrained is returned when too few mails were trained to classify.
+var ErrUntrained = errors.New("bayes: not enough mails trained")
+
+// Store is the source of token statistics, usually *storage.DB.
+type Store interface {
+	BayesTotals() (*storage.BayesCount, error)
+	BayesTokens(tokens []string) (map[string]storage.BayesCount, error)
+	TrainBayes(key string, tokens []string, spam bool) (bool, error)
+}
+
+// Classifier scores mails by their tokens.
+type Classifier struct {
+	store Store
+	// MinMails is the number of spam and ham mails each, which need to be
+	// trained before mails are classified.
+	MinMails int64
+}
+
+// New creates a classifier using a store of token statistics.
+func New(store Store) *Classifier {
+	return &Classifier{store: store}
+}
+
+// Train counts a mail as spam or ham. False is returned if the mail was
+// already trained with the same class.
+func (c *Classifier) Train(r io.Reader, spam bool) (bool, error) {
+	doc, err := Read(r)
+	if err != nil {
+		return false, err
+	}
+
+	return c.store.TrainBayes(doc.Key, doc.Tokens, spam)
+}
+
+// Classify returns the probability of a mail being spam between 0 and 1.
+// ErrUntrained is returned until enough mails are trained.
+func (c *Classifier) Classify(r io.Reader) (float64, error) {
+	totals, err := c.store.BayesTotals()
+	if err != nil {
+		return 0, err
+	}
+
+	minMails := c.MinMails
+	if minMails < 1 {
+		minMails = 1
+	}
+
+	if totals.Spam < minMails || totals.Ham < minMails {
+		return 0, ErrUntrained
+	}
+
+	doc, err := Read(r)
+	if err != nil {
+		return 0, err
+	}
+
+	counts, err := c.store.BayesTokens(doc.Tokens)
+	if err != nil {
+		return 0, err
+	}
+
+	var probabilities []float64
+
+	for _, token := range doc.Tokens {
+		p := tokenProbability(counts[token], totals)
+		if math.Abs(p-0.5) >= minDeviation {
+			probabilities = append(probabilities, p)
+		}
+	}
+
+	// the most significant tokens first
+	sort.Slice(probabilities, func(i, j int) bool {
+		return math.Abs(probabilities[i]-0.5) > math.Abs(probabilities[j]-0.5)
+	})
+
+	if len(probabilities) > maxTokens {
+		probabilities = probabilities[:maxTokens]
+	}
+
+	return combine(probabilities), nil
+}
+
+// tokenProbability returns the probability of a mail containing the token
+// being spam, adjusted towards neutral for rarely seen tokens.
+func tokenProbability(count storage.BayesCount, totals *storage.BayesCount) float64 {
+	var (
+		spamRatio = float64(count.Spam) / float64(totals.Spam)
+		hamRatio  = float64(count.Ham) / float64(totals.Ham)
+		n         = float64(count.Spam + count.Ham)
+	)
+
+	if spamRatio+hamRatio == 0 {
+		return assumed
+	}
+
+	p := spamRatio / (spamRatio + hamRatio)
+	return (strength*assumed + n*p) / (strength + n)
+}
+
+// combine merges token probabilities into a single score using Fisher's
+// method. Without tokens the score is neutral.
+func combine(probabilities []float64) float64 {
+	if len(probabilities) == 0 {
+		return 0.5
+	}
+
+	var spamLog, hamLog float64
+
+	for _, p := range probabilities {
+		p = math.Min(math.Max(p, 0.01), 0.99)
+		spamLog += math.Log(1 - p)
+		hamLog += math.Log(p)
+	}
+
+	n := 2 * len(probabilities)
+	spamminess := 1 - chi2Q(-2*spamLog, n)
+	hamminess := 1 - chi2Q(-2*hamLog, n)
+
+	return (1 + spamminess - hamminess) / 2
+}
+
+// chi2Q is the probability of a chi squared distributed value with an even
+// degree of freedom being at least x2.
+func chi2Q(x2 float64, freedom int) float64 {
+	var (
+		m    = x2 / 2
+		term = math.Exp(-m)
+		sum  = term
+	)
+
+	for i := 1; i < freedom/2; i++ {
+		term *= m / float64(i)
+		sum += term
+	}
+
+	return math.Min(sum, 1)
+}
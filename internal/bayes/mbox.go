@@ -0,0 +1,72 @@
+// Copyright (C) 2020  Lukas Dietrich <lukas@lukasdietrich.com>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package bayes
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+)
+
+// ReadMbox calls fn with each mail of an mbox file. Lines quoted with ">"
+// before "From " are unquoted as in the "mboxrd" format.
+func ReadMbox(r io.Reader, fn func(io.Reader) error) error {
+	var (
+		br      = bufio.NewReader(r)
+		mail    bytes.Buffer
+		started bool
+	)
+
+	flush := func() error {
+		if !started {
+			return nil
+		}
+
+		defer mail.Reset()
+		return fn(&mail)
+	}
+
+	for {
+		line, err := br.ReadBytes('\n')
+
+		if len(line) > 0 {
+			switch {
+			case bytes.HasPrefix(line, []byte("From ")):
+				if err := flush(); err != nil {
+					return err
+				}
+
+				started = true
+
+			case started:
+				if unquoted := bytes.TrimLeft(line, ">"); len(unquoted) < len(line) &&
+					bytes.HasPrefix(unquoted, []byte("From ")) {
+					line = line[1:]
+				}
+
+				mail.Write(line)
+			}
+		}
+
+		if err == io.EOF {
+			return flush()
+		}
+
+		if err != nil {
+			return err
+		}
+	}
+}
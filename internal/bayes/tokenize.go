@@ -0,0 +1,206 @@
+// Copyright (C) 2020  Lukas Dietrich <lukas@lukasdietrich.com>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package bayes
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"io"
+	"io/ioutil"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net/mail"
+	"regexp"
+	"strings"
+	"unicode"
+)
+
+const (
+	// maxMessageSize limits how much of a mail is read for classification.
+	maxMessageSize = 512 * 1024
+	// maxPartDepth limits the nesting of multipart bodies.
+	maxPartDepth = 8
+
+	minTokenLength = 3
+	maxTokenLength = 32
+)
+
+var htmlTags = regexp.MustCompile(`(?s)<[^>]*>`)
+
+// Document is a tokenized mail.
+type Document struct {
+	// Key identifies a mail to avoid training it twice. It is the
+	// Message-ID or a hash of the body, if the mail has none.
+	Key string
+	// Tokens are the distinct tokens of the mail.
+	Tokens []string
+}
+
+// Read tokenizes a mail.
+func Read(r io.Reader) (*Document, error) {
+	raw, err := ioutil.ReadAll(io.LimitReader(r, maxMessageSize))
+	if err != nil {
+		return nil, err
+	}
+
+	t := tokenizer{seen: make(map[string]bool)}
+
+	msg, err := mail.ReadMessage(bytes.NewReader(raw))
+	if err != nil {
+		// not even a header, so treat everything as text
+		t.words("", string(raw))
+		return &Document{Key: hashKey(raw), Tokens: t.tokens}, nil
+	}
+
+	body, err := ioutil.ReadAll(msg.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	t.header(msg.Header)
+	t.part(msg.Header.Get("Content-Type"), msg.Header.Get("Content-Transfer-Encoding"), body, 0)
+
+	key := strings.TrimSpace(msg.Header.Get("Message-ID"))
+	if key == "" {
+		key = hashKey(body)
+	}
+
+	return &Document{Key: key, Tokens: t.tokens}, nil
+}
+
+func hashKey(b []byte) string {
+	sum := sha256.Sum256(b)
+	return "sha256:" + hex.EncodeToString(sum[:])
+}
+
+type tokenizer struct {
+	seen   map[string]bool
+	tokens []string
+}
+
+func (t *tokenizer) add(token string) {
+	if !t.seen[token] {
+		t.seen[token] = true
+		t.tokens = append(t.tokens, token)
+	}
+}
+
+func (t *tokenizer) header(header mail.Header) {
+	var decoder mime.WordDecoder
+
+	subject, err := decoder.DecodeHeader(header.Get("Subject"))
+	if err != nil {
+		subject = header.Get("Subject")
+	}
+
+	t.words("subject:", subject)
+
+	if addresses, err := header.AddressList("From"); err == nil {
+		for _, address := range addresses {
+			address := strings.ToLower(address.Address)
+			t.add("from:" + address)
+
+			if i := strings.LastIndexByte(address, '@'); i >= 0 {
+				t.add("from:@" + address[i+1:])
+			}
+		}
+	}
+}
+
+// part tokenizes the text of a body part. Other parts only contribute their
+// media type.
+func (t *tokenizer) part(contentType, encoding string, body []byte, depth int) {
+	mediaType, params, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		mediaType = "text/plain"
+	}
+
+	switch {
+	case strings.HasPrefix(mediaType, "multipart/"):
+		if depth >= maxPartDepth || params["boundary"] == "" {
+			return
+		}
+
+		r := multipart.NewReader(bytes.NewReader(body), params["boundary"])
+
+		for {
+			p, err := r.NextPart()
+			if err != nil {
+				return
+			}
+
+			// the multipart reader already decodes quoted-printable and
+			// removes the header, but leaves base64 to the caller
+			b, err := ioutil.ReadAll(p)
+			if err != nil {
+				return
+			}
+
+			t.part(p.Header.Get("Content-Type"), p.Header.Get("Content-Transfer-Encoding"), b, depth+1)
+		}
+
+	case mediaType == "text/html":
+		t.words("", htmlTags.ReplaceAllString(string(decode(encoding, body)), " "))
+
+	case strings.HasPrefix(mediaType, "text/"):
+		t.words("", string(decode(encoding, body)))
+
+	default:
+		t.add("type:" + mediaType)
+	}
+}
+
+// words adds the words of a text with a prefix.
+func (t *tokenizer) words(prefix, text string) {
+	fields := strings.FieldsFunc(strings.ToLower(text), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r) && r != '$' && r != '!' && r != '\''
+	})
+
+	for _, word := range fields {
+		word = strings.Trim(word, "'")
+
+		if len(word) >= minTokenLength && len(word) <= maxTokenLength {
+			t.add(prefix + word)
+		}
+	}
+}
+
+func decode(encoding string, body []byte) []byte {
+	switch strings.ToLower(strings.TrimSpace(encoding)) {
+	case "base64":
+		clean := bytes.Map(func(r rune) rune {
+			if unicode.IsSpace(r) {
+				return -1
+			}
+
+			return r
+		}, body)
+
+		decoded := make([]byte, base64.StdEncoding.DecodedLen(len(clean)))
+		n, _ := base64.StdEncoding.Decode(decoded, clean)
+		return decoded[:n]
+
+	case "quoted-printable":
+		decoded, _ := ioutil.ReadAll(quotedprintable.NewReader(bytes.NewReader(body)))
+		return decoded
+
+	default:
+		return body
+	}
+}
@@ -17,12 +17,17 @@ package certs
 
 import (
 	"crypto/tls"
+	"database/sql"
+	"errors"
 	"fmt"
+	"strings"
 	"sync"
 	"time"
 
 	"github.com/sirupsen/logrus"
 	"github.com/spf13/viper"
+
+	"github.com/lukasdietrich/briefmail/internal/storage"
 )
 
 const (
@@ -33,6 +38,8 @@ const (
 
 var log = logrus.WithField("prefix", "certs")
 
+var errNoCertificate = errors.New("no certificate configured")
+
 func init() {
 	viper.SetDefault("tls.source", sourceNone)
 }
@@ -55,38 +62,87 @@ func NewCertSource() (CertSource, error) {
 	}
 }
 
-func NewTlsConfig(source CertSource) *tls.Config {
+// NewTlsConfig returns a tls configuration presenting the certificate of the
+// source. Clients requesting a domain with its own certificate using SNI are
+// presented that certificate instead.
+func NewTlsConfig(source CertSource, db *storage.DB) *tls.Config {
 	var (
-		lastCert *tls.Certificate
-		lastTime time.Time
-		lock     sync.Mutex
+		fallback = cachedCertificate{source: source}
+		domains  sync.Map
 	)
 
 	return &tls.Config{
-		GetCertificate: func(*tls.ClientHelloInfo) (*tls.Certificate, error) {
-			lock.Lock()
-			defer lock.Unlock()
-
-			newTime, err := source.LastUpdate()
-			if err != nil {
-				log.Errorf("could not check for certificate updates: %v", err)
-				return nil, err
-			}
+		GetCertificate: func(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+			if hello.ServerName != "" {
+				if domain := domainSource(db, hello.ServerName); domain != nil {
+					key := domain.crtFilename + "\x00" + domain.keyFilename
+					cached, _ := domains.LoadOrStore(key, &cachedCertificate{source: domain})
 
-			if newTime.After(lastTime) {
-				newCert, err := source.Load()
-				if err != nil {
-					log.Errorf("could not load certificate: %v", err)
-					return nil, err
+					return cached.(*cachedCertificate).get()
 				}
-
-				lastTime = newTime
-				lastCert = newCert
-
-				log.Debugf("loaded certificate from %s", lastTime)
 			}
 
-			return lastCert, nil
+			return fallback.get()
 		},
 	}
 }
+
+// domainSource returns the certificate files of a domain, if it has any.
+func domainSource(db *storage.DB, serverName string) *filesCertSource {
+	domain, err := db.Domain(strings.ToLower(serverName))
+	if err != nil {
+		if !errors.Is(err, sql.ErrNoRows) {
+			log.Errorf("could not lookup domain %q: %v", serverName, err)
+		}
+
+		return nil
+	}
+
+	if domain.TLSCertificate == "" {
+		return nil
+	}
+
+	return &filesCertSource{
+		crtFilename: domain.TLSCertificate,
+		keyFilename: domain.TLSKey,
+	}
+}
+
+// cachedCertificate keeps the certificate of a source, until the source is
+// updated.
+type cachedCertificate struct {
+	source   CertSource
+	lastCert *tls.Certificate
+	lastTime time.Time
+	lock     sync.Mutex
+}
+
+func (c *cachedCertificate) get() (*tls.Certificate, error) {
+	if c.source == nil {
+		return nil, errNoCertificate
+	}
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	newTime, err := c.source.LastUpdate()
+	if err != nil {
+		log.Errorf("could not check for certificate updates: %v", err)
+		return nil, err
+	}
+
+	if newTime.After(c.lastTime) {
+		newCert, err := c.source.Load()
+		if err != nil {
+			log.Errorf("could not load certificate: %v", err)
+			return nil, err
+		}
+
+		c.lastTime = newTime
+		c.lastCert = newCert
+
+		log.Debugf("loaded certificate from %s", c.lastTime)
+	}
+
+	return c.lastCert, nil
+}
@@ -0,0 +1,133 @@
+// Copyright (C) 2020  Lukas Dietrich <lukas@lukasdietrich.com>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package delivery
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/lukasdietrich/briefmail/internal/addressbook"
+	"github.com/lukasdietrich/briefmail/internal/model"
+	"github.com/lukasdietrich/briefmail/internal/storage"
+)
+
+var (
+	errUnknownRecipient = errors.New("unknown recipient")
+	errListRecipient    = errors.New("mails cannot be requeued for a mailing list")
+)
+
+// Retry schedules a queued mail for immediate delivery. The running server
+// picks it up the next time it polls the queue.
+func (q *QueueWorker) Retry(id model.ID) error {
+	return q.DB.RescheduleQueue(id, time.Unix(0, 0))
+}
+
+// Hold excludes a queued mail from delivery until it is released.
+func (q *QueueWorker) Hold(id model.ID) error {
+	return q.DB.HoldQueue(id, true)
+}
+
+// Release includes a held mail in delivery again.
+func (q *QueueWorker) Release(id model.ID) error {
+	return q.DB.HoldQueue(id, false)
+}
+
+// Delete removes a mail from the queue. If bounce is true, the sender is
+// notified about all recipients, that did not receive the mail.
+func (q *QueueWorker) Delete(id model.ID, bounce bool) error {
+	elem, err := q.DB.QueueElement(id)
+	if err != nil {
+		return err
+	}
+
+	if bounce {
+		mail, err := q.DB.Mail(id)
+		if err != nil {
+			return err
+		}
+
+		reasons := make(map[string]string)
+		for _, addr := range elem.To {
+			reason := "removed from the queue by an administrator"
+			if last := elem.Errors[addr.String()]; last != "" {
+				reason = fmt.Sprintf("%s (last error: %s)", reason, last)
+			}
+
+			reasons[addr.String()] = reason
+		}
+
+		if err := q.notify(mail, actionFailed, elem.To, reasons); err != nil {
+			return err
+		}
+	}
+
+	if err := q.DB.DeleteFromQueue(id); err != nil {
+		return err
+	}
+
+	return storage.NewCleaner(q.DB, q.Blobs).Clean()
+}
+
+// Requeue replaces the recipients of a queued mail with a single new
+// recipient. Local recipients receive the mail immediately, while forwards
+// and remote recipients are scheduled for immediate delivery. Mailing lists
+// cannot be requeued.
+func (q *QueueWorker) Requeue(id model.ID, to *model.Address) error {
+	if _, err := q.DB.QueueElement(id); err != nil {
+		return err
+	}
+
+	entry := q.Addressbook.Lookup(to)
+	if entry == nil {
+		return errUnknownRecipient
+	}
+
+	switch entry.Kind {
+	case addressbook.Local:
+		mail, err := q.DB.Mail(id)
+		if err != nil {
+			return err
+		}
+
+		err = q.Store.Store(&LocalMail{
+			Mailbox:    *entry.Mailbox,
+			Recipient:  to,
+			From:       mail.From,
+			ID:         id,
+			Offset:     mail.Offset,
+			Deliveries: inbox,
+		})
+
+		if err != nil {
+			return err
+		}
+
+		return q.DB.DeleteFromQueue(id)
+
+	case addressbook.Forward:
+		return q.DB.ResetQueue(id, []*model.Address{entry.Address})
+
+	case addressbook.Remote, addressbook.Relay:
+		return q.DB.ResetQueue(id, []*model.Address{to})
+
+	case addressbook.List:
+		return errListRecipient
+
+	default:
+		return errUnknownRecipient
+	}
+}
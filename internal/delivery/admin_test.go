@@ -0,0 +1,58 @@
+// Copyright (C) 2020  Lukas Dietrich <lukas@lukasdietrich.com>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package delivery
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/lukasdietrich/briefmail/internal/addressbook"
+	"github.com/lukasdietrich/briefmail/internal/model"
+	"github.com/lukasdietrich/briefmail/internal/storage/storagetest"
+)
+
+func TestRequeueList(t *testing.T) {
+	db, cleanup := storagetest.OpenDB(t)
+	defer cleanup()
+
+	from, err := model.ParseAddress("alice@example.com")
+	assert.Nil(t, err)
+
+	to, err := model.ParseAddress("bob@example.org")
+	assert.Nil(t, err)
+
+	list, err := model.ParseAddress("friends@example.com")
+	assert.Nil(t, err)
+
+	id := model.NewID()
+	assert.Nil(t, db.AddMail(id, 100, 0, &model.Envelope{Date: time.Now(), From: from}))
+	assert.Nil(t, db.AddToQueue(id, nil, []*model.Address{to}))
+
+	q := QueueWorker{
+		DB: db,
+		Addressbook: lookupFunc(func(addr *model.Address) *addressbook.Entry {
+			return &addressbook.Entry{Kind: addressbook.List, Address: addr}
+		}),
+	}
+
+	assert.Equal(t, errListRecipient, q.Requeue(id, list))
+
+	elem, err := db.QueueElement(id)
+	assert.Nil(t, err)
+	assert.Equal(t, []*model.Address{to}, elem.To)
+}
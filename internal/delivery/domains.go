@@ -0,0 +1,49 @@
+// Copyright (C) 2020  Lukas Dietrich <lukas@lukasdietrich.com>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package delivery
+
+import (
+	"database/sql"
+	"errors"
+
+	"github.com/lukasdietrich/briefmail/internal/model"
+)
+
+var (
+	// ErrMessageTooLarge is returned if a mail exceeds the maximum size of the
+	// recipient domain.
+	ErrMessageTooLarge = errors.New("delivery: message exceeds the size limit of the domain")
+)
+
+// CheckSize returns ErrMessageTooLarge if a mail of the given size exceeds
+// the maximum size of the recipient domain. Domains without settings are only
+// limited by the global maximum size.
+func (m *Mailman) CheckSize(addr *model.Address, size int64) error {
+	domain, err := m.DB.Domain(addr.Domain)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil
+		}
+
+		return err
+	}
+
+	if domain.MaxSize > 0 && size > domain.MaxSize {
+		return ErrMessageTooLarge
+	}
+
+	return nil
+}
@@ -0,0 +1,380 @@
+// Copyright (C) 2020  Lukas Dietrich <lukas@lukasdietrich.com>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package delivery
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/rand"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/spf13/viper"
+
+	"github.com/lukasdietrich/briefmail/internal/addressbook"
+	"github.com/lukasdietrich/briefmail/internal/model"
+	"github.com/lukasdietrich/briefmail/internal/storage"
+)
+
+func init() {
+	viper.SetDefault("lists.confirmationAge", time.Hour*72)
+	viper.SetDefault("lists.unsubscribe.url", "")
+}
+
+var (
+	// ErrNotMember is returned if a non-member posts to a members-only list.
+	ErrNotMember = errors.New("delivery: posting is restricted to members")
+)
+
+// MayPost returns ErrNotMember if the sender is not allowed to post to a
+// members-only list. Any other entry is not restricted.
+func (m *Mailman) MayPost(entry *addressbook.Entry, from *model.Address) error {
+	if entry.Kind != addressbook.List ||
+		entry.Command != addressbook.ListPost ||
+		!entry.List.MembersOnly {
+		return nil
+	}
+
+	ok, err := m.DB.IsSubscribed(entry.List.Address, from)
+	if err != nil {
+		return err
+	}
+
+	if !ok {
+		return ErrNotMember
+	}
+
+	return nil
+}
+
+// handleList processes a mail to one of the addresses of a mailing list.
+func (m *Mailman) handleList(entry *addressbook.Entry, envelope *model.Envelope, id model.ID, offset int64) error {
+	log := log.WithField("list", entry.List.Address).WithField("command", entry.Command)
+
+	// mails from the null sender are bounces or automatic replies and
+	// must never cause any reaction
+	if envelope.From.String() == "" {
+		log.Debug("ignoring mail from the null sender")
+		return nil
+	}
+
+	switch entry.Command {
+	case addressbook.ListPost:
+		return m.distribute(entry.List, envelope, id, offset)
+
+	case addressbook.ListSubscribe, addressbook.ListUnsubscribe:
+		return m.requestConfirmation(entry.List, entry.Command, envelope.From)
+
+	case addressbook.ListConfirm:
+		return m.confirm(entry.List, entry.Token)
+
+	default:
+		log.WithField("from", envelope.From).Info("discarding bounce")
+		return nil
+	}
+}
+
+// distribute sends a copy of a mail to all subscribers of a list. The
+// envelope sender is rewritten to the bounce address of the list, so
+// delivery problems do not reach the original sender.
+func (m *Mailman) distribute(list *addressbook.MailingList, envelope *model.Envelope, id model.ID, offset int64) error {
+	log := log.WithField("list", list.Address)
+
+	if err := m.MayPost(&addressbook.Entry{
+		Kind:    addressbook.List,
+		List:    list,
+		Command: addressbook.ListPost,
+	}, envelope.From); err != nil {
+		if err == ErrNotMember {
+			log.WithField("from", envelope.From).Info("discarding post of non-member")
+			return nil
+		}
+
+		return err
+	}
+
+	r, err := m.Blobs.ReadOffset(id, offset)
+	if err != nil {
+		return err
+	}
+
+	headers, err := readHeaders(r)
+	r.Close()
+
+	if err != nil {
+		return err
+	}
+
+	listID := listID(list)
+
+	if hasListID(headers, listID) {
+		log.Warn("discarding mail, which already passed the list")
+		return nil
+	}
+
+	subscriptions, err := m.DB.Subscriptions(list.Address)
+	if err != nil {
+		return err
+	}
+
+	var (
+		to       []*model.Address
+		accepted []*storage.Subscription
+	)
+
+	for _, subscription := range subscriptions {
+		// lists must not be subscribed to themselves or other lists to
+		// prevent loops
+		if entry := m.Addressbook.Lookup(subscription.Address); entry != nil && entry.Kind != addressbook.List {
+			to = append(to, subscription.Address)
+			accepted = append(accepted, subscription)
+		}
+	}
+
+	if len(to) == 0 {
+		log.Debug("list has no subscribers")
+		return nil
+	}
+
+	log.WithField("subscribers", len(to)).Debug("distributing mail")
+
+	unsubscribeURL := viper.GetString("lists.unsubscribe.url")
+	if unsubscribeURL == "" {
+		return m.post(list, listID, envelope, id, offset, to, "")
+	}
+
+	// one-click unsubscribe links identify the subscriber, so everyone
+	// receives a copy of their own
+	var first error
+
+	for _, subscription := range accepted {
+		link := strings.TrimSuffix(unsubscribeURL, "/") + "/" + subscription.Token
+
+		if err := m.post(list, listID, envelope, id, offset, []*model.Address{subscription.Address}, link); err != nil {
+			log.WithField("to", subscription.Address).Errorf("could not distribute mail: %v", err)
+
+			if first == nil {
+				first = err
+			}
+		}
+	}
+
+	return first
+}
+
+// post delivers a copy of a mail with the list headers to subscribers. If
+// the link is not empty, it is offered for one-click unsubscription as
+// specified in RFC#8058.
+func (m *Mailman) post(
+	list *addressbook.MailingList,
+	listID string,
+	envelope *model.Envelope,
+	id model.ID,
+	offset int64,
+	to []*model.Address,
+	link string,
+) error {
+	r, err := m.Blobs.ReadOffset(id, offset)
+	if err != nil {
+		return err
+	}
+
+	defer r.Close()
+
+	unsubscribe := mailtoURL(list.CommandAddress(addressbook.ListUnsubscribe))
+
+	body := model.Body{Reader: r}
+	body.Prepend("Precedence", "list")
+
+	if link != "" {
+		body.Prepend("List-Unsubscribe-Post", "List-Unsubscribe=One-Click")
+		unsubscribe = fmt.Sprintf("<%s>, %s", link, unsubscribe)
+	}
+
+	body.Prepend("List-Unsubscribe", unsubscribe)
+	body.Prepend("List-Subscribe", mailtoURL(list.CommandAddress(addressbook.ListSubscribe)))
+	body.Prepend("List-Post", mailtoURL(list.Address))
+	body.Prepend("List-Id", listID)
+
+	listEnvelope := model.Envelope{
+		Helo: envelope.Helo,
+		Addr: envelope.Addr,
+		Date: time.Now(),
+		From: list.CommandAddress(addressbook.ListBounces),
+		To:   to,
+	}
+
+	failed, err := m.DeliverEach(&listEnvelope, body)
+	if err != nil {
+		return err
+	}
+
+	// subscribers, who did not receive their copy, are only logged, because
+	// failing the post would duplicate it for everyone else on a retry
+	if len(to) > 0 && len(failed) == len(to) {
+		return failed[to[0].String()]
+	}
+
+	for addr, err := range failed {
+		log.WithField("to", addr).Errorf("could not distribute mail: %v", err)
+	}
+
+	return nil
+}
+
+// listID returns the List-Id header as specified in RFC#2919.
+func listID(list *addressbook.MailingList) string {
+	id := fmt.Sprintf("<%s.%s>", list.Address.User, list.Address.Domain)
+
+	if list.Name != "" {
+		return fmt.Sprintf("%q %s", list.Name, id)
+	}
+
+	return id
+}
+
+// hasListID returns true if the headers already contain the List-Id.
+func hasListID(headers []byte, listID string) bool {
+	scanner := bufio.NewScanner(bytes.NewReader(headers))
+
+	for scanner.Scan() {
+		line := scanner.Text()
+
+		if len(line) > 8 && strings.EqualFold(line[:8], "list-id:") &&
+			strings.TrimSpace(line[8:]) == listID {
+			return true
+		}
+	}
+
+	return false
+}
+
+func mailtoURL(addr *model.Address) string {
+	return fmt.Sprintf("<mailto:%s>", addr)
+}
+
+// requestConfirmation stores a pending subscription change and asks the
+// subscriber to confirm it, so nobody can subscribe someone else.
+func (m *Mailman) requestConfirmation(list *addressbook.MailingList, command string, from *model.Address) error {
+	token := make([]byte, 16)
+	if _, err := rand.Read(token); err != nil {
+		return err
+	}
+
+	request := storage.ListRequest{
+		Token:   hex.EncodeToString(token),
+		List:    list.Address,
+		Address: from,
+		Action:  storage.ListSubscribe,
+		Date:    time.Now(),
+	}
+
+	if command == addressbook.ListUnsubscribe {
+		request.Action = storage.ListUnsubscribe
+	}
+
+	if err := m.DB.AddListRequest(&request); err != nil {
+		return err
+	}
+
+	hostname := viper.GetString("general.hostname")
+
+	envelope := model.Envelope{
+		Helo: hostname,
+		Addr: "127.0.0.1",
+		Date: request.Date,
+		From: list.CommandAddress(addressbook.ListBounces),
+		To:   []*model.Address{from},
+	}
+
+	log.WithField("list", list.Address).
+		WithField("action", request.Action).
+		Debug("requesting confirmation")
+
+	body := confirmationRequest(hostname, list, &request)
+	return m.Deliver(&envelope, model.Body{Reader: bytes.NewReader(body)})
+}
+
+// nolint:errcheck
+func confirmationRequest(hostname string, list *addressbook.MailingList, request *storage.ListRequest) []byte {
+	var (
+		b       bytes.Buffer
+		confirm = list.CommandAddress(addressbook.ListConfirm + "-" + request.Token)
+		subject = fmt.Sprintf("Confirm your subscription to %s", list.Address)
+		intent  = fmt.Sprintf("subscribe <%s> to %s", request.Address, list.Address)
+	)
+
+	if request.Action == storage.ListUnsubscribe {
+		subject = fmt.Sprintf("Confirm your unsubscription from %s", list.Address)
+		intent = fmt.Sprintf("unsubscribe <%s> from %s", request.Address, list.Address)
+	}
+
+	fmt.Fprintf(&b, "From: <%s>\r\n", confirm)
+	fmt.Fprintf(&b, "Reply-To: <%s>\r\n", confirm)
+	fmt.Fprintf(&b, "To: <%s>\r\n", request.Address)
+	fmt.Fprintf(&b, "Subject: %s\r\n", subject)
+	fmt.Fprintf(&b, "Date: %s\r\n", request.Date.Format(time.RFC1123Z))
+	fmt.Fprintf(&b, "Message-ID: <%s@%s>\r\n", model.NewID(), hostname)
+	fmt.Fprintf(&b, "Auto-Submitted: auto-replied\r\n")
+	fmt.Fprintf(&b, "Content-Type: text/plain; charset=utf-8\r\n")
+	fmt.Fprintf(&b, "\r\n")
+
+	fmt.Fprintf(&b, "Someone, hopefully you, asked to %s.\r\n\r\n", intent)
+	fmt.Fprintf(&b, "To confirm, reply to this mail or send a mail to\r\n<%s>.\r\n\r\n", confirm)
+	fmt.Fprintf(&b, "If you did not ask for this, you can ignore this mail.\r\n")
+
+	return b.Bytes()
+}
+
+// confirm applies a pending subscription change.
+func (m *Mailman) confirm(list *addressbook.MailingList, token string) error {
+	log := log.WithField("list", list.Address)
+
+	request, err := m.DB.TakeListRequest(token, viper.GetDuration("lists.confirmationAge"))
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			log.Info("ignoring unknown or expired confirmation")
+			return nil
+		}
+
+		return err
+	}
+
+	if request.List.User != list.Address.User || request.List.Domain != list.Address.Domain {
+		log.Info("ignoring confirmation for another list")
+		return nil
+	}
+
+	switch request.Action {
+	case storage.ListSubscribe:
+		err = m.DB.Subscribe(list.Address, request.Address)
+	case storage.ListUnsubscribe:
+		if err = m.DB.Unsubscribe(list.Address, request.Address); errors.Is(err, sql.ErrNoRows) {
+			err = nil
+		}
+	}
+
+	if err != nil {
+		return err
+	}
+
+	log.WithField("action", request.Action).Info("subscription changed")
+	return nil
+}
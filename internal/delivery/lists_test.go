@@ -0,0 +1,94 @@
+// Copyright (C) 2020  Lukas Dietrich <lukas@lukasdietrich.com>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package delivery
+
+import (
+	"io/ioutil"
+	"strings"
+	"testing"
+
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/lukasdietrich/briefmail/internal/addressbook"
+	"github.com/lukasdietrich/briefmail/internal/model"
+)
+
+func TestListID(t *testing.T) {
+	addr, err := model.ParseAddress("dev@example.com")
+	assert.Nil(t, err)
+
+	list := addressbook.MailingList{Address: addr}
+	assert.Equal(t, "<dev.example.com>", listID(&list))
+
+	list.Name = "Developers"
+	assert.Equal(t, `"Developers" <dev.example.com>`, listID(&list))
+
+	headers := []byte("Subject: test\r\nlist-id: \"Developers\" <dev.example.com>\r\n")
+	assert.True(t, hasListID(headers, listID(&list)))
+	assert.False(t, hasListID(headers, "<other.example.com>"))
+}
+
+func TestDistributeOneClick(t *testing.T) {
+	m, mailboxes, cleanup := localMailman(t)
+	defer cleanup()
+
+	viper.Set("lists.unsubscribe.url", "https://lists.example.com/unsubscribe/")
+	defer viper.Set("lists.unsubscribe.url", "")
+
+	addr, err := model.ParseAddress("dev@example.com")
+	assert.Nil(t, err)
+
+	list := addressbook.MailingList{Address: addr}
+	envelope := testEnvelope(t, "dev@example.com")
+	envelope.From, err = model.ParseAddress("sender@example.org")
+	assert.Nil(t, err)
+
+	for _, name := range []string{"alice", "bob"} {
+		subscriber, err := model.ParseAddress(name + "@example.com")
+		assert.Nil(t, err)
+		assert.Nil(t, m.DB.Subscribe(addr, subscriber))
+	}
+
+	subscriptions, err := m.DB.Subscriptions(addr)
+	assert.Nil(t, err)
+
+	id, _, err := m.Blobs.Write(strings.NewReader("Subject: hello\r\n\r\nbody\r\n"))
+	assert.Nil(t, err)
+	assert.Nil(t, m.distribute(&list, envelope, id, 0))
+
+	// everyone receives a copy with their own link
+	for _, subscription := range subscriptions {
+		entries, _, err := m.DB.Entries(mailboxes[subscription.Address.User])
+		assert.Nil(t, err)
+
+		if !assert.Len(t, entries, 1) {
+			continue
+		}
+
+		r, err := m.Blobs.Read(entries[0].MailID)
+		assert.Nil(t, err)
+
+		mail, err := ioutil.ReadAll(r)
+		assert.Nil(t, err)
+		r.Close()
+
+		assert.Contains(t, string(mail), "List-Unsubscribe: "+
+			"<https://lists.example.com/unsubscribe/"+subscription.Token+">,\r\n "+
+			"<mailto:dev-unsubscribe@example.com>\r\n")
+		assert.Contains(t, string(mail), "List-Unsubscribe-Post: List-Unsubscribe=One-Click\r\n")
+	}
+}
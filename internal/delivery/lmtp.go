@@ -0,0 +1,127 @@
+// Copyright (C) 2020  Lukas Dietrich <lukas@lukasdietrich.com>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package delivery
+
+import (
+	"io"
+	"net"
+	"net/textproto"
+	"strings"
+	"time"
+
+	"github.com/lukasdietrich/briefmail/internal/storage"
+)
+
+// lmtpStore hands mails to another mail store, like dovecot, using the
+// "Local Mail Transfer Protocol". The address is either "host:port" or
+// "unix:" followed by the path of a socket.
+//
+// see RFC#2033
+type lmtpStore struct {
+	address  string
+	hostname string
+	blobs    *storage.Blobs
+}
+
+func (s *lmtpStore) dial() (*textproto.Conn, error) {
+	network, address := "tcp", s.address
+
+	if strings.HasPrefix(address, "unix:") {
+		network, address = "unix", strings.TrimPrefix(address, "unix:")
+	}
+
+	conn, err := net.DialTimeout(network, address, time.Minute)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := conn.SetDeadline(time.Now().Add(transactionTimeout)); err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	return textproto.NewConn(conn), nil
+}
+
+// Store transfers a mail to the lmtp server once. Folders and flags cannot be
+// expressed in lmtp and are left to the receiving store.
+func (s *lmtpStore) Store(mail *LocalMail) error {
+	// the lmtp server adds its own Return-Path header
+	r, err := s.blobs.ReadOffset(mail.ID, mail.Offset)
+	if err != nil {
+		return err
+	}
+
+	defer r.Close()
+
+	conn, err := s.dial()
+	if err != nil {
+		return err
+	}
+
+	defer conn.Close()
+
+	if _, _, err := conn.ReadResponse(220); err != nil {
+		return err
+	}
+
+	if err := lmtpCommand(conn, 250, "LHLO %s", s.hostname); err != nil {
+		return err
+	}
+
+	if err := lmtpCommand(conn, 250, "MAIL FROM:<%s>", mail.From); err != nil {
+		return err
+	}
+
+	if err := lmtpCommand(conn, 250, "RCPT TO:<%s>", mail.Recipient); err != nil {
+		return err
+	}
+
+	if err := lmtpCommand(conn, 354, "DATA"); err != nil {
+		return err
+	}
+
+	w := conn.DotWriter()
+
+	if _, err := io.Copy(w, r); err != nil {
+		w.Close()
+		return err
+	}
+
+	if err := w.Close(); err != nil {
+		return err
+	}
+
+	// lmtp replies once per accepted recipient, which is a single one here
+	if _, _, err := conn.ReadResponse(250); err != nil {
+		return err
+	}
+
+	return lmtpCommand(conn, 221, "QUIT")
+}
+
+func lmtpCommand(conn *textproto.Conn, code int, format string, args ...interface{}) error {
+	id, err := conn.Cmd(format, args...)
+	if err != nil {
+		return err
+	}
+
+	conn.StartResponse(id)
+	defer conn.EndResponse(id)
+
+	_, _, err = conn.ReadResponse(code)
+	return err
+}
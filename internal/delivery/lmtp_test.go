@@ -0,0 +1,132 @@
+// Copyright (C) 2020  Lukas Dietrich <lukas@lukasdietrich.com>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package delivery
+
+import (
+	"net"
+	"net/textproto"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/lukasdietrich/briefmail/internal/model"
+	"github.com/lukasdietrich/briefmail/internal/storage"
+)
+
+// serveLMTP accepts a single lmtp transaction and returns the commands and
+// the received mail.
+func serveLMTP(l net.Listener, rcptReply string) <-chan []string {
+	result := make(chan []string, 1)
+
+	go func() {
+		var commands []string
+		defer func() { result <- commands }()
+
+		c, err := l.Accept()
+		if err != nil {
+			return
+		}
+
+		defer c.Close()
+
+		conn := textproto.NewConn(c)
+		conn.PrintfLine("220 localhost LMTP") // nolint:errcheck
+
+		for {
+			line, err := conn.ReadLine()
+			if err != nil {
+				return
+			}
+
+			commands = append(commands, line)
+
+			switch verb := strings.ToUpper(strings.Fields(line)[0]); verb {
+			case "LHLO":
+				conn.PrintfLine("250-localhost\r\n250 PIPELINING") // nolint:errcheck
+			case "RCPT":
+				conn.PrintfLine(rcptReply) // nolint:errcheck
+			case "DATA":
+				conn.PrintfLine("354 go ahead") // nolint:errcheck
+
+				data, err := conn.ReadDotBytes()
+				if err != nil {
+					return
+				}
+
+				commands = append(commands, string(data))
+				conn.PrintfLine("250 2.0.0 delivered") // nolint:errcheck
+			case "QUIT":
+				conn.PrintfLine("221 bye") // nolint:errcheck
+				return
+			default:
+				conn.PrintfLine("250 ok") // nolint:errcheck
+			}
+		}
+	}()
+
+	return result
+}
+
+func storeLMTP(t *testing.T, rcptReply string) ([]string, error) {
+	blobs, err := storage.NewInMemoryBlobs()
+	assert.Nil(t, err)
+
+	body := model.Body{Reader: strings.NewReader("Subject: hello\r\n\r\nbody\r\n")}
+	offset := body.Prepend("Return-Path", "<alice@example.com>")
+
+	id, _, err := blobs.Write(body)
+	assert.Nil(t, err)
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(t, err)
+
+	defer l.Close()
+
+	from, _ := model.ParseAddress("alice@example.com")
+	to, _ := model.ParseAddress("bob@example.org")
+
+	result := serveLMTP(l, rcptReply)
+	store := lmtpStore{address: l.Addr().String(), hostname: "localhost", blobs: blobs}
+
+	err = store.Store(&LocalMail{Recipient: to, From: from, ID: id, Offset: offset})
+	l.Close()
+
+	return <-result, err
+}
+
+func TestLMTPStore(t *testing.T) {
+	commands, err := storeLMTP(t, "250 2.1.5 ok")
+	assert.Nil(t, err)
+	assert.Equal(t, []string{
+		"LHLO localhost",
+		"MAIL FROM:<alice@example.com>",
+		"RCPT TO:<bob@example.org>",
+		"DATA",
+		"Subject: hello\n\nbody\n",
+		"QUIT",
+	}, commands)
+}
+
+func TestLMTPStoreRejected(t *testing.T) {
+	commands, err := storeLMTP(t, "550 5.1.1 unknown user")
+	assert.NotNil(t, err)
+	assert.Len(t, commands, 3)
+
+	protoErr, ok := err.(*textproto.Error)
+	assert.True(t, ok)
+	assert.Equal(t, 550, protoErr.Code)
+}
@@ -0,0 +1,183 @@
+// Copyright (C) 2020  Lukas Dietrich <lukas@lukasdietrich.com>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package delivery
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/lukasdietrich/briefmail/internal/model"
+	"github.com/lukasdietrich/briefmail/internal/sieve"
+	"github.com/lukasdietrich/briefmail/internal/storage"
+)
+
+var (
+	errInvalidMaildir = errors.New("mailbox name is not a valid maildir")
+
+	// maildirFlags maps system flags to the letters of the maildir info.
+	// Other flags cannot be expressed and are dropped.
+	maildirFlags = map[string]byte{
+		`\draft`:    'D',
+		`\flagged`:  'F',
+		`\answered`: 'R',
+		`\seen`:     'S',
+		`\deleted`:  'T',
+	}
+
+	maildirCounter uint64
+)
+
+// maildirStore writes mails into a maildir per mailbox, which is named like
+// the mailbox and placed in a common path. Folders other than the inbox are
+// subfolders as used by "Maildir++".
+//
+// see <https://cr.yp.to/proto/maildir.html>
+type maildirStore struct {
+	path  string
+	db    *storage.DB
+	blobs *storage.Blobs
+}
+
+func (s *maildirStore) Store(mail *LocalMail) error {
+	name, err := s.db.MailboxName(mail.Mailbox)
+	if err != nil {
+		return err
+	}
+
+	if name == "" || name != filepath.Base(name) || strings.HasPrefix(name, ".") {
+		return errInvalidMaildir
+	}
+
+	for _, d := range mail.Deliveries {
+		if err := s.write(maildirFolder(filepath.Join(s.path, name), d.Folder), d.Flags, mail.ID); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// write copies a mail into a folder of a maildir.
+func (s *maildirStore) write(dir string, flags []string, id model.ID) error {
+	r, err := s.blobs.Read(id)
+	if err != nil {
+		return err
+	}
+
+	defer r.Close()
+
+	_, err = writeMaildir(dir, flags, r)
+	return err
+}
+
+// maildirFolder returns the directory of a folder within a maildir.
+func maildirFolder(root, folder string) string {
+	if folder == "" || strings.EqualFold(folder, sieve.Inbox) {
+		return root
+	}
+
+	folder = strings.ReplaceAll(folder, "/", ".")
+	return filepath.Join(root, "."+strings.TrimLeft(folder, "."))
+}
+
+// writeMaildir delivers a mail into a maildir and returns the path of the
+// new file. The mail is written to "tmp" and only moved to "new" once it is
+// completely on disk, so readers never see partial mails. Mails with flags
+// are moved to "cur" instead, because "new" holds unseen mails without info.
+func writeMaildir(dir string, flags []string, r io.Reader) (string, error) {
+	for _, sub := range []string{"tmp", "new", "cur"} {
+		if err := os.MkdirAll(filepath.Join(dir, sub), 0700); err != nil {
+			return "", err
+		}
+	}
+
+	unique := maildirUnique(time.Now())
+	tmp := filepath.Join(dir, "tmp", unique)
+
+	f, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return "", err
+	}
+
+	if _, err := io.Copy(f, r); err != nil {
+		f.Close()
+		os.Remove(tmp)
+		return "", err
+	}
+
+	if err := f.Sync(); err != nil {
+		f.Close()
+		os.Remove(tmp)
+		return "", err
+	}
+
+	if err := f.Close(); err != nil {
+		os.Remove(tmp)
+		return "", err
+	}
+
+	target := filepath.Join(dir, "new", unique)
+	if info := maildirInfo(flags); info != "" {
+		target = filepath.Join(dir, "cur", unique+":2,"+info)
+	}
+
+	if err := os.Rename(tmp, target); err != nil {
+		os.Remove(tmp)
+		return "", err
+	}
+
+	return target, nil
+}
+
+// maildirUnique returns a unique file name of the form
+// "time.MusecPpidQcounter.host".
+func maildirUnique(now time.Time) string {
+	host, err := os.Hostname()
+	if err != nil {
+		host = "localhost"
+	}
+
+	host = strings.NewReplacer("/", `\057`, ":", `\072`).Replace(host)
+
+	return fmt.Sprintf("%d.M%dP%dQ%d.%s",
+		now.Unix(),
+		now.Nanosecond()/1000,
+		os.Getpid(),
+		atomic.AddUint64(&maildirCounter, 1),
+		host)
+}
+
+// maildirInfo returns the flag letters of the maildir info in ascii order.
+func maildirInfo(flags []string) string {
+	var letters []byte
+
+	for _, flag := range flags {
+		letter, ok := maildirFlags[strings.ToLower(flag)]
+		if ok && !strings.ContainsRune(string(letters), rune(letter)) {
+			letters = append(letters, letter)
+		}
+	}
+
+	sort.Slice(letters, func(i, j int) bool { return letters[i] < letters[j] })
+	return string(letters)
+}
@@ -0,0 +1,66 @@
+// Copyright (C) 2020  Lukas Dietrich <lukas@lukasdietrich.com>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package delivery
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMaildirFolder(t *testing.T) {
+	assert.Equal(t, "/mail/alice", maildirFolder("/mail/alice", "INBOX"))
+	assert.Equal(t, "/mail/alice", maildirFolder("/mail/alice", "inbox"))
+	assert.Equal(t, "/mail/alice/.Junk", maildirFolder("/mail/alice", "Junk"))
+	assert.Equal(t, "/mail/alice/.Lists.dev", maildirFolder("/mail/alice", "Lists/dev"))
+	assert.Equal(t, "/mail/alice/.hidden", maildirFolder("/mail/alice", "..hidden"))
+}
+
+func TestMaildirInfo(t *testing.T) {
+	assert.Equal(t, "", maildirInfo(nil))
+	assert.Equal(t, "", maildirInfo([]string{"$Label1"}))
+	assert.Equal(t, "FS", maildirInfo([]string{`\Seen`, `\flagged`, `\Seen`}))
+	assert.Equal(t, "DRT", maildirInfo([]string{`\Deleted`, `\Answered`, `\Draft`}))
+}
+
+func TestWriteMaildir(t *testing.T) {
+	dir, err := ioutil.TempDir("", "maildir")
+	assert.Nil(t, err)
+
+	defer os.RemoveAll(dir)
+
+	unseen, err := writeMaildir(dir, nil, strings.NewReader("Subject: one\r\n\r\n"))
+	assert.Nil(t, err)
+	assert.Equal(t, filepath.Join(dir, "new"), filepath.Dir(unseen))
+
+	seen, err := writeMaildir(dir, []string{`\Seen`}, strings.NewReader("Subject: two\r\n\r\n"))
+	assert.Nil(t, err)
+	assert.Equal(t, filepath.Join(dir, "cur"), filepath.Dir(seen))
+	assert.True(t, strings.HasSuffix(seen, ":2,S"))
+	assert.NotEqual(t, filepath.Base(unseen), strings.TrimSuffix(filepath.Base(seen), ":2,S"))
+
+	content, err := ioutil.ReadFile(unseen)
+	assert.Nil(t, err)
+	assert.Equal(t, "Subject: one\r\n\r\n", string(content))
+
+	tmp, err := ioutil.ReadDir(filepath.Join(dir, "tmp"))
+	assert.Nil(t, err)
+	assert.Empty(t, tmp)
+}
@@ -20,6 +20,7 @@ import (
 
 	"github.com/lukasdietrich/briefmail/internal/addressbook"
 	"github.com/lukasdietrich/briefmail/internal/model"
+	"github.com/lukasdietrich/briefmail/internal/srs"
 	"github.com/lukasdietrich/briefmail/internal/storage"
 )
 
@@ -28,60 +29,219 @@ type Mailman struct {
 	Blobs       *storage.Blobs
 	Addressbook addressbook.Addressbook
 	Queue       *QueueWorker
+	SRS         *srs.SRS
+	Store       LocalStore
 }
 
+// Deliver stores a mail and hands it to all recipients of the envelope. The
+// delivery only succeeds, if every recipient received the mail. Callers
+// with several recipients should use DeliverEach instead, so that a failure
+// for one recipient does not cause the mail to be duplicated for the others.
 func (m *Mailman) Deliver(envelope *model.Envelope, mail model.Body) error {
+	failed, err := m.DeliverEach(envelope, mail)
+	if err != nil {
+		return err
+	}
+
+	for _, addr := range envelope.To {
+		if err := failed[addr.String()]; err != nil {
+			return fmt.Errorf("delivery to %s failed: %w", addr, err)
+		}
+	}
+
+	return nil
+}
+
+// DeliverEach stores a mail and hands it to all recipients of the envelope.
+// The errors of recipients, which did not receive the mail, are returned by
+// their address. An error is only returned, if the mail could not be stored
+// at all.
+func (m *Mailman) DeliverEach(envelope *model.Envelope, mail model.Body) (map[string]error, error) {
 	offset := mail.Prepend("Return-Path", fmt.Sprintf("<%s>", envelope.From))
 	id, size, err := m.Blobs.Write(mail)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
 	if err := m.DB.AddMail(id, size, offset, envelope); err != nil {
 		m.Blobs.Delete(id)
-		return err
+		return nil, err
 	}
 
+	log := log.WithField("mail", id)
+
+	defer func() {
+		if err := m.DB.Delivered(id); err != nil {
+			log.Warnf("could not mark mail as delivered: %v", err)
+		}
+	}()
+
 	var (
-		mailboxes []int64
-		queue     []*model.Address
+		owners         = make(map[int64]*model.Address)
+		recipients     = make(map[int64][]*model.Address)
+		queued         []*model.Address
+		queue          []*model.Address
+		forwarded      []*model.Address
+		forwards       []*model.Address
+		lists          []*addressbook.Entry
+		listRecipients []*model.Address
+		failed         = make(map[string]error)
 	)
 
 	for _, addr := range envelope.To {
 		entry := m.Addressbook.Lookup(addr)
 		if entry == nil {
-			return fmt.Errorf("could not deliver to %s", addr)
+			failed[addr.String()] = fmt.Errorf("could not deliver to %s", addr)
+			continue
 		}
 
 		switch entry.Kind {
 		case addressbook.Local:
-			mailboxes = append(mailboxes, *entry.Mailbox)
+			if owners[*entry.Mailbox] == nil {
+				owners[*entry.Mailbox] = addr
+			}
+
+			recipients[*entry.Mailbox] = append(recipients[*entry.Mailbox], addr)
+
+		case addressbook.Forward:
+			forwarded = append(forwarded, addr)
+			forwards = append(forwards, entry.Address)
 
-		case addressbook.Forward, addressbook.Remote:
+		case addressbook.Remote, addressbook.Relay:
+			queued = append(queued, addr)
 			queue = append(queue, entry.Address)
+
+		case addressbook.List:
+			lists = append(lists, entry)
+			listRecipients = append(listRecipients, addr)
 		}
 	}
 
-	log := log.WithField("mail", id)
+	fail := func(addresses []*model.Address, err error) {
+		log.WithField("to", addresses).Errorf("could not deliver mail: %v", err)
+
+		for _, addr := range addresses {
+			failed[addr.String()] = err
+		}
+	}
 
-	if len(mailboxes) > 0 {
-		if err := m.DB.AddEntries(id, mailboxes); err != nil {
-			return err
+	for mailbox, owner := range owners {
+		redirects, err := m.deliverLocal(mailbox, owner, envelope, id, offset, size)
+		if err != nil {
+			fail(recipients[mailbox], err)
+			continue
 		}
 
-		log.WithField("mailboxes", mailboxes).
-			Debug("mail delivered to local mailboxes")
+		forwards = append(forwards, redirects...)
+
+		if err := m.warnQuota(mailbox, owner); err != nil {
+			log.Warn(err)
+		}
+	}
+
+	if len(forwards) > 0 {
+		from, err := m.rewriteSender(envelope.From)
+
+		switch {
+		case err != nil:
+			fail(forwarded, err)
+
+		case from == nil:
+			// the sender is kept, so forwards share the queue element of
+			// remote recipients
+			queued = append(queued, forwarded...)
+			queue = append(queue, forwards...)
+
+		case len(queue) == 0:
+			if err := m.enqueue(id, from, forwards); err != nil {
+				fail(forwarded, err)
+			}
+
+		default:
+			// the queue keeps one sender per mail, so forwards are queued
+			// as a copy, while remote recipients keep the original sender
+			if err := m.enqueueCopy(id, offset, envelope, from, forwards); err != nil {
+				fail(forwarded, err)
+			}
+		}
 	}
 
 	if len(queue) > 0 {
-		if err := m.DB.AddToQueue(id, queue); err != nil {
-			return err
+		if err := m.enqueue(id, nil, queue); err != nil {
+			fail(queued, err)
 		}
+	}
+
+	for i, entry := range lists {
+		if err := m.handleList(entry, envelope, id, offset); err != nil {
+			fail(listRecipients[i:i+1], err)
+		}
+	}
 
-		log.Debug("mail queued for outbound delivery")
+	return failed, nil
+}
 
-		m.Queue.WakeUp()
+// enqueue adds a mail to the queue for outbound delivery and wakes up the
+// worker. If from is nil, the sender of the mail is used unchanged.
+func (m *Mailman) enqueue(id model.ID, from *model.Address, queue []*model.Address) error {
+	if err := m.DB.AddToQueue(id, from, queue); err != nil {
+		return err
 	}
 
+	log.WithField("mail", id).Debug("mail queued for outbound delivery")
+
+	m.Queue.WakeUp()
 	return nil
 }
+
+// enqueueCopy stores a copy of a mail and adds it to the queue with a
+// different sender.
+func (m *Mailman) enqueueCopy(
+	id model.ID,
+	offset int64,
+	envelope *model.Envelope,
+	from *model.Address,
+	queue []*model.Address,
+) error {
+	r, err := m.Blobs.Read(id)
+	if err != nil {
+		return err
+	}
+
+	defer r.Close()
+
+	copyID, size, err := m.Blobs.Write(r)
+	if err != nil {
+		return err
+	}
+
+	if err := m.DB.AddMail(copyID, size, offset, envelope); err != nil {
+		m.Blobs.Delete(copyID)
+		return err
+	}
+
+	defer func() {
+		if err := m.DB.Delivered(copyID); err != nil {
+			log.WithField("mail", copyID).Warnf("could not mark mail as delivered: %v", err)
+		}
+	}()
+
+	return m.enqueue(copyID, from, queue)
+}
+
+// rewriteSender rewrites the envelope sender of forwarded mails using SRS, so
+// the forwarded mail passes SPF checks at the final destination. Local
+// senders and the null sender are kept unchanged, in which case nil is
+// returned.
+func (m *Mailman) rewriteSender(from *model.Address) (*model.Address, error) {
+	if m.SRS == nil || from.String() == "" {
+		return nil, nil
+	}
+
+	entry := m.Addressbook.Lookup(from)
+	if entry == nil || (entry.Kind != addressbook.Remote && entry.Kind != addressbook.Relay) {
+		return nil, nil
+	}
+
+	return m.SRS.Forward(from)
+}
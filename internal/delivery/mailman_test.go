@@ -0,0 +1,193 @@
+// Copyright (C) 2020  Lukas Dietrich <lukas@lukasdietrich.com>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package delivery
+
+import (
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/lukasdietrich/briefmail/internal/addressbook"
+	"github.com/lukasdietrich/briefmail/internal/model"
+	"github.com/lukasdietrich/briefmail/internal/srs"
+	"github.com/lukasdietrich/briefmail/internal/storage"
+	"github.com/lukasdietrich/briefmail/internal/storage/storagetest"
+)
+
+// failingStore fails to store mails for a single mailbox.
+type failingStore struct {
+	LocalStore
+	mailbox int64
+}
+
+func (s *failingStore) Store(mail *LocalMail) error {
+	if mail.Mailbox == s.mailbox {
+		return errors.New("disk full")
+	}
+
+	return s.LocalStore.Store(mail)
+}
+
+// localMailman creates a mailman delivering to the mailboxes of two users.
+func localMailman(t *testing.T) (*Mailman, map[string]int64, func()) {
+	db, cleanup := storagetest.OpenDB(t)
+
+	blobs, err := storage.NewInMemoryBlobs()
+	assert.Nil(t, err)
+
+	mailboxes := make(map[string]int64)
+
+	for _, name := range []string{"alice", "bob"} {
+		mailbox, err := db.AddMailbox(name, "secret")
+		assert.Nil(t, err)
+
+		mailboxes[name] = mailbox
+	}
+
+	m := Mailman{
+		DB:    db,
+		Blobs: blobs,
+		Addressbook: lookupFunc(func(addr *model.Address) *addressbook.Entry {
+			if mailbox, ok := mailboxes[addr.User]; ok {
+				return &addressbook.Entry{Kind: addressbook.Local, Mailbox: &mailbox}
+			}
+
+			return nil
+		}),
+		Store: &databaseStore{db: db},
+	}
+
+	return &m, mailboxes, cleanup
+}
+
+func testEnvelope(t *testing.T, to ...string) *model.Envelope {
+	envelope := model.Envelope{
+		Helo: "localhost",
+		Addr: "127.0.0.1",
+		Date: time.Now(),
+		From: model.NilAddress,
+	}
+
+	for _, raw := range to {
+		addr, err := model.ParseAddress(raw)
+		assert.Nil(t, err)
+
+		envelope.To = append(envelope.To, addr)
+	}
+
+	return &envelope
+}
+
+func TestDeliverFolders(t *testing.T) {
+	m, mailboxes, cleanup := localMailman(t)
+	defer cleanup()
+
+	assert.Nil(t, m.DB.PutScript(mailboxes["alice"], "main", `
+		require ["fileinto", "imap4flags"];
+		fileinto :flags "\\Flagged" "Archive";
+		keep;
+	`))
+
+	assert.Nil(t, m.DB.SetActiveScript(mailboxes["alice"], "main"))
+
+	err := m.Deliver(testEnvelope(t, "alice@example.com"),
+		model.Body{Reader: strings.NewReader("Subject: hello\r\n\r\nbody\r\n")})
+
+	assert.Nil(t, err)
+
+	for _, folder := range []string{"INBOX", "Archive"} {
+		entries, err := m.DB.FolderEntries(mailboxes["alice"], folder)
+		assert.Nil(t, err)
+		assert.Len(t, entries, 1, folder)
+	}
+}
+
+func TestDeliverPartially(t *testing.T) {
+	m, mailboxes, cleanup := localMailman(t)
+	defer cleanup()
+
+	m.Store = &failingStore{LocalStore: m.Store, mailbox: mailboxes["bob"]}
+
+	failed, err := m.DeliverEach(testEnvelope(t, "alice@example.com", "bob@example.com", "carol@example.com"),
+		model.Body{Reader: strings.NewReader("Subject: hello\r\n\r\nbody\r\n")})
+
+	assert.Nil(t, err)
+	assert.Len(t, failed, 2)
+	assert.NotNil(t, failed["bob@example.com"])
+	assert.NotNil(t, failed["carol@example.com"])
+
+	entries, _, err := m.DB.Entries(mailboxes["alice"])
+	assert.Nil(t, err)
+	assert.Len(t, entries, 1)
+
+	// a partial success must not be reported as a success
+	assert.NotNil(t, m.Deliver(testEnvelope(t, "alice@example.com", "bob@example.com"),
+		model.Body{Reader: strings.NewReader("Subject: again\r\n\r\nbody\r\n")}))
+
+	assert.NotNil(t, m.Deliver(testEnvelope(t, "bob@example.com"),
+		model.Body{Reader: strings.NewReader("Subject: never\r\n\r\nbody\r\n")}))
+}
+
+func TestDeliverForwardsWithRewrittenSender(t *testing.T) {
+	m, _, cleanup := localMailman(t)
+	defer cleanup()
+
+	rewriter, err := srs.New("mx.example.com", []string{"secret"}, 21)
+	assert.Nil(t, err)
+
+	target, err := model.ParseAddress("carol@example.net")
+	assert.Nil(t, err)
+
+	m.SRS = rewriter
+	m.Queue = &QueueWorker{}
+	m.Addressbook = lookupFunc(func(addr *model.Address) *addressbook.Entry {
+		switch addr.Domain {
+		case "example.com":
+			return &addressbook.Entry{Kind: addressbook.Forward, Address: target}
+		default:
+			return &addressbook.Entry{Kind: addressbook.Remote, Address: addr}
+		}
+	})
+
+	envelope := testEnvelope(t, "carol@example.com", "dave@example.org")
+	envelope.From, err = model.ParseAddress("sender@example.org")
+	assert.Nil(t, err)
+
+	failed, err := m.DeliverEach(envelope, model.Body{Reader: strings.NewReader("Subject: hello\r\n\r\nbody\r\n")})
+	assert.Nil(t, err)
+	assert.Empty(t, failed)
+
+	queue, err := m.DB.Queue()
+	assert.Nil(t, err)
+
+	if !assert.Len(t, queue, 2) {
+		return
+	}
+
+	senders := make(map[string]string)
+	for _, elem := range queue {
+		if assert.Len(t, elem.To, 1) && elem.From != nil {
+			senders[elem.To[0].String()] = elem.From.String()
+		}
+	}
+
+	// only the forward is sent with the rewritten sender
+	assert.Equal(t, "", senders["dave@example.org"])
+	assert.True(t, strings.HasPrefix(senders["carol@example.net"], "SRS0="), senders["carol@example.net"])
+}
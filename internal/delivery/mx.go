@@ -0,0 +1,157 @@
+// Copyright (C) 2020  Lukas Dietrich <lukas@lukasdietrich.com>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package delivery
+
+import (
+	"errors"
+	"math/rand"
+	"net"
+	"sort"
+	"strings"
+
+	mdns "github.com/miekg/dns"
+	"github.com/spf13/viper"
+
+	"github.com/lukasdietrich/briefmail/internal/dns"
+)
+
+func init() {
+	viper.SetDefault("delivery.source.ipv4", "")
+	viper.SetDefault("delivery.source.ipv6", "")
+}
+
+var (
+	errNullMX = errors.New("domain does not accept mail (null mx)")
+	errSelfMX = errors.New("no mx preferred over this server")
+)
+
+// lookupHosts returns the list of hosts responsible for accepting mail for a
+// domain in the order they should be tried, as specified in RFC#5321 5.1.
+// If the domain has no mx records, the domain itself is used as an implicit
+// mx. A domain publishing a null mx (see RFC#7505) results in errNullMX and a
+// domain, that does not exist, in dns.ErrNotFound. Both are permanent, while
+// failed lookups are retried later.
+// If this server is one of the mx itself, e.g. as a backup mx, only hosts
+// preferred over this server are returned.
+func lookupHosts(domain string) ([]string, error) {
+	records, err := dns.QueryMX(domain)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(records) == 0 {
+		return []string{domain}, nil
+	}
+
+	if isNullMX(records) {
+		return nil, errNullMX
+	}
+
+	orderMX(records, rand.Shuffle)
+
+	records = preferredOver(records, viper.GetString("general.hostname"))
+	if len(records) == 0 {
+		return nil, errSelfMX
+	}
+
+	hosts := make([]string, 0, len(records))
+
+	for _, record := range records {
+		if record.Mx == "." {
+			continue
+		}
+
+		hosts = append(hosts, record.Mx)
+	}
+
+	return hosts, nil
+}
+
+// isNullMX checks if the records are a single null mx record of the form
+// "MX 0 .".
+func isNullMX(records []*mdns.MX) bool {
+	return len(records) == 1 && records[0].Mx == "."
+}
+
+// orderMX sorts the records by preference and shuffles records of the same
+// preference to spread the load between equal hosts.
+func orderMX(records []*mdns.MX, shuffle func(int, func(int, int))) {
+	shuffle(len(records), func(i, j int) {
+		records[i], records[j] = records[j], records[i]
+	})
+
+	sort.SliceStable(records, func(i, j int) bool {
+		return records[i].Preference < records[j].Preference
+	})
+}
+
+// preferredOver removes a host and all hosts of equal or lower preference from
+// the ordered records, as specified in RFC#5321 5.1.
+func preferredOver(records []*mdns.MX, host string) []*mdns.MX {
+	for i, record := range records {
+		if strings.EqualFold(strings.TrimSuffix(record.Mx, "."), host) {
+			for i > 0 && records[i-1].Preference == record.Preference {
+				i--
+			}
+
+			return records[:i]
+		}
+	}
+
+	return records
+}
+
+// lookupAddresses resolves all ipv4 and ipv6 addresses of a host. Lookup
+// errors are only returned, if no address could be resolved at all.
+func lookupAddresses(host string) ([]net.IP, error) {
+	var ips []net.IP
+
+	a, errA := dns.QueryA(host)
+	for _, record := range a {
+		ips = append(ips, record.A)
+	}
+
+	aaaa, errAAAA := dns.QueryAAAA(host)
+	for _, record := range aaaa {
+		ips = append(ips, record.AAAA)
+	}
+
+	if len(ips) == 0 {
+		if errA != nil {
+			return nil, errA
+		}
+
+		return nil, errAAAA
+	}
+
+	return ips, nil
+}
+
+// sourceAddr returns the configured local address to bind to when connecting
+// to ip, or nil if the choice is left to the operating system.
+func sourceAddr(ip net.IP) net.Addr {
+	key := "delivery.source.ipv6"
+	if ip.To4() != nil {
+		key = "delivery.source.ipv4"
+	}
+
+	source := net.ParseIP(viper.GetString(key))
+	if source == nil {
+		return nil
+	}
+
+	return &net.TCPAddr{IP: source}
+}
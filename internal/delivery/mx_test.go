@@ -0,0 +1,66 @@
+// Copyright (C) 2020  Lukas Dietrich <lukas@lukasdietrich.com>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package delivery
+
+import (
+	"testing"
+
+	mdns "github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestOrderMX(t *testing.T) {
+	records := []*mdns.MX{
+		{Preference: 20, Mx: "c."},
+		{Preference: 10, Mx: "a."},
+		{Preference: 30, Mx: "d."},
+		{Preference: 10, Mx: "b."},
+	}
+
+	reverse := func(n int, swap func(int, int)) {
+		for i := 0; i < n/2; i++ {
+			swap(i, n-1-i)
+		}
+	}
+
+	orderMX(records, reverse)
+
+	var hosts []string
+	for _, record := range records {
+		hosts = append(hosts, record.Mx)
+	}
+
+	assert.Equal(t, []string{"b.", "a.", "c.", "d."}, hosts)
+}
+
+func TestPreferredOver(t *testing.T) {
+	records := []*mdns.MX{
+		{Preference: 10, Mx: "a."},
+		{Preference: 20, Mx: "b."},
+		{Preference: 20, Mx: "self."},
+		{Preference: 30, Mx: "c."},
+	}
+
+	assert.Equal(t, records[:1], preferredOver(records, "self"))
+	assert.Equal(t, records, preferredOver(records, "other"))
+	assert.Empty(t, preferredOver(records, "A"))
+}
+
+func TestNullMX(t *testing.T) {
+	assert.True(t, isNullMX([]*mdns.MX{{Preference: 0, Mx: "."}}))
+	assert.False(t, isNullMX([]*mdns.MX{{Preference: 0, Mx: "mx.example."}}))
+	assert.False(t, isNullMX(nil))
+}
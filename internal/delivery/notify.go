@@ -0,0 +1,246 @@
+// Copyright (C) 2020  Lukas Dietrich <lukas@lukasdietrich.com>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package delivery
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/spf13/viper"
+
+	"github.com/lukasdietrich/briefmail/internal/model"
+	"github.com/lukasdietrich/briefmail/internal/storage"
+)
+
+const (
+	actionFailed  = "failed"
+	actionDelayed = "delayed"
+
+	// maxReportHeaders limits how many bytes of the original header are
+	// included in a delivery status notification.
+	maxReportHeaders = 64 * 1024
+)
+
+// report is a delivery status notification as specified in RFC#3464.
+type report struct {
+	hostname   string
+	action     string
+	mail       *storage.Mail
+	recipients []*model.Address
+	reasons    map[string]string
+	headers    []byte
+}
+
+func (r *report) subject() string {
+	if r.action == actionDelayed {
+		return "Delivery delayed"
+	}
+
+	return "Undelivered Mail Returned to Sender"
+}
+
+func (r *report) status() string {
+	if r.action == actionDelayed {
+		return "4.0.0"
+	}
+
+	return "5.0.0"
+}
+
+// nolint:errcheck
+func (r *report) bytes(now time.Time) []byte {
+	var (
+		b        bytes.Buffer
+		boundary = model.NewID().String()
+	)
+
+	fmt.Fprintf(&b, "From: Mail Delivery System <MAILER-DAEMON@%s>\r\n", r.hostname)
+	fmt.Fprintf(&b, "To: <%s>\r\n", r.mail.From)
+	fmt.Fprintf(&b, "Subject: %s\r\n", r.subject())
+	fmt.Fprintf(&b, "Date: %s\r\n", now.Format(time.RFC1123Z))
+	fmt.Fprintf(&b, "Message-ID: <%s@%s>\r\n", model.NewID(), r.hostname)
+	fmt.Fprintf(&b, "Auto-Submitted: auto-replied\r\n")
+	fmt.Fprintf(&b, "MIME-Version: 1.0\r\n")
+	fmt.Fprintf(&b, "Content-Type: multipart/report; report-type=delivery-status;\r\n")
+	fmt.Fprintf(&b, "\tboundary=\"%s\"\r\n", boundary)
+	fmt.Fprintf(&b, "\r\n")
+
+	fmt.Fprintf(&b, "--%s\r\n", boundary)
+	fmt.Fprintf(&b, "Content-Type: text/plain; charset=utf-8\r\n\r\n")
+
+	if r.action == actionDelayed {
+		fmt.Fprintf(&b, "Your mail could not be delivered yet. ")
+		fmt.Fprintf(&b, "Delivery will be retried, no action is required.\r\n\r\n")
+	} else {
+		fmt.Fprintf(&b, "Your mail could not be delivered ")
+		fmt.Fprintf(&b, "to one or more recipients.\r\n\r\n")
+	}
+
+	for _, addr := range r.recipients {
+		fmt.Fprintf(&b, "<%s>", addr)
+
+		if reason := r.reasons[addr.String()]; reason != "" {
+			fmt.Fprintf(&b, ": %s", reason)
+		}
+
+		fmt.Fprintf(&b, "\r\n")
+	}
+
+	fmt.Fprintf(&b, "\r\n--%s\r\n", boundary)
+	fmt.Fprintf(&b, "Content-Type: message/delivery-status\r\n\r\n")
+	fmt.Fprintf(&b, "Reporting-MTA: dns; %s\r\n", r.hostname)
+	fmt.Fprintf(&b, "Arrival-Date: %s\r\n", r.mail.Date.Format(time.RFC1123Z))
+
+	for _, addr := range r.recipients {
+		fmt.Fprintf(&b, "\r\n")
+		fmt.Fprintf(&b, "Final-Recipient: rfc822; %s\r\n", addr)
+		fmt.Fprintf(&b, "Action: %s\r\n", r.action)
+		fmt.Fprintf(&b, "Status: %s\r\n", r.status())
+
+		if reason := r.reasons[addr.String()]; reason != "" {
+			fmt.Fprintf(&b, "Diagnostic-Code: smtp; %s\r\n", reason)
+		}
+	}
+
+	if len(r.headers) > 0 {
+		fmt.Fprintf(&b, "\r\n--%s\r\n", boundary)
+		fmt.Fprintf(&b, "Content-Type: text/rfc822-headers\r\n\r\n")
+		b.Write(r.headers)
+	}
+
+	fmt.Fprintf(&b, "\r\n--%s--\r\n", boundary)
+
+	return b.Bytes()
+}
+
+// readHeaders reads the header section of a mail up to the first empty line.
+func readHeaders(r io.Reader) ([]byte, error) {
+	var (
+		b  bytes.Buffer
+		br = bufio.NewReader(io.LimitReader(r, maxReportHeaders))
+	)
+
+	for {
+		line, err := br.ReadBytes('\n')
+		if len(bytes.TrimSpace(line)) == 0 {
+			break
+		}
+
+		b.Write(line)
+
+		if err != nil {
+			if err == io.EOF {
+				break
+			}
+
+			return nil, err
+		}
+	}
+
+	return b.Bytes(), nil
+}
+
+// notify sends a delivery status notification to the sender of a mail. Mails
+// from the null sender never cause a notification to avoid loops.
+func (q *QueueWorker) notify(
+	mail *storage.Mail,
+	action string,
+	recipients []*model.Address,
+	reasons map[string]string,
+) error {
+	if mail.From == nil || mail.From.String() == "" || len(recipients) == 0 {
+		return nil
+	}
+
+	var headers []byte
+
+	if r, err := q.Blobs.ReadOffset(mail.ID, mail.Offset); err == nil {
+		headers, _ = readHeaders(r)
+		r.Close()
+	}
+
+	mailman := Mailman{
+		DB:          q.DB,
+		Blobs:       q.Blobs,
+		Addressbook: q.Addressbook,
+		Queue:       q,
+		Store:       q.Store,
+	}
+
+	return mailman.report(mail, headers, action, recipients, reasons)
+}
+
+// NotifyRefused sends a delivery status notification to the sender of a
+// received mail, which was refused for some recipients, e.g. because their
+// mailbox is full. The reasons are keyed by the address of the recipient.
+// Mails from the null sender never cause a notification to avoid loops.
+func (m *Mailman) NotifyRefused(
+	envelope *model.Envelope,
+	body io.Reader,
+	recipients []*model.Address,
+	reasons map[string]string,
+) error {
+	if envelope.From == nil || envelope.From.String() == "" || len(recipients) == 0 {
+		return nil
+	}
+
+	headers, err := readHeaders(body)
+	if err != nil {
+		return err
+	}
+
+	mail := storage.Mail{
+		Date: envelope.Date,
+		From: envelope.From,
+	}
+
+	return m.report(&mail, headers, actionFailed, recipients, reasons)
+}
+
+// report delivers a delivery status notification to the sender of a mail.
+func (m *Mailman) report(
+	mail *storage.Mail,
+	headers []byte,
+	action string,
+	recipients []*model.Address,
+	reasons map[string]string,
+) error {
+	var (
+		hostname = viper.GetString("general.hostname")
+		now      = time.Now()
+		r        = report{
+			hostname:   hostname,
+			action:     action,
+			mail:       mail,
+			recipients: recipients,
+			reasons:    reasons,
+			headers:    headers,
+		}
+	)
+
+	envelope := model.Envelope{
+		Helo: hostname,
+		Addr: "127.0.0.1",
+		Date: now,
+		From: model.NilAddress,
+		To:   []*model.Address{mail.From},
+	}
+
+	return m.Deliver(&envelope, model.Body{Reader: bytes.NewReader(r.bytes(now))})
+}
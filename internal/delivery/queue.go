@@ -16,6 +16,7 @@
 package delivery
 
 import (
+	"context"
 	"crypto/tls"
 	"database/sql"
 	"errors"
@@ -23,13 +24,13 @@ import (
 	"net"
 	"net/smtp"
 	"net/textproto"
-	"sort"
 	"sync"
 	"time"
 
 	"github.com/sirupsen/logrus"
 	"github.com/spf13/viper"
 
+	"github.com/lukasdietrich/briefmail/internal/addressbook"
 	"github.com/lukasdietrich/briefmail/internal/dns"
 	"github.com/lukasdietrich/briefmail/internal/model"
 	"github.com/lukasdietrich/briefmail/internal/storage"
@@ -39,26 +40,135 @@ var (
 	errCouldNotConnect = errors.New("could not connect to any mx host")
 )
 
+func init() {
+	viper.SetDefault("delivery.queue.lease", time.Minute*30)
+	viper.SetDefault("delivery.queue.poll", time.Minute)
+}
+
+const (
+	// errorBackoff is the time to wait before the queue is checked again,
+	// after the database could not be queried.
+	errorBackoff = time.Minute * 5
+
+	// transactionTimeout limits the time of a complete smtp transaction
+	// including the data transfer.
+	transactionTimeout = time.Minute * 10
+)
+
 type QueueWorker struct {
-	DB    *storage.DB
-	Blobs *storage.Blobs
+	DB          *storage.DB
+	Blobs       *storage.Blobs
+	Addressbook addressbook.Addressbook
+	Store       LocalStore
+
+	lock     sync.Mutex         `wire:"-"`
+	alarm    *time.Timer        `wire:"-"`
+	busy     bool               `wire:"-"`
+	started  bool               `wire:"-"`
+	stopped  bool               `wire:"-"`
+	running  sync.WaitGroup     `wire:"-"`
+	schedule *schedule          `wire:"-"`
+	ctx      context.Context    `wire:"-"`
+	cancel   context.CancelFunc `wire:"-"`
+	// leased are the queue elements of delivery attempts in progress.
+	leased map[model.ID]bool `wire:"-"`
+}
 
-	lock  sync.Mutex  `wire:"-"`
-	alarm *time.Timer `wire:"-"`
-	busy  bool        `wire:"-"`
+// Start begins processing the queue. Mails queued before the last shutdown
+// are picked up again according to their persisted schedule. The queue is
+// polled periodically, so changes made by other processes (e.g. the
+// administration shell) are noticed without a restart.
+//
+// A worker, that was never started, does not deliver anything. Waking it up
+// only leaves the queue to the running server.
+func (q *QueueWorker) Start() {
+	log.Info("starting queue worker")
+
+	q.lock.Lock()
+	q.started = true
+	q.lock.Unlock()
+
+	q.WakeUp()
+}
+
+// Shutdown stops the worker from starting new delivery attempts and waits
+// for attempts in progress to finish. Once the context is done, attempts
+// still in progress are aborted and their leases released, so they are
+// retried right after the next start instead of once the leases expire.
+func (q *QueueWorker) Shutdown(ctx context.Context) {
+	q.lock.Lock()
+
+	q.stopped = true
+
+	if q.alarm != nil {
+		q.alarm.Stop()
+		q.alarm = nil
+	}
+
+	cancel := q.cancel
+	q.lock.Unlock()
+
+	done := make(chan struct{})
+
+	go func() {
+		q.running.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-ctx.Done():
+		log.Warn("aborting outbound deliveries in progress")
+
+		if cancel != nil {
+			cancel()
+		}
+
+		q.abandon()
+	}
+
+	log.Info("queue worker stopped")
+}
+
+// abandon releases the leases of all delivery attempts in progress without
+// waiting for them.
+func (q *QueueWorker) abandon() {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	for id := range q.leased {
+		log.WithField("mail", id).Warn("abandoning outbound delivery in progress")
+
+		if err := q.DB.ReleaseQueue(id); err != nil {
+			log.Error(err)
+		}
+	}
 }
 
 func (q *QueueWorker) WakeUp() {
 	q.lock.Lock()
 	defer q.lock.Unlock()
 
+	if q.stopped || !q.started {
+		return
+	}
+
 	if q.alarm != nil {
 		q.alarm.Stop()
 		q.alarm = nil
 	}
 
+	if q.ctx == nil {
+		q.ctx, q.cancel = context.WithCancel(context.Background())
+	}
+
+	if q.schedule == nil {
+		q.schedule = newSchedule()
+	}
+
 	if !q.busy {
 		q.busy = true
+		q.running.Add(1)
 		go q.work()
 	}
 }
@@ -67,57 +177,110 @@ func (q *QueueWorker) sleep(d time.Duration) {
 	q.alarm = time.AfterFunc(d, q.WakeUp)
 }
 
+// next leases the queue element, which is due next. If no element is due,
+// the duration until the next element is due is returned instead.
 func (q *QueueWorker) next() (*storage.QueueElement, time.Duration, error) {
-	elem, err := q.DB.PeekQueue()
-	if err != nil {
-		if err == sql.ErrNoRows {
-			return nil, 0, nil
+	for {
+		elem, err := q.DB.PeekQueue()
+		if err != nil {
+			if err == sql.ErrNoRows {
+				return nil, 0, nil
+			}
+
+			return nil, 0, err
 		}
 
-		return nil, 0, err
-	}
+		due := elem.Date
+		if elem.Lease.After(due) {
+			due = elem.Lease
+		}
 
-	if sleep := elem.Date.Sub(time.Now()); sleep > 0 {
-		return nil, sleep, nil
-	}
+		now := time.Now()
 
-	return elem, 0, nil
+		if sleep := due.Sub(now); sleep > 0 {
+			return nil, sleep, nil
+		}
+
+		lease := now.Add(viper.GetDuration("delivery.queue.lease"))
+
+		ok, err := q.DB.LeaseQueue(elem.MailID, elem.Lease, lease)
+		if err != nil {
+			return nil, 0, err
+		}
+
+		if ok {
+			return elem, 0, nil
+		}
+
+		// another worker leased the element in the meantime
+	}
 }
 
 func (q *QueueWorker) work() {
+	defer q.running.Done()
+
 	cleaner := storage.NewCleaner(q.DB, q.Blobs)
 
 	for {
 		q.lock.Lock()
 
+		if q.stopped {
+			q.busy = false
+			q.lock.Unlock()
+
+			return
+		}
+
 		elem, sleep, err := q.next()
 		if err != nil {
 			log.Error(err)
-			time.Sleep(time.Minute * 5)
 
-			continue
+			q.busy = false
+			q.sleep(errorBackoff)
+			q.lock.Unlock()
+
+			return
 		}
 
 		if elem == nil {
 			q.busy = false
 
+			poll := viper.GetDuration("delivery.queue.poll")
+			if poll > 0 && (sleep == 0 || sleep > poll) {
+				sleep = poll
+			}
+
 			if sleep > 0 {
 				q.sleep(sleep)
 			}
 		}
 
+		if elem != nil {
+			if q.leased == nil {
+				q.leased = make(map[model.ID]bool)
+			}
+
+			q.leased[elem.MailID] = true
+		}
+
+		ctx := q.ctx
 		q.lock.Unlock()
 
 		if elem == nil {
 			break
 		}
 
-		q.do(elem)
+		q.do(ctx, elem)
+
+		q.lock.Lock()
+		delete(q.leased, elem.MailID)
+		q.lock.Unlock()
+
 		cleaner.Clean()
 	}
 }
 
-func (q *QueueWorker) do(elem *storage.QueueElement) {
+func (q *QueueWorker) do(ctx context.Context, elem *storage.QueueElement) {
 	log := log.WithFields(logrus.Fields{
 		"mail":    elem.MailID,
 		"attempt": elem.Attempts,
@@ -132,49 +295,105 @@ func (q *QueueWorker) do(elem *storage.QueueElement) {
 	}
 
 	var (
-		delivered     []*model.Address
 		undeliverable []*model.Address
 		pending       []*model.Address
+		remaining     = elem.To
+		reasons       = make(map[string]string)
 	)
 
-	for domain, addresses := range addressesByDomain(elem.To) {
-		var c client
+	sender := mail.From
+	if elem.From != nil {
+		sender = elem.From
+	}
+
+	fail := func(addresses []*model.Address, err error) {
+		for _, addr := range addresses {
+			reasons[addr.String()] = err.Error()
+		}
+	}
 
-		if err := c.connect(domain); err != nil {
+	for domain, addresses := range addressesByDomain(elem.To) {
+		if ctx.Err() != nil {
 			pending = append(pending, addresses...)
 			continue
 		}
 
-		defer c.close()
+		c := client{reasons: reasons}
+
+		if err := c.connect(ctx, domain); err != nil {
+			if errors.Is(err, errNullMX) || errors.Is(err, dns.ErrNotFound) {
+				undeliverable = append(undeliverable, addresses...)
+			} else {
+				pending = append(pending, addresses...)
+			}
+
+			fail(addresses, err)
+			continue
+		}
 
 		r, err := q.Blobs.ReadOffset(mail.ID, mail.Offset)
 		if err != nil {
+			c.close()
 			pending = append(pending, addresses...)
 			continue
 		}
 
 		hostname := viper.GetString("general.hostname")
-		err = c.send(r, hostname, mail.From, addresses)
+		err = c.send(ctx, r, hostname, sender, addresses)
 		r.Close()
+		c.close()
 
 		if err != nil {
+			undeliverable = append(undeliverable, c.undeliverable...)
+			addresses = without(addresses, c.undeliverable)
 			pending = append(pending, addresses...)
+			fail(addresses, err)
 			continue
 		}
 
-		delivered = append(delivered, c.delivered...)
 		undeliverable = append(undeliverable, c.undeliverable...)
 		pending = append(pending, c.pending...)
+
+		if len(c.delivered) > 0 {
+			// persist progress right away, so a crash does not cause
+			// duplicate deliveries to this domain
+			remaining = without(remaining, c.delivered)
+
+			if err := q.DB.SetQueueRecipients(elem.MailID, remaining); err != nil {
+				log.Error(err)
+			}
+		}
+	}
+
+	if ctx.Err() != nil {
+		// the attempt was aborted during shutdown and does not count
+		log.Warn("delivery attempt aborted")
+
+		if err := q.DB.ReleaseQueue(elem.MailID); err != nil {
+			log.Error(err)
+		}
+
+		return
 	}
 
 	if len(pending) > 0 {
-		tryAgain, nextAttempt := scheduleAttempt(elem.Attempts + 1)
+		tryAgain, nextAttempt := q.schedule.next(elem.Attempts+1, mail.Date, time.Now())
 
 		if tryAgain {
-			err := q.DB.UpdateQueue(elem.MailID, pending, nextAttempt)
+			err := q.DB.UpdateQueue(elem.MailID, pending, nextAttempt, reasons)
 			if err != nil {
 				log.Error(err)
 			}
+
+			if !elem.Warned && q.schedule.shouldWarn(mail.Date, time.Now()) {
+				if err := q.notify(mail, actionDelayed, pending, reasons); err != nil {
+					log.Error(err)
+				}
+
+				if err := q.DB.MarkQueueWarned(elem.MailID); err != nil {
+					log.Error(err)
+				}
+			}
 		} else {
 			undeliverable = append(undeliverable, pending...)
 			pending = nil
@@ -184,10 +403,16 @@ func (q *QueueWorker) do(elem *storage.QueueElement) {
 	if len(undeliverable) > 0 {
 		log.WithField("to", undeliverable).
 			Warn("could not deliver to some recipients")
+
+		if err := q.notify(mail, actionFailed, undeliverable, reasons); err != nil {
+			log.Error(err)
+		}
 	}
 
-	if len(pending) == 0 && len(undeliverable) == 0 {
-		log.Info("delivered mail to all recipients")
+	if len(pending) == 0 {
+		if len(undeliverable) == 0 {
+			log.Info("delivered mail to all recipients")
+		}
 
 		if err := q.DB.DeleteFromQueue(elem.MailID); err != nil {
 			log.Error(err)
@@ -195,31 +420,32 @@ func (q *QueueWorker) do(elem *storage.QueueElement) {
 	}
 }
 
-func scheduleAttempt(attempt int) (bool, time.Time) {
-	now := time.Now()
-
-	switch true {
-	case attempt < 5:
-		return true, now.Add(time.Minute * 10)
-
-	case attempt < 10:
-		return true, now.Add(time.Minute * 30)
+func addressesByDomain(addresses []*model.Address) map[string][]*model.Address {
+	domains := make(map[string][]*model.Address)
 
-	case attempt < 30:
-		return true, now.Add(time.Minute * 60)
+	for _, addr := range addresses {
+		domains[addr.Domain] = append(domains[addr.Domain], addr)
 	}
 
-	return false, now
+	return domains
 }
 
-func addressesByDomain(addresses []*model.Address) map[string][]*model.Address {
-	domains := make(map[string][]*model.Address)
+// without returns all addresses, which are not contained in exclude.
+func without(addresses, exclude []*model.Address) []*model.Address {
+	excluded := make(map[string]bool)
+	for _, addr := range exclude {
+		excluded[addr.String()] = true
+	}
+
+	var result []*model.Address
 
 	for _, addr := range addresses {
-		domains[addr.Domain] = append(domains[addr.Domain], addr)
+		if !excluded[addr.String()] {
+			result = append(result, addr)
+		}
 	}
 
-	return domains
+	return result
 }
 
 type client struct {
@@ -229,6 +455,7 @@ type client struct {
 	delivered     []*model.Address
 	undeliverable []*model.Address
 	pending       []*model.Address
+	reasons       map[string]string
 }
 
 func (c *client) close() {
@@ -241,35 +468,67 @@ func (c *client) close() {
 	}
 }
 
-func (c *client) connect(domain string) error {
-	records, err := dns.QueryMX(domain)
+func (c *client) connect(ctx context.Context, domain string) error {
+	hosts, err := lookupHosts(domain)
 	if err != nil {
 		return err
 	}
 
-	sort.Slice(records, func(i, j int) bool {
-		return records[i].Preference < records[j].Preference
-	})
-
-	for _, record := range records {
-		c.conn, err = net.Dial("tcp", net.JoinHostPort(record.Mx, "25"))
+	for _, host := range hosts {
+		ips, err := lookupAddresses(host)
 		if err != nil {
 			continue
 		}
 
-		c.client, err = smtp.NewClient(c.conn, record.Mx)
-		if err != nil {
-			c.conn.Close()
-			continue
-		}
+		for _, ip := range ips {
+			dialer := net.Dialer{
+				Timeout:   time.Minute,
+				LocalAddr: sourceAddr(ip),
+			}
 
-		return nil
+			c.conn, err = dialer.DialContext(ctx, "tcp", net.JoinHostPort(ip.String(), "25"))
+			if err != nil {
+				if ctx.Err() != nil {
+					return ctx.Err()
+				}
+
+				continue
+			}
+
+			if err := c.conn.SetDeadline(time.Now().Add(transactionTimeout)); err != nil {
+				c.conn.Close()
+				continue
+			}
+
+			c.client, err = smtp.NewClient(c.conn, host)
+			if err != nil {
+				c.conn.Close()
+				continue
+			}
+
+			return nil
+		}
 	}
 
 	return errCouldNotConnect
 }
 
-func (c *client) send(r io.Reader, hostname string, from *model.Address, to []*model.Address) error {
+// send transfers a mail to the connected host. Recipients are only
+// considered delivered, once the host accepted the complete mail.
+func (c *client) send(ctx context.Context, r io.Reader, hostname string, from *model.Address, to []*model.Address) error {
+	// abort the transaction by closing the connection, when the context is
+	// canceled
+	done := make(chan struct{})
+	defer close(done)
+
+	go func() {
+		select {
+		case <-ctx.Done():
+			c.conn.Close()
+		case <-done:
+		}
+	}()
+
 	if err := c.client.Hello(hostname); err != nil {
 		return err
 	}
@@ -285,10 +544,14 @@ func (c *client) send(r io.Reader, hostname string, from *model.Address, to []*m
 		return err
 	}
 
+	var accepted []*model.Address
+
 	for _, addr := range to {
 		if err := c.client.Rcpt(addr.String()); err != nil {
 			if _err, ok := err.(*textproto.Error); ok {
-				if _err.Code == 550 {
+				c.reasons[addr.String()] = _err.Error()
+
+				if _err.Code >= 500 {
 					c.undeliverable = append(c.undeliverable, addr)
 					continue
 				}
@@ -300,7 +563,11 @@ func (c *client) send(r io.Reader, hostname string, from *model.Address, to []*m
 			return err
 		}
 
-		c.delivered = append(c.delivered, addr)
+		accepted = append(accepted, addr)
+	}
+
+	if len(accepted) == 0 {
+		return nil
 	}
 
 	w, err := c.client.Data()
@@ -308,8 +575,25 @@ func (c *client) send(r io.Reader, hostname string, from *model.Address, to []*m
 		return err
 	}
 
-	defer w.Close()
+	if _, err := io.Copy(w, r); err != nil {
+		w.Close()
+		return err
+	}
+
+	// the final reply to the data is only read when closing the writer
+	if err := w.Close(); err != nil {
+		if _err, ok := err.(*textproto.Error); ok && _err.Code >= 500 {
+			for _, addr := range accepted {
+				c.reasons[addr.String()] = _err.Error()
+			}
+
+			c.undeliverable = append(c.undeliverable, accepted...)
+			return nil
+		}
+
+		return err
+	}
 
-	_, err = io.Copy(w, r)
-	return err
+	c.delivered = accepted
+	return nil
 }
@@ -0,0 +1,59 @@
+// Copyright (C) 2020  Lukas Dietrich <lukas@lukasdietrich.com>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package delivery
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/lukasdietrich/briefmail/internal/model"
+	"github.com/lukasdietrich/briefmail/internal/storage/storagetest"
+)
+
+func TestShutdownReleasesLeases(t *testing.T) {
+	db, cleanup := storagetest.OpenDB(t)
+	defer cleanup()
+
+	from, err := model.ParseAddress("alice@example.com")
+	assert.Nil(t, err)
+
+	to, err := model.ParseAddress("bob@example.org")
+	assert.Nil(t, err)
+
+	id := model.NewID()
+	assert.Nil(t, db.AddMail(id, 100, 0, &model.Envelope{Date: time.Now(), From: from}))
+	assert.Nil(t, db.AddToQueue(id, nil, []*model.Address{to}))
+
+	ok, err := db.LeaseQueue(id, time.Unix(0, 0), time.Now().Add(time.Hour))
+	assert.Nil(t, err)
+	assert.True(t, ok)
+
+	// a delivery attempt, which never finishes
+	q := QueueWorker{DB: db, leased: map[model.ID]bool{id: true}}
+	q.running.Add(1)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	q.Shutdown(ctx)
+
+	elem, err := db.QueueElement(id)
+	assert.Nil(t, err)
+	assert.Equal(t, time.Unix(0, 0), elem.Lease)
+}
@@ -0,0 +1,136 @@
+// Copyright (C) 2020  Lukas Dietrich <lukas@lukasdietrich.com>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package delivery
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/spf13/viper"
+
+	"github.com/lukasdietrich/briefmail/internal/addressbook"
+	"github.com/lukasdietrich/briefmail/internal/model"
+	"github.com/lukasdietrich/briefmail/internal/storage"
+)
+
+func init() {
+	viper.SetDefault("quota.warning", 0.9)
+}
+
+var (
+	// ErrQuotaExceeded is returned if a local mailbox cannot receive a mail
+	// without exceeding its quota.
+	ErrQuotaExceeded = errors.New("delivery: mailbox quota exceeded")
+)
+
+// CheckQuota returns ErrQuotaExceeded if a mail of the given size cannot be
+// delivered to a local recipient. Other recipients are never limited.
+func (m *Mailman) CheckQuota(addr *model.Address, size int64) error {
+	entry := m.Addressbook.Lookup(addr)
+	if entry == nil || entry.Kind != addressbook.Local {
+		return nil
+	}
+
+	quota, usage, err := m.DB.Quota(*entry.Mailbox)
+	if err != nil {
+		return err
+	}
+
+	if quota.Exceeded(usage, size) {
+		return ErrQuotaExceeded
+	}
+
+	return nil
+}
+
+// warnQuota sends a warning to the owner of a mailbox once the usage reaches
+// the soft limit. The owner is warned again only after the usage dropped
+// below the soft limit in between.
+func (m *Mailman) warnQuota(mailbox int64, owner *model.Address) error {
+	quota, usage, err := m.DB.Quota(mailbox)
+	if err != nil {
+		return err
+	}
+
+	reached := quota.Reached(usage, viper.GetFloat64("quota.warning"))
+
+	if reached == usage.Warned {
+		return nil
+	}
+
+	// remember the warning before delivering it, so the warning itself does
+	// not cause another one
+	if err := m.DB.SetQuotaWarned(mailbox, reached); err != nil {
+		return err
+	}
+
+	if !reached {
+		return nil
+	}
+
+	log.WithField("mailbox", mailbox).Info("mailbox reached the quota warning")
+
+	var (
+		hostname = viper.GetString("general.hostname")
+		now      = time.Now()
+	)
+
+	envelope := model.Envelope{
+		Helo: hostname,
+		Addr: "127.0.0.1",
+		Date: now,
+		From: model.NilAddress,
+		To:   []*model.Address{owner},
+	}
+
+	body := quotaWarning(hostname, owner, quota, usage, now)
+	return m.Deliver(&envelope, model.Body{Reader: bytes.NewReader(body)})
+}
+
+// nolint:errcheck
+func quotaWarning(
+	hostname string,
+	owner *model.Address,
+	quota *storage.Quota,
+	usage *storage.Usage,
+	now time.Time,
+) []byte {
+	var b bytes.Buffer
+
+	fmt.Fprintf(&b, "From: Mail Delivery System <MAILER-DAEMON@%s>\r\n", hostname)
+	fmt.Fprintf(&b, "To: <%s>\r\n", owner)
+	fmt.Fprintf(&b, "Subject: Your mailbox is almost full\r\n")
+	fmt.Fprintf(&b, "Date: %s\r\n", now.Format(time.RFC1123Z))
+	fmt.Fprintf(&b, "Message-ID: <%s@%s>\r\n", model.NewID(), hostname)
+	fmt.Fprintf(&b, "Auto-Submitted: auto-generated\r\n")
+	fmt.Fprintf(&b, "Content-Type: text/plain; charset=utf-8\r\n")
+	fmt.Fprintf(&b, "\r\n")
+
+	fmt.Fprintf(&b, "Your mailbox is almost full. Once it is full, new mails ")
+	fmt.Fprintf(&b, "will be rejected.\r\nPlease delete mails you no longer need.\r\n\r\n")
+
+	if quota.Size > 0 {
+		fmt.Fprintf(&b, "Size:     %d of %d bytes\r\n", usage.Size, quota.Size)
+	}
+
+	if quota.Messages > 0 {
+		fmt.Fprintf(&b, "Messages: %d of %d\r\n", usage.Messages, quota.Messages)
+	}
+
+	return b.Bytes()
+}
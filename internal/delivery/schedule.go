@@ -0,0 +1,96 @@
+// Copyright (C) 2020  Lukas Dietrich <lukas@lukasdietrich.com>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package delivery
+
+import (
+	"math"
+	"math/rand"
+	"time"
+
+	"github.com/spf13/viper"
+)
+
+func init() {
+	viper.SetDefault("delivery.retry.initial", time.Minute*10)
+	viper.SetDefault("delivery.retry.maximum", time.Hour*4)
+	viper.SetDefault("delivery.retry.factor", 2.0)
+	viper.SetDefault("delivery.retry.jitter", 0.2)
+
+	viper.SetDefault("delivery.queue.lifetime", time.Hour*24*5)
+	viper.SetDefault("delivery.queue.warning", time.Hour*4)
+}
+
+// schedule computes when a failed delivery attempt should be retried. Delays
+// grow exponentially from initial by factor up to maximum. Each delay is
+// randomly varied by +/- jitter to avoid retrying many mails at once.
+type schedule struct {
+	initial  time.Duration
+	maximum  time.Duration
+	factor   float64
+	jitter   float64
+	lifetime time.Duration
+	warning  time.Duration
+	random   func() float64
+}
+
+func newSchedule() *schedule {
+	return &schedule{
+		initial:  viper.GetDuration("delivery.retry.initial"),
+		maximum:  viper.GetDuration("delivery.retry.maximum"),
+		factor:   viper.GetFloat64("delivery.retry.factor"),
+		jitter:   viper.GetFloat64("delivery.retry.jitter"),
+		lifetime: viper.GetDuration("delivery.queue.lifetime"),
+		warning:  viper.GetDuration("delivery.queue.warning"),
+		random:   rand.Float64,
+	}
+}
+
+// delay returns the backoff before the given attempt, which starts at 1.
+func (s *schedule) delay(attempt int) time.Duration {
+	if attempt < 1 {
+		attempt = 1
+	}
+
+	d := float64(s.initial) * math.Pow(s.factor, float64(attempt-1))
+	if max := float64(s.maximum); s.maximum > 0 && d > max {
+		d = max
+	}
+
+	if s.jitter > 0 {
+		d += d * s.jitter * (2*s.random() - 1)
+	}
+
+	return time.Duration(d)
+}
+
+// next returns the time of the next attempt for a mail queued at the given
+// time. If the next attempt would exceed the queue lifetime, false is
+// returned and the mail should be given up.
+func (s *schedule) next(attempt int, queued, now time.Time) (bool, time.Time) {
+	next := now.Add(s.delay(attempt))
+
+	if s.lifetime > 0 && next.After(queued.Add(s.lifetime)) {
+		return false, now
+	}
+
+	return true, next
+}
+
+// shouldWarn returns true if a mail queued at the given time has been delayed
+// long enough to warn the sender.
+func (s *schedule) shouldWarn(queued, now time.Time) bool {
+	return s.warning > 0 && now.Sub(queued) >= s.warning
+}
@@ -0,0 +1,74 @@
+// Copyright (C) 2020  Lukas Dietrich <lukas@lukasdietrich.com>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package delivery
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func makeSchedule(random float64) *schedule {
+	return &schedule{
+		initial:  time.Minute * 10,
+		maximum:  time.Hour,
+		factor:   2,
+		jitter:   0.5,
+		lifetime: time.Hour * 24,
+		warning:  time.Hour * 4,
+		random:   func() float64 { return random },
+	}
+}
+
+func TestScheduleDelay(t *testing.T) {
+	s := makeSchedule(0.5) // no jitter
+
+	assert.Equal(t, time.Minute*10, s.delay(1))
+	assert.Equal(t, time.Minute*20, s.delay(2))
+	assert.Equal(t, time.Minute*40, s.delay(3))
+	assert.Equal(t, time.Hour, s.delay(4))
+	assert.Equal(t, time.Hour, s.delay(100))
+}
+
+func TestScheduleJitter(t *testing.T) {
+	assert.Equal(t, time.Minute*5, makeSchedule(0).delay(1))
+	assert.Equal(t, time.Minute*15, makeSchedule(1).delay(1))
+}
+
+func TestScheduleLifetime(t *testing.T) {
+	var (
+		s      = makeSchedule(0.5)
+		queued = time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	)
+
+	ok, next := s.next(1, queued, queued)
+	assert.True(t, ok)
+	assert.Equal(t, queued.Add(time.Minute*10), next)
+
+	ok, _ = s.next(10, queued, queued.Add(time.Hour*23+time.Minute*30))
+	assert.False(t, ok)
+}
+
+func TestScheduleWarning(t *testing.T) {
+	var (
+		s      = makeSchedule(0.5)
+		queued = time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	)
+
+	assert.False(t, s.shouldWarn(queued, queued.Add(time.Hour)))
+	assert.True(t, s.shouldWarn(queued, queued.Add(time.Hour*4)))
+}
@@ -0,0 +1,233 @@
+// Copyright (C) 2020  Lukas Dietrich <lukas@lukasdietrich.com>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package delivery
+
+import (
+	"bytes"
+	"database/sql"
+	"errors"
+	"time"
+
+	"github.com/spf13/viper"
+
+	"github.com/lukasdietrich/briefmail/internal/addressbook"
+	"github.com/lukasdietrich/briefmail/internal/model"
+	"github.com/lukasdietrich/briefmail/internal/sieve"
+	"github.com/lukasdietrich/briefmail/internal/storage"
+)
+
+// deliverLocal files a mail into a local mailbox according to the active
+// sieve script of the mailbox. Mailboxes without a script keep every mail in
+// the inbox. Addresses the mail is redirected to are returned.
+func (m *Mailman) deliverLocal(
+	mailbox int64,
+	owner *model.Address,
+	envelope *model.Envelope,
+	id model.ID,
+	offset, size int64,
+) ([]*model.Address, error) {
+	log := log.WithField("mail", id).WithField("mailbox", mailbox)
+
+	msg, result, err := m.filter(mailbox, owner, envelope, id, offset, size)
+	if err != nil {
+		// see RFC#5228 2.10.6: errors during execution cause the implicit
+		// keep
+		log.Warnf("sieve script failed: %v", err)
+		result = &sieve.Result{Deliveries: []sieve.Delivery{{Folder: sieve.Inbox}}}
+	}
+
+	if len(result.Deliveries) > 0 {
+		err := m.Store.Store(&LocalMail{
+			Mailbox:    mailbox,
+			Recipient:  owner,
+			From:       envelope.From,
+			ID:         id,
+			Offset:     offset,
+			Deliveries: result.Deliveries,
+		})
+
+		if err != nil {
+			return nil, err
+		}
+
+		for _, d := range result.Deliveries {
+			log.WithField("folder", d.Folder).Debug("mail delivered to local mailbox")
+		}
+	}
+
+	if result.Rejected {
+		if err := m.sendRejection(owner, envelope, id, offset, result.Reject); err != nil {
+			log.Warnf("could not send rejection: %v", err)
+		}
+	}
+
+	if !result.Rejected {
+		if err := m.autoReply(mailbox, owner, envelope, id, offset, size, msg, result.Vacation); err != nil {
+			log.Warnf("could not send vacation response: %v", err)
+		}
+	}
+
+	return m.redirect(envelope, id, offset, result.Redirects), nil
+}
+
+// filter executes the active sieve script of a mailbox. Without an active
+// script the result is an implicit keep.
+func (m *Mailman) filter(
+	mailbox int64,
+	owner *model.Address,
+	envelope *model.Envelope,
+	id model.ID,
+	offset, size int64,
+) (*sieve.Message, *sieve.Result, error) {
+	src, err := m.DB.ActiveScript(mailbox)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, &sieve.Result{Deliveries: []sieve.Delivery{{Folder: sieve.Inbox}}}, nil
+		}
+
+		return nil, nil, err
+	}
+
+	script, err := sieve.Parse(src)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	msg, err := m.readMessage(owner, envelope, id, offset, size)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	result, err := sieve.Execute(script, msg)
+	return msg, result, err
+}
+
+// readMessage reads the header of a mail for a local recipient.
+func (m *Mailman) readMessage(
+	owner *model.Address,
+	envelope *model.Envelope,
+	id model.ID,
+	offset, size int64,
+) (*sieve.Message, error) {
+	r, err := m.Blobs.ReadOffset(id, offset)
+	if err != nil {
+		return nil, err
+	}
+
+	defer r.Close()
+
+	msg, err := sieve.ReadMessage(envelope.From, owner, size-offset, r)
+	if err != nil {
+		return nil, err
+	}
+
+	msg.Separators = viper.GetString("addressbook.separator")
+	return msg, nil
+}
+
+// redirect delivers redirected mails to local mailboxes directly, without
+// running their scripts again, and returns the remaining addresses, which
+// need to be queued. Failed local redirects are only logged, since the mail
+// already reached the mailbox of the script.
+func (m *Mailman) redirect(
+	envelope *model.Envelope,
+	id model.ID,
+	offset int64,
+	redirects []*model.Address,
+) []*model.Address {
+	var queue []*model.Address
+
+	for _, addr := range redirects {
+		entry := m.Addressbook.Lookup(addr)
+		if entry == nil {
+			continue
+		}
+
+		switch entry.Kind {
+		case addressbook.Local:
+			err := m.Store.Store(&LocalMail{
+				Mailbox:    *entry.Mailbox,
+				Recipient:  addr,
+				From:       envelope.From,
+				ID:         id,
+				Offset:     offset,
+				Deliveries: inbox,
+			})
+
+			if err != nil {
+				log.WithField("mail", id).
+					WithField("to", addr).
+					Errorf("could not redirect mail: %v", err)
+			}
+
+		case addressbook.Forward:
+			queue = append(queue, entry.Address)
+
+		case addressbook.Remote, addressbook.Relay:
+			queue = append(queue, addr)
+
+		default:
+			log.WithField("to", addr).Warn("ignoring redirect to a mailing list")
+		}
+	}
+
+	return queue
+}
+
+// sendRejection returns a rejected mail to its sender as specified in
+// RFC#5429 2.1. Mails from the null sender are never answered.
+func (m *Mailman) sendRejection(
+	owner *model.Address,
+	envelope *model.Envelope,
+	id model.ID,
+	offset int64,
+	reason string,
+) error {
+	if envelope.From.String() == "" {
+		return nil
+	}
+
+	r, err := m.Blobs.ReadOffset(id, offset)
+	if err != nil {
+		return err
+	}
+
+	headers, err := readHeaders(r)
+	r.Close()
+
+	if err != nil {
+		return err
+	}
+
+	now := time.Now()
+
+	rejection := report{
+		hostname:   viper.GetString("general.hostname"),
+		action:     actionFailed,
+		mail:       &storage.Mail{Date: envelope.Date, From: envelope.From},
+		recipients: []*model.Address{owner},
+		reasons:    map[string]string{owner.String(): reason},
+		headers:    headers,
+	}
+
+	return m.Deliver(&model.Envelope{
+		Helo: rejection.hostname,
+		Addr: "127.0.0.1",
+		Date: now,
+		From: model.NilAddress,
+		To:   []*model.Address{envelope.From},
+	}, model.Body{Reader: bytes.NewReader(rejection.bytes(now))})
+}
@@ -0,0 +1,107 @@
+// Copyright (C) 2020  Lukas Dietrich <lukas@lukasdietrich.com>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package delivery
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/spf13/viper"
+
+	"github.com/lukasdietrich/briefmail/internal/model"
+	"github.com/lukasdietrich/briefmail/internal/sieve"
+	"github.com/lukasdietrich/briefmail/internal/storage"
+)
+
+func init() {
+	viper.SetDefault("delivery.store.backend", "database")
+	viper.SetDefault("delivery.store.lmtp.address", "")
+	viper.SetDefault("delivery.store.maildir.path", "data/maildir")
+}
+
+// LocalMail is a mail filed into a single local mailbox.
+type LocalMail struct {
+	// Mailbox is the id of the receiving mailbox.
+	Mailbox int64
+	// Recipient is the address the mail was delivered to.
+	Recipient *model.Address
+	// From is the envelope sender.
+	From *model.Address
+	// ID and Offset locate the stored mail. The Return-Path header ends at
+	// the offset.
+	ID     model.ID
+	Offset int64
+	// Deliveries are the distinct folders and their flags chosen by the
+	// sieve script of the mailbox. The mail is filed into each of them.
+	Deliveries []sieve.Delivery
+}
+
+// inbox files a mail into the inbox without any flags.
+var inbox = []sieve.Delivery{{Folder: sieve.Inbox}}
+
+// LocalStore files mails into local mailboxes. The mail itself is always
+// written to the blobs first, so a store only decides where a mailbox keeps
+// its mails.
+type LocalStore interface {
+	Store(mail *LocalMail) error
+}
+
+// NewLocalStore creates the store configured by "delivery.store.backend",
+// which is one of "database", "lmtp" or "maildir".
+func NewLocalStore(db *storage.DB, blobs *storage.Blobs) (LocalStore, error) {
+	switch backend := viper.GetString("delivery.store.backend"); backend {
+	case "database", "":
+		return &databaseStore{db: db}, nil
+
+	case "lmtp":
+		address := viper.GetString("delivery.store.lmtp.address")
+		if address == "" {
+			return nil, errors.New("delivery.store.lmtp.address is not set")
+		}
+
+		return &lmtpStore{
+			address:  address,
+			hostname: viper.GetString("general.hostname"),
+			blobs:    blobs,
+		}, nil
+
+	case "maildir":
+		return &maildirStore{
+			path:  viper.GetString("delivery.store.maildir.path"),
+			db:    db,
+			blobs: blobs,
+		}, nil
+
+	default:
+		return nil, fmt.Errorf("unknown delivery store %q", backend)
+	}
+}
+
+// databaseStore keeps mails in the blobs and adds an entry per folder to the
+// mailbox, so they can be retrieved using pop3.
+type databaseStore struct {
+	db *storage.DB
+}
+
+func (s *databaseStore) Store(mail *LocalMail) error {
+	for _, d := range mail.Deliveries {
+		if err := s.db.AddEntry(mail.ID, mail.Mailbox, d.Folder, d.Flags); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
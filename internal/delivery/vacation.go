@@ -0,0 +1,290 @@
+// Copyright (C) 2020  Lukas Dietrich <lukas@lukasdietrich.com>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package delivery
+
+import (
+	"bytes"
+	"database/sql"
+	"errors"
+	"fmt"
+	"mime"
+	netmail "net/mail"
+	"strings"
+	"time"
+
+	"github.com/spf13/viper"
+
+	"github.com/lukasdietrich/briefmail/internal/model"
+	"github.com/lukasdietrich/briefmail/internal/sieve"
+)
+
+// autoReply sends a vacation response requested by the sieve script of a
+// mailbox. Without such a request, the out of office settings of the mailbox
+// are used, if they are active.
+func (m *Mailman) autoReply(
+	mailbox int64,
+	owner *model.Address,
+	envelope *model.Envelope,
+	id model.ID,
+	offset, size int64,
+	msg *sieve.Message,
+	vacation *sieve.Vacation,
+) error {
+	if vacation == nil {
+		settings, err := m.DB.Vacation(mailbox)
+		if err != nil {
+			if errors.Is(err, sql.ErrNoRows) {
+				return nil
+			}
+
+			return err
+		}
+
+		if !settings.Active(time.Now()) {
+			return nil
+		}
+
+		vacation = &sieve.Vacation{
+			Reason:    settings.Body,
+			Subject:   settings.Subject,
+			Addresses: settings.Addresses,
+			Days:      settings.Days,
+			// a changed response is sent again to senders already answered
+			Handle: fmt.Sprintf("settings\x00%s\x00%s", settings.Subject, settings.Body),
+		}
+	}
+
+	if msg == nil {
+		var err error
+
+		if msg, err = m.readMessage(owner, envelope, id, offset, size); err != nil {
+			return err
+		}
+	}
+
+	return m.sendVacation(mailbox, owner, envelope, msg, vacation)
+}
+
+// sendVacation answers a mail with a vacation response as specified in
+// RFC#5230 and RFC#3834. Automatic mails, mails from lists and mails not
+// addressed to the owner directly are never answered. Each sender receives
+// the same response at most once within the days of the vacation.
+func (m *Mailman) sendVacation(
+	mailbox int64,
+	owner *model.Address,
+	envelope *model.Envelope,
+	msg *sieve.Message,
+	vacation *sieve.Vacation,
+) error {
+	sender := envelope.From
+
+	if !shouldAutoReply(sender, msg) || !addressedTo(msg, owner, vacation.Addresses) {
+		return nil
+	}
+
+	days := vacation.Days
+	if days < 1 {
+		days = 1
+	}
+
+	now := time.Now()
+
+	replied, err := m.DB.VacationReplied(mailbox, sender, vacation.Handle,
+		now.Add(-time.Duration(days)*24*time.Hour))
+
+	if err != nil || replied {
+		return err
+	}
+
+	log.WithField("mailbox", mailbox).
+		WithField("to", sender).
+		Debug("sending vacation response")
+
+	from, err := m.vacationFrom(mailbox, owner, vacation.From)
+	if err != nil {
+		return err
+	}
+
+	hostname := viper.GetString("general.hostname")
+
+	err = m.Deliver(&model.Envelope{
+		Helo: hostname,
+		Addr: "127.0.0.1",
+		Date: now,
+		From: model.NilAddress,
+		To:   []*model.Address{sender},
+	}, model.Body{Reader: bytes.NewReader(vacationResponse(hostname, from, sender, msg, vacation, now))})
+
+	if err != nil {
+		return err
+	}
+
+	// the reply is only recorded once it was sent, so a failed response is
+	// sent again for the next mail of the sender
+	return m.DB.AddVacationReply(mailbox, sender, vacation.Handle, now)
+}
+
+// vacationFrom returns the From header of a vacation response. The :from of
+// the vacation action is only used, if the mailbox may send as the address.
+// Otherwise the owner is used, so scripts cannot send as arbitrary addresses.
+func (m *Mailman) vacationFrom(mailbox int64, owner *model.Address, from string) (string, error) {
+	fallback := fmt.Sprintf("<%s>", owner)
+
+	if from == "" {
+		return fallback, nil
+	}
+
+	parsed, err := netmail.ParseAddress(from)
+	if err != nil {
+		return fallback, nil
+	}
+
+	addr, err := model.ParseAddress(parsed.Address)
+	if err != nil {
+		return fallback, nil
+	}
+
+	ok, err := m.MaySendAs(mailbox, addr)
+	if err != nil {
+		return "", err
+	}
+
+	if !ok {
+		log.WithField("mailbox", mailbox).
+			WithField("from", addr).
+			Warn("vacation response may not be sent as the requested address")
+
+		return fallback, nil
+	}
+
+	return parsed.String(), nil
+}
+
+// shouldAutoReply returns false for mails, which must not be answered
+// automatically.
+//
+// see RFC#3834 2 and RFC#5230 4.6
+func shouldAutoReply(sender *model.Address, msg *sieve.Message) bool {
+	if sender.String() == "" {
+		return false
+	}
+
+	user := strings.ToLower(sender.User)
+	if user == "mailer-daemon" || strings.HasPrefix(user, "owner-") || strings.HasSuffix(user, "-request") {
+		return false
+	}
+
+	for _, value := range msg.Header("Auto-Submitted") {
+		if !strings.EqualFold(strings.TrimSpace(strings.SplitN(value, ";", 2)[0]), "no") {
+			return false
+		}
+	}
+
+	for _, value := range msg.Header("Precedence") {
+		switch strings.ToLower(value) {
+		case "bulk", "list", "junk":
+			return false
+		}
+	}
+
+	for _, name := range []string{"List-Id", "List-Help", "List-Unsubscribe", "List-Post"} {
+		if len(msg.Header(name)) > 0 {
+			return false
+		}
+	}
+
+	return true
+}
+
+// addressedTo returns true if the owner or one of the alternative addresses
+// is a recipient in the header of the mail.
+func addressedTo(msg *sieve.Message, owner *model.Address, alternatives []string) bool {
+	candidates := []string{owner.User + "@" + owner.Domain}
+
+	for _, raw := range alternatives {
+		if addr, err := model.ParseAddress(raw); err == nil {
+			candidates = append(candidates, addr.User+"@"+addr.Domain)
+		}
+	}
+
+	for _, name := range []string{"To", "Cc", "Bcc", "Resent-To", "Resent-Cc"} {
+		for _, raw := range msg.Addresses(name) {
+			addr, err := model.ParseAddress(raw)
+			if err != nil {
+				continue
+			}
+
+			for _, candidate := range candidates {
+				if strings.EqualFold(addr.User+"@"+addr.Domain, candidate) {
+					return true
+				}
+			}
+		}
+	}
+
+	return false
+}
+
+// nolint:errcheck
+func vacationResponse(
+	hostname, from string,
+	sender *model.Address,
+	msg *sieve.Message,
+	vacation *sieve.Vacation,
+	now time.Time,
+) []byte {
+	var b bytes.Buffer
+
+	subject := vacation.Subject
+	if subject == "" {
+		subject = "Auto: "
+		if original := msg.Header("Subject"); len(original) > 0 {
+			subject += original[0]
+		}
+	}
+
+	fmt.Fprintf(&b, "From: %s\r\n", from)
+	fmt.Fprintf(&b, "To: <%s>\r\n", sender)
+	fmt.Fprintf(&b, "Subject: %s\r\n", mime.QEncoding.Encode("utf-8", subject))
+	fmt.Fprintf(&b, "Date: %s\r\n", now.Format(time.RFC1123Z))
+	fmt.Fprintf(&b, "Message-ID: <%s@%s>\r\n", model.NewID(), hostname)
+
+	if ids := msg.Header("Message-ID"); len(ids) > 0 {
+		references := ids[0]
+		if previous := msg.Header("References"); len(previous) > 0 {
+			references = previous[0] + " " + references
+		}
+
+		fmt.Fprintf(&b, "In-Reply-To: %s\r\n", ids[0])
+		fmt.Fprintf(&b, "References: %s\r\n", references)
+	}
+
+	fmt.Fprintf(&b, "Auto-Submitted: auto-replied\r\n")
+	fmt.Fprintf(&b, "MIME-Version: 1.0\r\n")
+
+	if vacation.Mime {
+		// the reason already starts with its own mime header
+		b.WriteString(vacation.Reason)
+		return b.Bytes()
+	}
+
+	fmt.Fprintf(&b, "Content-Type: text/plain; charset=utf-8\r\n")
+	fmt.Fprintf(&b, "\r\n")
+	b.WriteString(strings.ReplaceAll(strings.ReplaceAll(vacation.Reason, "\r\n", "\n"), "\n", "\r\n"))
+	fmt.Fprintf(&b, "\r\n")
+
+	return b.Bytes()
+}
@@ -0,0 +1,146 @@
+// Copyright (C) 2020  Lukas Dietrich <lukas@lukasdietrich.com>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package delivery
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/lukasdietrich/briefmail/internal/addressbook"
+	"github.com/lukasdietrich/briefmail/internal/model"
+	"github.com/lukasdietrich/briefmail/internal/sieve"
+	"github.com/lukasdietrich/briefmail/internal/storage/storagetest"
+)
+
+// lookupFunc is an addressbook backed by a function.
+type lookupFunc func(*model.Address) *addressbook.Entry
+
+func (f lookupFunc) Lookup(addr *model.Address) *addressbook.Entry {
+	return f(addr)
+}
+
+func readSieveMessage(t *testing.T, header string) *sieve.Message {
+	msg, err := sieve.ReadMessage(model.NilAddress, model.NilAddress, 0,
+		strings.NewReader(header+"\r\nbody\r\n"))
+
+	assert.Nil(t, err)
+	return msg
+}
+
+func TestShouldAutoReply(t *testing.T) {
+	sender, err := model.ParseAddress("alice@example.com")
+	assert.Nil(t, err)
+
+	for header, expected := range map[string]bool{
+		"Subject: hello\r\n":                     true,
+		"Auto-Submitted: no\r\n":                 true,
+		"Auto-Submitted: auto-replied\r\n":       false,
+		"Precedence: bulk\r\n":                   false,
+		"List-Id: <dev.example.com>\r\n":         false,
+		"List-Unsubscribe: <mailto:x@y.com>\r\n": false,
+	} {
+		assert.Equal(t, expected, shouldAutoReply(sender, readSieveMessage(t, header)), header)
+	}
+
+	msg := readSieveMessage(t, "Subject: hello\r\n")
+	assert.False(t, shouldAutoReply(model.NilAddress, msg))
+
+	daemon, err := model.ParseAddress("MAILER-DAEMON@example.com")
+	assert.Nil(t, err)
+	assert.False(t, shouldAutoReply(daemon, msg))
+}
+
+func TestAddressedTo(t *testing.T) {
+	owner, err := model.ParseAddress("bob@example.org")
+	assert.Nil(t, err)
+
+	msg := readSieveMessage(t, "To: Bob <BOB@example.org>\r\n")
+	assert.True(t, addressedTo(msg, owner, nil))
+
+	msg = readSieveMessage(t, "To: team@example.org\r\nCc: carol@example.net\r\n")
+	assert.False(t, addressedTo(msg, owner, nil))
+	assert.True(t, addressedTo(msg, owner, []string{"team@example.org"}))
+}
+
+func TestVacationFrom(t *testing.T) {
+	db, cleanup := storagetest.OpenDB(t)
+	defer cleanup()
+
+	mailbox, err := db.AddMailbox("bob", "secret")
+	assert.Nil(t, err)
+
+	team, err := model.ParseAddress("team@example.org")
+	assert.Nil(t, err)
+	assert.Nil(t, db.GrantSendAs("bob", team))
+
+	m := Mailman{
+		DB: db,
+		Addressbook: lookupFunc(func(*model.Address) *addressbook.Entry {
+			return nil
+		}),
+	}
+
+	owner, err := model.ParseAddress("bob@example.org")
+	assert.Nil(t, err)
+
+	for from, expected := range map[string]string{
+		"":                              "<bob@example.org>",
+		"Team <team@example.org>":       `"Team" <team@example.org>`,
+		"Boss <boss@example.org>":       "<bob@example.org>",
+		"invalid\r\nBcc: x@example.com": "<bob@example.org>",
+	} {
+		actual, err := m.vacationFrom(mailbox, owner, from)
+		assert.Nil(t, err)
+		assert.Equal(t, expected, actual, from)
+	}
+}
+
+func TestSendVacationRecordsDeliveredReplies(t *testing.T) {
+	m, mailboxes, cleanup := localMailman(t)
+	defer cleanup()
+
+	store := m.Store
+	m.Store = &failingStore{LocalStore: store, mailbox: mailboxes["bob"]}
+
+	alice, err := model.ParseAddress("alice@example.com")
+	assert.Nil(t, err)
+
+	bob, err := model.ParseAddress("bob@example.com")
+	assert.Nil(t, err)
+
+	envelope := testEnvelope(t, "alice@example.com")
+	envelope.From = bob
+
+	msg := readSieveMessage(t, "From: bob@example.com\r\nTo: alice@example.com\r\nSubject: hello\r\n")
+	vacation := sieve.Vacation{Reason: "I am away", Days: 7, Handle: "away"}
+
+	// a response, which could not be delivered, is not recorded
+	assert.NotNil(t, m.sendVacation(mailboxes["alice"], alice, envelope, msg, &vacation))
+
+	replied, err := m.DB.VacationReplied(mailboxes["alice"], bob, "away", time.Now().Add(-time.Hour))
+	assert.Nil(t, err)
+	assert.False(t, replied)
+
+	m.Store = store
+	assert.Nil(t, m.sendVacation(mailboxes["alice"], alice, envelope, msg, &vacation))
+
+	replied, err = m.DB.VacationReplied(mailboxes["alice"], bob, "away", time.Now().Add(-time.Hour))
+	assert.Nil(t, err)
+	assert.True(t, replied)
+}
@@ -20,6 +20,7 @@ import (
 )
 
 var WireSet = wire.NewSet(
+	NewLocalStore,
 	wire.Struct(new(Mailman), "*"),
 	wire.Struct(new(QueueWorker), "*"),
 )
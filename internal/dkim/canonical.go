@@ -0,0 +1,157 @@
+// Copyright (C) 2020  Lukas Dietrich <lukas@lukasdietrich.com>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package dkim
+
+import (
+	"bytes"
+	"strings"
+)
+
+const (
+	simple  = "simple"
+	relaxed = "relaxed"
+)
+
+// field is a raw header field including its folded continuation lines and
+// the terminating CRLF.
+type field struct {
+	name string
+	raw  string
+}
+
+// splitMessage splits a message into its header fields and body. Bare line
+// feeds are treated as line breaks.
+func splitMessage(message []byte) ([]field, []byte) {
+	var (
+		lines  = strings.SplitAfter(strings.ReplaceAll(string(message), "\r\n", "\n"), "\n")
+		fields []field
+		i      int
+	)
+
+	for ; i < len(lines); i++ {
+		line := strings.TrimSuffix(lines[i], "\n")
+		if line == "" {
+			i++
+			break
+		}
+
+		if (line[0] == ' ' || line[0] == '\t') && len(fields) > 0 {
+			fields[len(fields)-1].raw += line + "\r\n"
+			continue
+		}
+
+		name := line
+		if colon := strings.IndexByte(line, ':'); colon > -1 {
+			name = line[:colon]
+		}
+
+		fields = append(fields, field{
+			name: strings.TrimSpace(name),
+			raw:  line + "\r\n",
+		})
+	}
+
+	var body bytes.Buffer
+
+	for ; i < len(lines); i++ {
+		if lines[i] == "" {
+			continue
+		}
+
+		body.WriteString(strings.TrimSuffix(lines[i], "\n"))
+		body.WriteString("\r\n")
+	}
+
+	return fields, body.Bytes()
+}
+
+// canonicalHeader canonicalizes a header field as specified in RFC#6376
+// 3.4.1 and 3.4.2.
+func canonicalHeader(raw, algorithm string) string {
+	if algorithm != relaxed {
+		return raw
+	}
+
+	var (
+		colon = strings.IndexByte(raw, ':')
+		name  = strings.ToLower(strings.TrimSpace(raw[:colon]))
+		value = strings.ReplaceAll(raw[colon+1:], "\r\n", "")
+	)
+
+	return name + ":" + strings.TrimSpace(compressSpace(value)) + "\r\n"
+}
+
+// canonicalBody canonicalizes a body as specified in RFC#6376 3.4.3 and
+// 3.4.4. The body must consist of CRLF terminated lines.
+func canonicalBody(body []byte, algorithm string) []byte {
+	lines := strings.SplitAfter(string(body), "\r\n")
+
+	if algorithm == relaxed {
+		for i, line := range lines {
+			line = strings.TrimSuffix(line, "\r\n")
+			line = strings.TrimRight(compressSpace(line), " ")
+
+			if i < len(lines)-1 {
+				line += "\r\n"
+			}
+
+			lines[i] = line
+		}
+	}
+
+	// remove trailing empty lines
+	for len(lines) > 0 && (lines[len(lines)-1] == "" || lines[len(lines)-1] == "\r\n") {
+		lines = lines[:len(lines)-1]
+	}
+
+	if len(lines) == 0 {
+		if algorithm == relaxed {
+			return nil
+		}
+
+		return []byte("\r\n")
+	}
+
+	return []byte(strings.Join(lines, ""))
+}
+
+// compressSpace reduces all sequences of whitespace to a single space.
+func compressSpace(s string) string {
+	var (
+		b     strings.Builder
+		space bool
+	)
+
+	for _, r := range s {
+		if r == ' ' || r == '\t' {
+			space = true
+			continue
+		}
+
+		if space {
+			b.WriteByte(' ')
+			space = false
+		}
+
+		b.WriteRune(r)
+	}
+
+	if space {
+		b.WriteByte(' ')
+	}
+
+	return b.String()
+}
@@ -0,0 +1,382 @@
+// Copyright (C) 2020  Lukas Dietrich <lukas@lukasdietrich.com>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+// Package dkim verifies DomainKeys Identified Mail signatures as specified in
+// RFC#6376 using rsa-sha256 or ed25519-sha256 (see RFC#8463).
+package dkim
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/lukasdietrich/briefmail/internal/dns"
+)
+
+// maxSignatures limits the number of signatures verified per message.
+const maxSignatures = 5
+
+var (
+	// ErrTemporary is returned by Verify, if the key of a signature could not
+	// be looked up. Verifying the message again later may find more valid
+	// signatures.
+	ErrTemporary = errors.New("dkim: temporary key lookup failure")
+
+	errSyntax      = errors.New("dkim: malformed signature")
+	errUnsupported = errors.New("dkim: unsupported algorithm")
+	errExpired     = errors.New("dkim: signature expired")
+	errPartialBody = errors.New("dkim: signature does not cover the whole body")
+	errBodyHash    = errors.New("dkim: body hash mismatch")
+	errNoKey       = errors.New("dkim: no key")
+	errSignature   = errors.New("dkim: invalid signature")
+)
+
+// LookupFunc returns the txt records of a name. A name, that does not exist,
+// has no records, while errors are considered temporary.
+type LookupFunc func(name string) ([]string, error)
+
+// LookupDNS looks up txt records using the default resolver.
+func LookupDNS(name string) ([]string, error) {
+	records, err := dns.QueryTXT(name)
+	if err != nil {
+		if errors.Is(err, dns.ErrNotFound) {
+			return nil, nil
+		}
+
+		return nil, err
+	}
+
+	var txt []string
+
+	for _, record := range records {
+		txt = append(txt, strings.Join(record.Txt, ""))
+	}
+
+	return txt, nil
+}
+
+// Verify checks the signatures of a message and returns the signing domains
+// of all valid signatures. Invalid signatures are ignored. If the key of any
+// signature could not be looked up, the valid domains are returned together
+// with ErrTemporary.
+func Verify(r io.Reader, lookup LookupFunc) ([]string, error) {
+	message, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+
+	fields, body := splitMessage(message)
+
+	var (
+		domains   []string
+		count     int
+		temporary error
+	)
+
+	for i, f := range fields {
+		if !strings.EqualFold(f.name, "DKIM-Signature") {
+			continue
+		}
+
+		if count++; count > maxSignatures {
+			break
+		}
+
+		domain, err := verifySignature(fields[:i], fields[i+1:], f, body, lookup)
+		if err != nil {
+			if errors.Is(err, ErrTemporary) {
+				temporary = err
+			}
+
+			continue
+		}
+
+		domains = append(domains, domain)
+	}
+
+	return domains, temporary
+}
+
+type signature struct {
+	algorithm       string
+	domain          string
+	selector        string
+	headers         []string
+	headerCanon     string
+	bodyCanon       string
+	bodyHash        []byte
+	data            []byte
+	length          int64
+	expiration      int64
+	unsignedRawForm string
+}
+
+func verifySignature(above, below []field, f field, body []byte, lookup LookupFunc) (string, error) {
+	sig, err := parseSignature(f.raw)
+	if err != nil {
+		return "", err
+	}
+
+	if sig.expiration > 0 && time.Now().Unix() > sig.expiration {
+		return "", errExpired
+	}
+
+	// content appended to a body signed with a length limit is not covered
+	// by the signature, so such signatures are not trusted at all.
+	body = canonicalBody(body, sig.bodyCanon)
+	if sig.length >= 0 && sig.length < int64(len(body)) {
+		return "", errPartialBody
+	}
+
+	if bodyHash := sha256.Sum256(body); !bytes.Equal(bodyHash[:], sig.bodyHash) {
+		return "", errBodyHash
+	}
+
+	key, err := lookupKey(sig, lookup)
+	if err != nil {
+		return "", err
+	}
+
+	// the signature field itself is never signed, so only the fields in
+	// front of it are considered. It is appended without the trailing CRLF
+	// and with an empty signature.
+	hash := sha256.New()
+	for _, raw := range selectHeaders(append(append([]field{}, above...), below...), sig.headers) {
+		io.WriteString(hash, canonicalHeader(raw, sig.headerCanon)) // nolint:errcheck
+	}
+
+	io.WriteString(hash, strings.TrimSuffix( // nolint:errcheck
+		canonicalHeader(sig.unsignedRawForm, sig.headerCanon), "\r\n"))
+
+	digest := hash.Sum(nil)
+
+	switch key := key.(type) {
+	case *rsa.PublicKey:
+		if rsa.VerifyPKCS1v15(key, crypto.SHA256, digest, sig.data) != nil {
+			return "", errSignature
+		}
+
+	case ed25519.PublicKey:
+		if !ed25519.Verify(key, digest, sig.data) {
+			return "", errSignature
+		}
+	}
+
+	return sig.domain, nil
+}
+
+// selectHeaders picks the fields named in the signature from the bottom up as
+// specified in RFC#6376 5.4.2. Names without a matching field are skipped.
+func selectHeaders(fields []field, names []string) []string {
+	var (
+		used     = make(map[int]bool)
+		selected []string
+	)
+
+	for _, name := range names {
+		for i := len(fields) - 1; i >= 0; i-- {
+			if !used[i] && strings.EqualFold(fields[i].name, name) {
+				used[i] = true
+				selected = append(selected, fields[i].raw)
+
+				break
+			}
+		}
+	}
+
+	return selected
+}
+
+func parseSignature(raw string) (*signature, error) {
+	colon := strings.IndexByte(raw, ':')
+	tags := parseTags(raw[colon+1:])
+
+	if tags["v"] != "1" {
+		return nil, errSyntax
+	}
+
+	sig := signature{
+		algorithm:       tags["a"],
+		domain:          strings.ToLower(tags["d"]),
+		selector:        tags["s"],
+		headerCanon:     simple,
+		bodyCanon:       simple,
+		length:          -1,
+		unsignedRawForm: raw[:colon+1] + removeSignatureData(raw[colon+1:]),
+	}
+
+	if sig.algorithm != "rsa-sha256" && sig.algorithm != "ed25519-sha256" {
+		return nil, errUnsupported
+	}
+
+	if sig.domain == "" || sig.selector == "" {
+		return nil, errSyntax
+	}
+
+	if c, ok := tags["c"]; ok {
+		parts := strings.SplitN(c, "/", 2)
+		sig.headerCanon = parts[0]
+
+		if len(parts) == 2 {
+			sig.bodyCanon = parts[1]
+		}
+	}
+
+	for _, h := range strings.Split(tags["h"], ":") {
+		if h = strings.TrimSpace(h); h != "" {
+			sig.headers = append(sig.headers, h)
+		}
+	}
+
+	// the from header field must be signed, see RFC#6376 5.4
+	if !containsFold(sig.headers, "From") {
+		return nil, errSyntax
+	}
+
+	var err error
+
+	if sig.bodyHash, err = base64.StdEncoding.DecodeString(tags["bh"]); err != nil {
+		return nil, errSyntax
+	}
+
+	if sig.data, err = base64.StdEncoding.DecodeString(tags["b"]); err != nil {
+		return nil, errSyntax
+	}
+
+	if l, ok := tags["l"]; ok {
+		if sig.length, err = strconv.ParseInt(l, 10, 64); err != nil {
+			return nil, errSyntax
+		}
+	}
+
+	if x, ok := tags["x"]; ok {
+		if sig.expiration, err = strconv.ParseInt(x, 10, 64); err != nil {
+			return nil, errSyntax
+		}
+	}
+
+	return &sig, nil
+}
+
+func lookupKey(sig *signature, lookup LookupFunc) (crypto.PublicKey, error) {
+	records, err := lookup(fmt.Sprintf("%s._domainkey.%s", sig.selector, sig.domain))
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrTemporary, err)
+	}
+
+	for _, record := range records {
+		tags := parseTags(record)
+
+		if v, ok := tags["v"]; ok && v != "DKIM1" {
+			continue
+		}
+
+		data, err := base64.StdEncoding.DecodeString(tags["p"])
+		if err != nil || len(data) == 0 {
+			// an empty key was revoked
+			continue
+		}
+
+		switch k := tags["k"]; {
+		case (k == "" || k == "rsa") && sig.algorithm == "rsa-sha256":
+			if key, err := x509.ParsePKIXPublicKey(data); err == nil {
+				if key, ok := key.(*rsa.PublicKey); ok {
+					return key, nil
+				}
+			}
+
+			if key, err := x509.ParsePKCS1PublicKey(data); err == nil {
+				return key, nil
+			}
+
+		case k == "ed25519" && sig.algorithm == "ed25519-sha256":
+			if len(data) == ed25519.PublicKeySize {
+				return ed25519.PublicKey(data), nil
+			}
+		}
+	}
+
+	return nil, errNoKey
+}
+
+// parseTags parses a tag list as specified in RFC#6376 3.2. Whitespace is
+// removed from the values, since none of the used tags may contain any.
+func parseTags(s string) map[string]string {
+	tags := make(map[string]string)
+
+	for _, part := range strings.Split(s, ";") {
+		eq := strings.IndexByte(part, '=')
+		if eq < 0 {
+			continue
+		}
+
+		name := strings.TrimSpace(part[:eq])
+		tags[name] = removeSpace(part[eq+1:])
+	}
+
+	return tags
+}
+
+// removeSignatureData empties the value of the "b" tag, while keeping the
+// rest of the tag list unchanged.
+func removeSignatureData(s string) string {
+	parts := strings.Split(s, ";")
+
+	for i, part := range parts {
+		eq := strings.IndexByte(part, '=')
+		if eq > -1 && strings.TrimSpace(part[:eq]) == "b" {
+			parts[i] = part[:eq+1]
+
+			// keep the line break of a folded last tag
+			if i == len(parts)-1 && strings.HasSuffix(part, "\r\n") {
+				parts[i] += "\r\n"
+			}
+		}
+	}
+
+	return strings.Join(parts, ";")
+}
+
+func removeSpace(s string) string {
+	return strings.Map(func(r rune) rune {
+		switch r {
+		case ' ', '\t', '\r', '\n':
+			return -1
+		}
+
+		return r
+	}, s)
+}
+
+func containsFold(list []string, s string) bool {
+	for _, e := range list {
+		if strings.EqualFold(e, s) {
+			return true
+		}
+	}
+
+	return false
+}
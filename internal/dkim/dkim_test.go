@@ -0,0 +1,172 @@
+// Copyright (C) 2020  Lukas Dietrich <lukas@lukasdietrich.com>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package dkim
+
+import (
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// see RFC#6376 3.4.5
+func TestCanonicalization(t *testing.T) {
+	fields, body := splitMessage([]byte("A: X\r\nB : Y\t\r\n\tZ  \r\n\r\n C \r\nD \t E\r\n\r\n\r\n"))
+	assert.Len(t, fields, 2)
+
+	assert.Equal(t, "a:X\r\n", canonicalHeader(fields[0].raw, relaxed))
+	assert.Equal(t, "b:Y Z\r\n", canonicalHeader(fields[1].raw, relaxed))
+	assert.Equal(t, " C\r\nD E\r\n", string(canonicalBody(body, relaxed)))
+
+	assert.Equal(t, "B : Y\t\r\n\tZ  \r\n", canonicalHeader(fields[1].raw, simple))
+	assert.Equal(t, " C \r\nD \t E\r\n", string(canonicalBody(body, simple)))
+
+	assert.Equal(t, "\r\n", string(canonicalBody(nil, simple)))
+	assert.Empty(t, canonicalBody(nil, relaxed))
+}
+
+func TestVerify(t *testing.T) {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 1024)
+	assert.Nil(t, err)
+
+	rsaPublic, err := x509.MarshalPKIXPublicKey(&rsaKey.PublicKey)
+	assert.Nil(t, err)
+
+	edPublic, edKey, err := ed25519.GenerateKey(rand.Reader)
+	assert.Nil(t, err)
+
+	lookup := func(name string) ([]string, error) {
+		switch name {
+		case "rsa._domainkey.example.com":
+			return []string{"v=DKIM1; k=rsa; p=" + base64.StdEncoding.EncodeToString(rsaPublic)}, nil
+		case "ed._domainkey.example.org":
+			return []string{"v=DKIM1; k=ed25519; p=" + base64.StdEncoding.EncodeToString(edPublic)}, nil
+		}
+
+		return nil, nil
+	}
+
+	message := "From: Alice <alice@example.com>\r\n" +
+		"To: bob@example.net\r\n" +
+		"Subject:  Hello \r\n" +
+		"\r\n" +
+		"Hi Bob,  \r\n" +
+		"\r\n" +
+		"how are you?\r\n" +
+		"\r\n"
+
+	signRSA := func(digest []byte) []byte {
+		sig, err := rsa.SignPKCS1v15(rand.Reader, rsaKey, crypto.SHA256, digest)
+		assert.Nil(t, err)
+		return sig
+	}
+
+	signEd := func(digest []byte) []byte {
+		return ed25519.Sign(edKey, digest)
+	}
+
+	_, body := splitMessage([]byte(message))
+	whole := len(canonicalBody(body, relaxed))
+
+	var (
+		signedRSA     = sign(t, message, "rsa-sha256", "example.com", "rsa", "relaxed/relaxed", -1, signRSA)
+		signedEd      = sign(t, message, "ed25519-sha256", "example.org", "ed", "simple/simple", -1, signEd)
+		signedBad     = sign(t, message, "rsa-sha256", "example.org", "ed", "relaxed/relaxed", -1, signRSA)
+		signedPartial = sign(t, message, "rsa-sha256", "example.com", "rsa", "relaxed/relaxed", 8, signRSA)
+		signedWhole   = sign(t, message, "rsa-sha256", "example.com", "rsa", "relaxed/relaxed", whole, signRSA)
+	)
+
+	for _, test := range []struct {
+		message string
+		domains []string
+	}{
+		{message, nil},
+		{signedRSA, []string{"example.com"}},
+		{signedEd, []string{"example.org"}},
+		{signedBad, nil},
+		{signedEd + "appended\r\n", nil},
+		{strings.Replace(signedRSA, "Hello", "Bye", 1), nil},
+		{strings.Replace(signedRSA, "Hi Bob,  ", "Hi  Bob,", 1), []string{"example.com"}},
+		{strings.Replace(signedEd, "Hi Bob,  ", "Hi  Bob,", 1), nil},
+		{signedPartial, nil},
+		{signedWhole, []string{"example.com"}},
+	} {
+		domains, err := Verify(strings.NewReader(test.message), lookup)
+		assert.Nil(t, err)
+		assert.Equal(t, test.domains, domains)
+	}
+}
+
+func TestVerifyTemporary(t *testing.T) {
+	message := "DKIM-Signature: v=1; a=rsa-sha256; d=example.com; s=rsa;\r\n\tc=relaxed/relaxed; h=from;\r\n" +
+		"\tbh=47DEQpj8HBSa+/TImW+5JCeuQeRkm5NMpJWZG3hSuFU=; b=AAAA\r\n" +
+		"From: alice@example.com\r\n" +
+		"\r\n"
+
+	lookup := func(string) ([]string, error) {
+		return nil, errors.New("servfail")
+	}
+
+	domains, err := Verify(strings.NewReader(message), lookup)
+	assert.True(t, errors.Is(err, ErrTemporary), err)
+	assert.Empty(t, domains)
+}
+
+// sign adds a signature to a message using the canonicalization of the
+// verifier, which is tested separately. A non-negative length only signs the
+// start of the body.
+func sign(t *testing.T, message, algorithm, domain, selector, canon string, length int, fn func([]byte) []byte) string {
+	var (
+		fields, body = splitMessage([]byte(message))
+		canons       = strings.Split(canon, "/")
+		canonical    = canonicalBody(body, canons[1])
+		tags         = fmt.Sprintf("v=1; a=%s; d=%s; s=%s; c=%s;", algorithm, domain, selector, canon)
+		hash         = sha256.New()
+	)
+
+	if length >= 0 {
+		canonical = canonical[:length]
+		tags += fmt.Sprintf(" l=%d;", length)
+	}
+
+	var (
+		bodyHash = sha256.Sum256(canonical)
+		raw      = fmt.Sprintf("DKIM-Signature: %s\r\n"+
+			"\th=from:to:subject; bh=%s;\r\n\tb=\r\n",
+			tags, base64.StdEncoding.EncodeToString(bodyHash[:]))
+	)
+
+	for _, f := range selectHeaders(fields, []string{"from", "to", "subject"}) {
+		io.WriteString(hash, canonicalHeader(f, canons[0])) // nolint:errcheck
+	}
+
+	io.WriteString(hash, strings.TrimSuffix(canonicalHeader(raw, canons[0]), "\r\n")) // nolint:errcheck
+
+	signed := strings.TrimSuffix(raw, "\r\n") + base64.StdEncoding.EncodeToString(fn(hash.Sum(nil))) + "\r\n"
+	assert.Contains(t, signed, "b=")
+
+	return signed + message
+}
@@ -27,6 +27,14 @@ func QueryA(domain string) ([]*dns.A, error) {
 	return DefaultResolver.QueryA(domain)
 }
 
+func QueryAAAA(domain string) ([]*dns.AAAA, error) {
+	return DefaultResolver.QueryAAAA(domain)
+}
+
 func QueryMX(domain string) ([]*dns.MX, error) {
 	return DefaultResolver.QueryMX(domain)
 }
+
+func QueryTXT(domain string) ([]*dns.TXT, error) {
+	return DefaultResolver.QueryTXT(domain)
+}
@@ -15,7 +15,21 @@
 
 package dns
 
-import "github.com/miekg/dns"
+import (
+	"errors"
+	"fmt"
+
+	"github.com/miekg/dns"
+)
+
+var (
+	// ErrNotFound is returned if the queried domain does not exist
+	// (NXDOMAIN). It is a permanent error.
+	ErrNotFound = errors.New("domain does not exist")
+	// ErrTemporary is returned if the server could not answer the query,
+	// e.g. with SERVFAIL or REFUSED. The query should be retried later.
+	ErrTemporary = errors.New("temporary dns failure")
+)
 
 type Resolver struct {
 	addr string
@@ -36,7 +50,19 @@ func (r *Resolver) query(domain string, t uint16) (*dns.Msg, error) {
 		}},
 	}
 
-	return dns.Exchange(&m, r.addr)
+	res, err := dns.Exchange(&m, r.addr)
+	if err != nil {
+		return nil, err
+	}
+
+	switch res.Rcode {
+	case dns.RcodeSuccess:
+		return res, nil
+	case dns.RcodeNameError:
+		return nil, fmt.Errorf("%s: %w", domain, ErrNotFound)
+	default:
+		return nil, fmt.Errorf("%s: %s: %w", domain, dns.RcodeToString[res.Rcode], ErrTemporary)
+	}
 }
 
 func (r *Resolver) QueryA(domain string) ([]*dns.A, error) {
@@ -56,6 +82,23 @@ func (r *Resolver) QueryA(domain string) ([]*dns.A, error) {
 	return records, err
 }
 
+func (r *Resolver) QueryAAAA(domain string) ([]*dns.AAAA, error) {
+	res, err := r.query(domain, dns.TypeAAAA)
+	if err != nil {
+		return nil, err
+	}
+
+	records := make([]*dns.AAAA, 0, len(res.Answer))
+
+	for _, rr := range res.Answer {
+		if r, ok := rr.(*dns.AAAA); ok {
+			records = append(records, r)
+		}
+	}
+
+	return records, err
+}
+
 func (r *Resolver) QueryMX(domain string) ([]*dns.MX, error) {
 	res, err := r.query(domain, dns.TypeMX)
 	if err != nil {
@@ -72,3 +115,20 @@ func (r *Resolver) QueryMX(domain string) ([]*dns.MX, error) {
 
 	return records, err
 }
+
+func (r *Resolver) QueryTXT(domain string) ([]*dns.TXT, error) {
+	res, err := r.query(domain, dns.TypeTXT)
+	if err != nil {
+		return nil, err
+	}
+
+	records := make([]*dns.TXT, 0, len(res.Answer))
+
+	for _, rr := range res.Answer {
+		if r, ok := rr.(*dns.TXT); ok {
+			records = append(records, r)
+		}
+	}
+
+	return records, err
+}
@@ -0,0 +1,72 @@
+// Copyright (C) 2020  Lukas Dietrich <lukas@lukasdietrich.com>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package dns
+
+import (
+	"errors"
+	"net"
+	"testing"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestQueryRcode(t *testing.T) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	assert.Nil(t, err)
+
+	server := dns.Server{
+		PacketConn: conn,
+		Handler: dns.HandlerFunc(func(w dns.ResponseWriter, req *dns.Msg) {
+			var res dns.Msg
+			res.SetReply(req)
+
+			switch req.Question[0].Name {
+			case "missing.example.":
+				res.Rcode = dns.RcodeNameError
+			case "broken.example.":
+				res.Rcode = dns.RcodeServerFailure
+			case "refused.example.":
+				res.Rcode = dns.RcodeRefused
+			default:
+				res.Answer = append(res.Answer, &dns.MX{
+					Hdr:        dns.RR_Header{Name: req.Question[0].Name, Rrtype: dns.TypeMX, Class: dns.ClassINET},
+					Preference: 10,
+					Mx:         "mx.example.",
+				})
+			}
+
+			w.WriteMsg(&res) // nolint:errcheck
+		}),
+	}
+
+	go server.ActivateAndServe() // nolint:errcheck
+	defer server.Shutdown()      // nolint:errcheck
+
+	resolver := NewResolver(conn.LocalAddr().String())
+
+	records, err := resolver.QueryMX("example.com")
+	assert.Nil(t, err)
+	assert.Len(t, records, 1)
+
+	_, err = resolver.QueryMX("missing.example")
+	assert.True(t, errors.Is(err, ErrNotFound), err)
+
+	for _, domain := range []string{"broken.example", "refused.example"} {
+		_, err = resolver.QueryMX(domain)
+		assert.True(t, errors.Is(err, ErrTemporary), err)
+	}
+}
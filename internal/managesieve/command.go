@@ -0,0 +1,213 @@
+// Copyright (C) 2020  Lukas Dietrich <lukas@lukasdietrich.com>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package managesieve
+
+import (
+	"bytes"
+	"errors"
+	"strconv"
+
+	"github.com/lukasdietrich/briefmail/internal/textproto"
+)
+
+// maxLiteralSize limits the size of literals sent by clients, which are
+// mostly scripts.
+const maxLiteralSize = 1 << 20
+
+var (
+	errLiteralTooLarge = errors.New("managesieve: literal too large")
+)
+
+// command represents a command-line as specified in RFC#5804 4:
+//
+//     command-name *(SP argument) CRLF
+//     argument = number / string
+//     string   = quoted / literal-c2s
+//     literal-c2s = "{" number "+}" CRLF *OCTET
+type command struct {
+	name string
+	args []argument
+}
+
+// argument is either a number or a string.
+type argument struct {
+	text   string
+	number bool
+}
+
+func (c *command) readFrom(r textproto.Reader) error {
+	line, err := r.ReadLine()
+	if err != nil {
+		return err
+	}
+
+	return c.parse(r, line)
+}
+
+// parse parses a command-line. Literals are read from r, since they span
+// multiple lines.
+func (c *command) parse(r textproto.Reader, line []byte) error {
+	c.name = ""
+	c.args = nil
+
+	line = bytes.TrimLeft(line, " ")
+	end := bytes.IndexByte(line, ' ')
+	if end < 0 {
+		end = len(line)
+	}
+
+	c.name = string(bytes.ToUpper(line[:end]))
+	line = line[end:]
+
+	args, err := parseArguments(r, line)
+	if err != nil {
+		return err
+	}
+
+	c.args = args
+	return nil
+}
+
+// parseArguments parses space separated arguments up to the end of the
+// command.
+func parseArguments(r textproto.Reader, line []byte) ([]argument, error) {
+	var args []argument
+
+	for {
+		line = bytes.TrimLeft(line, " ")
+		if len(line) == 0 {
+			return args, nil
+		}
+
+		switch {
+		case line[0] == '"':
+			text, rest, err := parseQuoted(line)
+			if err != nil {
+				return nil, err
+			}
+
+			args = append(args, argument{text: text})
+			line = rest
+
+		case line[0] == '{':
+			size, err := parseLiteralSize(line)
+			if err != nil {
+				return nil, err
+			}
+
+			text, rest, err := readLiteral(r, size)
+			if err != nil {
+				return nil, err
+			}
+
+			args = append(args, argument{text: text})
+			line = rest
+
+		case line[0] >= '0' && line[0] <= '9':
+			end := bytes.IndexByte(line, ' ')
+			if end < 0 {
+				end = len(line)
+			}
+
+			if _, err := strconv.ParseUint(string(line[:end]), 10, 32); err != nil {
+				return nil, errInvalidSyntax
+			}
+
+			args = append(args, argument{text: string(line[:end]), number: true})
+			line = line[end:]
+
+		default:
+			return nil, errInvalidSyntax
+		}
+	}
+}
+
+// parseQuoted parses a quoted string, in which only '"' and '\' are escaped.
+func parseQuoted(line []byte) (string, []byte, error) {
+	var b bytes.Buffer
+
+	for i := 1; i < len(line); i++ {
+		switch line[i] {
+		case '"':
+			return b.String(), line[i+1:], nil
+
+		case '\\':
+			if i++; i >= len(line) || (line[i] != '"' && line[i] != '\\') {
+				return "", nil, errInvalidSyntax
+			}
+
+			b.WriteByte(line[i])
+
+		default:
+			b.WriteByte(line[i])
+		}
+	}
+
+	return "", nil, errInvalidSyntax
+}
+
+// parseLiteralSize parses the size of a literal, which must be the last
+// token of a line. Both synchronizing and non-synchronizing literals are
+// accepted.
+func parseLiteralSize(line []byte) (int, error) {
+	end := len(line) - 1
+	if line[end] != '}' {
+		return 0, errInvalidSyntax
+	}
+
+	if line[end-1] == '+' {
+		end--
+	}
+
+	size, err := strconv.Atoi(string(line[1:end]))
+	if err != nil || size < 0 {
+		return 0, errInvalidSyntax
+	}
+
+	if size > maxLiteralSize {
+		return 0, errLiteralTooLarge
+	}
+
+	return size, nil
+}
+
+// readLiteral reads a literal of the given size and returns the rest of the
+// command-line following it. Since lines are read without their line break,
+// line breaks within the literal are assumed to be CRLF.
+func readLiteral(r textproto.Reader, size int) (string, []byte, error) {
+	var b bytes.Buffer
+
+	for {
+		line, err := r.ReadLine()
+		if err != nil {
+			return "", nil, err
+		}
+
+		if b.Len() >= size {
+			// the literal ended with a line break
+			b.Truncate(size)
+			return b.String(), append([]byte(nil), line...), nil
+		}
+
+		if remaining := size - b.Len(); len(line) >= remaining {
+			b.Write(line[:remaining])
+			return b.String(), append([]byte(nil), line[remaining:]...), nil
+		}
+
+		b.Write(line)
+		b.WriteString("\r\n")
+	}
+}
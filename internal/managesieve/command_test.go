@@ -0,0 +1,129 @@
+// Copyright (C) 2020  Lukas Dietrich <lukas@lukasdietrich.com>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package managesieve
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type lineReader struct {
+	scanner *bufio.Scanner
+}
+
+func (r *lineReader) ReadLine() ([]byte, error) {
+	if !r.scanner.Scan() {
+		return nil, io.EOF
+	}
+
+	return r.scanner.Bytes(), nil
+}
+
+func (r *lineReader) DotReader() io.Reader {
+	return nil
+}
+
+func readCommand(input string) (*command, error) {
+	var c command
+	return &c, c.readFrom(&lineReader{bufio.NewScanner(strings.NewReader(input))})
+}
+
+func TestParseCommand(t *testing.T) {
+	for input, expected := range map[string]command{
+		"logout\r\n": {name: "LOGOUT"},
+		"Authenticate \"PLAIN\" \"AGEAYg==\"\r\n": {
+			name: "AUTHENTICATE",
+			args: []argument{{text: "PLAIN"}, {text: "AGEAYg=="}},
+		},
+		"HAVESPACE \"a \\\"b\\\\\" 1024\r\n": {
+			name: "HAVESPACE",
+			args: []argument{{text: `a "b\`}, {text: "1024", number: true}},
+		},
+		"PUTSCRIPT \"main\" {12+}\r\nkeep;\r\nstop;\r\n": {
+			name: "PUTSCRIPT",
+			args: []argument{{text: "main"}, {text: "keep;\r\nstop;"}},
+		},
+		"PUTSCRIPT \"main\" {7}\r\nkeep;\r\n\r\n": {
+			name: "PUTSCRIPT",
+			args: []argument{{text: "main"}, {text: "keep;\r\n"}},
+		},
+		"CHECKSCRIPT {0+}\r\n\r\n": {
+			name: "CHECKSCRIPT",
+			args: []argument{{text: ""}},
+		},
+		"RENAMESCRIPT {3+}\r\nold \"new\"\r\n": {
+			name: "RENAMESCRIPT",
+			args: []argument{{text: "old"}, {text: "new"}},
+		},
+	} {
+		c, err := readCommand(input)
+		assert.Nil(t, err, input)
+		assert.Equal(t, expected, *c, input)
+	}
+
+	for _, input := range []string{
+		"PUTSCRIPT \"main\r\n",
+		"PUTSCRIPT main\r\n",
+		"PUTSCRIPT \"main\" {abc+}\r\n",
+		"GETSCRIPT \"a\\b\"\r\n",
+	} {
+		_, err := readCommand(input)
+		assert.Equal(t, errInvalidSyntax, err, input)
+	}
+
+	_, err := readCommand("PUTSCRIPT \"main\" {99999999+}\r\n")
+	assert.Equal(t, errLiteralTooLarge, err)
+}
+
+func TestWriteString(t *testing.T) {
+	var b bytes.Buffer
+
+	w := bufio.NewWriter(&b)
+	writeString(&testWriter{w}, `say "hi"`)
+	writeString(&testWriter{w}, "two\r\nlines")
+	w.Flush()
+
+	assert.Equal(t, `"say \"hi\""{10}`+"\r\ntwo\r\nlines", b.String())
+}
+
+type testWriter struct {
+	*bufio.Writer
+}
+
+func (w *testWriter) WriteString(s string) error {
+	_, err := w.Writer.WriteString(s)
+	return err
+}
+
+func (w *testWriter) Endline() error {
+	return w.WriteString("\r\n")
+}
+
+func (w *testWriter) DotWriter() io.WriteCloser {
+	return nil
+}
+
+func TestValidScriptName(t *testing.T) {
+	assert.True(t, validScriptName("My Filters"))
+	assert.False(t, validScriptName(""))
+	assert.False(t, validScriptName("a\tb"))
+	assert.False(t, validScriptName("a b"))
+}
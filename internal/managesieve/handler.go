@@ -0,0 +1,559 @@
+// Copyright (C) 2020  Lukas Dietrich <lukas@lukasdietrich.com>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package managesieve
+
+import (
+	"crypto/tls"
+	"database/sql"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/lukasdietrich/briefmail/internal/sasl"
+	"github.com/lukasdietrich/briefmail/internal/sieve"
+	"github.com/lukasdietrich/briefmail/internal/storage"
+)
+
+var (
+	errCloseSession  = errors.New("managesieve: session closed")
+	errBadSequence   = errors.New("managesieve: bad sequence of commands")
+	errInvalidSyntax = errors.New("managesieve: invalid syntax")
+)
+
+type handler func(*session, *command) error
+
+// stringArgs returns the arguments of a command, if they are exactly n
+// strings.
+func stringArgs(c *command, n int) ([]string, error) {
+	if len(c.args) != n {
+		return nil, errInvalidSyntax
+	}
+
+	args := make([]string, n)
+
+	for i, arg := range c.args {
+		if arg.number {
+			return nil, errInvalidSyntax
+		}
+
+		args[i] = arg.text
+	}
+
+	return args, nil
+}
+
+// validScriptName checks a script name as specified in RFC#5804 1.6.
+func validScriptName(name string) bool {
+	if name == "" || len(name) > 256 || !utf8.ValidString(name) {
+		return false
+	}
+
+	for _, r := range name {
+		if unicode.IsControl(r) || r == '\u2028' || r == '\u2029' {
+			return false
+		}
+	}
+
+	return true
+}
+
+// writeCapabilities writes the capabilities followed by an OK response as
+// specified in RFC#5804 1.7.
+//
+// nolint:errcheck
+func writeCapabilities(s *session, config *tls.Config) error {
+	writeCapability := func(name, value string) {
+		writeString(s, name)
+
+		if value != "" {
+			s.WriteString(" ")
+			writeString(s, value)
+		}
+
+		s.Endline()
+	}
+
+	writeCapability("IMPLEMENTATION", "briefmail")
+	writeCapability("SIEVE", strings.Join(sieve.Extensions, " "))
+
+	if !s.authenticated {
+		writeCapability("SASL", strings.Join(sasl.Mechanisms(s.IsTLS()), " "))
+	}
+
+	if config != nil && !s.IsTLS() {
+		writeCapability("STARTTLS", "")
+	}
+
+	writeCapability("VERSION", "1.0")
+
+	return s.send(&reply{statusOk, codeNone, "ready"})
+}
+
+// `CAPABILITY` command as specified in RFC#5804 2.4
+//
+//     "CAPABILITY" CRLF
+func capability(config *tls.Config) handler {
+	return func(s *session, c *command) error {
+		if len(c.args) > 0 {
+			return errInvalidSyntax
+		}
+
+		return writeCapabilities(s, config)
+	}
+}
+
+// `STARTTLS` command as specified in RFC#5804 2.2
+//
+//     "STARTTLS" CRLF
+func starttls(config *tls.Config) handler {
+	var (
+		rReady          = reply{statusOk, codeNone, "ready to go undercover."}
+		rTLSUnavailable = reply{statusNo, codeNone, "I am afraid, I lost my disguise!"}
+		rAlreadyTLS     = reply{statusNo, codeNone, "what are you afraid of?"}
+	)
+
+	return func(s *session, c *command) error {
+		if len(c.args) > 0 {
+			return errInvalidSyntax
+		}
+
+		if s.authenticated {
+			return errBadSequence
+		}
+
+		if config == nil {
+			return s.send(&rTLSUnavailable)
+		}
+
+		if s.IsTLS() {
+			return s.send(&rAlreadyTLS)
+		}
+
+		if err := s.send(&rReady); err != nil {
+			return err
+		}
+
+		if err := s.UpgradeTLS(config); err != nil {
+			return err
+		}
+
+		// the capabilities may have changed after the negotiation
+		return writeCapabilities(s, config)
+	}
+}
+
+// `AUTHENTICATE` command as specified in RFC#5804 2.1
+//
+//     "AUTHENTICATE" SP auth-type [SP string] CRLF
+//     *(string CRLF)
+func authenticate(db *storage.DB) handler {
+	var (
+		rOk          = reply{statusOk, codeNone, "I knew it was you!"}
+		rFail        = reply{statusNo, codeNone, "nice try"}
+		rCancelled   = reply{statusNo, codeNone, "fine, keep your secrets."}
+		rUnsupported = reply{statusNo, codeNone, "never heard of that mechanism."}
+		rEncrypt     = reply{statusNo, codeEncryptNeeded, "not without encryption."}
+	)
+
+	return func(s *session, c *command) error {
+		if s.authenticated {
+			return errBadSequence
+		}
+
+		if len(c.args) < 1 || len(c.args) > 2 {
+			return errInvalidSyntax
+		}
+
+		args, err := stringArgs(c, len(c.args))
+		if err != nil {
+			return err
+		}
+
+		server, err := sasl.NewServer(args[0], s.IsTLS(), db)
+		if err != nil {
+			if sasl.RequireTLS() && !s.IsTLS() {
+				if _, err := sasl.NewServer(args[0], true, db); err == nil {
+					return s.send(&rEncrypt)
+				}
+			}
+
+			return s.send(&rUnsupported)
+		}
+
+		var response []byte
+
+		if len(args) == 2 {
+			if response, err = sasl.DecodeResponse([]byte(args[1])); err != nil {
+				return errInvalidSyntax
+			}
+		}
+
+		for {
+			challenge, done, err := server.Next(response)
+			if err != nil {
+				if err == sasl.ErrMalformed {
+					return errInvalidSyntax
+				}
+
+				return err
+			}
+
+			if done {
+				break
+			}
+
+			if err := s.sendString(base64.StdEncoding.EncodeToString(challenge)); err != nil {
+				return err
+			}
+
+			line, err := s.ReadLine()
+			if err != nil {
+				return err
+			}
+
+			args, err := parseArguments(s, line)
+			if err != nil || len(args) != 1 || args[0].number {
+				return errInvalidSyntax
+			}
+
+			if args[0].text == "*" {
+				return s.send(&rCancelled)
+			}
+
+			if response, err = sasl.DecodeResponse([]byte(args[0].text)); err != nil {
+				return errInvalidSyntax
+			}
+		}
+
+		mailbox := server.Mailbox()
+		if mailbox == nil {
+			return s.send(&rFail)
+		}
+
+		s.authenticated = true
+		s.mailbox = *mailbox
+
+		return s.send(&rOk)
+	}
+}
+
+// `LOGOUT` command as specified in RFC#5804 2.3
+//
+//     "LOGOUT" CRLF
+func logout() handler {
+	rOk := reply{statusOk, codeNone, "see you later!"}
+
+	return func(s *session, _ *command) error {
+		if err := s.send(&rOk); err != nil {
+			return err
+		}
+
+		return errCloseSession
+	}
+}
+
+// `NOOP` command as specified in RFC#5804 2.14
+//
+//     "NOOP" [SP string] CRLF
+func noop() handler {
+	rOk := reply{statusOk, codeNone, "nothing to do"}
+
+	return func(s *session, _ *command) error {
+		return s.send(&rOk)
+	}
+}
+
+// `HAVESPACE` command as specified in RFC#5804 2.5
+//
+//     "HAVESPACE" SP script-name SP number CRLF
+func havespace() handler {
+	rOk := reply{statusOk, codeNone, "plenty of space"}
+
+	return func(s *session, c *command) error {
+		if !s.authenticated {
+			return errBadSequence
+		}
+
+		if len(c.args) != 2 || c.args[0].number || !c.args[1].number {
+			return errInvalidSyntax
+		}
+
+		if size, _ := strconv.ParseUint(c.args[1].text, 10, 32); size > maxLiteralSize {
+			return s.send(&rTooLarge)
+		}
+
+		return s.send(&rOk)
+	}
+}
+
+// `PUTSCRIPT` command as specified in RFC#5804 2.6
+//
+//     "PUTSCRIPT" SP script-name SP script-content CRLF
+func putscript(db *storage.DB) handler {
+	var (
+		rOk      = reply{statusOk, codeNone, "script saved"}
+		rBadName = reply{statusNo, codeNone, "that is no name for a script"}
+	)
+
+	return func(s *session, c *command) error {
+		if !s.authenticated {
+			return errBadSequence
+		}
+
+		args, err := stringArgs(c, 2)
+		if err != nil {
+			return err
+		}
+
+		if !validScriptName(args[0]) {
+			return s.send(&rBadName)
+		}
+
+		if _, err := sieve.Parse(args[1]); err != nil {
+			return s.send(&reply{statusNo, codeNone, err.Error()})
+		}
+
+		if err := db.PutScript(s.mailbox, args[0], args[1]); err != nil {
+			return err
+		}
+
+		return s.send(&rOk)
+	}
+}
+
+// `CHECKSCRIPT` command as specified in RFC#5804 2.12
+//
+//     "CHECKSCRIPT" SP script-content CRLF
+func checkscript() handler {
+	rOk := reply{statusOk, codeNone, "looks good to me"}
+
+	return func(s *session, c *command) error {
+		if !s.authenticated {
+			return errBadSequence
+		}
+
+		args, err := stringArgs(c, 1)
+		if err != nil {
+			return err
+		}
+
+		if _, err := sieve.Parse(args[0]); err != nil {
+			return s.send(&reply{statusNo, codeNone, err.Error()})
+		}
+
+		return s.send(&rOk)
+	}
+}
+
+// `LISTSCRIPTS` command as specified in RFC#5804 2.7
+//
+//     "LISTSCRIPTS" CRLF
+func listscripts(db *storage.DB) handler {
+	rOk := reply{statusOk, codeNone, "that is all"}
+
+	return func(s *session, c *command) error {
+		if !s.authenticated {
+			return errBadSequence
+		}
+
+		if len(c.args) > 0 {
+			return errInvalidSyntax
+		}
+
+		scripts, err := db.Scripts(s.mailbox)
+		if err != nil {
+			return err
+		}
+
+		for _, script := range scripts {
+			writeString(s, script.Name)
+
+			if script.Active {
+				s.WriteString(" ACTIVE") // nolint:errcheck
+			}
+
+			s.Endline() // nolint:errcheck
+		}
+
+		return s.send(&rOk)
+	}
+}
+
+// `GETSCRIPT` command as specified in RFC#5804 2.9
+//
+//     "GETSCRIPT" SP script-name CRLF
+func getscript(db *storage.DB) handler {
+	var (
+		rOk          = reply{statusOk, codeNone, "here you go"}
+		rNonExistent = reply{statusNo, codeNonExistent, "there is no such script"}
+	)
+
+	return func(s *session, c *command) error {
+		if !s.authenticated {
+			return errBadSequence
+		}
+
+		args, err := stringArgs(c, 1)
+		if err != nil {
+			return err
+		}
+
+		script, err := db.Script(s.mailbox, args[0])
+		if err != nil {
+			if errors.Is(err, sql.ErrNoRows) {
+				return s.send(&rNonExistent)
+			}
+
+			return err
+		}
+
+		// scripts are always sent as literal
+		fmt.Fprintf(s, "{%d}\r\n", len(script)) // nolint:errcheck
+		s.WriteString(script)                   // nolint:errcheck
+		s.Endline()                             // nolint:errcheck
+
+		return s.send(&rOk)
+	}
+}
+
+// `SETACTIVE` command as specified in RFC#5804 2.8
+//
+//     "SETACTIVE" SP active-sieve-script-name CRLF
+func setactive(db *storage.DB) handler {
+	var (
+		rOk          = reply{statusOk, codeNone, "done"}
+		rNonExistent = reply{statusNo, codeNonExistent, "there is no such script"}
+	)
+
+	return func(s *session, c *command) error {
+		if !s.authenticated {
+			return errBadSequence
+		}
+
+		args, err := stringArgs(c, 1)
+		if err != nil {
+			return err
+		}
+
+		if err := db.SetActiveScript(s.mailbox, args[0]); err != nil {
+			if errors.Is(err, sql.ErrNoRows) {
+				return s.send(&rNonExistent)
+			}
+
+			return err
+		}
+
+		return s.send(&rOk)
+	}
+}
+
+// `DELETESCRIPT` command as specified in RFC#5804 2.10
+//
+//     "DELETESCRIPT" SP script-name CRLF
+func deletescript(db *storage.DB) handler {
+	var (
+		rOk          = reply{statusOk, codeNone, "gone"}
+		rNonExistent = reply{statusNo, codeNonExistent, "there is no such script"}
+		rActive      = reply{statusNo, codeActive, "deactivate the script first"}
+	)
+
+	return func(s *session, c *command) error {
+		if !s.authenticated {
+			return errBadSequence
+		}
+
+		args, err := stringArgs(c, 1)
+		if err != nil {
+			return err
+		}
+
+		active, err := isActive(db, s.mailbox, args[0])
+		if err != nil {
+			return err
+		}
+
+		if active {
+			return s.send(&rActive)
+		}
+
+		if err := db.DeleteScript(s.mailbox, args[0]); err != nil {
+			if errors.Is(err, sql.ErrNoRows) {
+				return s.send(&rNonExistent)
+			}
+
+			return err
+		}
+
+		return s.send(&rOk)
+	}
+}
+
+// `RENAMESCRIPT` command as specified in RFC#5804 2.11
+//
+//     "RENAMESCRIPT" SP old-script-name SP new-script-name CRLF
+func renamescript(db *storage.DB) handler {
+	var (
+		rOk            = reply{statusOk, codeNone, "renamed"}
+		rNonExistent   = reply{statusNo, codeNonExistent, "there is no such script"}
+		rAlreadyExists = reply{statusNo, codeAlreadyExists, "that name is taken"}
+		rBadName       = reply{statusNo, codeNone, "that is no name for a script"}
+	)
+
+	return func(s *session, c *command) error {
+		if !s.authenticated {
+			return errBadSequence
+		}
+
+		args, err := stringArgs(c, 2)
+		if err != nil {
+			return err
+		}
+
+		if !validScriptName(args[1]) {
+			return s.send(&rBadName)
+		}
+
+		switch err := db.RenameScript(s.mailbox, args[0], args[1]); {
+		case err == nil:
+			return s.send(&rOk)
+		case errors.Is(err, sql.ErrNoRows):
+			return s.send(&rNonExistent)
+		case errors.Is(err, storage.ErrScriptExists):
+			return s.send(&rAlreadyExists)
+		default:
+			return err
+		}
+	}
+}
+
+func isActive(db *storage.DB, mailbox int64, name string) (bool, error) {
+	scripts, err := db.Scripts(mailbox)
+	if err != nil {
+		return false, err
+	}
+
+	for _, script := range scripts {
+		if script.Name == name {
+			return script.Active, nil
+		}
+	}
+
+	return false, nil
+}
@@ -0,0 +1,144 @@
+// Copyright (C) 2020  Lukas Dietrich <lukas@lukasdietrich.com>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+// Package managesieve implements a server to manage the sieve scripts of
+// mailboxes.
+//
+// see RFC#5804
+package managesieve
+
+import (
+	"crypto/tls"
+	"io"
+	"net"
+
+	"github.com/sirupsen/logrus"
+
+	"github.com/lukasdietrich/briefmail/internal/storage"
+	"github.com/lukasdietrich/briefmail/internal/textproto"
+)
+
+var log = logrus.WithField("prefix", "managesieve")
+
+type Proto struct {
+	tlsConfig  *tls.Config
+	handlerMap map[string]handler
+}
+
+// New creates a new Protocol instance to be used with a textproto Server
+func New(db *storage.DB, tlsConfig *tls.Config) *Proto {
+	return &Proto{
+		tlsConfig: tlsConfig,
+		handlerMap: map[string]handler{
+			"CAPABILITY":   capability(tlsConfig),
+			"STARTTLS":     starttls(tlsConfig),
+			"AUTHENTICATE": authenticate(db),
+			"LOGOUT":       logout(),
+			"NOOP":         noop(),
+
+			"HAVESPACE":    havespace(),
+			"PUTSCRIPT":    putscript(db),
+			"CHECKSCRIPT":  checkscript(),
+			"LISTSCRIPTS":  listscripts(db),
+			"GETSCRIPT":    getscript(db),
+			"SETACTIVE":    setactive(db),
+			"DELETESCRIPT": deletescript(db),
+			"RENAMESCRIPT": renamescript(db),
+		},
+	}
+}
+
+var (
+	rBye            = reply{statusBye, codeNone, "closing connection"}
+	rTimeout        = reply{statusBye, codeNone, "timed out"}
+	rError          = reply{statusBye, codeTryLater, "local error in processing"}
+	rNotImplemented = reply{statusNo, codeNone, "command not implemented"}
+	rBadSequence    = reply{statusNo, codeNone, "bad sequence of commands"}
+	rInvalidSyntax  = reply{statusNo, codeNone, "invalid syntax"}
+	rTooLarge       = reply{statusNo, codeQuotaMaxSize, "that is too much to handle"}
+)
+
+func (p *Proto) Handle(c textproto.Conn) {
+	s := &session{Conn: c}
+
+	// the server starts with the capabilities as specified in RFC#5804 1.7
+	if err := writeCapabilities(s, p.tlsConfig); err != nil {
+		return
+	}
+
+	switch err := p.loop(s); err {
+	case io.EOF, errCloseSession, nil:
+	default:
+		log.Warn(err)
+
+		if errt, ok := err.(*net.OpError); ok && errt.Timeout() {
+			s.send(&rTimeout)
+		} else {
+			s.send(&rError)
+		}
+	}
+}
+
+func (p *Proto) loop(s *session) error {
+	var cmd command
+
+	for {
+		if err := s.read(&cmd); err != nil {
+			switch err {
+			case errInvalidSyntax:
+				if err := s.send(&rInvalidSyntax); err != nil {
+					return err
+				}
+
+				continue
+
+			case errLiteralTooLarge:
+				// the literal cannot be skipped reliably
+				s.send(&rTooLarge)
+				return errCloseSession
+
+			default:
+				return err
+			}
+		}
+
+		h, ok := p.handlerMap[cmd.name]
+
+		if !ok {
+			if err := s.send(&rNotImplemented); err != nil {
+				return err
+			}
+
+			continue
+		}
+
+		if err := h(s, &cmd); err != nil {
+			switch err {
+			case errBadSequence:
+				if err := s.send(&rBadSequence); err != nil {
+					return err
+				}
+
+			case errInvalidSyntax:
+				if err := s.send(&rInvalidSyntax); err != nil {
+					return err
+				}
+
+			default:
+				return err
+			}
+		}
+	}
+}
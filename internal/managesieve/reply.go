@@ -0,0 +1,86 @@
+// Copyright (C) 2020  Lukas Dietrich <lukas@lukasdietrich.com>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package managesieve
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/lukasdietrich/briefmail/internal/textproto"
+)
+
+// respCode is a response code as specified in RFC#5804 1.3.
+type respCode string
+
+const (
+	codeNone          respCode = ""
+	codeActive        respCode = "ACTIVE"
+	codeAlreadyExists respCode = "ALREADYEXISTS"
+	codeEncryptNeeded respCode = "ENCRYPT-NEEDED"
+	codeNonExistent   respCode = "NONEXISTENT"
+	codeQuotaMaxSize  respCode = "QUOTA/MAXSIZE"
+	codeTryLater      respCode = "TRYLATER"
+)
+
+type status string
+
+const (
+	statusOk  status = "OK"
+	statusNo  status = "NO"
+	statusBye status = "BYE"
+)
+
+type reply struct {
+	status status
+	code   respCode
+	text   string
+}
+
+// nolint:errcheck
+func (r *reply) writeTo(w textproto.Writer) error {
+	w.WriteString(string(r.status))
+
+	if r.code != codeNone {
+		w.WriteString(" (")
+		w.WriteString(string(r.code))
+		w.WriteString(")")
+	}
+
+	if r.text != "" {
+		w.WriteString(" ")
+		writeString(w, r.text)
+	}
+
+	w.Endline()
+
+	return w.Flush()
+}
+
+// writeString writes a string as a quoted string if possible, otherwise as a
+// literal.
+//
+// nolint:errcheck
+func writeString(w textproto.Writer, s string) {
+	if len(s) > 1024 || strings.ContainsAny(s, "\r\n\x00") {
+		fmt.Fprintf(w, "{%d}\r\n", len(s))
+		w.WriteString(s)
+		return
+	}
+
+	w.WriteString(`"`)
+	w.WriteString(strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(s))
+	w.WriteString(`"`)
+}
@@ -0,0 +1,58 @@
+// Copyright (C) 2020  Lukas Dietrich <lukas@lukasdietrich.com>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package managesieve
+
+import (
+	"time"
+
+	"github.com/lukasdietrich/briefmail/internal/textproto"
+)
+
+type session struct {
+	textproto.Conn
+
+	authenticated bool
+	mailbox       int64
+}
+
+func (s *session) send(r *reply) error {
+	if err := s.SetWriteTimeout(time.Minute * 5); err != nil {
+		return err
+	}
+
+	return r.writeTo(s)
+}
+
+// sendString sends a single string on its own line, as used for sasl
+// challenges.
+func (s *session) sendString(text string) error {
+	if err := s.SetWriteTimeout(time.Minute * 5); err != nil {
+		return err
+	}
+
+	writeString(s, text)
+	s.Endline() // nolint:errcheck
+
+	return s.Flush()
+}
+
+func (s *session) read(c *command) error {
+	if err := s.SetReadTimeout(time.Minute * 5); err != nil {
+		return err
+	}
+
+	return c.readFrom(s)
+}
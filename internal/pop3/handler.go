@@ -16,15 +16,24 @@
 package pop3
 
 import (
+	"bufio"
+	"bytes"
+	"crypto/md5"
+	"crypto/subtle"
 	"crypto/tls"
+	"database/sql"
+	"encoding/hex"
 	"errors"
 	"fmt"
 	"io"
 	"strconv"
+	"strings"
+	"time"
 
 	"github.com/sirupsen/logrus"
 
 	"github.com/lukasdietrich/briefmail/internal/model"
+	"github.com/lukasdietrich/briefmail/internal/sasl"
 	"github.com/lukasdietrich/briefmail/internal/storage"
 )
 
@@ -40,13 +49,20 @@ type handler func(*session, *command) error
 //
 //     "USER" <mailbox> CRLF
 func user() handler {
-	rOk := reply{true, "now the secret"}
+	var (
+		rOk           = reply{true, "now the secret"}
+		rEncryptFirst = codeAuth.reply("not without encryption")
+	)
 
 	return func(s *session, c *command) error {
 		if !s.state.in(sInit, sUser) {
 			return errBadSequence
 		}
 
+		if !plaintextAllowed(s) {
+			return s.send(&rEncryptFirst)
+		}
+
 		args := c.args()
 
 		if len(args) != 1 {
@@ -64,11 +80,7 @@ func user() handler {
 //
 //     "PASS" <password> CRLF
 func pass(l *locks, db *storage.DB) handler {
-	var (
-		rOk        = reply{true, "I knew it was you!"}
-		rWrongPass = reply{false, "nice try"}
-		rLocked    = reply{false, "there is two of you?"}
-	)
+	rWrongPass := codeAuth.reply("nice try")
 
 	return func(s *session, c *command) error {
 		if !s.state.in(sUser) {
@@ -90,24 +102,186 @@ func pass(l *locks, db *storage.DB) handler {
 			return s.send(&rWrongPass)
 		}
 
-		if !l.lock(id) {
-			return s.send(&rLocked)
+		return open(s, l, db, id)
+	}
+}
+
+// `APOP` command as specified in RFC#1939
+//
+//     "APOP" <mailbox> <digest> CRLF
+func apop(l *locks, db *storage.DB) handler {
+	rWrongDigest := codeAuth.reply("nice try")
+
+	return func(s *session, c *command) error {
+		if !s.state.in(sInit) {
+			return errBadSequence
+		}
+
+		args := c.args()
+
+		if len(args) != 2 {
+			return errInvalidSyntax
 		}
 
-		s.mailbox.entries, s.mailbox.size, err = db.Entries(id)
+		id, secret, err := db.APOPSecret(string(args[0]))
 		if err != nil {
+			if err == sql.ErrNoRows {
+				return s.send(&rWrongDigest)
+			}
+
 			return err
 		}
 
-		s.mailbox.id = id
-		s.mailbox.marks = make(map[int64]bool)
+		// mailboxes without a shared secret cannot use apop
+		if secret == "" {
+			return s.send(&rWrongDigest)
+		}
 
-		s.state = sTransaction
+		var (
+			expected = md5.Sum([]byte(s.timestamp + secret))
+			digest   = bytes.ToLower(args[1])
+		)
 
-		return s.send(&rOk)
+		if subtle.ConstantTimeCompare([]byte(hex.EncodeToString(expected[:])), digest) != 1 {
+			return s.send(&rWrongDigest)
+		}
+
+		return open(s, l, db, id)
+	}
+}
+
+// `AUTH` command as specified in RFC#5034
+//
+//     "AUTH" [ <mechanism> [ <initial-response> ] ] CRLF
+func auth(l *locks, db *storage.DB) handler {
+	var (
+		rMechanisms  = reply{true, "I know these"}
+		rFail        = codeAuth.reply("nice try")
+		rCancelled   = reply{false, "fine, keep your secrets."}
+		rUnsupported = reply{false, "never heard of that mechanism."}
+	)
+
+	return func(s *session, c *command) error {
+		if !s.state.in(sInit) {
+			return errBadSequence
+		}
+
+		args := c.args()
+
+		if len(args) == 0 {
+			// list the available mechanisms as specified in RFC#1734
+			if err := s.send(&rMechanisms); err != nil {
+				return err
+			}
+
+			for _, mechanism := range sasl.Mechanisms(s.IsTLS()) {
+				s.WriteString(mechanism) // nolint:errcheck
+				s.Endline()              // nolint:errcheck
+			}
+
+			s.WriteString(".")
+			s.Endline()
+
+			return s.Flush()
+		}
+
+		if len(args) > 2 {
+			return errInvalidSyntax
+		}
+
+		server, err := sasl.NewServer(string(args[0]), s.IsTLS(), db)
+		if err != nil {
+			return s.send(&rUnsupported)
+		}
+
+		var response []byte
+
+		if len(args) == 2 {
+			if response, err = sasl.DecodeResponse(args[1]); err != nil {
+				return errInvalidSyntax
+			}
+		}
+
+		for {
+			challenge, done, err := server.Next(response)
+			if err != nil {
+				if err == sasl.ErrMalformed {
+					return errInvalidSyntax
+				}
+
+				return err
+			}
+
+			if done {
+				break
+			}
+
+			if err := s.challenge(challenge); err != nil {
+				return err
+			}
+
+			line, err := s.ReadLine()
+			if err != nil {
+				return err
+			}
+
+			if string(line) == "*" {
+				return s.send(&rCancelled)
+			}
+
+			if response, err = sasl.DecodeResponse(line); err != nil {
+				return errInvalidSyntax
+			}
+		}
+
+		if mailbox := server.Mailbox(); mailbox != nil {
+			return open(s, l, db, *mailbox)
+		}
+
+		return s.send(&rFail)
 	}
 }
 
+// open locks an authenticated mailbox and enters the transaction state.
+func open(s *session, l *locks, db *storage.DB, id int64) error {
+	var (
+		rOk      = reply{true, "I knew it was you!"}
+		rLocked  = codeInUse.reply("there is two of you?")
+		rTooSoon = codeLoginDelay.reply("you were just here.")
+	)
+
+	if l.tooSoon(id) {
+		return s.send(&rTooSoon)
+	}
+
+	if !l.lock(id) {
+		return s.send(&rLocked)
+	}
+
+	entries, size, err := db.Entries(id)
+	if err != nil {
+		l.unlock(id)
+		return err
+	}
+
+	retention, err := db.Retention(id)
+	if err != nil {
+		l.unlock(id)
+		return err
+	}
+
+	s.mailbox.id = id
+	s.mailbox.entries = entries
+	s.mailbox.size = size
+	s.mailbox.marks = make(map[int64]bool)
+	s.mailbox.retrieved = make(map[int64]bool)
+	s.mailbox.retention = retention
+
+	s.state = sTransaction
+
+	return s.send(&rOk)
+}
+
 // `QUIT` command as specified in RFC#1939
 //
 //     "QUIT" CRLF
@@ -133,6 +307,18 @@ func quit(db *storage.DB, blobs *storage.Blobs) handler {
 				return err
 			}
 
+			retrieved := make([]model.ID, 0, len(s.mailbox.retrieved))
+
+			for n := range s.mailbox.retrieved {
+				if !s.mailbox.marks[n] {
+					retrieved = append(retrieved, s.mailbox.entries[int(n)].MailID)
+				}
+			}
+
+			if err := db.MarkRetrieved(retrieved, s.mailbox.id, time.Now()); err != nil {
+				return err
+			}
+
 			if err := cleaner.Clean(); err != nil {
 				log.Warn(err)
 			}
@@ -314,6 +500,8 @@ func retr(blobs *storage.Blobs) handler {
 			return err
 		}
 
+		s.mailbox.retrieved[n] = true
+
 		w := s.DotWriter()
 
 		_, err = io.Copy(w, r)
@@ -326,6 +514,97 @@ func retr(blobs *storage.Blobs) handler {
 	}
 }
 
+// `TOP` command as specified in RFC#1939
+//
+//     "TOP" <id> <lines> CRLF
+func top(blobs *storage.Blobs) handler {
+	var (
+		rOk        = reply{true, "top of the message coming"}
+		rNoMessage = reply{false, "no such message"}
+	)
+
+	return func(s *session, c *command) error {
+		if !s.state.in(sTransaction) {
+			return errBadSequence
+		}
+
+		args := c.args()
+
+		if len(args) != 2 {
+			return errInvalidSyntax
+		}
+
+		n, err := strconv.ParseInt(string(args[0]), 10, 64)
+		if err != nil {
+			return errInvalidSyntax
+		}
+
+		lines, err := strconv.ParseInt(string(args[1]), 10, 64)
+		if err != nil || lines < 0 {
+			return errInvalidSyntax
+		}
+
+		n--
+
+		if n < 0 || n >= int64(len(s.mailbox.entries)) || s.mailbox.marks[n] {
+			return s.send(&rNoMessage)
+		}
+
+		if err := s.send(&rOk); err != nil {
+			return err
+		}
+
+		r, err := blobs.Read(s.mailbox.entries[n].MailID)
+		if err != nil {
+			return err
+		}
+
+		w := s.DotWriter()
+
+		err = copyTop(w, r, lines)
+
+		r.Close()
+		w.Close()
+		s.Flush()
+
+		return err
+	}
+}
+
+// copyTop copies the header section, the empty line separating it from the
+// body and the first lines of the body.
+func copyTop(w io.Writer, r io.Reader, lines int64) error {
+	var (
+		br     = bufio.NewReader(r)
+		inBody = false
+	)
+
+	for !inBody || lines > 0 {
+		line, err := br.ReadBytes('\n')
+		if len(line) > 0 {
+			if _, err := w.Write(line); err != nil {
+				return err
+			}
+		}
+
+		if err != nil {
+			if err == io.EOF {
+				return nil
+			}
+
+			return err
+		}
+
+		if inBody {
+			lines--
+		} else if len(bytes.TrimRight(line, "\r\n")) == 0 {
+			inBody = true
+		}
+	}
+
+	return nil
+}
+
 // `DELE` command as specified in RFC#1939
 //
 //     "DELE" <id> CRLF
@@ -425,19 +704,56 @@ func stls(config *tls.Config) handler {
 // `CAPA` command as specified in RFC#2449
 //
 //     "CAPA" CRLF
-func capa(capabilities ...string) handler {
+func capa(db *storage.DB, config *tls.Config, loginDelay time.Duration) handler {
 	var (
 		rOk = reply{true, "I can do some things"}
+
+		capabilities = []string{
+			"TOP",
+			"UIDL",
+			"RESP-CODES",
+			"AUTH-RESP-CODE",
+			"PIPELINING",
+		}
 	)
 
+	if loginDelay > 0 {
+		capabilities = append(capabilities,
+			fmt.Sprintf("LOGIN-DELAY %d", int64(loginDelay/time.Second)))
+	}
+
+	capabilities = append(capabilities, "IMPLEMENTATION briefmail")
+
 	return func(s *session, _ *command) error {
 		if err := s.send(&rOk); err != nil {
 			return err
 		}
 
+		// nolint:errcheck
+		writeCapability := func(capability string) {
+			s.WriteString(capability)
+			s.Endline()
+		}
+
+		if config != nil && !s.IsTLS() {
+			writeCapability("STLS")
+		}
+
+		if plaintextAllowed(s) {
+			writeCapability("USER")
+		}
+
+		writeCapability("SASL " + strings.Join(sasl.Mechanisms(s.IsTLS()), " "))
+
+		expire, err := expireCapability(s, db)
+		if err != nil {
+			return err
+		}
+
+		writeCapability(expire)
+
 		for _, capability := range capabilities {
-			s.WriteString(capability) // nolint:errcheck
-			s.Endline()               // nolint:errcheck
+			writeCapability(capability)
 		}
 
 		s.WriteString(".")
@@ -446,3 +762,32 @@ func capa(capabilities ...string) handler {
 		return s.Flush()
 	}
 }
+
+// expireCapability returns the retention policy as specified in RFC#2449 6.7.
+// Before authentication, the shortest policy of all mailboxes is announced.
+func expireCapability(s *session, db *storage.DB) (string, error) {
+	if s.state.in(sTransaction) {
+		if days := s.mailbox.retention.Days; days > 0 {
+			return fmt.Sprintf("EXPIRE %d", days), nil
+		}
+
+		return "EXPIRE NEVER", nil
+	}
+
+	days, err := db.ShortestRetention()
+	if err != nil {
+		return "", err
+	}
+
+	if days > 0 {
+		return fmt.Sprintf("EXPIRE %d USER", days), nil
+	}
+
+	return "EXPIRE NEVER", nil
+}
+
+// plaintextAllowed returns whether USER and PASS may be used on the
+// connection.
+func plaintextAllowed(s *session) bool {
+	return s.IsTLS() || !sasl.RequireTLS()
+}
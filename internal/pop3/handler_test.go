@@ -0,0 +1,42 @@
+// Copyright (C) 2020  Lukas Dietrich <lukas@lukasdietrich.com>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package pop3
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCopyTop(t *testing.T) {
+	mail := "Subject: test\r\nFrom: <a@example.com>\r\n\r\nline 1\r\nline 2\r\nline 3\r\n"
+
+	for _, test := range []struct {
+		lines    int64
+		expected string
+	}{
+		{0, "Subject: test\r\nFrom: <a@example.com>\r\n\r\n"},
+		{2, "Subject: test\r\nFrom: <a@example.com>\r\n\r\nline 1\r\nline 2\r\n"},
+		{10, mail},
+	} {
+		var b bytes.Buffer
+
+		assert.NoError(t, copyTop(&b, strings.NewReader(mail), test.lines))
+		assert.Equal(t, test.expected, b.String())
+	}
+}
@@ -15,16 +15,23 @@
 
 package pop3
 
-import "sync"
+import (
+	"sync"
+	"time"
+)
 
 type locks struct {
 	entries map[int64]bool
+	logins  map[int64]time.Time
+	delay   time.Duration
 	mu      sync.Mutex
 }
 
-func newLocks() *locks {
+func newLocks(delay time.Duration) *locks {
 	return &locks{
 		entries: make(map[int64]bool),
+		logins:  make(map[int64]time.Time),
+		delay:   delay,
 	}
 }
 
@@ -37,6 +44,7 @@ func (l *locks) lock(key int64) bool {
 	}
 
 	l.entries[key] = true
+	l.logins[key] = time.Now()
 	return true
 }
 
@@ -46,3 +54,13 @@ func (l *locks) unlock(key int64) {
 
 	delete(l.entries, key)
 }
+
+// tooSoon returns true if the last login of key is more recent than the
+// configured login delay.
+func (l *locks) tooSoon(key int64) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	last, ok := l.logins[key]
+	return ok && l.delay > 0 && time.Since(last) < l.delay
+}
@@ -18,10 +18,14 @@ package pop3
 import (
 	"bytes"
 	"crypto/tls"
+	"fmt"
 	"io"
 	"net"
+	"os"
+	"time"
 
 	"github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
 
 	"github.com/lukasdietrich/briefmail/internal/storage"
 	"github.com/lukasdietrich/briefmail/internal/textproto"
@@ -29,7 +33,12 @@ import (
 
 var log = logrus.WithField("prefix", "pop3")
 
+func init() {
+	viper.SetDefault("mail.loginDelay", time.Duration(0))
+}
+
 type Proto struct {
+	hostname   string
 	locks      *locks
 	handlerMap map[string]handler
 }
@@ -40,22 +49,27 @@ func New(
 	blobs *storage.Blobs,
 	tlsConfig *tls.Config,
 ) *Proto {
-	locks := newLocks()
+	var (
+		loginDelay = viper.GetDuration("mail.loginDelay")
+		locks      = newLocks(loginDelay)
+	)
 
 	return &Proto{
-		locks: locks,
+		hostname: viper.GetString("general.hostname"),
+		locks:    locks,
 		handlerMap: map[string]handler{
-			"CAPA": capa(
-				"USER",
-				"UIDL"),
+			"CAPA": capa(db, tlsConfig, loginDelay),
 
 			"USER": user(),
 			"PASS": pass(locks, db),
+			"APOP": apop(locks, db),
+			"AUTH": auth(locks, db),
 
 			"STAT": stat(),
 			"LIST": list(),
 			"UIDL": uidl(),
 			"RETR": retr(blobs),
+			"TOP":  top(blobs),
 			"DELE": dele(),
 
 			"NOOP": noop(),
@@ -71,7 +85,7 @@ var (
 	rReady          = reply{true, "ready"}
 	rBye            = reply{true, "closing transmission channel"}
 	rTimeout        = reply{false, "timed out"}
-	rError          = reply{false, "action aborted: local error in processing"}
+	rError          = codeSysTemp.reply("action aborted: local error in processing")
 	rNotImplemented = reply{false, "command not implemented"}
 	rBadSequence    = reply{false, "bad sequence of commands"}
 	rInvalidSyntax  = reply{false, "invalid syntax"}
@@ -79,11 +93,13 @@ var (
 
 func (p *Proto) Handle(c textproto.Conn) {
 	s := &session{
-		Conn:  c,
-		state: sInit,
+		Conn:      c,
+		state:     sInit,
+		timestamp: newTimestamp(p.hostname),
 	}
 
-	if err := s.send(&rReady); err != nil {
+	// the timestamp is required for apop as specified in RFC#1939 7
+	if err := s.send(&reply{true, rReady.text + " " + s.timestamp}); err != nil {
 		return
 	}
 
@@ -105,6 +121,11 @@ func (p *Proto) Handle(c textproto.Conn) {
 	}
 }
 
+// newTimestamp returns a unique string of the form <process-id.clock@hostname>.
+func newTimestamp(hostname string) string {
+	return fmt.Sprintf("<%d.%d@%s>", os.Getpid(), time.Now().UnixNano(), hostname)
+}
+
 func (p *Proto) loop(s *session) error {
 	var cmd command
 
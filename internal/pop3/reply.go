@@ -19,6 +19,22 @@ import (
 	"github.com/lukasdietrich/briefmail/internal/textproto"
 )
 
+// respCode is an extended response code as specified in RFC#2449 8 and
+// RFC#3206.
+type respCode string
+
+const (
+	codeAuth       respCode = "AUTH"
+	codeInUse      respCode = "IN-USE"
+	codeLoginDelay respCode = "LOGIN-DELAY"
+	codeSysTemp    respCode = "SYS/TEMP"
+)
+
+// reply returns a negative reply prefixed with the response code.
+func (c respCode) reply(text string) reply {
+	return reply{false, "[" + string(c) + "] " + text}
+}
+
 type reply struct {
 	ok   bool
 	text string
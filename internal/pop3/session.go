@@ -16,6 +16,7 @@
 package pop3
 
 import (
+	"encoding/base64"
 	"time"
 
 	"github.com/lukasdietrich/briefmail/internal/storage"
@@ -51,15 +52,18 @@ func (s sessionState) in(any ...sessionState) bool {
 type session struct {
 	textproto.Conn
 
-	state sessionState
-	name  string
+	state     sessionState
+	name      string
+	timestamp string
 
 	mailbox struct {
-		id      int64
-		marks   map[int64]bool
-		entries []storage.Entry
-		size    int64
-		sizeDel int64
+		id        int64
+		marks     map[int64]bool
+		retrieved map[int64]bool
+		retention *storage.Retention
+		entries   []storage.Entry
+		size      int64
+		sizeDel   int64
 	}
 }
 
@@ -71,6 +75,19 @@ func (s *session) send(r *reply) error {
 	return r.writeTo(s)
 }
 
+// challenge sends a sasl server challenge as specified in RFC#5034 4.
+func (s *session) challenge(b []byte) error {
+	if err := s.SetWriteTimeout(time.Minute * 5); err != nil {
+		return err
+	}
+
+	s.WriteString("+ ")                                 // nolint:errcheck
+	s.WriteString(base64.StdEncoding.EncodeToString(b)) // nolint:errcheck
+	s.Endline()                                         // nolint:errcheck
+
+	return s.Flush()
+}
+
 func (s *session) read(c *command) error {
 	if err := s.SetReadTimeout(time.Minute * 5); err != nil {
 		return err
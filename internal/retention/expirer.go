@@ -0,0 +1,131 @@
+// Copyright (C) 2020  Lukas Dietrich <lukas@lukasdietrich.com>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+// Package retention enforces the retention policies of mailboxes.
+package retention
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+
+	"github.com/lukasdietrich/briefmail/internal/storage"
+)
+
+var log = logrus.WithField("prefix", "retention")
+
+func init() {
+	viper.SetDefault("retention.interval", time.Hour)
+}
+
+// Expirer periodically deletes mails, which exceed the retention policy of
+// their mailbox.
+type Expirer struct {
+	DB    *storage.DB
+	Blobs *storage.Blobs
+
+	stop    chan struct{}  `wire:"-"`
+	running sync.WaitGroup `wire:"-"`
+}
+
+// Start runs the expirer in the background until Shutdown is called.
+func (e *Expirer) Start() {
+	interval := viper.GetDuration("retention.interval")
+	if interval <= 0 {
+		log.Info("retention policies are not enforced")
+		return
+	}
+
+	log.Infof("enforcing retention policies every %s", interval)
+
+	e.stop = make(chan struct{})
+	e.running.Add(1)
+
+	go e.run(interval)
+}
+
+// Shutdown stops the expirer and waits for a run in progress to finish or
+// the context to be done.
+func (e *Expirer) Shutdown(ctx context.Context) {
+	if e.stop == nil {
+		return
+	}
+
+	close(e.stop)
+
+	done := make(chan struct{})
+
+	go func() {
+		e.running.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-ctx.Done():
+	}
+}
+
+func (e *Expirer) run(interval time.Duration) {
+	defer e.running.Done()
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		if _, err := e.Expire(time.Now()); err != nil {
+			log.Warn(err)
+		}
+
+		select {
+		case <-ticker.C:
+		case <-e.stop:
+			return
+		}
+	}
+}
+
+// Expire deletes all mails, which exceed the retention policy of their
+// mailbox at the given time, and returns how many entries were deleted.
+func (e *Expirer) Expire(now time.Time) (int, error) {
+	expired, err := e.DB.ExpiredEntries(now)
+	if err != nil {
+		return 0, err
+	}
+
+	var count int
+
+	for mailbox, mails := range expired {
+		if err := e.DB.DeleteEntries(mails, mailbox); err != nil {
+			return count, err
+		}
+
+		log.WithFields(logrus.Fields{
+			"mailbox": mailbox,
+			"expired": len(mails),
+		}).Debug("deleted expired mails")
+
+		count += len(mails)
+	}
+
+	if count > 0 {
+		return count, storage.NewCleaner(e.DB, e.Blobs).Clean()
+	}
+
+	return count, nil
+}
@@ -0,0 +1,52 @@
+// Copyright (C) 2020  Lukas Dietrich <lukas@lukasdietrich.com>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package sasl
+
+// loginServer implements the obsolete, but widely used LOGIN mechanism.
+//
+// see <https://tools.ietf.org/html/draft-murchison-sasl-login-00>
+type loginServer struct {
+	creds   Credentials
+	name    *string
+	mailbox *int64
+}
+
+var (
+	challengeUsername = []byte("Username:")
+	challengePassword = []byte("Password:")
+)
+
+func (l *loginServer) Next(response []byte) ([]byte, bool, error) {
+	if l.name == nil {
+		if response == nil {
+			return challengeUsername, false, nil
+		}
+
+		name := string(response)
+		l.name = &name
+
+		return challengePassword, false, nil
+	}
+
+	mailbox, err := authenticate(l.creds, *l.name, string(response))
+	l.mailbox = mailbox
+
+	return nil, true, err
+}
+
+func (l *loginServer) Mailbox() *int64 {
+	return l.mailbox
+}
@@ -0,0 +1,55 @@
+// Copyright (C) 2020  Lukas Dietrich <lukas@lukasdietrich.com>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package sasl
+
+import (
+	"bytes"
+)
+
+// plainServer implements the PLAIN mechanism.
+//
+// see RFC#4616
+type plainServer struct {
+	creds   Credentials
+	mailbox *int64
+}
+
+func (p *plainServer) Next(response []byte) ([]byte, bool, error) {
+	if response == nil {
+		// ask for the credentials with an empty challenge
+		return []byte{}, false, nil
+	}
+
+	// [authzid] NUL authcid NUL passwd
+	fields := bytes.Split(response, []byte{0})
+	if len(fields) != 3 {
+		return nil, true, ErrMalformed
+	}
+
+	if len(fields[0]) > 0 && !bytes.Equal(fields[0], fields[1]) {
+		// acting on behalf of another user is not supported
+		return nil, true, nil
+	}
+
+	mailbox, err := authenticate(p.creds, string(fields[1]), string(fields[2]))
+	p.mailbox = mailbox
+
+	return nil, true, err
+}
+
+func (p *plainServer) Mailbox() *int64 {
+	return p.mailbox
+}
@@ -0,0 +1,132 @@
+// Copyright (C) 2020  Lukas Dietrich <lukas@lukasdietrich.com>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+// Package sasl implements the server side of the "Simple Authentication and
+// Security Layer" mechanisms shared by smtp and pop3.
+//
+// see RFC#4422
+package sasl
+
+import (
+	"encoding/base64"
+	"errors"
+	"strings"
+
+	"github.com/spf13/viper"
+
+	"github.com/lukasdietrich/briefmail/internal/storage"
+)
+
+func init() {
+	viper.SetDefault("auth.requireTLS", false)
+}
+
+const (
+	mechPlain       = "PLAIN"
+	mechLogin       = "LOGIN"
+	mechScramSHA256 = "SCRAM-SHA-256"
+)
+
+var (
+	// ErrUnsupported is returned for unknown or disabled mechanisms.
+	ErrUnsupported = errors.New("sasl: unsupported mechanism")
+	// ErrMalformed is returned when a client response cannot be parsed.
+	ErrMalformed = errors.New("sasl: malformed response")
+)
+
+// Credentials is the source of mailbox credentials, usually *storage.DB.
+type Credentials interface {
+	// Authenticate checks a plain text password.
+	Authenticate(name, pass string) (int64, bool, error)
+	// Scram returns the keys derived from a password.
+	Scram(name string) (int64, *storage.ScramCredentials, error)
+}
+
+// Server is the server side of a single authentication exchange.
+type Server interface {
+	// Next consumes the next client response. The first call receives the
+	// initial response, which is nil if the client did not send one. It
+	// returns the next challenge, or done once the exchange is complete.
+	Next(response []byte) (challenge []byte, done bool, err error)
+	// Mailbox returns the authenticated mailbox once the exchange is done,
+	// or nil if the authentication failed.
+	Mailbox() *int64
+}
+
+// RequireTLS returns whether the configured policy forbids plain text
+// passwords over unencrypted connections.
+func RequireTLS() bool {
+	return viper.GetBool("auth.requireTLS")
+}
+
+// Mechanisms returns all mechanisms available on a connection.
+func Mechanisms(isTLS bool) []string {
+	mechanisms := []string{mechScramSHA256}
+
+	if isTLS || !RequireTLS() {
+		mechanisms = append(mechanisms, mechPlain, mechLogin)
+	}
+
+	return mechanisms
+}
+
+// NewServer starts a new exchange of a mechanism. ErrUnsupported is returned
+// if the mechanism is unknown or not available on the connection.
+func NewServer(mechanism string, isTLS bool, creds Credentials) (Server, error) {
+	mechanism = strings.ToUpper(mechanism)
+
+	for _, available := range Mechanisms(isTLS) {
+		if mechanism != available {
+			continue
+		}
+
+		switch mechanism {
+		case mechPlain:
+			return &plainServer{creds: creds}, nil
+		case mechLogin:
+			return &loginServer{creds: creds}, nil
+		case mechScramSHA256:
+			return &scramServer{creds: creds}, nil
+		}
+	}
+
+	return nil, ErrUnsupported
+}
+
+// DecodeResponse decodes a base64 encoded client response. A single "=" is an
+// empty initial response. The result is never nil, so an empty response can be
+// told apart from a missing one.
+func DecodeResponse(b []byte) ([]byte, error) {
+	if string(b) == "=" {
+		return []byte{}, nil
+	}
+
+	response, err := base64.StdEncoding.DecodeString(string(b))
+	if response == nil {
+		response = []byte{}
+	}
+
+	return response, err
+}
+
+// authenticate checks a plain text password and returns the mailbox or nil.
+func authenticate(creds Credentials, name, pass string) (*int64, error) {
+	mailbox, ok, err := creds.Authenticate(name, pass)
+	if err != nil || !ok {
+		return nil, err
+	}
+
+	return &mailbox, nil
+}
@@ -0,0 +1,203 @@
+// Copyright (C) 2020  Lukas Dietrich <lukas@lukasdietrich.com>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package sasl
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/crypto/pbkdf2"
+
+	"github.com/lukasdietrich/briefmail/internal/storage"
+)
+
+type fakeCredentials struct {
+	name  string
+	pass  string
+	scram *storage.ScramCredentials
+}
+
+func newFakeCredentials(name, pass string) *fakeCredentials {
+	var (
+		salt      = []byte("0123456789abcdef")
+		salted    = pbkdf2.Key([]byte(pass), salt, 4096, sha256.Size, sha256.New)
+		storedKey = sha256.Sum256(hmacSHA256(salted, []byte("Client Key")))
+	)
+
+	return &fakeCredentials{
+		name: name,
+		pass: pass,
+		scram: &storage.ScramCredentials{
+			Salt:       salt,
+			Iterations: 4096,
+			StoredKey:  storedKey[:],
+			ServerKey:  hmacSHA256(salted, []byte("Server Key")),
+		},
+	}
+}
+
+func (f *fakeCredentials) Authenticate(name, pass string) (int64, bool, error) {
+	return 42, name == f.name && pass == f.pass, nil
+}
+
+func (f *fakeCredentials) Scram(name string) (int64, *storage.ScramCredentials, error) {
+	if name != f.name {
+		return 0, nil, nil
+	}
+
+	return 42, f.scram, nil
+}
+
+func TestPlain(t *testing.T) {
+	creds := newFakeCredentials("alice", "secret")
+
+	for _, test := range []struct {
+		response string
+		ok       bool
+	}{
+		{"\x00alice\x00secret", true},
+		{"alice\x00alice\x00secret", true},
+		{"bob\x00alice\x00secret", false},
+		{"\x00alice\x00wrong", false},
+	} {
+		server, err := NewServer("plain", false, creds)
+		assert.NoError(t, err)
+
+		challenge, done, err := server.Next(nil)
+		assert.NoError(t, err)
+		assert.False(t, done)
+		assert.Empty(t, challenge)
+
+		_, done, err = server.Next([]byte(test.response))
+		assert.NoError(t, err)
+		assert.True(t, done)
+		assert.Equal(t, test.ok, server.Mailbox() != nil, test.response)
+	}
+}
+
+func TestLogin(t *testing.T) {
+	server, err := NewServer("LOGIN", false, newFakeCredentials("alice", "secret"))
+	assert.NoError(t, err)
+
+	challenge, done, err := server.Next(nil)
+	assert.NoError(t, err)
+	assert.False(t, done)
+	assert.Equal(t, "Username:", string(challenge))
+
+	challenge, done, err = server.Next([]byte("alice"))
+	assert.NoError(t, err)
+	assert.False(t, done)
+	assert.Equal(t, "Password:", string(challenge))
+
+	_, done, err = server.Next([]byte("secret"))
+	assert.NoError(t, err)
+	assert.True(t, done)
+	assert.Equal(t, int64(42), *server.Mailbox())
+}
+
+func TestMechanismsRequireTLS(t *testing.T) {
+	creds := newFakeCredentials("alice", "secret")
+
+	viper.Set("auth.requireTLS", true)
+	defer viper.Set("auth.requireTLS", false)
+
+	assert.Equal(t, []string{"SCRAM-SHA-256"}, Mechanisms(false))
+	assert.Equal(t, []string{"SCRAM-SHA-256", "PLAIN", "LOGIN"}, Mechanisms(true))
+
+	_, err := NewServer("PLAIN", false, creds)
+	assert.Equal(t, ErrUnsupported, err)
+
+	_, err = NewServer("PLAIN", true, creds)
+	assert.NoError(t, err)
+}
+
+func TestScram(t *testing.T) {
+	for _, test := range []struct {
+		name string
+		pass string
+		ok   bool
+	}{
+		{"alice", "secret", true},
+		{"alice", "wrong", false},
+		{"bob", "secret", false},
+	} {
+		ok := scramExchange(t, newFakeCredentials("alice", "secret"), test.name, test.pass)
+		assert.Equal(t, test.ok, ok, "%s:%s", test.name, test.pass)
+	}
+}
+
+// scramExchange acts as a scram client and returns true if the server
+// accepted the password and proved its knowledge of the credentials.
+func scramExchange(t *testing.T, creds Credentials, name, pass string) bool {
+	server, err := NewServer(mechScramSHA256, false, creds)
+	assert.NoError(t, err)
+
+	var (
+		clientFirstBare = fmt.Sprintf("n=%s,r=clientnonce", name)
+		clientFirst     = "n,," + clientFirstBare
+	)
+
+	challenge, done, err := server.Next([]byte(clientFirst))
+	assert.NoError(t, err)
+	if done {
+		return false
+	}
+
+	var (
+		serverFirst = string(challenge)
+		attrs       = parseScramAttributes(serverFirst)
+	)
+
+	assert.True(t, strings.HasPrefix(attrs["r"], "clientnonce"))
+	salt, _ := base64.StdEncoding.DecodeString(attrs["s"])
+
+	var (
+		withoutProof    = fmt.Sprintf("c=%s,r=%s", base64.StdEncoding.EncodeToString([]byte("n,,")), attrs["r"])
+		authMessage     = []byte(clientFirstBare + "," + serverFirst + "," + withoutProof)
+		salted          = pbkdf2.Key([]byte(pass), salt, 4096, sha256.Size, sha256.New)
+		clientKey       = hmacSHA256(salted, []byte("Client Key"))
+		storedKey       = sha256.Sum256(clientKey)
+		clientSignature = hmacSHA256(storedKey[:], authMessage)
+		proof           = make([]byte, len(clientKey))
+	)
+
+	for i := range clientKey {
+		proof[i] = clientKey[i] ^ clientSignature[i]
+	}
+
+	clientFinal := withoutProof + ",p=" + base64.StdEncoding.EncodeToString(proof)
+
+	challenge, done, err = server.Next([]byte(clientFinal))
+	assert.NoError(t, err)
+	if done {
+		assert.Nil(t, server.Mailbox())
+		return false
+	}
+
+	serverSignature := hmacSHA256(hmacSHA256(salted, []byte("Server Key")), authMessage)
+	assert.Equal(t, "v="+base64.StdEncoding.EncodeToString(serverSignature), string(challenge))
+
+	_, done, err = server.Next([]byte{})
+	assert.NoError(t, err)
+	assert.True(t, done)
+
+	return server.Mailbox() != nil
+}
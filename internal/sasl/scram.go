@@ -0,0 +1,208 @@
+// Copyright (C) 2020  Lukas Dietrich <lukas@lukasdietrich.com>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package sasl
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"fmt"
+	"strings"
+)
+
+const scramNonceLength = 18
+
+// scramServer implements the SCRAM-SHA-256 mechanism without channel
+// binding.
+//
+// see RFC#5802 and RFC#7677
+type scramServer struct {
+	creds Credentials
+
+	gs2Header       string
+	clientFirstBare string
+	serverFirst     string
+	nonce           string
+
+	id          int64
+	credentials *scramCredentials
+	mailbox     *int64
+}
+
+type scramCredentials struct {
+	salt       []byte
+	iterations int
+	storedKey  []byte
+	serverKey  []byte
+}
+
+func (s *scramServer) Next(response []byte) ([]byte, bool, error) {
+	switch {
+	case s.serverFirst == "":
+		if response == nil {
+			// ask for the client-first-message with an empty challenge
+			return []byte{}, false, nil
+		}
+
+		return s.clientFirst(string(response))
+
+	case s.mailbox == nil:
+		return s.clientFinal(string(response))
+
+	default:
+		// the client acknowledged the server signature
+		return nil, true, nil
+	}
+}
+
+func (s *scramServer) Mailbox() *int64 {
+	return s.mailbox
+}
+
+// clientFirst handles the message
+//
+//     gs2-header client-first-message-bare
+//     "n,," "n=" saslname ",r=" c-nonce
+func (s *scramServer) clientFirst(message string) ([]byte, bool, error) {
+	parts := strings.SplitN(message, ",", 3)
+	if len(parts) != 3 {
+		return nil, true, ErrMalformed
+	}
+
+	switch {
+	case parts[0] == "n", parts[0] == "y":
+	default:
+		// channel binding is not supported
+		return nil, true, nil
+	}
+
+	if parts[1] != "" {
+		// acting on behalf of another user is not supported
+		return nil, true, nil
+	}
+
+	s.gs2Header = parts[0] + "," + parts[1] + ","
+	s.clientFirstBare = parts[2]
+
+	attrs := parseScramAttributes(s.clientFirstBare)
+
+	name, ok := attrs["n"]
+	if !ok {
+		return nil, true, ErrMalformed
+	}
+
+	clientNonce, ok := attrs["r"]
+	if !ok || clientNonce == "" {
+		return nil, true, ErrMalformed
+	}
+
+	name = strings.NewReplacer("=2C", ",", "=3D", "=").Replace(name)
+
+	id, creds, err := s.creds.Scram(name)
+	if err != nil || creds == nil {
+		// unknown users and users without scram credentials fail the
+		// same way
+		return nil, true, nil
+	}
+
+	serverNonce := make([]byte, scramNonceLength)
+	if _, err := rand.Read(serverNonce); err != nil {
+		return nil, true, err
+	}
+
+	s.id = id
+	s.credentials = &scramCredentials{
+		salt:       creds.Salt,
+		iterations: creds.Iterations,
+		storedKey:  creds.StoredKey,
+		serverKey:  creds.ServerKey,
+	}
+
+	s.nonce = clientNonce + base64.RawStdEncoding.EncodeToString(serverNonce)
+	s.serverFirst = fmt.Sprintf("r=%s,s=%s,i=%d",
+		s.nonce,
+		base64.StdEncoding.EncodeToString(s.credentials.salt),
+		s.credentials.iterations)
+
+	return []byte(s.serverFirst), false, nil
+}
+
+// clientFinal handles the message
+//
+//     "c=" base64(gs2-header) ",r=" nonce ",p=" base64(proof)
+func (s *scramServer) clientFinal(message string) ([]byte, bool, error) {
+	i := strings.LastIndex(message, ",p=")
+	if i < 0 {
+		return nil, true, ErrMalformed
+	}
+
+	var (
+		withoutProof = message[:i]
+		attrs        = parseScramAttributes(withoutProof)
+	)
+
+	proof, err := base64.StdEncoding.DecodeString(message[i+3:])
+	if err != nil {
+		return nil, true, ErrMalformed
+	}
+
+	if attrs["c"] != base64.StdEncoding.EncodeToString([]byte(s.gs2Header)) ||
+		attrs["r"] != s.nonce {
+		return nil, true, nil
+	}
+
+	authMessage := []byte(s.clientFirstBare + "," + s.serverFirst + "," + withoutProof)
+
+	clientSignature := hmacSHA256(s.credentials.storedKey, authMessage)
+	if len(proof) != len(clientSignature) {
+		return nil, true, nil
+	}
+
+	clientKey := make([]byte, len(proof))
+	for i := range proof {
+		clientKey[i] = proof[i] ^ clientSignature[i]
+	}
+
+	storedKey := sha256.Sum256(clientKey)
+	if subtle.ConstantTimeCompare(storedKey[:], s.credentials.storedKey) != 1 {
+		return nil, true, nil
+	}
+
+	s.mailbox = &s.id
+
+	serverSignature := hmacSHA256(s.credentials.serverKey, authMessage)
+	return []byte("v=" + base64.StdEncoding.EncodeToString(serverSignature)), false, nil
+}
+
+func parseScramAttributes(message string) map[string]string {
+	attrs := make(map[string]string)
+
+	for _, attr := range strings.Split(message, ",") {
+		if len(attr) > 2 && attr[1] == '=' {
+			attrs[attr[:1]] = attr[2:]
+		}
+	}
+
+	return attrs
+}
+
+func hmacSHA256(key, data []byte) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write(data) // nolint:errcheck
+	return mac.Sum(nil)
+}
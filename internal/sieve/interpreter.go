@@ -0,0 +1,417 @@
+// Copyright (C) 2020  Lukas Dietrich <lukas@lukasdietrich.com>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package sieve
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/lukasdietrich/briefmail/internal/model"
+)
+
+// Inbox is the folder of the implicit keep.
+const Inbox = "INBOX"
+
+// maxRedirects limits the number of redirect actions of a single execution.
+const maxRedirects = 4
+
+// Delivery stores the mail in a folder of the mailbox.
+type Delivery struct {
+	Folder string
+	Flags  []string
+}
+
+// Vacation is an auto reply as specified in RFC#5230.
+type Vacation struct {
+	Reason    string
+	Subject   string
+	From      string
+	Addresses []string
+	Days      int64
+	Handle    string
+	Mime      bool
+}
+
+// Result are the actions collected by executing a script.
+type Result struct {
+	Deliveries []Delivery
+	Redirects  []*model.Address
+	Rejected   bool
+	Reject     string
+	Vacation   *Vacation
+}
+
+// execution is the state of a single run of a script.
+type execution struct {
+	msg    *Message
+	result Result
+	flags  []string
+	cancel bool
+	stop   bool
+}
+
+// Execute runs a script for a message and returns the resulting actions.
+// Unless the implicit keep is cancelled by an action, the result contains a
+// delivery to the inbox.
+func Execute(script *Script, msg *Message) (*Result, error) {
+	e := execution{msg: msg}
+
+	if err := e.block(script.commands); err != nil {
+		return nil, err
+	}
+
+	if !e.cancel {
+		e.deliver(Inbox, e.flags)
+	}
+
+	if e.result.Rejected && (len(e.result.Deliveries) > 0 ||
+		len(e.result.Redirects) > 0 || e.result.Vacation != nil) {
+		return nil, fmt.Errorf("reject cannot be combined with other actions")
+	}
+
+	return &e.result, nil
+}
+
+func (e *execution) block(commands []*node) error {
+	// skip tracks whether a branch of the current if-chain was taken.
+	skip := false
+
+	for _, n := range commands {
+		if e.stop {
+			return nil
+		}
+
+		switch n.name {
+		case "if", "elsif", "else":
+			if n.name == "if" {
+				skip = false
+			}
+
+			if skip {
+				continue
+			}
+
+			if n.name != "else" && !e.test(n.tests[0]) {
+				continue
+			}
+
+			skip = true
+
+			if err := e.block(n.block); err != nil {
+				return err
+			}
+
+		default:
+			if err := e.command(n); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+func (e *execution) command(n *node) error {
+	switch n.name {
+	case "require":
+	case "stop":
+		e.stop = true
+
+	case "keep":
+		e.deliver(Inbox, e.flagsOf(n))
+		e.cancel = true
+
+	case "discard":
+		e.cancel = true
+
+	case "fileinto":
+		e.deliver(n.args[0].strings[0], e.flagsOf(n))
+		e.cancel = e.cancel || !n.has("copy")
+
+	case "redirect":
+		to, err := model.ParseAddress(n.args[0].strings[0])
+		if err != nil || to == model.NilAddress {
+			return errorf(n.line, "invalid redirect address %q", n.args[0].strings[0])
+		}
+
+		if len(e.result.Redirects) >= maxRedirects {
+			return errorf(n.line, "too many redirects")
+		}
+
+		e.result.Redirects = append(e.result.Redirects, to)
+		e.cancel = e.cancel || !n.has("copy")
+
+	case "reject":
+		e.result.Rejected = true
+		e.result.Reject = n.args[0].strings[0]
+		e.cancel = true
+
+	case "vacation":
+		if e.result.Vacation != nil {
+			return errorf(n.line, "vacation may only be used once")
+		}
+
+		e.result.Vacation = e.vacation(n)
+
+	case "setflag":
+		e.flags = normalizeFlags(n.args[0].strings)
+
+	case "addflag":
+		e.flags = normalizeFlags(append(e.flags, n.args[0].strings...))
+
+	case "removeflag":
+		remove := normalizeFlags(n.args[0].strings)
+		flags := e.flags[:0:0]
+
+		for _, flag := range e.flags {
+			if !containsFold(remove, flag) {
+				flags = append(flags, flag)
+			}
+		}
+
+		e.flags = flags
+	}
+
+	return nil
+}
+
+// deliver adds a delivery to a folder. Deliveries to the same folder are
+// merged.
+func (e *execution) deliver(folder string, flags []string) {
+	for i, d := range e.result.Deliveries {
+		if strings.EqualFold(d.Folder, folder) {
+			e.result.Deliveries[i].Flags = normalizeFlags(append(d.Flags, flags...))
+			return
+		}
+	}
+
+	e.result.Deliveries = append(e.result.Deliveries, Delivery{
+		Folder: folder,
+		Flags:  flags,
+	})
+}
+
+func (e *execution) flagsOf(n *node) []string {
+	if flags, ok := n.tags["flags"]; ok {
+		return normalizeFlags(flags.strings)
+	}
+
+	return e.flags
+}
+
+func (e *execution) vacation(n *node) *Vacation {
+	v := Vacation{
+		Reason: n.args[0].strings[0],
+		Days:   7,
+		Mime:   n.has("mime"),
+	}
+
+	if days, ok := n.tags["days"]; ok {
+		v.Days = days.num
+	}
+
+	if subject, ok := n.tags["subject"]; ok {
+		v.Subject = subject.strings[0]
+	}
+
+	if from, ok := n.tags["from"]; ok {
+		v.From = from.strings[0]
+	}
+
+	if addresses, ok := n.tags["addresses"]; ok {
+		v.Addresses = addresses.strings
+	}
+
+	if handle, ok := n.tags["handle"]; ok {
+		v.Handle = handle.strings[0]
+	} else {
+		v.Handle = fmt.Sprintf("%s\x00%s\x00%s", v.Subject, v.From, v.Reason)
+	}
+
+	return &v
+}
+
+func (e *execution) test(n *node) bool {
+	switch n.name {
+	case "true":
+		return true
+
+	case "false":
+		return false
+
+	case "not":
+		return !e.test(n.tests[0])
+
+	case "allof":
+		for _, test := range n.tests {
+			if !e.test(test) {
+				return false
+			}
+		}
+
+		return true
+
+	case "anyof":
+		for _, test := range n.tests {
+			if e.test(test) {
+				return true
+			}
+		}
+
+		return false
+
+	case "exists":
+		for _, name := range n.args[0].strings {
+			if len(e.msg.Header(name)) == 0 {
+				return false
+			}
+		}
+
+		return true
+
+	case "size":
+		limit := n.args[0].num
+
+		if n.has("over") {
+			return e.msg.Size > limit
+		}
+
+		return e.msg.Size < limit
+
+	case "header":
+		var values []string
+
+		for _, name := range n.args[0].strings {
+			values = append(values, e.msg.Header(name)...)
+		}
+
+		return newMatcher(n).any(values, n.args[1].strings)
+
+	case "address":
+		var addresses []string
+
+		for _, name := range n.args[0].strings {
+			addresses = append(addresses, e.msg.Addresses(name)...)
+		}
+
+		return e.matchAddresses(n, addresses)
+
+	case "envelope":
+		var addresses []string
+
+		for _, part := range n.args[0].strings {
+			switch strings.ToLower(part) {
+			case "from":
+				addresses = append(addresses, addressString(e.msg.From))
+			case "to":
+				addresses = append(addresses, addressString(e.msg.To))
+			}
+		}
+
+		return e.matchAddresses(n, addresses)
+
+	case "body":
+		return newMatcher(n).any(e.bodyValues(n), n.args[0].strings)
+
+	case "hasflag":
+		return newMatcher(n).any(e.flags, n.args[0].strings)
+	}
+
+	return false
+}
+
+func (e *execution) matchAddresses(n *node, addresses []string) bool {
+	var values []string
+
+	for _, address := range addresses {
+		if part, ok := addressPart(n, address, e.msg.Separators); ok {
+			values = append(values, part)
+		}
+	}
+
+	return newMatcher(n).any(values, n.args[1].strings)
+}
+
+// bodyValues returns the parts of the body selected by the transform of a
+// body test as specified in RFC#5173 5.
+func (e *execution) bodyValues(n *node) []string {
+	if n.has("raw") {
+		return []string{string(e.msg.rawBody())}
+	}
+
+	prefixes := []string{"text"}
+	if content, ok := n.tags["content"]; ok {
+		prefixes = content.strings
+	}
+
+	var values []string
+
+	for _, p := range e.msg.parts() {
+		for _, prefix := range prefixes {
+			if matchContentType(p.contentType, prefix) {
+				values = append(values, string(p.content))
+				break
+			}
+		}
+	}
+
+	return values
+}
+
+// matchContentType returns true if a content type matches a type ("text"),
+// a type and subtype ("text/html") or is matched by the empty prefix.
+func matchContentType(contentType, prefix string) bool {
+	prefix = strings.ToLower(prefix)
+
+	if prefix == "" || prefix == contentType {
+		return true
+	}
+
+	return !strings.Contains(prefix, "/") && strings.HasPrefix(contentType, prefix+"/")
+}
+
+func addressString(addr *model.Address) string {
+	if addr == nil {
+		return ""
+	}
+
+	return addr.String()
+}
+
+// normalizeFlags splits space separated flags and removes duplicates.
+func normalizeFlags(list []string) []string {
+	var flags []string
+
+	for _, item := range list {
+		for _, flag := range strings.Fields(item) {
+			if !containsFold(flags, flag) {
+				flags = append(flags, flag)
+			}
+		}
+	}
+
+	return flags
+}
+
+func containsFold(list []string, s string) bool {
+	for _, item := range list {
+		if strings.EqualFold(item, s) {
+			return true
+		}
+	}
+
+	return false
+}
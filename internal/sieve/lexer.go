@@ -0,0 +1,290 @@
+// Copyright (C) 2020  Lukas Dietrich <lukas@lukasdietrich.com>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package sieve
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+type tokenKind int
+
+const (
+	tokenEOF tokenKind = iota
+	tokenIdentifier
+	tokenTag
+	tokenNumber
+	tokenString
+	tokenPunct
+)
+
+type token struct {
+	kind  tokenKind
+	text  string
+	num   int64
+	line  int
+	punct byte
+}
+
+func (t token) String() string {
+	switch t.kind {
+	case tokenEOF:
+		return "end of script"
+	case tokenString:
+		return fmt.Sprintf("string %q", t.text)
+	case tokenPunct:
+		return fmt.Sprintf("%q", t.punct)
+	}
+
+	return fmt.Sprintf("%q", t.text)
+}
+
+// lexer splits a script into tokens as specified in RFC#5228 8.1.
+type lexer struct {
+	src  string
+	pos  int
+	line int
+}
+
+func (l *lexer) errorf(format string, args ...interface{}) error {
+	return &Error{Line: l.line, Message: fmt.Sprintf(format, args...)}
+}
+
+func (l *lexer) tokens() ([]token, error) {
+	var tokens []token
+
+	for {
+		t, err := l.next()
+		if err != nil {
+			return nil, err
+		}
+
+		tokens = append(tokens, t)
+
+		if t.kind == tokenEOF {
+			return tokens, nil
+		}
+	}
+}
+
+func (l *lexer) next() (token, error) {
+	if err := l.skipSpace(); err != nil {
+		return token{}, err
+	}
+
+	if l.pos >= len(l.src) {
+		return token{kind: tokenEOF, line: l.line}, nil
+	}
+
+	c := l.src[l.pos]
+
+	switch {
+	case strings.IndexByte(";,[]{}()", c) > -1:
+		l.pos++
+		return token{kind: tokenPunct, punct: c, text: string(c), line: l.line}, nil
+
+	case c == '"':
+		return l.quotedString()
+
+	case c == ':':
+		l.pos++
+
+		name := l.identifier()
+		if name == "" {
+			return token{}, l.errorf("expected tag name after ':'")
+		}
+
+		return token{kind: tokenTag, text: strings.ToLower(name), line: l.line}, nil
+
+	case isDigit(c):
+		return l.number()
+
+	case isIdentStart(c):
+		line := l.line
+		name := l.identifier()
+
+		if strings.EqualFold(name, "text") && strings.HasPrefix(l.src[l.pos:], ":") {
+			l.pos++
+			return l.multiLineString(line)
+		}
+
+		return token{kind: tokenIdentifier, text: strings.ToLower(name), line: line}, nil
+	}
+
+	return token{}, l.errorf("unexpected character %q", c)
+}
+
+func (l *lexer) skipSpace() error {
+	for l.pos < len(l.src) {
+		switch c := l.src[l.pos]; {
+		case c == '\n':
+			l.line++
+			l.pos++
+
+		case c == ' ' || c == '\t' || c == '\r':
+			l.pos++
+
+		case c == '#':
+			for l.pos < len(l.src) && l.src[l.pos] != '\n' {
+				l.pos++
+			}
+
+		case strings.HasPrefix(l.src[l.pos:], "/*"):
+			end := strings.Index(l.src[l.pos+2:], "*/")
+			if end < 0 {
+				return l.errorf("unterminated comment")
+			}
+
+			l.line += strings.Count(l.src[l.pos:l.pos+2+end], "\n")
+			l.pos += end + 4
+
+		default:
+			return nil
+		}
+	}
+
+	return nil
+}
+
+func (l *lexer) identifier() string {
+	start := l.pos
+
+	for l.pos < len(l.src) && (isIdentStart(l.src[l.pos]) || isDigit(l.src[l.pos])) {
+		l.pos++
+	}
+
+	return l.src[start:l.pos]
+}
+
+func (l *lexer) number() (token, error) {
+	start := l.pos
+
+	for l.pos < len(l.src) && isDigit(l.src[l.pos]) {
+		l.pos++
+	}
+
+	n, err := strconv.ParseInt(l.src[start:l.pos], 10, 64)
+	if err != nil {
+		return token{}, l.errorf("invalid number %q", l.src[start:l.pos])
+	}
+
+	if l.pos < len(l.src) {
+		switch l.src[l.pos] {
+		case 'K', 'k':
+			n <<= 10
+			l.pos++
+		case 'M', 'm':
+			n <<= 20
+			l.pos++
+		case 'G', 'g':
+			n <<= 30
+			l.pos++
+		}
+	}
+
+	return token{kind: tokenNumber, num: n, text: l.src[start:l.pos], line: l.line}, nil
+}
+
+func (l *lexer) quotedString() (token, error) {
+	var (
+		b    strings.Builder
+		line = l.line
+	)
+
+	for l.pos++; l.pos < len(l.src); l.pos++ {
+		switch c := l.src[l.pos]; c {
+		case '"':
+			l.pos++
+			return token{kind: tokenString, text: b.String(), line: line}, nil
+
+		case '\\':
+			// any escaped character stands for itself
+			if l.pos++; l.pos < len(l.src) {
+				b.WriteByte(l.src[l.pos])
+			}
+
+		case '\n':
+			l.line++
+			b.WriteByte(c)
+
+		default:
+			b.WriteByte(c)
+		}
+	}
+
+	return token{}, &Error{Line: line, Message: "unterminated string"}
+}
+
+// multiLineString reads the lines following "text:" up to a line consisting
+// of a single dot. A leading dot of other lines is removed if doubled.
+func (l *lexer) multiLineString(line int) (token, error) {
+	// the rest of the line may only contain whitespace or a comment
+	for l.pos < len(l.src) && (l.src[l.pos] == ' ' || l.src[l.pos] == '\t') {
+		l.pos++
+	}
+
+	if strings.HasPrefix(l.src[l.pos:], "#") {
+		for l.pos < len(l.src) && l.src[l.pos] != '\n' {
+			l.pos++
+		}
+	}
+
+	if strings.HasPrefix(l.src[l.pos:], "\r\n") {
+		l.pos += 2
+	} else if strings.HasPrefix(l.src[l.pos:], "\n") {
+		l.pos++
+	} else {
+		return token{}, l.errorf("expected line break after text:")
+	}
+
+	l.line++
+
+	var b strings.Builder
+
+	for l.pos < len(l.src) {
+		end := strings.IndexByte(l.src[l.pos:], '\n')
+		if end < 0 {
+			break
+		}
+
+		raw := l.src[l.pos : l.pos+end+1]
+		l.pos += end + 1
+		l.line++
+
+		content := strings.TrimRight(raw, "\r\n")
+		if content == "." {
+			return token{kind: tokenString, text: b.String(), line: line}, nil
+		}
+
+		if strings.HasPrefix(content, "..") {
+			raw = raw[1:]
+		}
+
+		b.WriteString(strings.TrimSuffix(strings.TrimSuffix(raw, "\n"), "\r"))
+		b.WriteString("\r\n")
+	}
+
+	return token{}, &Error{Line: line, Message: "unterminated multi-line string"}
+}
+
+func isDigit(c byte) bool {
+	return c >= '0' && c <= '9'
+}
+
+func isIdentStart(c byte) bool {
+	return c == '_' || (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z')
+}
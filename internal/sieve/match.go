@@ -0,0 +1,181 @@
+// Copyright (C) 2020  Lukas Dietrich <lukas@lukasdietrich.com>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package sieve
+
+import (
+	"strings"
+	"unicode/utf8"
+)
+
+// matcher compares values against keys using a match type and comparator as
+// specified in RFC#5228 2.7.
+type matcher struct {
+	matchType  string
+	comparator string
+}
+
+func newMatcher(n *node) matcher {
+	m := matcher{
+		matchType:  "is",
+		comparator: comparatorASCIICaseMap,
+	}
+
+	for _, matchType := range [...]string{"is", "contains", "matches"} {
+		if n.has(matchType) {
+			m.matchType = matchType
+		}
+	}
+
+	if c, ok := n.tags["comparator"]; ok {
+		m.comparator = c.strings[0]
+	}
+
+	return m
+}
+
+// any returns true if any of the values matches any of the keys.
+func (m matcher) any(values, keys []string) bool {
+	for _, value := range values {
+		for _, key := range keys {
+			if m.match(value, key) {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+func (m matcher) match(value, key string) bool {
+	if m.comparator == comparatorASCIICaseMap {
+		value = toLowerASCII(value)
+		key = toLowerASCII(key)
+	}
+
+	switch m.matchType {
+	case "contains":
+		return strings.Contains(value, key)
+	case "matches":
+		return matchWildcard(value, key)
+	}
+
+	return value == key
+}
+
+func toLowerASCII(s string) string {
+	return strings.Map(func(r rune) rune {
+		if r >= 'A' && r <= 'Z' {
+			return r + 'a' - 'A'
+		}
+
+		return r
+	}, s)
+}
+
+// matchWildcard matches a value against a pattern, where "*" matches any
+// sequence of characters, "?" matches a single character and "\" escapes the
+// following character.
+func matchWildcard(value, pattern string) bool {
+	for len(pattern) > 0 {
+		switch pattern[0] {
+		case '*':
+			pattern = pattern[1:]
+
+			for i := 0; i <= len(value); {
+				if matchWildcard(value[i:], pattern) {
+					return true
+				}
+
+				if i == len(value) {
+					break
+				}
+
+				_, size := utf8.DecodeRuneInString(value[i:])
+				i += size
+			}
+
+			return false
+
+		case '?':
+			if len(value) == 0 {
+				return false
+			}
+
+			_, size := utf8.DecodeRuneInString(value)
+			value = value[size:]
+			pattern = pattern[1:]
+
+		default:
+			if pattern[0] == '\\' && len(pattern) > 1 {
+				pattern = pattern[1:]
+			}
+
+			_, size := utf8.DecodeRuneInString(pattern)
+			if !strings.HasPrefix(value, pattern[:size]) {
+				return false
+			}
+
+			value = value[size:]
+			pattern = pattern[size:]
+		}
+	}
+
+	return len(value) == 0
+}
+
+// addressPart extracts the part of an address selected by the tags of a test.
+// The second result is false, if the address has no such part, e.g. no detail.
+func addressPart(n *node, address, separators string) (string, bool) {
+	var (
+		localpart = address
+		domain    string
+	)
+
+	if i := strings.LastIndexByte(address, '@'); i > -1 {
+		localpart = address[:i]
+		domain = address[i+1:]
+	}
+
+	switch {
+	case n.has("localpart"):
+		return localpart, true
+
+	case n.has("domain"):
+		return domain, true
+
+	case n.has("user"), n.has("detail"):
+		i := -1
+		if separators != "" {
+			i = strings.IndexAny(localpart, separators)
+		}
+
+		if n.has("user") {
+			if i > -1 {
+				return localpart[:i], true
+			}
+
+			return localpart, true
+		}
+
+		if i > -1 {
+			return localpart[i+1:], true
+		}
+
+		return "", false
+	}
+
+	return address, true
+}
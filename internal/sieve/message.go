@@ -0,0 +1,199 @@
+// Copyright (C) 2020  Lukas Dietrich <lukas@lukasdietrich.com>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package sieve
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/base64"
+	"io"
+	"io/ioutil"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	netmail "net/mail"
+	"net/textproto"
+	"strings"
+
+	"github.com/lukasdietrich/briefmail/internal/model"
+)
+
+// maxBodySize limits the part of a body examined by body tests.
+const maxBodySize = 1 << 20
+
+// Message is the mail a script is executed for.
+type Message struct {
+	// From is the envelope sender and To the recipient, whose script is
+	// executed.
+	From *model.Address
+	To   *model.Address
+	Size int64
+	// Separators split the user of an address from its detail.
+	Separators string
+
+	header netmail.Header
+	body   io.Reader
+	raw    []byte
+	read   bool
+}
+
+// ReadMessage reads the header of a mail. The body is only read once a body
+// test requires it.
+func ReadMessage(from, to *model.Address, size int64, r io.Reader) (*Message, error) {
+	msg, err := netmail.ReadMessage(bufio.NewReader(r))
+	if err != nil {
+		return nil, err
+	}
+
+	return &Message{
+		From:       from,
+		To:         to,
+		Size:       size,
+		Separators: "+",
+		header:     msg.Header,
+		body:       msg.Body,
+	}, nil
+}
+
+// Header returns all values of a header field with encoded words decoded.
+func (m *Message) Header(name string) []string {
+	var (
+		decoder mime.WordDecoder
+		values  []string
+	)
+
+	for _, value := range m.header[textproto.CanonicalMIMEHeaderKey(name)] {
+		if decoded, err := decoder.DecodeHeader(value); err == nil {
+			value = decoded
+		}
+
+		values = append(values, strings.TrimSpace(value))
+	}
+
+	return values
+}
+
+// Addresses returns the addresses of a header field. Values, which cannot be
+// parsed as an address list, are returned unchanged.
+func (m *Message) Addresses(name string) []string {
+	var addresses []string
+
+	for _, value := range m.header[textproto.CanonicalMIMEHeaderKey(name)] {
+		list, err := netmail.ParseAddressList(value)
+		if err != nil {
+			addresses = append(addresses, strings.TrimSpace(value))
+			continue
+		}
+
+		for _, addr := range list {
+			addresses = append(addresses, addr.Address)
+		}
+	}
+
+	return addresses
+}
+
+func (m *Message) rawBody() []byte {
+	if !m.read {
+		m.raw, _ = ioutil.ReadAll(io.LimitReader(m.body, maxBodySize))
+		m.read = true
+	}
+
+	return m.raw
+}
+
+// part is a decoded leaf of the mime structure of a mail.
+type part struct {
+	contentType string
+	content     []byte
+}
+
+// parts returns the decoded leaf parts of the mail.
+func (m *Message) parts() []part {
+	return collectParts(textproto.MIMEHeader(m.header), m.rawBody(), 0)
+}
+
+func collectParts(header textproto.MIMEHeader, body []byte, depth int) []part {
+	contentType, params, err := mime.ParseMediaType(header.Get("Content-Type"))
+	if err != nil {
+		contentType = "text/plain"
+	}
+
+	if strings.HasPrefix(contentType, "multipart/") && params["boundary"] != "" && depth < 8 {
+		var (
+			parts  []part
+			reader = multipart.NewReader(bytes.NewReader(body), params["boundary"])
+		)
+
+		for {
+			p, err := reader.NextRawPart()
+			if err != nil {
+				return parts
+			}
+
+			content, err := ioutil.ReadAll(p)
+			if err != nil {
+				return parts
+			}
+
+			parts = append(parts, collectParts(p.Header, content, depth+1)...)
+		}
+	}
+
+	return []part{{
+		contentType: contentType,
+		content:     decodeTransfer(header.Get("Content-Transfer-Encoding"), body),
+	}}
+}
+
+func decodeTransfer(encoding string, body []byte) []byte {
+	var r io.Reader
+
+	switch strings.ToLower(strings.TrimSpace(encoding)) {
+	case "base64":
+		r = base64.NewDecoder(base64.StdEncoding, newlineFilter{bytes.NewReader(body)})
+	case "quoted-printable":
+		r = quotedprintable.NewReader(bytes.NewReader(body))
+	default:
+		return body
+	}
+
+	decoded, err := ioutil.ReadAll(r)
+	if err != nil && len(decoded) == 0 {
+		return body
+	}
+
+	return decoded
+}
+
+// newlineFilter drops line breaks, which the base64 decoder does not accept.
+type newlineFilter struct {
+	r io.Reader
+}
+
+func (f newlineFilter) Read(p []byte) (int, error) {
+	n, err := f.r.Read(p)
+
+	j := 0
+	for _, c := range p[:n] {
+		if c != '\r' && c != '\n' {
+			p[j] = c
+			j++
+		}
+	}
+
+	return j, err
+}
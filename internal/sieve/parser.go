@@ -0,0 +1,485 @@
+// Copyright (C) 2020  Lukas Dietrich <lukas@lukasdietrich.com>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+// Package sieve implements the mail filtering language as specified in
+// RFC#5228 with the extensions listed in Extensions.
+package sieve
+
+import (
+	"fmt"
+	"sort"
+)
+
+// Error is a syntax or semantic error in a script.
+type Error struct {
+	Line    int
+	Message string
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("line %d: %s", e.Line, e.Message)
+}
+
+func errorf(line int, format string, args ...interface{}) error {
+	return &Error{Line: line, Message: fmt.Sprintf(format, args...)}
+}
+
+// Script is a parsed and validated sieve script.
+type Script struct {
+	commands   []*node
+	extensions map[string]bool
+}
+
+// value is a string list or a number argument.
+type value struct {
+	strings []string
+	num     int64
+	number  bool
+}
+
+// argument is either a tag or a value, before tag values are bound.
+type argument struct {
+	tag   string
+	value *value
+	line  int
+}
+
+// node is a command or a test.
+type node struct {
+	name  string
+	line  int
+	tags  map[string]*value
+	args  []*value
+	tests []*node
+	block []*node
+
+	raw []argument
+}
+
+func (n *node) has(tag string) bool {
+	_, ok := n.tags[tag]
+	return ok
+}
+
+// Parse parses and validates a script.
+func Parse(src string) (*Script, error) {
+	l := lexer{src: src, line: 1}
+
+	tokens, err := l.tokens()
+	if err != nil {
+		return nil, err
+	}
+
+	p := parser{tokens: tokens}
+
+	commands, err := p.commands()
+	if err != nil {
+		return nil, err
+	}
+
+	if t := p.peek(); t.kind != tokenEOF {
+		return nil, errorf(t.line, "unexpected %s", t)
+	}
+
+	script := Script{
+		commands:   commands,
+		extensions: make(map[string]bool),
+	}
+
+	if err := script.validate(); err != nil {
+		return nil, err
+	}
+
+	return &script, nil
+}
+
+type parser struct {
+	tokens []token
+	pos    int
+}
+
+func (p *parser) peek() token {
+	return p.tokens[p.pos]
+}
+
+func (p *parser) take() token {
+	t := p.tokens[p.pos]
+	if t.kind != tokenEOF {
+		p.pos++
+	}
+
+	return t
+}
+
+func (p *parser) isPunct(c byte) bool {
+	t := p.peek()
+	return t.kind == tokenPunct && t.punct == c
+}
+
+func (p *parser) expect(c byte) error {
+	if t := p.take(); t.kind != tokenPunct || t.punct != c {
+		return errorf(t.line, "expected %q, got %s", c, t)
+	}
+
+	return nil
+}
+
+// commands = *command
+func (p *parser) commands() ([]*node, error) {
+	var commands []*node
+
+	for p.peek().kind == tokenIdentifier {
+		command, err := p.command()
+		if err != nil {
+			return nil, err
+		}
+
+		commands = append(commands, command)
+	}
+
+	return commands, nil
+}
+
+// command = identifier arguments (";" / block)
+func (p *parser) command() (*node, error) {
+	command, err := p.node()
+	if err != nil {
+		return nil, err
+	}
+
+	if p.isPunct('{') {
+		p.take()
+
+		if command.block, err = p.commands(); err != nil {
+			return nil, err
+		}
+
+		// an empty block is still a block
+		if command.block == nil {
+			command.block = []*node{}
+		}
+
+		return command, p.expect('}')
+	}
+
+	return command, p.expect(';')
+}
+
+// identifier arguments, where arguments = *argument [test / test-list]
+func (p *parser) node() (*node, error) {
+	t := p.take()
+	if t.kind != tokenIdentifier {
+		return nil, errorf(t.line, "expected identifier, got %s", t)
+	}
+
+	n := node{name: t.text, line: t.line}
+
+	for {
+		t := p.peek()
+
+		switch {
+		case t.kind == tokenTag:
+			p.take()
+			n.raw = append(n.raw, argument{tag: t.text, line: t.line})
+
+		case t.kind == tokenNumber:
+			p.take()
+			n.raw = append(n.raw, argument{value: &value{num: t.num, number: true}, line: t.line})
+
+		case t.kind == tokenString || p.isPunct('['):
+			list, err := p.stringList()
+			if err != nil {
+				return nil, err
+			}
+
+			n.raw = append(n.raw, argument{value: &value{strings: list}, line: t.line})
+
+		case t.kind == tokenIdentifier:
+			test, err := p.node()
+			if err != nil {
+				return nil, err
+			}
+
+			n.tests = []*node{test}
+			return &n, nil
+
+		case p.isPunct('('):
+			p.take()
+
+			for {
+				test, err := p.node()
+				if err != nil {
+					return nil, err
+				}
+
+				n.tests = append(n.tests, test)
+
+				if !p.isPunct(',') {
+					break
+				}
+
+				p.take()
+			}
+
+			return &n, p.expect(')')
+
+		default:
+			return &n, nil
+		}
+	}
+}
+
+// string-list = "[" string *("," string) "]" / string
+func (p *parser) stringList() ([]string, error) {
+	if t := p.peek(); t.kind == tokenString {
+		p.take()
+		return []string{t.text}, nil
+	}
+
+	if err := p.expect('['); err != nil {
+		return nil, err
+	}
+
+	var list []string
+
+	for {
+		t := p.take()
+		if t.kind != tokenString {
+			return nil, errorf(t.line, "expected string, got %s", t)
+		}
+
+		list = append(list, t.text)
+
+		if !p.isPunct(',') {
+			break
+		}
+
+		p.take()
+	}
+
+	return list, p.expect(']')
+}
+
+// Extensions are the capabilities supported by the interpreter.
+var Extensions = []string{
+	"body",
+	"comparator-i;ascii-casemap",
+	"comparator-i;octet",
+	"copy",
+	"envelope",
+	"fileinto",
+	"imap4flags",
+	"reject",
+	"subaddress",
+	"vacation",
+}
+
+func isSupported(extension string) bool {
+	i := sort.SearchStrings(Extensions, extension)
+	return i < len(Extensions) && Extensions[i] == extension
+}
+
+func (s *Script) validate() error {
+	requires := true
+
+	for _, command := range s.commands {
+		if command.name != "require" {
+			requires = false
+			continue
+		}
+
+		if !requires {
+			return errorf(command.line, "require must precede other commands")
+		}
+
+		if err := s.bind(command, false); err != nil {
+			return err
+		}
+
+		for _, extension := range command.args[0].strings {
+			if !isSupported(extension) {
+				return errorf(command.line, "unsupported extension %q", extension)
+			}
+
+			s.extensions[extension] = true
+		}
+	}
+
+	return s.validateBlock(s.commands, true)
+}
+
+func (s *Script) validateBlock(commands []*node, topLevel bool) error {
+	var previous string
+
+	for _, command := range commands {
+		switch command.name {
+		case "require":
+			if !topLevel {
+				return errorf(command.line, "require must precede other commands")
+			}
+
+		case "elsif", "else":
+			if previous != "if" && previous != "elsif" {
+				return errorf(command.line, "%s without if", command.name)
+			}
+
+			fallthrough
+
+		default:
+			if err := s.bind(command, false); err != nil {
+				return err
+			}
+		}
+
+		if command.block != nil {
+			if err := s.validateBlock(command.block, false); err != nil {
+				return err
+			}
+		}
+
+		previous = command.name
+	}
+
+	return nil
+}
+
+// bind checks a command or test against its specification and assigns the
+// values of tags.
+func (s *Script) bind(n *node, isTest bool) error {
+	specs := commands
+	kind := "command"
+
+	if isTest {
+		specs = tests
+		kind = "test"
+	}
+
+	spec, ok := specs[n.name]
+	if !ok {
+		return errorf(n.line, "unknown %s %q", kind, n.name)
+	}
+
+	if spec.extension != "" && !s.extensions[spec.extension] {
+		return errorf(n.line, "%s %q requires %q", kind, n.name, spec.extension)
+	}
+
+	n.tags = make(map[string]*value)
+	groups := make(map[string]string)
+
+	for i := 0; i < len(n.raw); i++ {
+		arg := n.raw[i]
+
+		if arg.tag == "" {
+			n.args = append(n.args, arg.value)
+			continue
+		}
+
+		if len(n.args) > 0 {
+			return errorf(arg.line, "tag :%s must precede other arguments", arg.tag)
+		}
+
+		tag, ok := spec.tags[arg.tag]
+		if !ok {
+			return errorf(arg.line, "unknown tag :%s for %q", arg.tag, n.name)
+		}
+
+		if tag.extension != "" && !s.extensions[tag.extension] {
+			return errorf(arg.line, "tag :%s requires %q", arg.tag, tag.extension)
+		}
+
+		if _, ok := n.tags[arg.tag]; ok {
+			return errorf(arg.line, "duplicate tag :%s", arg.tag)
+		}
+
+		if tag.group != "" {
+			if other, ok := groups[tag.group]; ok {
+				return errorf(arg.line, "tag :%s conflicts with :%s", arg.tag, other)
+			}
+
+			groups[tag.group] = arg.tag
+		}
+
+		var v *value
+
+		if tag.value != argNone {
+			if i++; i >= len(n.raw) || n.raw[i].tag != "" || !n.raw[i].value.is(tag.value) {
+				return errorf(arg.line, "tag :%s expects %s", arg.tag, tag.value)
+			}
+
+			v = n.raw[i].value
+		}
+
+		n.tags[arg.tag] = v
+	}
+
+	if len(n.args) != len(spec.args) {
+		return errorf(n.line, "%q expects %d arguments", n.name, len(spec.args))
+	}
+
+	for i, kind := range spec.args {
+		if !n.args[i].is(kind) {
+			return errorf(n.line, "argument %d of %q must be %s", i+1, n.name, kind)
+		}
+	}
+
+	for _, group := range spec.required {
+		if _, ok := groups[group]; !ok {
+			return errorf(n.line, "%q requires a %s tag", n.name, group)
+		}
+	}
+
+	if err := validateComparator(n); err != nil {
+		return err
+	}
+
+	switch {
+	case spec.tests == 1 && len(n.tests) != 1:
+		return errorf(n.line, "%q expects a test", n.name)
+	case spec.tests == -1 && len(n.tests) == 0:
+		return errorf(n.line, "%q expects a list of tests", n.name)
+	case spec.tests == 0 && len(n.tests) > 0:
+		return errorf(n.line, "%q does not accept tests", n.name)
+	}
+
+	if spec.block != (n.block != nil) {
+		if spec.block {
+			return errorf(n.line, "%q expects a block", n.name)
+		}
+
+		return errorf(n.line, "%q does not accept a block", n.name)
+	}
+
+	for _, test := range n.tests {
+		if err := s.bind(test, true); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func validateComparator(n *node) error {
+	c, ok := n.tags["comparator"]
+	if !ok {
+		return nil
+	}
+
+	switch c.strings[0] {
+	case comparatorOctet, comparatorASCIICaseMap:
+		return nil
+	}
+
+	return errorf(n.line, "unsupported comparator %q", c.strings[0])
+}
@@ -0,0 +1,245 @@
+// Copyright (C) 2020  Lukas Dietrich <lukas@lukasdietrich.com>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package sieve
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/lukasdietrich/briefmail/internal/model"
+)
+
+const testMessage = "From: Alice <alice@example.com>\r\n" +
+	"To: bob+lists@example.org, carol@example.net\r\n" +
+	"Subject: =?utf-8?q?Gr=C3=BC=C3=9Fe?= from the list\r\n" +
+	"List-Id: <golang.example.com>\r\n" +
+	"Content-Type: multipart/alternative; boundary=xyz\r\n" +
+	"\r\n" +
+	"--xyz\r\n" +
+	"Content-Type: text/plain\r\n" +
+	"Content-Transfer-Encoding: quoted-printable\r\n" +
+	"\r\n" +
+	"Meet me at the caf=C3=A9.\r\n" +
+	"--xyz\r\n" +
+	"Content-Type: text/html\r\n" +
+	"Content-Transfer-Encoding: base64\r\n" +
+	"\r\n" +
+	"PHA+U2VjcmV0IHBsYW5zPC9wPg==\r\n" +
+	"--xyz--\r\n"
+
+func mustAddress(raw string) *model.Address {
+	addr, err := model.ParseAddress(raw)
+	if err != nil {
+		panic(err)
+	}
+
+	return addr
+}
+
+func execute(t *testing.T, src string) (*Result, error) {
+	script, err := Parse(src)
+	if !assert.Nil(t, err) {
+		return nil, err
+	}
+
+	msg, err := ReadMessage(
+		mustAddress("alice@example.com"),
+		mustAddress("bob+lists@example.org"),
+		int64(len(testMessage)),
+		strings.NewReader(testMessage))
+
+	if !assert.Nil(t, err) {
+		return nil, err
+	}
+
+	return Execute(script, msg)
+}
+
+func TestParseErrors(t *testing.T) {
+	for src, message := range map[string]string{
+		`fileinto "a";`: "line 1: command \"fileinto\" requires \"fileinto\"",
+		"require \"fileinto\";\nkeep;\nrequire \"body\";": "line 3: require must precede other commands",
+		`require "notify";`:     "line 1: unsupported extension \"notify\"",
+		`keep`:                  "line 1: expected ';', got end of script",
+		`else { keep; }`:        "line 1: else without if",
+		`if size 100 { keep; }`: "line 1: \"size\" requires a size tag",
+		`if header :is :contains "a" "b" { keep; }`: "line 1: tag :contains conflicts with :is",
+		`if address :detail "to" "a" { keep; }`:     "line 1: tag :detail requires \"subaddress\"",
+		`if header :comparator "i;foo" "a" "b" {}`:  "line 1: unsupported comparator \"i;foo\"",
+		`redirect;`:             "line 1: \"redirect\" expects 1 arguments",
+		"keep;\n\"unterminated": "line 2: unterminated string",
+	} {
+		_, err := Parse(src)
+		if assert.NotNil(t, err, src) {
+			assert.Equal(t, message, err.Error(), src)
+		}
+	}
+}
+
+func TestParseMultiLine(t *testing.T) {
+	script, err := Parse("require \"reject\";\r\n" +
+		"reject text:\r\n" +
+		"first line\r\n" +
+		"..second line\r\n" +
+		".\r\n" +
+		";\r\n")
+
+	assert.Nil(t, err)
+	assert.Equal(t, "first line\r\n.second line\r\n", script.commands[1].args[0].strings[0])
+}
+
+func TestMatchWildcard(t *testing.T) {
+	assert.True(t, matchWildcard("hello world", "hello*"))
+	assert.True(t, matchWildcard("hello world", "*o w*"))
+	assert.True(t, matchWildcard("hello", "h?llo"))
+	assert.True(t, matchWildcard("a*b", `a\*b`))
+	assert.False(t, matchWildcard("axb", `a\*b`))
+	assert.False(t, matchWildcard("hello", "h?lo"))
+	assert.True(t, matchWildcard("", "*"))
+}
+
+func TestTests(t *testing.T) {
+	for src, expected := range map[string]bool{
+		`header :contains "subject" "grüße"`:                        true,
+		`header :is "subject" "nope"`:                               false,
+		`header :comparator "i;octet" :contains "subject" "GRÜSSE"`: false,
+		`address :domain "from" "example.com"`:                      true,
+		`address :all :is ["to", "cc"] "carol@example.net"`:         true,
+		`address :localpart :matches "to" "bob*"`:                   true,
+		`envelope :detail "to" "lists"`:                             true,
+		`envelope :user "to" "bob"`:                                 true,
+		`envelope :detail "from" ""`:                                false,
+		`exists ["list-id", "from"]`:                                true,
+		`exists ["list-id", "x-spam"]`:                              false,
+		`size :over 100`:                                            true,
+		`size :under 1K`:                                            true,
+		`not true`:                                                  false,
+		`anyof (false, true)`:                                       true,
+		`allof (true, false)`:                                       false,
+		`body :contains "café"`:                                     true,
+		`body :contains "secret"`:                                   true,
+		`body :content "text/plain" :contains "secret"`:             false,
+		`body :raw :contains "PHA+U2VjcmV0"`:                        true,
+		`body :text :contains "PHA+U2VjcmV0"`:                       false,
+	} {
+		src := "require [\"envelope\", \"subaddress\", \"body\", \"fileinto\"];\n" +
+			"if " + src + " { fileinto \"matched\"; }"
+
+		result, err := execute(t, src)
+		if assert.Nil(t, err, src) {
+			_, matched := folders(result)["matched"]
+			assert.Equal(t, expected, matched, src)
+		}
+	}
+}
+
+func folders(result *Result) map[string][]string {
+	m := make(map[string][]string)
+
+	for _, d := range result.Deliveries {
+		m[d.Folder] = d.Flags
+	}
+
+	return m
+}
+
+func TestExecute(t *testing.T) {
+	result, err := execute(t, `
+		require ["fileinto", "copy", "imap4flags"];
+
+		if header :contains "list-id" "golang" {
+			addflag ["\\Seen", "list"];
+			fileinto :copy "Lists";
+			redirect :copy "archive@example.com";
+		} elsif true {
+			discard;
+		} else {
+			discard;
+		}
+
+		removeflag "list";
+		stop;
+		discard;
+	`)
+
+	assert.Nil(t, err)
+	assert.Equal(t, map[string][]string{
+		"Lists": {`\Seen`, "list"},
+		Inbox:   {`\Seen`},
+	}, folders(result))
+	assert.Equal(t, []*model.Address{mustAddress("archive@example.com")}, result.Redirects)
+	assert.False(t, result.Rejected)
+	assert.Nil(t, result.Vacation)
+}
+
+func TestExecuteCancel(t *testing.T) {
+	result, err := execute(t, `
+		require ["fileinto", "imap4flags"];
+		if hasflag "none" { keep; }
+		fileinto "Archive";
+		fileinto "archive";
+		redirect "other@example.com";
+	`)
+
+	assert.Nil(t, err)
+	assert.Equal(t, map[string][]string{"Archive": nil}, folders(result))
+	assert.Len(t, result.Redirects, 1)
+
+	result, err = execute(t, `discard;`)
+	assert.Nil(t, err)
+	assert.Empty(t, result.Deliveries)
+}
+
+func TestExecuteReject(t *testing.T) {
+	result, err := execute(t, `require "reject"; reject "go away";`)
+	assert.Nil(t, err)
+	assert.True(t, result.Rejected)
+	assert.Equal(t, "go away", result.Reject)
+	assert.Empty(t, result.Deliveries)
+
+	_, err = execute(t, `require "reject"; reject "go away"; keep;`)
+	assert.NotNil(t, err)
+
+	_, err = execute(t, `
+		redirect "a@example.com"; redirect "b@example.com";
+		redirect "c@example.com"; redirect "d@example.com";
+		redirect "e@example.com";
+	`)
+	assert.NotNil(t, err)
+}
+
+func TestExecuteVacation(t *testing.T) {
+	result, err := execute(t, `
+		require "vacation";
+		vacation :days 3 :subject "Away" :addresses ["bob@example.org"] "Back soon.";
+	`)
+
+	assert.Nil(t, err)
+	assert.Equal(t, map[string][]string{Inbox: nil}, folders(result))
+
+	if assert.NotNil(t, result.Vacation) {
+		assert.Equal(t, int64(3), result.Vacation.Days)
+		assert.Equal(t, "Away", result.Vacation.Subject)
+		assert.Equal(t, []string{"bob@example.org"}, result.Vacation.Addresses)
+		assert.Equal(t, "Back soon.", result.Vacation.Reason)
+		assert.NotEmpty(t, result.Vacation.Handle)
+	}
+
+	_, err = execute(t, `require "vacation"; vacation "a"; vacation "b";`)
+	assert.NotNil(t, err)
+}
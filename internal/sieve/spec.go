@@ -0,0 +1,200 @@
+// Copyright (C) 2020  Lukas Dietrich <lukas@lukasdietrich.com>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package sieve
+
+type argKind int
+
+const (
+	argNone argKind = iota
+	argString
+	argStringList
+	argNumber
+)
+
+func (k argKind) String() string {
+	switch k {
+	case argString:
+		return "a string"
+	case argStringList:
+		return "a string list"
+	case argNumber:
+		return "a number"
+	}
+
+	return "nothing"
+}
+
+func (v *value) is(kind argKind) bool {
+	switch kind {
+	case argString:
+		return !v.number && len(v.strings) == 1
+	case argStringList:
+		return !v.number
+	case argNumber:
+		return v.number
+	}
+
+	return false
+}
+
+type tagSpec struct {
+	value     argKind
+	group     string
+	extension string
+}
+
+type spec struct {
+	extension string
+	tags      map[string]tagSpec
+	args      []argKind
+	// required lists tag groups of which one tag must be present.
+	required []string
+	// tests is 1 for a single test, -1 for a list of tests and 0 for none.
+	tests int
+	block bool
+}
+
+const (
+	comparatorOctet        = "i;octet"
+	comparatorASCIICaseMap = "i;ascii-casemap"
+)
+
+var (
+	comparatorTags = map[string]tagSpec{
+		"comparator": {value: argString, group: "comparator"},
+	}
+
+	matchTags = map[string]tagSpec{
+		"is":       {group: "match-type"},
+		"contains": {group: "match-type"},
+		"matches":  {group: "match-type"},
+	}
+
+	addressPartTags = map[string]tagSpec{
+		"all":       {group: "address-part"},
+		"localpart": {group: "address-part"},
+		"domain":    {group: "address-part"},
+		"user":      {group: "address-part", extension: "subaddress"},
+		"detail":    {group: "address-part", extension: "subaddress"},
+	}
+
+	bodyTransformTags = map[string]tagSpec{
+		"raw":     {group: "transform"},
+		"content": {value: argStringList, group: "transform"},
+		"text":    {group: "transform"},
+	}
+
+	copyTag = map[string]tagSpec{
+		"copy": {extension: "copy"},
+	}
+
+	flagsTag = map[string]tagSpec{
+		"flags": {value: argStringList, extension: "imap4flags"},
+	}
+)
+
+func mergeTags(sets ...map[string]tagSpec) map[string]tagSpec {
+	merged := make(map[string]tagSpec)
+
+	for _, set := range sets {
+		for name, tag := range set {
+			merged[name] = tag
+		}
+	}
+
+	return merged
+}
+
+var commands = map[string]spec{
+	"require": {args: []argKind{argStringList}},
+	"if":      {tests: 1, block: true},
+	"elsif":   {tests: 1, block: true},
+	"else":    {block: true},
+	"stop":    {},
+	"keep":    {tags: flagsTag},
+	"discard": {},
+
+	"fileinto": {
+		extension: "fileinto",
+		tags:      mergeTags(copyTag, flagsTag),
+		args:      []argKind{argString},
+	},
+	"redirect": {
+		tags: copyTag,
+		args: []argKind{argString},
+	},
+	"reject": {
+		extension: "reject",
+		args:      []argKind{argString},
+	},
+	"vacation": {
+		extension: "vacation",
+		tags: map[string]tagSpec{
+			"days":      {value: argNumber},
+			"subject":   {value: argString},
+			"from":      {value: argString},
+			"addresses": {value: argStringList},
+			"mime":      {},
+			"handle":    {value: argString},
+		},
+		args: []argKind{argString},
+	},
+
+	"setflag":    {extension: "imap4flags", args: []argKind{argStringList}},
+	"addflag":    {extension: "imap4flags", args: []argKind{argStringList}},
+	"removeflag": {extension: "imap4flags", args: []argKind{argStringList}},
+}
+
+var tests = map[string]spec{
+	"address": {
+		tags: mergeTags(comparatorTags, matchTags, addressPartTags),
+		args: []argKind{argStringList, argStringList},
+	},
+	"envelope": {
+		extension: "envelope",
+		tags:      mergeTags(comparatorTags, matchTags, addressPartTags),
+		args:      []argKind{argStringList, argStringList},
+	},
+	"header": {
+		tags: mergeTags(comparatorTags, matchTags),
+		args: []argKind{argStringList, argStringList},
+	},
+	"exists": {args: []argKind{argStringList}},
+	"size": {
+		tags: map[string]tagSpec{
+			"over":  {group: "size"},
+			"under": {group: "size"},
+		},
+		args:     []argKind{argNumber},
+		required: []string{"size"},
+	},
+	"allof": {tests: -1},
+	"anyof": {tests: -1},
+	"not":   {tests: 1},
+	"true":  {},
+	"false": {},
+
+	"body": {
+		extension: "body",
+		tags:      mergeTags(comparatorTags, matchTags, bodyTransformTags),
+		args:      []argKind{argStringList},
+	},
+	"hasflag": {
+		extension: "imap4flags",
+		tags:      mergeTags(comparatorTags, matchTags),
+		args:      []argKind{argStringList},
+	},
+}
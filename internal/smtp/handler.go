@@ -30,7 +30,9 @@ import (
 
 	"github.com/lukasdietrich/briefmail/internal/addressbook"
 	"github.com/lukasdietrich/briefmail/internal/delivery"
+	"github.com/lukasdietrich/briefmail/internal/dkim"
 	"github.com/lukasdietrich/briefmail/internal/model"
+	"github.com/lukasdietrich/briefmail/internal/sasl"
 	"github.com/lukasdietrich/briefmail/internal/smtp/hook"
 	"github.com/lukasdietrich/briefmail/internal/storage"
 )
@@ -73,6 +75,12 @@ func ehlo(hostname string, extensions ...string) handler {
 		s.WriteString(hostname)
 		s.Endline()
 
+		// the available mechanisms depend on whether the connection is
+		// encrypted
+		s.WriteString("250-AUTH ")
+		s.WriteString(strings.Join(sasl.Mechanisms(s.IsTLS()), " "))
+		s.Endline()
+
 		for _, ext := range extensions[1:] {
 			s.WriteString("250-")
 			s.WriteString(ext)
@@ -112,6 +120,8 @@ func rset() handler {
 		s.envelope.From = nil
 		s.envelope.To = nil
 		s.headers = nil
+		s.size = 0
+		s.authenticated = nil
 
 		return s.send(&rOk)
 	}
@@ -140,7 +150,7 @@ func quit() handler {
 // `MAIL` command as specified in RFC#5321 4.1.1.2
 //
 //     "MAIL FROM:<" <Reverse-path> ">" [ SP Parameters ] CRLF
-func mail(book addressbook.Addressbook, maxSize int64, hooks []hook.FromHook) handler {
+func mail(mailman delivery.Mailman, book addressbook.Addressbook, maxSize int64, hooks []hook.FromHook) handler {
 	var (
 		rOk   = reply{250, "noted."}
 		rSize = reply{552, "bit too much"}
@@ -162,45 +172,50 @@ func mail(book addressbook.Addressbook, maxSize int64, hooks []hook.FromHook) ha
 			return err
 		}
 
-		entry := book.Lookup(from)
-
 		if s.isSubmission() {
 			// authenticated connections must send
 			// mails from a local address, which
-			// the current user owns
+			// the current user owns or was granted
+			// to send as
+
+			ok, err := mailman.MaySendAs(*s.mailbox, from)
+			if err != nil {
+				return err
+			}
 
-			if entry == nil ||
-				entry.Kind != addressbook.Local ||
-				*entry.Mailbox != *s.mailbox {
+			if !ok {
 				return s.send(&rAuth)
 			}
 		} else {
 			// unauthenticated connections must send
 			// mails from a remote address
 
-			if entry == nil ||
+			if entry := book.Lookup(from); entry == nil ||
 				entry.Kind == addressbook.Local {
 				return s.send(&rAuth)
 			}
 		}
 
+		var declaredSize int64
+
 		// see RFC#1870 "6. The extended MAIL command"
-		if maxSize > 0 {
-			if size, ok := params["SIZE"]; ok {
-				isize, err := strconv.ParseInt(size, 10, 64)
-				if err != nil {
-					return errCommandSyntax
-				}
+		if size, ok := params["SIZE"]; ok {
+			isize, err := strconv.ParseInt(size, 10, 64)
+			if err != nil {
+				return errCommandSyntax
+			}
 
-				if isize > maxSize {
-					return s.send(&rSize)
-				}
+			if maxSize > 0 && isize > maxSize {
+				return s.send(&rSize)
 			}
+
+			declaredSize = isize
 		}
 
 		var (
-			ip      = net.ParseIP(s.RemoteAddr())
-			headers []hook.HeaderField
+			ip            = net.ParseIP(s.RemoteAddr())
+			headers       []hook.HeaderField
+			authenticated []string
 		)
 
 		for _, hook := range hooks {
@@ -214,10 +229,14 @@ func mail(book addressbook.Addressbook, maxSize int64, hooks []hook.FromHook) ha
 			}
 
 			headers = append(headers, result.Headers...)
+			authenticated = append(authenticated, result.Authenticated...)
 		}
 
 		s.headers = headers
+		s.authenticated = authenticated
 		s.envelope.From = from
+		s.envelope.To = nil
+		s.size = declaredSize
 		s.state = sMail
 
 		return s.send(&rOk)
@@ -231,7 +250,10 @@ func rcpt(mailman delivery.Mailman, book addressbook.Addressbook) handler {
 	var (
 		rOk                = reply{250, "yup, another?"}
 		rTooManyRecipients = reply{452, "that is quite a crowd already!"}
+		rMailboxFull       = reply{452, "4.2.2 mailbox is full, try again later."}
 		rInvalidRecipient  = reply{550, "never heard of that person."}
+		rNotMember         = reply{550, "members only, sorry."}
+		rTooLarge          = reply{552, "5.3.4 message too big for that domain."}
 	)
 
 	return func(s *session, c *command) error {
@@ -265,6 +287,32 @@ func rcpt(mailman delivery.Mailman, book addressbook.Addressbook) handler {
 			return s.send(&rInvalidRecipient)
 		}
 
+		if err := mailman.MayPost(entry, s.envelope.From); err != nil {
+			if err == delivery.ErrNotMember {
+				return s.send(&rNotMember)
+			}
+
+			return err
+		}
+
+		// the declared size is only a hint, so the size and quota are
+		// checked again once the mail was received
+		if err := mailman.CheckSize(to, s.size); err != nil {
+			if err == delivery.ErrMessageTooLarge {
+				return s.send(&rTooLarge)
+			}
+
+			return err
+		}
+
+		if err := mailman.CheckQuota(to, s.size); err != nil {
+			if err == delivery.ErrQuotaExceeded {
+				return s.send(&rMailboxFull)
+			}
+
+			return err
+		}
+
 		s.envelope.To = append(s.envelope.To, to)
 		s.state = sRcpt
 
@@ -275,11 +323,16 @@ func rcpt(mailman delivery.Mailman, book addressbook.Addressbook) handler {
 // `DATA` command as specified in RFC#5321 4.1.1.4
 //
 //     "DATA" CRLF
-func data(mailman delivery.Mailman, cache *storage.Cache, maxSize int64, hooks []hook.DataHook) handler {
+func data(mailman delivery.Mailman, cache *storage.Cache, maxSize int64, alignment string, hooks []hook.DataHook) handler {
 	var (
-		rData = reply{354, "go ahead. period."}
-		rOk   = reply{250, "confirmed transfer."}
-		rSize = reply{552, "I am already full, thanks"}
+		rData       = reply{354, "go ahead. period."}
+		rOk         = reply{250, "confirmed transfer."}
+		rSize       = reply{552, "I am already full, thanks"}
+		rSendAs     = reply{550, "5.7.1 that does not sound like you"}
+		rUnaligned  = reply{550, "5.7.1 that does not sound like anyone from here"}
+		rAlignLater = reply{451, "4.7.5 could not verify that you are from here, try again later"}
+		rFailed     = reply{554, "5.3.0 local error in processing"}
+		rRejected   = reply{550, "5.7.1 nobody wants your mail"}
 	)
 
 	return func(s *session, _ *command) error {
@@ -334,24 +387,147 @@ func data(mailman delivery.Mailman, cache *storage.Cache, maxSize int64, hooks [
 
 		defer entry.Release()
 
+		// recipients, which cannot take the mail, are refused individually
+		// and notified about after the delivery, because a single reply
+		// would refuse the mail for everyone
+		var (
+			accepted []*model.Address
+			refused  []*model.Address
+			reasons  = make(map[string]string)
+			rRefused *reply
+		)
+
+		for _, to := range s.envelope.To {
+			r, err := checkRecipient(mailman, to, entry.Size())
+			if err != nil {
+				return err
+			}
+
+			if r == nil {
+				accepted = append(accepted, to)
+				continue
+			}
+
+			if rRefused == nil {
+				rRefused = r
+			}
+
+			refused = append(refused, to)
+			reasons[to.String()] = fmt.Sprintf("%d %s", r.code, r.text)
+		}
+
+		if len(accepted) == 0 {
+			return s.send(rRefused)
+		}
+
+		r, err = entry.Reader()
+		if err != nil {
+			return err
+		}
+
+		// alignment results are only added by this server
+		changes, err := hook.RemoveFields(r, alignmentHeaderKey)
+		if err != nil {
+			return err
+		}
+
 		var headers []hook.HeaderField
 
-		for _, hook := range hooks {
+		if s.isSubmission() {
 			r, err := entry.Reader()
 			if err != nil {
 				return err
 			}
 
-			result, err := hook(s.isSubmission(), r)
+			ok, err := maySendAsHeader(mailman, *s.mailbox, r)
 			if err != nil {
 				return err
 			}
 
-			if result.Reject {
-				return s.send(&reply{result.Code, result.Text})
+			if !ok {
+				return s.send(&rSendAs)
 			}
+		} else if alignment != alignmentNone {
+			unaligned, err := unalignedSenders(mailman.Addressbook, s.authenticated, entry)
+			temporary := errors.Is(err, dkim.ErrTemporary)
 
-			headers = append(headers, result.Headers...)
+			if err != nil && !temporary {
+				return err
+			}
+
+			if len(unaligned) > 0 {
+				if alignment == alignmentReject {
+					if temporary {
+						return s.send(&rAlignLater)
+					}
+
+					return s.send(&rUnaligned)
+				}
+
+				headers = append(headers, alignmentHeader(unaligned, temporary))
+			}
+		}
+
+		var (
+			replacement []byte
+			discard     bool
+		)
+
+		if len(hooks) > 0 {
+			session, err := s.hookSession(mailman.DB)
+			if err != nil {
+				return err
+			}
+
+			session.To = accepted
+
+			for _, hook := range hooks {
+				r, err := entry.Reader()
+				if err != nil {
+					return err
+				}
+
+				result, err := hook(session, r)
+				if err != nil {
+					return err
+				}
+
+				if result.Reject {
+					return s.send(&reply{result.Code, result.Text})
+				}
+
+				// recipients rejected by a hook are refused like those
+				// without room for the mail
+				if len(result.Refused) > 0 {
+					var remaining []*model.Address
+
+					for _, to := range accepted {
+						rejection, ok := result.Refused[to.String()]
+						if !ok {
+							remaining = append(remaining, to)
+							continue
+						}
+
+						refused = append(refused, to)
+						reasons[to.String()] = fmt.Sprintf("%d %s", rejection.Code, rejection.Text)
+					}
+
+					if len(remaining) == 0 {
+						return s.send(&rRejected)
+					}
+
+					accepted = remaining
+					session.To = accepted
+				}
+
+				headers = append(headers, result.Headers...)
+				changes = append(changes, result.ChangeHeaders...)
+				discard = discard || result.Discard
+
+				if result.Body != nil {
+					replacement = result.Body
+				}
+			}
 		}
 
 		r, err = entry.Reader()
@@ -359,18 +535,61 @@ func data(mailman delivery.Mailman, cache *storage.Cache, maxSize int64, hooks [
 			return err
 		}
 
+		if len(changes) > 0 || replacement != nil {
+			if r, err = hook.Modify(r, changes, replacement); err != nil {
+				return err
+			}
+		}
+
+		if discard {
+			log.WithField("from", s.envelope.From).
+				Info("mail discarded by a hook")
+
+			s.state = sHelo
+			return s.send(&rOk)
+		}
+
 		body = model.Body{Reader: r}
 		for _, header := range headers {
 			body.Prepend(header.Key, header.Value)
 		}
 
-		if err := mailman.Deliver(&s.envelope, body); err != nil {
+		envelope := s.envelope
+		envelope.To = accepted
+
+		failed, err := mailman.DeliverEach(&envelope, body)
+		if err != nil {
 			return err
 		}
 
+		// the mail is accepted, as long as one recipient received it. the
+		// sender is notified about the others like about refused recipients
+		if len(failed) == len(accepted) {
+			return failed[accepted[0].String()]
+		}
+
+		for _, to := range accepted {
+			if failed[to.String()] != nil {
+				refused = append(refused, to)
+				reasons[to.String()] = fmt.Sprintf("%d %s", rFailed.code, rFailed.text)
+			}
+		}
+
 		log.WithField("from", s.envelope.From).
 			Debug("mail successfully received")
 
+		if len(refused) > 0 {
+			r, err := entry.Reader()
+			if err != nil {
+				return err
+			}
+
+			if err := mailman.NotifyRefused(&s.envelope, r, refused, reasons); err != nil {
+				log.WithField("from", s.envelope.From).
+					Warnf("could not notify about refused recipients: %v", err)
+			}
+		}
+
 		s.state = sHelo
 		return s.send(&rOk)
 	}
@@ -406,98 +625,72 @@ func starttls(config *tls.Config) handler {
 // `AUTH` command as specified in RFC#4954
 //
 //     "AUTH" <Mechanism> [ Payload ] CRLF
-func auth(db *storage.DB) handler {
+func auth(creds sasl.Credentials) handler {
 	var (
-		rUsername = reply{334, "VXNlcm5hbWU6"}
-		rPassword = reply{334, "UGFzc3dvcmQ6"}
-		rOk       = reply{235, "I was sure I saw you before."}
-		rFail     = reply{535, "Solid attempt."}
+		rOk          = reply{235, "I was sure I saw you before."}
+		rFail        = reply{535, "Solid attempt."}
+		rCancelled   = reply{501, "fine, keep your secrets."}
+		rUnsupported = reply{504, "never heard of that mechanism."}
 	)
 
 	return func(s *session, c *command) error {
-		if !s.state.in(sHelo) {
+		if !s.state.in(sHelo) || s.mailbox != nil {
 			return errBadSequence
 		}
 
-		var (
-			fields = bytes.Fields(c.tail)
-			name   string
-			pass   string
-		)
-
-		if len(fields) < 1 {
+		fields := bytes.Fields(c.tail)
+		if len(fields) < 1 || len(fields) > 2 {
 			return errCommandSyntax
 		}
 
-		switch strings.ToUpper(string(fields[0])) {
-		case "PLAIN":
-			if len(fields) != 2 {
-				return errCommandSyntax
-			}
+		server, err := sasl.NewServer(string(fields[0]), s.IsTLS(), creds)
+		if err != nil {
+			return s.send(&rUnsupported)
+		}
 
-			b, err := base64.StdEncoding.DecodeString(string(fields[1]))
-			if err != nil {
-				return errCommandSyntax
-			}
+		var response []byte
 
-			fields = bytes.Split(b, []byte{0})
-			if len(fields) != 3 {
+		if len(fields) == 2 {
+			if response, err = sasl.DecodeResponse(fields[1]); err != nil {
 				return errCommandSyntax
 			}
+		}
 
-			if len(fields[0]) > 0 {
-				if !bytes.Equal(fields[0], fields[1]) {
-					return s.send(&rFail)
+		for {
+			challenge, done, err := server.Next(response)
+			if err != nil {
+				if err == sasl.ErrMalformed {
+					return errCommandSyntax
 				}
-			}
-
-			name = string(fields[1])
-			pass = string(fields[2])
-
-		case "LOGIN":
-			if err := s.send(&rUsername); err != nil {
-				return err
-			}
 
-			b, err := s.ReadLine()
-			if err != nil {
 				return err
 			}
 
-			b, err = base64.StdEncoding.DecodeString(string(b))
-			if err != nil {
-				return errCommandSyntax
+			if done {
+				break
 			}
 
-			name = string(b)
-
-			if err := s.send(&rPassword); err != nil {
+			r := reply{334, base64.StdEncoding.EncodeToString(challenge)}
+			if err := s.send(&r); err != nil {
 				return err
 			}
 
-			b, err = s.ReadLine()
+			line, err := s.ReadLine()
 			if err != nil {
 				return err
 			}
 
-			b, err = base64.StdEncoding.DecodeString(string(b))
-			if err != nil {
-				return errCommandSyntax
+			if string(line) == "*" {
+				return s.send(&rCancelled)
 			}
 
-			pass = string(b)
-
-		default:
-			return errCommandSyntax
-		}
-
-		mailbox, ok, err := db.Authenticate(name, pass)
-		if err != nil {
-			return err
+			if response, err = sasl.DecodeResponse(line); err != nil {
+				return errCommandSyntax
+			}
 		}
 
-		if ok {
-			s.mailbox = &mailbox
+		if mailbox := server.Mailbox(); mailbox != nil {
+			s.mailbox = mailbox
 			return s.send(&rOk)
 		}
 
@@ -0,0 +1,105 @@
+// Copyright (C) 2020  Lukas Dietrich <lukas@lukasdietrich.com>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package smtp
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/lukasdietrich/briefmail/internal/storage"
+)
+
+func TestDataRefusesPerRecipient(t *testing.T) {
+	f, cleanup := newFixture(t, "alice", "bob")
+	defer cleanup()
+
+	// bob has room for an empty mail only
+	assert.Nil(t, f.db.SetQuota("bob", &storage.Quota{Size: 1}))
+
+	conn, closeConn := f.dial(t, New(f.mailman, f.book, f.cache, f.db, nil, nil, nil))
+	defer closeConn()
+
+	mail := "From: sender@example.org\r\nSubject: hello\r\n\r\nbody\r\n"
+
+	expect(t, conn, 220, "")
+	expect(t, conn, 250, "EHLO localhost")
+	expect(t, conn, 250, "MAIL FROM:<sender@example.org>")
+	expect(t, conn, 250, "RCPT TO:<alice@example.com>")
+	expect(t, conn, 250, "RCPT TO:<bob@example.com>")
+	expect(t, conn, 354, "DATA")
+
+	send(t, conn, mail)
+	expect(t, conn, 250, "")
+
+	assert.Equal(t, 1, f.entries(t, "alice"))
+	assert.Equal(t, 0, f.entries(t, "bob"))
+
+	// the sender is notified about bob
+	queue, err := f.db.Queue()
+	assert.Nil(t, err)
+
+	if assert.Len(t, queue, 1) && assert.Len(t, queue[0].To, 1) {
+		assert.Equal(t, "sender@example.org", queue[0].To[0].String())
+	}
+
+	// a mail nobody can take is still refused as a whole
+	expect(t, conn, 250, "MAIL FROM:<sender@example.org>")
+	expect(t, conn, 250, "RCPT TO:<bob@example.com>")
+	expect(t, conn, 354, "DATA")
+
+	send(t, conn, mail)
+	expect(t, conn, 452, "")
+
+	queue, err = f.db.Queue()
+	assert.Nil(t, err)
+	assert.Len(t, queue, 1)
+
+	expect(t, conn, 221, "QUIT")
+}
+
+func TestDataNotifiesFailedRecipients(t *testing.T) {
+	f, cleanup := newFixture(t, "alice", "bob")
+	defer cleanup()
+
+	f.mailman.Store = &failingStore{LocalStore: f.mailman.Store, mailbox: f.mailboxes["bob"]}
+
+	conn, closeConn := f.dial(t, New(f.mailman, f.book, f.cache, f.db, nil, nil, nil))
+	defer closeConn()
+
+	expect(t, conn, 220, "")
+	expect(t, conn, 250, "EHLO localhost")
+	expect(t, conn, 250, "MAIL FROM:<sender@example.org>")
+	expect(t, conn, 250, "RCPT TO:<alice@example.com>")
+	expect(t, conn, 250, "RCPT TO:<bob@example.com>")
+	expect(t, conn, 354, "DATA")
+
+	send(t, conn, "From: sender@example.org\r\nSubject: hello\r\n\r\nbody\r\n")
+	expect(t, conn, 250, "")
+
+	assert.Equal(t, 1, f.entries(t, "alice"))
+	assert.Equal(t, 0, f.entries(t, "bob"))
+
+	// the sender is notified about bob instead of losing him silently
+	queue, err := f.db.Queue()
+	assert.Nil(t, err)
+
+	if assert.Len(t, queue, 1) && assert.Len(t, queue[0].To, 1) {
+		assert.Equal(t, "sender@example.org", queue[0].To[0].String())
+	}
+
+	expect(t, conn, 221, "QUIT")
+}
@@ -0,0 +1,224 @@
+// Copyright (C) 2020  Lukas Dietrich <lukas@lukasdietrich.com>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package smtp
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	netmail "net/mail"
+	"strings"
+
+	"github.com/spf13/viper"
+
+	"github.com/lukasdietrich/briefmail/internal/addressbook"
+	"github.com/lukasdietrich/briefmail/internal/delivery"
+	"github.com/lukasdietrich/briefmail/internal/dkim"
+	"github.com/lukasdietrich/briefmail/internal/model"
+	"github.com/lukasdietrich/briefmail/internal/smtp/hook"
+	"github.com/lukasdietrich/briefmail/internal/storage"
+)
+
+// Actions for inbound mails with header senders in local domains, which are
+// not aligned with an authenticated domain.
+const (
+	alignmentNone   = "none"
+	alignmentTag    = "tag"
+	alignmentReject = "reject"
+)
+
+// alignmentHeaderKey is the header field added to mails with unaligned
+// senders. Fields with the key are removed from received mails, so they
+// cannot be forged.
+const alignmentHeaderKey = "X-Briefmail-Alignment"
+
+var (
+	errMissingFrom = errors.New("smtp: missing from header")
+)
+
+func init() {
+	viper.SetDefault("alignment.action", alignmentTag)
+}
+
+// headerAddresses parses the addresses of a header field as specified in
+// RFC#5322 3.6.2. A missing field results in no addresses, while a malformed
+// field or any malformed address in it is an error.
+func headerAddresses(header netmail.Header, key string) ([]*model.Address, error) {
+	list, err := header.AddressList(key)
+	if err != nil {
+		if err == netmail.ErrHeaderNotPresent {
+			return nil, nil
+		}
+
+		return nil, err
+	}
+
+	var addresses []*model.Address
+
+	for _, entry := range list {
+		addr, err := model.ParseAddress(entry.Address)
+		if err != nil {
+			return nil, err
+		}
+
+		addresses = append(addresses, addr)
+	}
+
+	return addresses, nil
+}
+
+// headerSenders returns the addresses of the From and Sender header fields.
+// The From header is required.
+func headerSenders(r io.Reader) ([]*model.Address, error) {
+	msg, err := netmail.ReadMessage(r)
+	if err != nil {
+		return nil, err
+	}
+
+	from, err := headerAddresses(msg.Header, "From")
+	if err != nil {
+		return nil, err
+	}
+
+	if len(from) == 0 {
+		return nil, errMissingFrom
+	}
+
+	sender, err := headerAddresses(msg.Header, "Sender")
+	if err != nil {
+		return nil, err
+	}
+
+	return append(from, sender...), nil
+}
+
+// maySendAsHeader checks the From and Sender header of a submitted mail, so
+// users cannot bypass the envelope check by only changing the header. Mails
+// with a missing From or any malformed sender are rejected, since the senders
+// cannot be verified.
+func maySendAsHeader(mailman delivery.Mailman, mailbox int64, r io.Reader) (bool, error) {
+	senders, err := headerSenders(r)
+	if err != nil {
+		return false, nil
+	}
+
+	for _, sender := range senders {
+		ok, err := mailman.MaySendAs(mailbox, sender)
+		if err != nil || !ok {
+			return false, err
+		}
+	}
+
+	return true, nil
+}
+
+// unalignedSenders returns the header senders of an inbound mail, which claim
+// to be from a local domain without being aligned with the spf authenticated
+// envelope sender or a valid dkim signature. If a dkim key could not be looked
+// up, the unaligned senders are returned with dkim.ErrTemporary.
+func unalignedSenders(book addressbook.Addressbook, authenticated []string, entry *storage.CacheEntry) ([]*model.Address, error) {
+	r, err := entry.Reader()
+	if err != nil {
+		return nil, err
+	}
+
+	senders, err := headerSenders(r)
+	if err != nil {
+		// a malformed header does not claim anything
+		return nil, nil
+	}
+
+	var local []*model.Address
+
+	for _, sender := range senders {
+		if isLocalDomain(book, sender) {
+			local = append(local, sender)
+		}
+	}
+
+	if len(local) == 0 {
+		return nil, nil
+	}
+
+	// dkim is only verified when needed, since it requires dns lookups
+	r, err = entry.Reader()
+	if err != nil {
+		return nil, err
+	}
+
+	signers, err := dkim.Verify(r, dkim.LookupDNS)
+	if err != nil && !errors.Is(err, dkim.ErrTemporary) {
+		return nil, err
+	}
+
+	authenticated = append(append([]string{}, authenticated...), signers...)
+
+	var unaligned []*model.Address
+
+	for _, sender := range local {
+		if !isAligned(sender.Domain, authenticated) {
+			unaligned = append(unaligned, sender)
+		}
+	}
+
+	if len(unaligned) == 0 {
+		return nil, nil
+	}
+
+	return unaligned, err
+}
+
+// isLocalDomain returns true if mails to the domain of an address are
+// delivered by this server. Domains this server is only a backup mx for are
+// not local.
+func isLocalDomain(book addressbook.Addressbook, addr *model.Address) bool {
+	entry := book.Lookup(addr)
+	return entry == nil || (entry.Kind != addressbook.Remote && entry.Kind != addressbook.Relay)
+}
+
+// isAligned checks the relaxed alignment of a domain with any of the
+// authenticated domains. Without a list of public suffixes, the organizational
+// domain is approximated by accepting parent and subdomains.
+func isAligned(domain string, authenticated []string) bool {
+	for _, a := range authenticated {
+		if domain == a ||
+			strings.HasSuffix(domain, "."+a) ||
+			strings.HasSuffix(a, "."+domain) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// alignmentHeader tags a mail with unaligned senders. The result is
+// "temperror" instead of "fail", if a dkim key could not be looked up.
+func alignmentHeader(unaligned []*model.Address, temporary bool) hook.HeaderField {
+	senders := make([]string, len(unaligned))
+	for i, addr := range unaligned {
+		senders[i] = addr.String()
+	}
+
+	result := "fail"
+	if temporary {
+		result = "temperror"
+	}
+
+	return hook.HeaderField{
+		Key:   alignmentHeaderKey,
+		Value: fmt.Sprintf("%s (header.from=%s)", result, strings.Join(senders, ",")),
+	}
+}
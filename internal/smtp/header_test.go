@@ -0,0 +1,79 @@
+// Copyright (C) 2020  Lukas Dietrich <lukas@lukasdietrich.com>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package smtp
+
+import (
+	netmail "net/mail"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestHeaderAddresses(t *testing.T) {
+	msg, err := netmail.ReadMessage(strings.NewReader(
+		"From: Alice <alice@example.com>, bob@example.org\r\n" +
+			"Sender: invalid\r\n" +
+			"\r\n" +
+			"body\r\n"))
+	assert.Nil(t, err)
+
+	addresses, err := headerAddresses(msg.Header, "From")
+	assert.Nil(t, err)
+
+	var from []string
+	for _, addr := range addresses {
+		from = append(from, addr.String())
+	}
+
+	assert.Equal(t, []string{"alice@example.com", "bob@example.org"}, from)
+
+	_, err = headerAddresses(msg.Header, "Sender")
+	assert.NotNil(t, err)
+
+	addresses, err = headerAddresses(msg.Header, "Reply-To")
+	assert.Nil(t, err)
+	assert.Empty(t, addresses)
+}
+
+func TestHeaderSenders(t *testing.T) {
+	for _, header := range []string{
+		"Subject: no sender\r\n",
+		"From: \r\n",
+		"From: alice@example.com, invalid\r\n",
+		"From: alice@example.com\r\nSender: invalid\r\n",
+	} {
+		_, err := headerSenders(strings.NewReader(header + "\r\nbody\r\n"))
+		assert.NotNil(t, err, header)
+	}
+
+	senders, err := headerSenders(strings.NewReader(
+		"From: alice@example.com\r\nSender: bob@example.org\r\n\r\nbody\r\n"))
+
+	assert.Nil(t, err)
+	assert.Len(t, senders, 2)
+}
+
+func TestIsAligned(t *testing.T) {
+	authenticated := []string{"example.com", "mail.example.org"}
+
+	assert.True(t, isAligned("example.com", authenticated))
+	assert.True(t, isAligned("news.example.com", authenticated))
+	assert.True(t, isAligned("example.org", authenticated))
+	assert.False(t, isAligned("other.example.org", authenticated))
+	assert.False(t, isAligned("badexample.com", authenticated))
+	assert.False(t, isAligned("example.com", nil))
+}
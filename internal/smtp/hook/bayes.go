@@ -0,0 +1,69 @@
+// Copyright (C) 2020  Lukas Dietrich <lukas@lukasdietrich.com>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package hook
+
+import (
+	"io"
+
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+
+	"github.com/lukasdietrich/briefmail/internal/bayes"
+	"github.com/lukasdietrich/briefmail/internal/storage"
+)
+
+func makeBayesHook(db *storage.DB) DataHook {
+	var (
+		threshold  = viper.GetFloat64("hook.bayes.threshold")
+		reject     = viper.GetFloat64("hook.bayes.reject")
+		classifier = bayes.New(db)
+	)
+
+	classifier.MinMails = viper.GetInt64("hook.bayes.minMails")
+
+	logrus.Debugf("hook: registering bayes hook (threshold=%.2f, reject=%.2f)", threshold, reject)
+
+	return func(session *Session, r io.Reader) (*Result, error) {
+		if session.Submission {
+			return &Result{}, nil
+		}
+
+		log := logrus.WithField("prefix", "bayes")
+
+		score, err := classifier.Classify(r)
+		if err != nil {
+			if err == bayes.ErrUntrained {
+				log.Debug(err)
+				return &Result{}, nil
+			}
+
+			log.Warn(err)
+			return nil, err
+		}
+
+		log.Debugf("mail scored %.4f", score)
+
+		if reject > 0 && score >= reject {
+			return &Result{
+				Reject: true,
+				Code:   550,
+				Text:   "5.7.1 that smells like spam",
+			}, nil
+		}
+
+		return &Result{Headers: spamHeaders(score >= threshold, score, threshold)}, nil
+	}
+}
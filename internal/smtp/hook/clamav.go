@@ -0,0 +1,177 @@
+// Copyright (C) 2020  Lukas Dietrich <lukas@lukasdietrich.com>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package hook
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+)
+
+const (
+	// clamdChunkSize is the size of the chunks a mail is streamed in.
+	clamdChunkSize = 64 * 1024
+	// clamdHeaderAllowance is added to the mail size limit to account for
+	// headers added after the size was checked.
+	clamdHeaderAllowance = 64 * 1024
+)
+
+var (
+	errClamdResponse = errors.New("clamd: malformed response")
+	errClamdTooLarge = errors.New("clamd: mail exceeds the scan size")
+)
+
+func makeClamavHook() DataHook {
+	var (
+		address = viper.GetString("hook.clamav.address")
+		s       = scanner{
+			name:     "clamav",
+			timeout:  viper.GetDuration("hook.clamav.timeout"),
+			failOpen: viper.GetBool("hook.clamav.failOpen"),
+			maxSize:  viper.GetInt64("hook.clamav.maxSize"),
+		}
+	)
+
+	if s.maxSize <= 0 {
+		// scan every mail, which is accepted at all, including the headers
+		// added on receipt
+		if size := viper.GetInt64("mail.size"); size > 0 {
+			s.maxSize = size + clamdHeaderAllowance
+		}
+	}
+
+	logrus.Debugf("hook: registering clamav hook (address=%s)", address)
+
+	return func(_ *Session, r io.Reader) (*Result, error) {
+		signature, err := s.scanClamd(address, r)
+		if err != nil {
+			if err == errClamdTooLarge && !s.failOpen {
+				return &Result{
+					Reject: true,
+					Code:   552,
+					Text:   "5.3.4 message too big to be scanned",
+				}, nil
+			}
+
+			return s.failure(err)
+		}
+
+		if signature != "" {
+			logrus.WithField("prefix", "clamav").Infof("rejecting mail infected with %s", signature)
+
+			return &Result{
+				Reject: true,
+				Code:   554,
+				Text:   fmt.Sprintf("5.7.1 virus found: %s", signature),
+			}, nil
+		}
+
+		return &Result{}, nil
+	}
+}
+
+// scanClamd streams a mail to clamd using the INSTREAM command and returns
+// the name of the signature found, or an empty string if the mail is clean.
+//
+// see <https://docs.clamav.net/manual/Usage/Scanning.html#instream>
+func (s *scanner) scanClamd(address string, r io.Reader) (string, error) {
+	conn, err := s.dial(address)
+	if err != nil {
+		return "", err
+	}
+
+	defer conn.Close()
+
+	w := bufio.NewWriter(conn)
+
+	// the "z" prefix terminates commands and replies with a null byte
+	if _, err := w.WriteString("zINSTREAM\x00"); err != nil {
+		return "", err
+	}
+
+	var (
+		chunk = make([]byte, clamdChunkSize)
+		size  [4]byte
+		total int64
+	)
+
+	for {
+		n, err := io.ReadFull(r, chunk)
+		if n > 0 {
+			if total += int64(n); s.maxSize > 0 && total > s.maxSize {
+				return "", errClamdTooLarge
+			}
+
+			binary.BigEndian.PutUint32(size[:], uint32(n))
+			w.Write(size[:])   // nolint:errcheck
+			w.Write(chunk[:n]) // nolint:errcheck
+		}
+
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			break
+		}
+
+		if err != nil {
+			return "", err
+		}
+	}
+
+	// a chunk of length zero ends the stream
+	binary.BigEndian.PutUint32(size[:], 0)
+	w.Write(size[:]) // nolint:errcheck
+
+	if err := w.Flush(); err != nil {
+		return "", err
+	}
+
+	reply, err := bufio.NewReader(conn).ReadString('\x00')
+	if err != nil {
+		return "", err
+	}
+
+	return parseClamdReply(strings.TrimSuffix(reply, "\x00"))
+}
+
+// parseClamdReply parses a reply like "stream: OK" or
+// "stream: Eicar-Signature FOUND".
+func parseClamdReply(reply string) (string, error) {
+	i := strings.Index(reply, ": ")
+	if i < 0 {
+		return "", errClamdResponse
+	}
+
+	result := reply[i+2:]
+
+	switch {
+	case result == "OK":
+		return "", nil
+
+	case strings.HasSuffix(result, " FOUND"):
+		return strings.TrimSuffix(result, " FOUND"), nil
+
+	case strings.HasSuffix(result, " ERROR"):
+		return "", fmt.Errorf("clamd: %s", strings.TrimSuffix(result, " ERROR"))
+
+	default:
+		return "", errClamdResponse
+	}
+}
@@ -0,0 +1,111 @@
+// Copyright (C) 2020  Lukas Dietrich <lukas@lukasdietrich.com>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package hook
+
+import (
+	"bufio"
+	"encoding/binary"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// serveClamd answers a single INSTREAM command and returns the received
+// stream.
+func serveClamd(l net.Listener, reply string) <-chan string {
+	var (
+		result = make(chan string, 1)
+		stream strings.Builder
+	)
+
+	serveOnce(l, func(conn net.Conn) {
+		br := bufio.NewReader(conn)
+		if command, err := br.ReadString('\x00'); err != nil || command != "zINSTREAM\x00" {
+			return
+		}
+
+		for {
+			var size [4]byte
+			if _, err := io.ReadFull(br, size[:]); err != nil {
+				return
+			}
+
+			n := binary.BigEndian.Uint32(size[:])
+			if n == 0 {
+				break
+			}
+
+			chunk := make([]byte, n)
+			if _, err := io.ReadFull(br, chunk); err != nil {
+				return
+			}
+
+			stream.Write(chunk)
+		}
+
+		conn.Write([]byte(reply + "\x00")) // nolint:errcheck
+	}, func() {
+		result <- stream.String()
+	})
+
+	return result
+}
+
+func TestScanClamd(t *testing.T) {
+	for reply, expected := range map[string]string{
+		"stream: OK":                    "",
+		"stream: Eicar-Signature FOUND": "Eicar-Signature",
+	} {
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		assert.Nil(t, err)
+
+		s := scanner{name: "clamav", timeout: time.Second}
+		mail := strings.Repeat("x", clamdChunkSize+10)
+		received := serveClamd(l, reply)
+
+		signature, err := s.scanClamd(l.Addr().String(), strings.NewReader(mail))
+		assert.Nil(t, err)
+		assert.Equal(t, expected, signature)
+		assert.Equal(t, mail, <-received)
+
+		l.Close()
+	}
+}
+
+func TestScanClamdTooLarge(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(t, err)
+
+	defer l.Close()
+
+	s := scanner{name: "clamav", timeout: time.Second, maxSize: 4}
+	serveClamd(l, "stream: OK")
+
+	_, err = s.scanClamd(l.Addr().String(), strings.NewReader("12345"))
+	assert.Equal(t, errClamdTooLarge, err)
+}
+
+func TestParseClamdReply(t *testing.T) {
+	_, err := parseClamdReply("stream: INSTREAM size limit exceeded. ERROR")
+	assert.EqualError(t, err, "clamd: INSTREAM size limit exceeded.")
+
+	_, err = parseClamdReply("nonsense")
+	assert.Equal(t, errClamdResponse, err)
+}
@@ -16,6 +16,7 @@
 package hook
 
 import (
+	"errors"
 	"net"
 	"strings"
 
@@ -48,6 +49,11 @@ func makeDnsblHook() FromHook {
 
 		records, err := dns.QueryA(strings.Join(reversed[:], "."))
 
+		// unlisted addresses do not exist in the blacklist zone
+		if errors.Is(err, dns.ErrNotFound) {
+			records, err = nil, nil
+		}
+
 		if err != nil {
 			log.Warn(err)
 			return nil, err
@@ -22,6 +22,7 @@ import (
 	"github.com/spf13/viper"
 
 	"github.com/lukasdietrich/briefmail/internal/model"
+	"github.com/lukasdietrich/briefmail/internal/storage"
 )
 
 func init() {
@@ -29,6 +30,32 @@ func init() {
 
 	viper.SetDefault("hook.dnsbl.enable", false)
 	viper.SetDefault("hook.dnsbl.server", "zen.spamhaus.org")
+
+	viper.SetDefault("hook.bayes.enable", false)
+	viper.SetDefault("hook.bayes.threshold", 0.9)
+	viper.SetDefault("hook.bayes.reject", 0.99)
+	viper.SetDefault("hook.bayes.minMails", 20)
+
+	viper.SetDefault("hook.spamd.enable", false)
+	viper.SetDefault("hook.spamd.address", "127.0.0.1:783")
+	viper.SetDefault("hook.spamd.user", "")
+	viper.SetDefault("hook.spamd.reject", 0)
+	viper.SetDefault("hook.spamd.timeout", "30s")
+	viper.SetDefault("hook.spamd.failOpen", true)
+	viper.SetDefault("hook.spamd.maxSize", 512000)
+
+	viper.SetDefault("hook.rspamd.enable", false)
+	viper.SetDefault("hook.rspamd.url", "http://127.0.0.1:11333")
+	viper.SetDefault("hook.rspamd.password", "")
+	viper.SetDefault("hook.rspamd.timeout", "30s")
+	viper.SetDefault("hook.rspamd.failOpen", true)
+	viper.SetDefault("hook.rspamd.maxSize", 2097152)
+
+	viper.SetDefault("hook.clamav.enable", false)
+	viper.SetDefault("hook.clamav.address", "unix:/run/clamav/clamd.ctl")
+	viper.SetDefault("hook.clamav.timeout", "2m")
+	viper.SetDefault("hook.clamav.failOpen", false)
+	viper.SetDefault("hook.clamav.maxSize", 0)
 }
 
 type HeaderField struct {
@@ -36,16 +63,55 @@ type HeaderField struct {
 	Value string
 }
 
+// HeaderChange modifies the header of a mail. Unlike Result.Headers, the
+// value is kept as is without folding it again.
+type HeaderChange struct {
+	Key   string
+	Value string
+	// Index is the occurrence of the field with the key, counting from 1,
+	// which is replaced by the value. An empty value removes the field.
+	Index int
+	// Insert adds a new field at the position Index among all fields
+	// instead, or at the end if Index is negative.
+	Insert bool
+}
+
 type Result struct {
 	Reject bool
 
 	Headers []HeaderField
 	Code    int
 	Text    string
+
+	// Authenticated are domains the hook verified to be allowed to send the
+	// mail, e.g. the domain of the envelope sender after an spf pass.
+	Authenticated []string
+
+	// Discard accepts the mail without delivering it.
+	Discard bool
+	// ChangeHeaders modify existing header fields of the mail.
+	ChangeHeaders []HeaderChange
+	// Body replaces the body of the mail, unless it is nil.
+	Body []byte
+	// Refused are rejections of single recipients keyed by their address.
+	// The mail is still delivered to all other recipients.
+	Refused map[string]*Result
+}
+
+// Session describes the smtp session a mail was received in.
+type Session struct {
+	Submission bool
+	IP         net.IP
+	Helo       string
+	From       *model.Address
+	To         []*model.Address
+	TLS        bool
+	// User is the name of the authenticated mailbox of a submission.
+	User string
 }
 
 type FromHook func(bool, net.IP, *model.Address) (*Result, error)
-type DataHook func(bool, io.Reader) (*Result, error)
+type DataHook func(*Session, io.Reader) (*Result, error)
 
 func FromHooks() []FromHook {
 	var hooks []FromHook
@@ -62,6 +128,35 @@ func FromHooks() []FromHook {
 	return hooks
 }
 
-func DataHooks() []DataHook {
-	return nil
+func DataHooks(db *storage.DB) ([]DataHook, error) {
+	var hooks []DataHook
+
+	// hooks run in a fixed order, so viruses are rejected before any
+	// spam classifier had to look at them
+	for _, builtin := range []struct {
+		key      string
+		makeHook func() DataHook
+	}{
+		{"clamav", makeClamavHook},
+		{"spamd", makeSpamdHook},
+		{"rspamd", makeRspamdHook},
+		{"bayes", func() DataHook { return makeBayesHook(db) }},
+	} {
+		if viper.GetBool("hook." + builtin.key + ".enable") {
+			hooks = append(hooks, builtin.makeHook())
+		}
+	}
+
+	milters, err := makeMilterHooks()
+	if err != nil {
+		return nil, err
+	}
+
+	policies, err := makePolicyHooks()
+	if err != nil {
+		return nil, err
+	}
+
+	hooks = append(hooks, milters...)
+	return append(hooks, policies...), nil
 }
@@ -0,0 +1,614 @@
+// Copyright (C) 2020  Lukas Dietrich <lukas@lukasdietrich.com>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package hook
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+)
+
+// Commands sent to a milter.
+//
+// see <https://github.com/avar/sendmail-pmilter/blob/master/doc/milter-protocol.txt>
+const (
+	milterCmdBody    = 'B'
+	milterCmdConnect = 'C'
+	milterCmdMacro   = 'D'
+	milterCmdEOB     = 'E'
+	milterCmdHelo    = 'H'
+	milterCmdHeader  = 'L'
+	milterCmdMail    = 'M'
+	milterCmdEOH     = 'N'
+	milterCmdOptNeg  = 'O'
+	milterCmdQuit    = 'Q'
+	milterCmdRcpt    = 'R'
+	milterCmdData    = 'T'
+)
+
+// Responses of a milter.
+const (
+	milterAccept    = 'a'
+	milterContinue  = 'c'
+	milterDiscard   = 'd'
+	milterProgress  = 'p'
+	milterReject    = 'r'
+	milterSkip      = 's'
+	milterTempfail  = 't'
+	milterReplyCode = 'y'
+
+	milterAddHeader    = 'h'
+	milterInsertHeader = 'i'
+	milterChangeHeader = 'm'
+	milterReplaceBody  = 'b'
+)
+
+// Actions a milter may take, of which only header and body changes are
+// supported.
+const (
+	milterActAddHeaders    = 0x01
+	milterActChangeBody    = 0x02
+	milterActChangeHeaders = 0x10
+)
+
+// Protocol flags to skip stages or their replies.
+const (
+	milterNoConnect      = 0x1
+	milterNoHelo         = 0x2
+	milterNoMail         = 0x4
+	milterNoRcpt         = 0x8
+	milterNoBody         = 0x10
+	milterNoHeaders      = 0x20
+	milterNoEOH          = 0x40
+	milterNoReplyHeader  = 0x80
+	milterNoUnknown      = 0x100
+	milterNoData         = 0x200
+	milterSkipBody       = 0x400
+	milterNoReplyConnect = 0x1000
+	milterNoReplyHelo    = 0x2000
+	milterNoReplyMail    = 0x4000
+	milterNoReplyRcpt    = 0x8000
+	milterNoReplyData    = 0x10000
+	milterNoReplyEOH     = 0x40000
+	milterNoReplyBody    = 0x80000
+
+	// milterProtocol are all flags offered to a milter.
+	milterProtocol = milterNoConnect | milterNoHelo | milterNoMail |
+		milterNoRcpt | milterNoBody | milterNoHeaders | milterNoEOH |
+		milterNoReplyHeader | milterNoUnknown | milterNoData |
+		milterSkipBody | milterNoReplyConnect | milterNoReplyHelo |
+		milterNoReplyMail | milterNoReplyRcpt | milterNoReplyData |
+		milterNoReplyEOH | milterNoReplyBody
+)
+
+const (
+	milterVersion = 6
+	// milterChunkSize is the largest body chunk sent at once.
+	milterChunkSize = 65535
+	// maxMilterPacket limits the size of a response.
+	maxMilterPacket = 1024 * 1024
+)
+
+var errMilterResponse = errors.New("milter: unexpected response")
+
+type milterConfig struct {
+	Name     string
+	Address  string
+	Timeout  time.Duration
+	FailOpen bool
+}
+
+func makeMilterHooks() ([]DataHook, error) {
+	var configs []milterConfig
+	if err := viper.UnmarshalKey("hook.milter", &configs); err != nil {
+		return nil, err
+	}
+
+	var (
+		hooks    []DataHook
+		hostname = viper.GetString("general.hostname")
+	)
+
+	for _, config := range configs {
+		hooks = append(hooks, makeMilterHook(config, hostname))
+	}
+
+	return hooks, nil
+}
+
+func makeMilterHook(config milterConfig, hostname string) DataHook {
+	if config.Timeout <= 0 {
+		config.Timeout = time.Minute
+	}
+
+	s := scanner{
+		name:     "milter " + config.Name,
+		timeout:  config.Timeout,
+		failOpen: config.FailOpen,
+	}
+
+	logrus.Debugf("hook: registering milter hook (name=%s, address=%s)", config.Name, config.Address)
+
+	return func(session *Session, r io.Reader) (*Result, error) {
+		conn, err := s.dial(config.Address)
+		if err != nil {
+			return s.failure(err)
+		}
+
+		defer conn.Close()
+
+		m := milter{
+			r:        bufio.NewReader(conn),
+			w:        bufio.NewWriter(conn),
+			hostname: hostname,
+		}
+
+		result, err := m.run(session, r)
+		if err != nil {
+			return s.failure(err)
+		}
+
+		return result, nil
+	}
+}
+
+// milter is the client side of a single milter conversation. Briefmail only
+// calls milters once the mail is complete, so all stages from connect to the
+// end of the body happen during DATA. A rejection of a recipient only refuses
+// that recipient, while a rejection at any other stage rejects the whole mail.
+type milter struct {
+	r        *bufio.Reader
+	w        *bufio.Writer
+	hostname string
+
+	version  uint32
+	protocol uint32
+
+	// refused are the rejections of single recipients by their address.
+	refused map[string]*Result
+}
+
+func (m *milter) run(session *Session, r io.Reader) (*Result, error) {
+	result, err := m.stages(session, r)
+
+	// the conversation is over, but it is polite to say so
+	m.send(milterCmdQuit) // nolint:errcheck
+
+	if stop, ok := err.(*milterStop); ok {
+		result, err = stop.result, nil
+	}
+
+	if result != nil && !result.Reject && len(m.refused) > 0 {
+		result.Refused = m.refused
+	}
+
+	return result, err
+}
+
+func (m *milter) stages(session *Session, r io.Reader) (*Result, error) {
+	if err := m.negotiate(); err != nil {
+		return nil, err
+	}
+
+	if err := m.connect(session); err != nil {
+		return nil, err
+	}
+
+	if session.Helo != "" {
+		err := m.stage(milterCmdHelo, milterNoHelo, milterNoReplyHelo, cstring(session.Helo))
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	mailMacros := []string{"{mail_addr}", session.From.String()}
+	if session.User != "" {
+		mailMacros = append(mailMacros, "{auth_authen}", session.User)
+	}
+
+	if err := m.macros(milterCmdMail, mailMacros...); err != nil {
+		return nil, err
+	}
+
+	err := m.stage(milterCmdMail, milterNoMail, milterNoReplyMail, cstring("<"+session.From.String()+">"))
+	if err != nil {
+		return nil, err
+	}
+
+	for _, to := range session.To {
+		if err := m.macros(milterCmdRcpt, "{rcpt_addr}", to.String()); err != nil {
+			return nil, err
+		}
+
+		err := m.stage(milterCmdRcpt, milterNoRcpt, milterNoReplyRcpt, cstring("<"+to.String()+">"))
+		if stop, ok := err.(*milterStop); ok && stop.result.Reject {
+			if m.refused == nil {
+				m.refused = make(map[string]*Result)
+			}
+
+			m.refused[to.String()] = stop.result
+
+			// the mail is only rejected as a whole, if nobody is left
+			if len(m.refused) == len(session.To) {
+				return nil, stop
+			}
+
+			continue
+		}
+
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if m.version >= 4 {
+		if err := m.stage(milterCmdData, milterNoData, milterNoReplyData); err != nil {
+			return nil, err
+		}
+	}
+
+	fields, body, err := readHeaderFields(r)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, field := range fields {
+		err := m.stage(milterCmdHeader, milterNoHeaders, milterNoReplyHeader,
+			cstring(field.key), cstring(field.value()))
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if err := m.stage(milterCmdEOH, milterNoEOH, milterNoReplyEOH); err != nil {
+		return nil, err
+	}
+
+	// skip the empty line between header and body
+	if _, err := body.ReadBytes('\n'); err != nil && err != io.EOF {
+		return nil, err
+	}
+
+	if err := m.body(body); err != nil {
+		return nil, err
+	}
+
+	if err := m.send(milterCmdEOB); err != nil {
+		return nil, err
+	}
+
+	return m.endOfMessage()
+}
+
+func (m *milter) negotiate() error {
+	var data [12]byte
+	binary.BigEndian.PutUint32(data[0:], milterVersion)
+	binary.BigEndian.PutUint32(data[4:], milterActAddHeaders|milterActChangeBody|milterActChangeHeaders)
+	binary.BigEndian.PutUint32(data[8:], milterProtocol)
+
+	if err := m.send(milterCmdOptNeg, data[:]); err != nil {
+		return err
+	}
+
+	cmd, reply, err := m.read()
+	if err != nil {
+		return err
+	}
+
+	if cmd != milterCmdOptNeg || len(reply) < 12 {
+		return errMilterResponse
+	}
+
+	m.version = binary.BigEndian.Uint32(reply[0:])
+	m.protocol = binary.BigEndian.Uint32(reply[8:]) & milterProtocol
+
+	return nil
+}
+
+func (m *milter) connect(session *Session) error {
+	if err := m.macros(milterCmdConnect, "j", m.hostname, "{daemon_name}", "briefmail"); err != nil {
+		return err
+	}
+
+	var data bytes.Buffer
+
+	if session.IP == nil {
+		data.Write(cstring("localhost"))
+		data.WriteByte('U')
+	} else {
+		data.Write(cstring("[" + session.IP.String() + "]"))
+
+		if session.IP.To4() != nil {
+			data.WriteByte('4')
+		} else {
+			data.WriteByte('6')
+		}
+
+		// the remote port is not known
+		data.Write([]byte{0, 0})
+		data.Write(cstring(session.IP.String()))
+	}
+
+	return m.stage(milterCmdConnect, milterNoConnect, milterNoReplyConnect, data.Bytes())
+}
+
+// macros sends macros, which are available to the milter at the following
+// command.
+func (m *milter) macros(cmd byte, pairs ...string) error {
+	data := []byte{cmd}
+	for _, s := range pairs {
+		data = append(data, cstring(s)...)
+	}
+
+	return m.send(milterCmdMacro, data)
+}
+
+// body sends the body in chunks, until the milter asks to skip the rest.
+func (m *milter) body(r io.Reader) error {
+	if m.protocol&milterNoBody != 0 {
+		return nil
+	}
+
+	chunk := make([]byte, milterChunkSize)
+
+	for {
+		n, err := io.ReadFull(r, chunk)
+		if n > 0 {
+			if err := m.send(milterCmdBody, chunk[:n]); err != nil {
+				return err
+			}
+
+			if m.protocol&milterNoReplyBody == 0 {
+				cmd, data, err := m.reply()
+				if err != nil {
+					return err
+				}
+
+				if cmd == milterSkip {
+					return nil
+				}
+
+				if err := m.decide(cmd, data); err != nil {
+					return err
+				}
+			}
+		}
+
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return nil
+		}
+
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// stage sends a command unless the milter opted out, and waits for the
+// decision unless the milter does not reply to it.
+func (m *milter) stage(cmd byte, skip, noReply uint32, data ...[]byte) error {
+	if m.protocol&skip != 0 {
+		return nil
+	}
+
+	if err := m.send(cmd, data...); err != nil {
+		return err
+	}
+
+	if m.protocol&noReply != 0 {
+		return nil
+	}
+
+	cmd, reply, err := m.reply()
+	if err != nil {
+		return err
+	}
+
+	return m.decide(cmd, reply)
+}
+
+// milterStop ends a conversation early with a decision.
+type milterStop struct {
+	result *Result
+}
+
+func (s *milterStop) Error() string {
+	return "milter: stopped"
+}
+
+// decide continues after a continue response and stops the conversation
+// with any other decision.
+func (m *milter) decide(cmd byte, data []byte) error {
+	if cmd == milterContinue {
+		return nil
+	}
+
+	result, err := milterDecision(cmd, data)
+	if err != nil {
+		return err
+	}
+
+	return &milterStop{result: result}
+}
+
+// endOfMessage collects the modifications up to the final decision.
+func (m *milter) endOfMessage() (*Result, error) {
+	var modifications Result
+
+	for {
+		cmd, data, err := m.reply()
+		if err != nil {
+			return nil, err
+		}
+
+		switch cmd {
+		case milterAddHeader, milterInsertHeader, milterChangeHeader:
+			change, err := parseMilterHeaderChange(cmd, data)
+			if err != nil {
+				return nil, err
+			}
+
+			modifications.ChangeHeaders = append(modifications.ChangeHeaders, *change)
+
+		case milterReplaceBody:
+			if modifications.Body == nil {
+				modifications.Body = []byte{}
+			}
+
+			modifications.Body = append(modifications.Body, data...)
+
+		case milterContinue, milterAccept:
+			return &modifications, nil
+
+		default:
+			return milterDecision(cmd, data)
+		}
+	}
+}
+
+// milterDecision maps a final response to a result.
+func milterDecision(cmd byte, data []byte) (*Result, error) {
+	switch cmd {
+	case milterAccept:
+		return &Result{}, nil
+
+	case milterDiscard:
+		return &Result{Discard: true}, nil
+
+	case milterReject:
+		return &Result{
+			Reject: true,
+			Code:   550,
+			Text:   "5.7.1 command rejected",
+		}, nil
+
+	case milterTempfail:
+		return &Result{
+			Reject: true,
+			Code:   451,
+			Text:   "4.7.1 try again later",
+		}, nil
+
+	case milterReplyCode:
+		// e.g. "554 5.7.1 go away"
+		reply := strings.TrimRight(string(data), "\x00")
+		if len(reply) < 3 {
+			return nil, errMilterResponse
+		}
+
+		code, err := strconv.Atoi(reply[:3])
+		if err != nil || code < 400 || code > 599 {
+			return nil, errMilterResponse
+		}
+
+		return &Result{
+			Reject: true,
+			Code:   code,
+			Text:   strings.TrimSpace(reply[3:]),
+		}, nil
+
+	default:
+		return nil, fmt.Errorf("milter: unexpected response %q", cmd)
+	}
+}
+
+// parseMilterHeaderChange parses a request to add, insert or change a header
+// field. Added fields go to the end of the header.
+func parseMilterHeaderChange(cmd byte, data []byte) (*HeaderChange, error) {
+	change := HeaderChange{Index: -1, Insert: true}
+
+	if cmd != milterAddHeader {
+		if len(data) < 4 {
+			return nil, errMilterResponse
+		}
+
+		change.Index = int(binary.BigEndian.Uint32(data))
+		change.Insert = cmd == milterInsertHeader
+		data = data[4:]
+	}
+
+	parts := bytes.SplitN(bytes.TrimSuffix(data, []byte{0}), []byte{0}, 2)
+	if len(parts) != 2 {
+		return nil, errMilterResponse
+	}
+
+	change.Key = string(parts[0])
+	change.Value = string(parts[1])
+
+	return &change, nil
+}
+
+// reply reads the next response, which is not a progress report.
+func (m *milter) reply() (byte, []byte, error) {
+	for {
+		cmd, data, err := m.read()
+		if err != nil || cmd != milterProgress {
+			return cmd, data, err
+		}
+	}
+}
+
+func (m *milter) send(cmd byte, data ...[]byte) error {
+	length := 1
+	for _, d := range data {
+		length += len(d)
+	}
+
+	var header [5]byte
+	binary.BigEndian.PutUint32(header[:], uint32(length))
+	header[4] = cmd
+
+	m.w.Write(header[:]) // nolint:errcheck
+
+	for _, d := range data {
+		m.w.Write(d) // nolint:errcheck
+	}
+
+	return m.w.Flush()
+}
+
+func (m *milter) read() (byte, []byte, error) {
+	var header [4]byte
+	if _, err := io.ReadFull(m.r, header[:]); err != nil {
+		return 0, nil, err
+	}
+
+	length := binary.BigEndian.Uint32(header[:])
+	if length < 1 || length > maxMilterPacket {
+		return 0, nil, errMilterResponse
+	}
+
+	packet := make([]byte, length)
+	if _, err := io.ReadFull(m.r, packet); err != nil {
+		return 0, nil, err
+	}
+
+	return packet[0], packet[1:], nil
+}
+
+// cstring terminates a string with a null byte.
+func cstring(s string) []byte {
+	return append([]byte(s), 0)
+}
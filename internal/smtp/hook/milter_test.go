@@ -0,0 +1,252 @@
+// Copyright (C) 2020  Lukas Dietrich <lukas@lukasdietrich.com>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package hook
+
+import (
+	"bufio"
+	"encoding/binary"
+	"io"
+	"io/ioutil"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/lukasdietrich/briefmail/internal/model"
+)
+
+type milterPacket struct {
+	cmd  byte
+	data string
+}
+
+// serveMilter runs a fake milter, which answers each command with the
+// packets returned by respond, and returns all received commands.
+func serveMilter(l net.Listener, protocol uint32, respond func(milterPacket) []milterPacket) <-chan []milterPacket {
+	var (
+		result   = make(chan []milterPacket, 1)
+		received []milterPacket
+	)
+
+	serveOnce(l, func(conn net.Conn) {
+		var (
+			r = bufio.NewReader(conn)
+			m = milter{r: r, w: bufio.NewWriter(conn)}
+		)
+
+		for {
+			cmd, data, err := m.read()
+			if err != nil {
+				return
+			}
+
+			packet := milterPacket{cmd: cmd, data: string(data)}
+			if cmd != milterCmdMacro {
+				received = append(received, packet)
+			}
+
+			switch cmd {
+			case milterCmdOptNeg:
+				var reply [12]byte
+				binary.BigEndian.PutUint32(reply[0:], milterVersion)
+				binary.BigEndian.PutUint32(reply[4:], milterActAddHeaders)
+				binary.BigEndian.PutUint32(reply[8:], protocol)
+
+				m.send(milterCmdOptNeg, reply[:]) // nolint:errcheck
+
+			case milterCmdMacro:
+
+			case milterCmdQuit:
+				return
+
+			default:
+				for _, reply := range respond(packet) {
+					m.send(reply.cmd, []byte(reply.data)) // nolint:errcheck
+				}
+			}
+		}
+	}, func() {
+		result <- received
+	})
+
+	return result
+}
+
+func runMilter(t *testing.T, protocol uint32, respond func(milterPacket) []milterPacket) (*Result, []milterPacket) {
+	return runMilterTo(t, []string{"bob@example.org"}, protocol, respond)
+}
+
+func runMilterTo(t *testing.T, recipients []string, protocol uint32, respond func(milterPacket) []milterPacket) (*Result, []milterPacket) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(t, err)
+
+	defer l.Close()
+
+	from, _ := model.ParseAddress("alice@example.com")
+
+	session := Session{
+		IP:   net.ParseIP("192.0.2.1"),
+		Helo: "mx.example.com",
+		From: from,
+	}
+
+	for _, raw := range recipients {
+		to, _ := model.ParseAddress(raw)
+		session.To = append(session.To, to)
+	}
+
+	received := serveMilter(l, protocol, respond)
+	hook := makeMilterHook(milterConfig{Name: "test", Address: l.Addr().String(), Timeout: time.Second}, "localhost")
+
+	result, err := hook(&session, strings.NewReader("Subject: hello\r\nX-Folded: a\r\n\tb\r\n\r\nbody\r\n"))
+	assert.Nil(t, err)
+
+	return result, <-received
+}
+
+func TestMilter(t *testing.T) {
+	result, received := runMilter(t, milterNoReplyHeader, func(p milterPacket) []milterPacket {
+		switch p.cmd {
+		case milterCmdHeader:
+			// headers are not answered
+			return nil
+
+		case milterCmdEOB:
+			return []milterPacket{
+				{cmd: milterProgress},
+				{cmd: milterInsertHeader, data: "\x00\x00\x00\x00Authentication-Results\x00mx; none\x00"},
+				{cmd: milterChangeHeader, data: "\x00\x00\x00\x01Subject\x00[tagged] hello\x00"},
+				{cmd: milterReplaceBody, data: "new body\r\n"},
+				{cmd: milterAccept},
+			}
+
+		default:
+			return []milterPacket{{cmd: milterContinue}}
+		}
+	})
+
+	assert.Equal(t, &Result{
+		ChangeHeaders: []HeaderChange{
+			{Key: "Authentication-Results", Value: "mx; none", Index: 0, Insert: true},
+			{Key: "Subject", Value: "[tagged] hello", Index: 1},
+		},
+		Body: []byte("new body\r\n"),
+	}, result)
+
+	assert.Equal(t, []milterPacket{
+		{cmd: milterCmdOptNeg, data: "\x00\x00\x00\x06\x00\x00\x00\x13" + string(uint32Bytes(milterProtocol))},
+		{cmd: milterCmdConnect, data: "[192.0.2.1]\x004\x00\x00192.0.2.1\x00"},
+		{cmd: milterCmdHelo, data: "mx.example.com\x00"},
+		{cmd: milterCmdMail, data: "<alice@example.com>\x00"},
+		{cmd: milterCmdRcpt, data: "<bob@example.org>\x00"},
+		{cmd: milterCmdData},
+		{cmd: milterCmdHeader, data: "Subject\x00hello\x00"},
+		{cmd: milterCmdHeader, data: "X-Folded\x00a\r\n\tb\x00"},
+		{cmd: milterCmdEOH},
+		{cmd: milterCmdBody, data: "body\r\n"},
+		{cmd: milterCmdEOB},
+		{cmd: milterCmdQuit},
+	}, received)
+}
+
+func TestMilterDecisions(t *testing.T) {
+	for _, test := range []struct {
+		reply    milterPacket
+		expected *Result
+	}{
+		{milterPacket{cmd: milterReject}, &Result{Reject: true, Code: 550, Text: "5.7.1 command rejected"}},
+		{milterPacket{cmd: milterTempfail}, &Result{Reject: true, Code: 451, Text: "4.7.1 try again later"}},
+		{milterPacket{cmd: milterReplyCode, data: "554 5.7.1 go away\x00"}, &Result{Reject: true, Code: 554, Text: "5.7.1 go away"}},
+		{milterPacket{cmd: milterDiscard}, &Result{Discard: true}},
+		{milterPacket{cmd: milterAccept}, &Result{}},
+	} {
+		reply := test.reply
+
+		result, received := runMilter(t, milterNoConnect|milterNoHelo, func(p milterPacket) []milterPacket {
+			if p.cmd == milterCmdRcpt {
+				return []milterPacket{reply}
+			}
+
+			return []milterPacket{{cmd: milterContinue}}
+		})
+
+		assert.Equal(t, test.expected, result)
+
+		// the conversation ends right after the recipient
+		assert.Len(t, received, 4)
+		assert.Equal(t, byte(milterCmdQuit), received[3].cmd)
+	}
+}
+
+func TestMilterRefusesRecipients(t *testing.T) {
+	result, received := runMilterTo(t, []string{"bob@example.org", "carol@example.org"},
+		milterNoConnect|milterNoHelo, func(p milterPacket) []milterPacket {
+			if p.cmd == milterCmdRcpt && p.data == "<bob@example.org>\x00" {
+				return []milterPacket{{cmd: milterReject}}
+			}
+
+			return []milterPacket{{cmd: milterContinue}}
+		})
+
+	// only bob is refused, while the mail goes on for carol
+	assert.Equal(t, &Result{
+		Refused: map[string]*Result{
+			"bob@example.org": {Reject: true, Code: 550, Text: "5.7.1 command rejected"},
+		},
+	}, result)
+
+	assert.Equal(t, byte(milterCmdEOB), received[len(received)-2].cmd)
+
+	// a mail nobody is left for is rejected as a whole
+	result, _ = runMilterTo(t, []string{"bob@example.org", "carol@example.org"},
+		milterNoConnect|milterNoHelo, func(p milterPacket) []milterPacket {
+			if p.cmd == milterCmdRcpt {
+				return []milterPacket{{cmd: milterReject}}
+			}
+
+			return []milterPacket{{cmd: milterContinue}}
+		})
+
+	assert.Equal(t, &Result{Reject: true, Code: 550, Text: "5.7.1 command rejected"}, result)
+}
+
+func TestMilterFailure(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(t, err)
+
+	address := l.Addr().String()
+	l.Close()
+
+	hook := makeMilterHook(milterConfig{Name: "test", Address: address, Timeout: time.Second}, "localhost")
+
+	result, err := hook(&Session{From: model.NilAddress}, strings.NewReader(""))
+	assert.Nil(t, err)
+	assert.Equal(t, 451, result.Code)
+}
+
+func uint32Bytes(n uint32) []byte {
+	var b [4]byte
+	binary.BigEndian.PutUint32(b[:], n)
+	return b[:]
+}
+
+func readAllString(t *testing.T, r io.Reader) string {
+	b, err := ioutil.ReadAll(r)
+	assert.Nil(t, err)
+	return string(b)
+}
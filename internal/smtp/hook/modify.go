@@ -0,0 +1,187 @@
+// Copyright (C) 2020  Lukas Dietrich <lukas@lukasdietrich.com>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package hook
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"strings"
+)
+
+// headerField is a raw header field including folded lines.
+type headerField struct {
+	key string
+	raw []byte
+}
+
+// value returns the value of a field without the leading space, but with
+// folded lines.
+func (f *headerField) value() string {
+	raw := string(f.raw)
+	raw = raw[strings.IndexByte(raw, ':')+1:]
+
+	return strings.TrimLeft(strings.TrimRight(raw, "\r\n"), " \t")
+}
+
+// readHeaderFields reads the header section of a mail up to, but excluding,
+// the empty line. The returned reader continues with the empty line.
+func readHeaderFields(r io.Reader) ([]headerField, *bufio.Reader, error) {
+	var (
+		br     = bufio.NewReader(r)
+		fields []headerField
+	)
+
+	for {
+		next, err := br.Peek(1)
+		if err == io.EOF {
+			return fields, br, nil
+		}
+
+		if err != nil {
+			return nil, nil, err
+		}
+
+		if next[0] == '\r' || next[0] == '\n' {
+			return fields, br, nil
+		}
+
+		line, err := br.ReadBytes('\n')
+		if err != nil && err != io.EOF {
+			return nil, nil, err
+		}
+
+		if (line[0] == ' ' || line[0] == '\t') && len(fields) > 0 {
+			last := &fields[len(fields)-1]
+			last.raw = append(last.raw, line...)
+			continue
+		}
+
+		key := string(line)
+		if i := strings.IndexByte(key, ':'); i >= 0 {
+			key = key[:i]
+		}
+
+		fields = append(fields, headerField{
+			key: strings.TrimSpace(key),
+			raw: line,
+		})
+	}
+}
+
+// RemoveFields returns changes removing all fields with the key from the
+// header of a mail.
+func RemoveFields(r io.Reader, key string) ([]HeaderChange, error) {
+	fields, _, err := readHeaderFields(r)
+	if err != nil {
+		return nil, err
+	}
+
+	var changes []HeaderChange
+
+	for _, field := range fields {
+		// removed fields are no longer counted, so the first one is
+		// removed each time
+		if strings.EqualFold(field.key, key) {
+			changes = append(changes, HeaderChange{Key: key, Index: 1})
+		}
+	}
+
+	return changes, nil
+}
+
+// Modify applies header changes to a mail and replaces its body, unless body
+// is nil.
+func Modify(r io.Reader, changes []HeaderChange, body []byte) (io.Reader, error) {
+	fields, br, err := readHeaderFields(r)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, change := range changes {
+		if change.Insert {
+			fields = insertHeaderField(fields, change)
+		} else {
+			fields = replaceHeaderField(fields, change)
+		}
+	}
+
+	var header bytes.Buffer
+	for _, field := range fields {
+		header.Write(field.raw)
+	}
+
+	if body == nil {
+		return io.MultiReader(&header, br), nil
+	}
+
+	return io.MultiReader(&header, strings.NewReader("\r\n"), bytes.NewReader(body)), nil
+}
+
+// insertHeaderField inserts a new field at a position or at the end.
+func insertHeaderField(fields []headerField, change HeaderChange) []headerField {
+	field := headerField{key: change.Key, raw: formatHeaderField(change.Key, change.Value)}
+
+	if change.Index < 0 || change.Index >= len(fields) {
+		return append(fields, field)
+	}
+
+	fields = append(fields, headerField{})
+	copy(fields[change.Index+1:], fields[change.Index:])
+	fields[change.Index] = field
+
+	return fields
+}
+
+// replaceHeaderField replaces a field or adds it, if there are not enough
+// fields with the key.
+func replaceHeaderField(fields []headerField, change HeaderChange) []headerField {
+	var count int
+
+	for i := range fields {
+		// removed fields are no longer counted
+		if fields[i].raw == nil || !strings.EqualFold(fields[i].key, change.Key) {
+			continue
+		}
+
+		if count++; count == change.Index {
+			fields[i].raw = formatHeaderField(change.Key, change.Value)
+			return fields
+		}
+	}
+
+	if change.Value == "" {
+		return fields
+	}
+
+	return append(fields, headerField{
+		key: change.Key,
+		raw: formatHeaderField(change.Key, change.Value),
+	})
+}
+
+// formatHeaderField formats a header field with crlf line endings, keeping
+// folded lines. An empty value results in no field at all.
+func formatHeaderField(key, value string) []byte {
+	if value == "" {
+		return nil
+	}
+
+	value = strings.ReplaceAll(value, "\r\n", "\n")
+	value = strings.ReplaceAll(value, "\n", "\r\n")
+
+	return []byte(key + ": " + strings.TrimLeft(value, " ") + "\r\n")
+}
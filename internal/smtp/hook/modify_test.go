@@ -0,0 +1,77 @@
+// Copyright (C) 2020  Lukas Dietrich <lukas@lukasdietrich.com>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package hook
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestModify(t *testing.T) {
+	mail := "Received: from a\r\n" +
+		"Subject: hello\r\n" +
+		"X-Tag: one\r\n" +
+		"X-Tag: two\r\n" +
+		"\t folded\r\n" +
+		"\r\n" +
+		"body\r\n"
+
+	r, err := Modify(strings.NewReader(mail), []HeaderChange{
+		{Key: "x-tag", Index: 1},
+		{Key: "X-Tag", Index: 1, Value: "three"},
+		{Key: "Subject", Index: 2, Value: "added"},
+		{Key: "X-Missing", Index: 1},
+		{Key: "Authentication-Results", Index: 1, Value: "mx;\n\tnone", Insert: true},
+		{Key: "X-Last", Index: -1, Value: "last", Insert: true},
+	}, nil)
+
+	assert.Nil(t, err)
+	assert.Equal(t, "Received: from a\r\n"+
+		"Authentication-Results: mx;\r\n\tnone\r\n"+
+		"Subject: hello\r\n"+
+		"X-Tag: three\r\n"+
+		"Subject: added\r\n"+
+		"X-Last: last\r\n"+
+		"\r\n"+
+		"body\r\n", readAllString(t, r))
+}
+
+func TestModifyBody(t *testing.T) {
+	r, err := Modify(strings.NewReader("Subject: hello\r\n\r\nbody\r\n"), nil, []byte("replaced\r\n"))
+	assert.Nil(t, err)
+	assert.Equal(t, "Subject: hello\r\n\r\nreplaced\r\n", readAllString(t, r))
+}
+
+func TestRemoveFields(t *testing.T) {
+	mail := "X-Briefmail-Alignment: pass\r\n" +
+		"Subject: hello\r\n" +
+		"x-briefmail-alignment: pass\r\n" +
+		"\t folded\r\n" +
+		"\r\n" +
+		"X-Briefmail-Alignment: body\r\n"
+
+	changes, err := RemoveFields(strings.NewReader(mail), "X-Briefmail-Alignment")
+	assert.Nil(t, err)
+	assert.Len(t, changes, 2)
+
+	r, err := Modify(strings.NewReader(mail), changes, nil)
+	assert.Nil(t, err)
+	assert.Equal(t, "Subject: hello\r\n"+
+		"\r\n"+
+		"X-Briefmail-Alignment: body\r\n", readAllString(t, r))
+}
@@ -0,0 +1,332 @@
+// Copyright (C) 2020  Lukas Dietrich <lukas@lukasdietrich.com>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package hook
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+)
+
+const (
+	policyAccept   = "accept"
+	policyReject   = "reject"
+	policyTempfail = "tempfail"
+
+	// maxPolicyResponse limits the size of a policy response.
+	maxPolicyResponse = 64 * 1024
+)
+
+var (
+	errPolicyConfig = errors.New("policy: either url or command is required")
+	errPolicyHeader = errors.New("policy: invalid header field")
+	errPolicyText   = errors.New("policy: text must not contain line breaks")
+)
+
+type policyConfig struct {
+	Name string
+	// URL receives a json description of the session.
+	URL string
+	// Headers adds the header of the mail to the description.
+	Headers bool
+	// Command receives the mail on stdin and the session as environment.
+	Command  []string
+	Timeout  time.Duration
+	FailOpen bool
+}
+
+// policyRequest is the json description of a session posted to a url.
+type policyRequest struct {
+	IP         string         `json:"ip"`
+	Helo       string         `json:"helo"`
+	From       string         `json:"from"`
+	Recipients []string       `json:"recipients"`
+	TLS        bool           `json:"tls"`
+	Submission bool           `json:"submission"`
+	User       string         `json:"user,omitempty"`
+	Headers    []policyHeader `json:"headers,omitempty"`
+}
+
+type policyHeader struct {
+	Key   string `json:"key"`
+	Value string `json:"value"`
+}
+
+// policyResponse is the decision of a policy. An empty response accepts the
+// mail.
+type policyResponse struct {
+	Action  string         `json:"action"`
+	Code    int            `json:"code"`
+	Text    string         `json:"text"`
+	Headers []policyHeader `json:"headers"`
+}
+
+func makePolicyHooks() ([]DataHook, error) {
+	var configs []policyConfig
+	if err := viper.UnmarshalKey("hook.policy", &configs); err != nil {
+		return nil, err
+	}
+
+	var hooks []DataHook
+
+	for _, config := range configs {
+		hook, err := makePolicyHook(config)
+		if err != nil {
+			return nil, fmt.Errorf("policy %s: %w", config.Name, err)
+		}
+
+		hooks = append(hooks, hook)
+	}
+
+	return hooks, nil
+}
+
+func makePolicyHook(config policyConfig) (DataHook, error) {
+	if (config.URL == "") == (len(config.Command) == 0) {
+		return nil, errPolicyConfig
+	}
+
+	if config.Timeout <= 0 {
+		config.Timeout = time.Minute
+	}
+
+	s := scanner{
+		name:     "policy " + config.Name,
+		timeout:  config.Timeout,
+		failOpen: config.FailOpen,
+	}
+
+	var check policyCheck
+	if config.URL != "" {
+		check = s.httpPolicy(config.URL, config.Headers)
+	} else {
+		check = s.execPolicy(config.Command)
+	}
+
+	logrus.Debugf("hook: registering policy hook (name=%s)", config.Name)
+
+	return func(session *Session, r io.Reader) (*Result, error) {
+		response, err := check(session, r)
+		if err != nil {
+			return s.failure(err)
+		}
+
+		result, err := response.result()
+		if err != nil {
+			return s.failure(err)
+		}
+
+		return result, nil
+	}, nil
+}
+
+type policyCheck func(*Session, io.Reader) (*policyResponse, error)
+
+// httpPolicy posts the session as json to a url and expects a json response.
+func (s *scanner) httpPolicy(url string, withHeaders bool) policyCheck {
+	client := http.Client{Timeout: s.timeout}
+
+	return func(session *Session, r io.Reader) (*policyResponse, error) {
+		request := newPolicyRequest(session)
+
+		if withHeaders {
+			fields, _, err := readHeaderFields(r)
+			if err != nil {
+				return nil, err
+			}
+
+			for _, field := range fields {
+				request.Headers = append(request.Headers, policyHeader{
+					Key:   field.key,
+					Value: field.value(),
+				})
+			}
+		}
+
+		body, err := json.Marshal(request)
+		if err != nil {
+			return nil, err
+		}
+
+		res, err := client.Post(url, "application/json", bytes.NewReader(body))
+		if err != nil {
+			return nil, err
+		}
+
+		defer res.Body.Close()
+
+		// any successful status is an answer, e.g. 204 without a body
+		// accepts the mail
+		if res.StatusCode < 200 || res.StatusCode > 299 {
+			return nil, fmt.Errorf("policy: %s", res.Status)
+		}
+
+		return parsePolicyResponse(res.Body)
+	}
+}
+
+// execPolicy runs a command with the mail on stdin and the session in
+// environment variables prefixed with "BRIEFMAIL_". The command writes its
+// json response to stdout.
+func (s *scanner) execPolicy(command []string) policyCheck {
+	return func(session *Session, r io.Reader) (*policyResponse, error) {
+		ctx, cancel := context.WithTimeout(context.Background(), s.timeout)
+		defer cancel()
+
+		var stdout, stderr bytes.Buffer
+
+		cmd := exec.CommandContext(ctx, command[0], command[1:]...)
+		cmd.Stdin = r
+		cmd.Stdout = &stdout
+		cmd.Stderr = &stderr
+		cmd.Env = append(os.Environ(), policyEnvironment(session)...)
+
+		if err := cmd.Run(); err != nil {
+			return nil, fmt.Errorf("%v: %s", err, strings.TrimSpace(stderr.String()))
+		}
+
+		return parsePolicyResponse(&stdout)
+	}
+}
+
+func newPolicyRequest(session *Session) *policyRequest {
+	request := policyRequest{
+		Helo:       session.Helo,
+		TLS:        session.TLS,
+		Submission: session.Submission,
+		User:       session.User,
+		Recipients: []string{},
+	}
+
+	if session.IP != nil {
+		request.IP = session.IP.String()
+	}
+
+	if session.From != nil {
+		request.From = session.From.String()
+	}
+
+	for _, to := range session.To {
+		request.Recipients = append(request.Recipients, to.String())
+	}
+
+	return &request
+}
+
+func policyEnvironment(session *Session) []string {
+	request := newPolicyRequest(session)
+
+	return []string{
+		"BRIEFMAIL_IP=" + request.IP,
+		"BRIEFMAIL_HELO=" + request.Helo,
+		"BRIEFMAIL_FROM=" + request.From,
+		"BRIEFMAIL_RECIPIENTS=" + strings.Join(request.Recipients, " "),
+		fmt.Sprintf("BRIEFMAIL_TLS=%t", request.TLS),
+		fmt.Sprintf("BRIEFMAIL_SUBMISSION=%t", request.Submission),
+		"BRIEFMAIL_USER=" + request.User,
+	}
+}
+
+func parsePolicyResponse(r io.Reader) (*policyResponse, error) {
+	b, err := ioutil.ReadAll(io.LimitReader(r, maxPolicyResponse))
+	if err != nil {
+		return nil, err
+	}
+
+	var response policyResponse
+
+	if len(bytes.TrimSpace(b)) == 0 {
+		return &response, nil
+	}
+
+	return &response, json.Unmarshal(b, &response)
+}
+
+// result maps the response to a result. Codes not matching the action are
+// replaced by a default. Header fields and texts, which would break out of
+// their line in the mail or the smtp reply, are refused.
+func (p *policyResponse) result() (*Result, error) {
+	if strings.ContainsAny(p.Text, "\r\n") {
+		return nil, errPolicyText
+	}
+
+	var headers []HeaderField
+	for _, header := range p.Headers {
+		if !isFieldName(header.Key) || strings.ContainsAny(header.Value, "\r\n") {
+			return nil, errPolicyHeader
+		}
+
+		headers = append(headers, HeaderField{Key: header.Key, Value: header.Value})
+	}
+
+	switch p.Action {
+	case policyAccept, "":
+		return &Result{Headers: headers}, nil
+
+	case policyReject:
+		return policyRejection(p, 500, 550, "5.7.1 rejected by policy"), nil
+
+	case policyTempfail:
+		return policyRejection(p, 400, 451, "4.7.1 try again later"), nil
+
+	default:
+		return nil, fmt.Errorf("policy: unknown action %q", p.Action)
+	}
+}
+
+func policyRejection(p *policyResponse, class, code int, text string) *Result {
+	if p.Code >= class && p.Code < class+100 {
+		code = p.Code
+	}
+
+	if p.Text != "" {
+		text = p.Text
+	}
+
+	return &Result{
+		Reject: true,
+		Code:   code,
+		Text:   text,
+	}
+}
+
+// isFieldName returns true if the key is a header field name as specified in
+// RFC#5322, i.e. printable ascii characters except the colon.
+func isFieldName(key string) bool {
+	if key == "" {
+		return false
+	}
+
+	for i := 0; i < len(key); i++ {
+		if c := key[i]; c < 33 || c > 126 || c == ':' {
+			return false
+		}
+	}
+
+	return true
+}
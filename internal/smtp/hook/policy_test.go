@@ -0,0 +1,158 @@
+// Copyright (C) 2020  Lukas Dietrich <lukas@lukasdietrich.com>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package hook
+
+import (
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/lukasdietrich/briefmail/internal/model"
+)
+
+func policySession() *Session {
+	from, _ := model.ParseAddress("alice@example.com")
+	to, _ := model.ParseAddress("bob@example.org")
+
+	return &Session{
+		IP:   net.ParseIP("192.0.2.1"),
+		Helo: "mx.example.com",
+		From: from,
+		To:   []*model.Address{to},
+		TLS:  true,
+	}
+}
+
+func TestHTTPPolicy(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var request policyRequest
+		assert.Nil(t, json.NewDecoder(r.Body).Decode(&request))
+
+		assert.Equal(t, policyRequest{
+			IP:         "192.0.2.1",
+			Helo:       "mx.example.com",
+			From:       "alice@example.com",
+			Recipients: []string{"bob@example.org"},
+			TLS:        true,
+			Headers:    []policyHeader{{Key: "Subject", Value: "hello"}},
+		}, request)
+
+		w.Write([]byte(`{ "headers": [ { "key": "X-Policy", "value": "checked" } ] }`)) // nolint:errcheck
+	}))
+
+	defer server.Close()
+
+	hook, err := makePolicyHook(policyConfig{Name: "test", URL: server.URL, Headers: true})
+	assert.Nil(t, err)
+
+	result, err := hook(policySession(), strings.NewReader("Subject: hello\r\n\r\nbody\r\n"))
+	assert.Nil(t, err)
+	assert.Equal(t, &Result{Headers: []HeaderField{{Key: "X-Policy", Value: "checked"}}}, result)
+}
+
+func TestHTTPPolicyNoContent(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	}))
+
+	defer server.Close()
+
+	hook, err := makePolicyHook(policyConfig{Name: "test", URL: server.URL})
+	assert.Nil(t, err)
+
+	result, err := hook(policySession(), strings.NewReader("Subject: hello\r\n\r\nbody\r\n"))
+	assert.Nil(t, err)
+	assert.Equal(t, &Result{}, result)
+}
+
+func TestExecPolicy(t *testing.T) {
+	hook, err := makePolicyHook(policyConfig{
+		Name: "test",
+		Command: []string{"sh", "-c", `
+			grep -q "^Subject: spam" || exit 0
+			printf '{ "action": "reject", "text": "5.7.1 %s" }' "$BRIEFMAIL_FROM"
+		`},
+		Timeout: 5 * time.Second,
+	})
+
+	assert.Nil(t, err)
+
+	result, err := hook(policySession(), strings.NewReader("Subject: hello\r\n\r\n"))
+	assert.Nil(t, err)
+	assert.Equal(t, &Result{}, result)
+
+	result, err = hook(policySession(), strings.NewReader("Subject: spam\r\n\r\n"))
+	assert.Nil(t, err)
+	assert.Equal(t, &Result{Reject: true, Code: 550, Text: "5.7.1 alice@example.com"}, result)
+}
+
+func TestPolicyFailure(t *testing.T) {
+	hook, err := makePolicyHook(policyConfig{Name: "test", Command: []string{"false"}})
+	assert.Nil(t, err)
+
+	result, err := hook(policySession(), strings.NewReader(""))
+	assert.Nil(t, err)
+	assert.Equal(t, 451, result.Code)
+
+	_, err = makePolicyHook(policyConfig{Name: "test"})
+	assert.Equal(t, errPolicyConfig, err)
+}
+
+func TestPolicyResult(t *testing.T) {
+	for _, test := range []struct {
+		response policyResponse
+		expected *Result
+	}{
+		{policyResponse{Action: "accept"}, &Result{}},
+		{policyResponse{Action: "reject"}, &Result{Reject: true, Code: 550, Text: "5.7.1 rejected by policy"}},
+		{policyResponse{Action: "reject", Code: 554, Text: "go away"}, &Result{Reject: true, Code: 554, Text: "go away"}},
+		{policyResponse{Action: "tempfail", Code: 550}, &Result{Reject: true, Code: 451, Text: "4.7.1 try again later"}},
+	} {
+		result, err := test.response.result()
+		assert.Nil(t, err)
+		assert.Equal(t, test.expected, result)
+	}
+
+	_, err := (&policyResponse{Action: "maybe"}).result()
+	assert.NotNil(t, err)
+}
+
+func TestPolicyResultInjection(t *testing.T) {
+	for _, test := range []struct {
+		response policyResponse
+		expected error
+	}{
+		{policyResponse{Action: "reject", Text: "go away\r\n250 ok"}, errPolicyText},
+		{policyResponse{Headers: []policyHeader{{Key: "X-Spam\r\nBcc", Value: "x"}}}, errPolicyHeader},
+		{policyResponse{Headers: []policyHeader{{Key: "X-Spam", Value: "yes\r\nBcc: x@example.com"}}}, errPolicyHeader},
+		{policyResponse{Headers: []policyHeader{{Key: "X Spam", Value: "yes"}}}, errPolicyHeader},
+		{policyResponse{Headers: []policyHeader{{Key: "X-Spam:", Value: "yes"}}}, errPolicyHeader},
+		{policyResponse{Headers: []policyHeader{{Key: "", Value: "yes"}}}, errPolicyHeader},
+	} {
+		_, err := test.response.result()
+		assert.Equal(t, test.expected, err, test.response)
+	}
+
+	result, err := (&policyResponse{Headers: []policyHeader{{Key: "X-Spam", Value: "yes"}}}).result()
+	assert.Nil(t, err)
+	assert.Equal(t, []HeaderField{{Key: "X-Spam", Value: "yes"}}, result.Headers)
+}
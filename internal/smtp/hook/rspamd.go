@@ -0,0 +1,212 @@
+// Copyright (C) 2020  Lukas Dietrich <lukas@lukasdietrich.com>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package hook
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+)
+
+// rspamd actions, which are mapped to results of the hook.
+//
+// see <https://rspamd.com/doc/architecture/protocol.html>
+const (
+	rspamdReject     = "reject"
+	rspamdSoftReject = "soft reject"
+	rspamdGreylist   = "greylist"
+	rspamdRewrite    = "rewrite subject"
+	rspamdAddHeader  = "add header"
+)
+
+type rspamdResponse struct {
+	Action        string  `json:"action"`
+	Score         float64 `json:"score"`
+	RequiredScore float64 `json:"required_score"`
+	Milter        struct {
+		AddHeaders map[string]json.RawMessage `json:"add_headers"`
+	} `json:"milter"`
+}
+
+func makeRspamdHook() DataHook {
+	var (
+		url      = strings.TrimSuffix(viper.GetString("hook.rspamd.url"), "/") + "/checkv2"
+		password = viper.GetString("hook.rspamd.password")
+		s        = scanner{
+			name:     "rspamd",
+			timeout:  viper.GetDuration("hook.rspamd.timeout"),
+			failOpen: viper.GetBool("hook.rspamd.failOpen"),
+			maxSize:  viper.GetInt64("hook.rspamd.maxSize"),
+		}
+		client = http.Client{Timeout: s.timeout}
+	)
+
+	logrus.Debugf("hook: registering rspamd hook (url=%s)", url)
+
+	return func(session *Session, r io.Reader) (*Result, error) {
+		if session.Submission {
+			return &Result{}, nil
+		}
+
+		mail, ok, err := s.read(r)
+		if err != nil {
+			return nil, err
+		}
+
+		if !ok {
+			return &Result{}, nil
+		}
+
+		response, err := checkRspamd(&client, url, password, session, mail)
+		if err != nil {
+			return s.failure(err)
+		}
+
+		logrus.WithField("prefix", "rspamd").
+			Debugf("mail scored %.2f/%.2f (%s)", response.Score, response.RequiredScore, response.Action)
+
+		return response.result(), nil
+	}
+}
+
+// result maps the action chosen by rspamd to a result. Subjects cannot be
+// rewritten, so mails are only tagged instead.
+func (r *rspamdResponse) result() *Result {
+	switch r.Action {
+	case rspamdReject:
+		return &Result{
+			Reject: true,
+			Code:   550,
+			Text:   "5.7.1 that smells like spam",
+		}
+
+	case rspamdSoftReject, rspamdGreylist:
+		return &Result{
+			Reject: true,
+			Code:   451,
+			Text:   "4.7.1 try again later",
+		}
+	}
+
+	spam := r.Action == rspamdRewrite || r.Action == rspamdAddHeader
+	headers := spamHeaders(spam, r.Score, r.RequiredScore)
+
+	keys := make([]string, 0, len(r.Milter.AddHeaders))
+	for key := range r.Milter.AddHeaders {
+		keys = append(keys, key)
+	}
+
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		for _, value := range rspamdHeaderValues(r.Milter.AddHeaders[key]) {
+			headers = append(headers, HeaderField{Key: key, Value: value})
+		}
+	}
+
+	return &Result{Headers: headers}
+}
+
+// rspamdHeaderValues decodes the value of a header added by rspamd, which is
+// either a string, an object with a value or a list of both.
+func rspamdHeaderValues(raw json.RawMessage) []string {
+	var (
+		value  string
+		object struct {
+			Value string `json:"value"`
+		}
+		list []json.RawMessage
+	)
+
+	switch {
+	case json.Unmarshal(raw, &value) == nil:
+		return []string{value}
+
+	case json.Unmarshal(raw, &list) == nil:
+		var values []string
+		for _, elem := range list {
+			values = append(values, rspamdHeaderValues(elem)...)
+		}
+
+		return values
+
+	case json.Unmarshal(raw, &object) == nil && object.Value != "":
+		return []string{object.Value}
+
+	default:
+		return nil
+	}
+}
+
+func checkRspamd(
+	client *http.Client,
+	url, password string,
+	session *Session,
+	mail []byte,
+) (*rspamdResponse, error) {
+	req, err := http.NewRequest(http.MethodPost, url, bytes.NewReader(mail))
+	if err != nil {
+		return nil, err
+	}
+
+	if password != "" {
+		req.Header.Set("Password", password)
+	}
+
+	// the envelope is passed as headers of the request
+	if session.IP != nil {
+		req.Header.Set("IP", session.IP.String())
+	}
+
+	req.Header.Set("Helo", session.Helo)
+
+	if session.From != nil {
+		req.Header.Set("From", session.From.String())
+	}
+
+	for _, to := range session.To {
+		req.Header.Add("Rcpt", to.String())
+	}
+
+	if session.User != "" {
+		req.Header.Set("User", session.User)
+	}
+
+	res, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("rspamd: %s", res.Status)
+	}
+
+	var response rspamdResponse
+	if err := json.NewDecoder(res.Body).Decode(&response); err != nil {
+		return nil, err
+	}
+
+	return &response, nil
+}
@@ -0,0 +1,95 @@
+// Copyright (C) 2020  Lukas Dietrich <lukas@lukasdietrich.com>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package hook
+
+import (
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/lukasdietrich/briefmail/internal/model"
+)
+
+func TestCheckRspamd(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+
+		assert.Equal(t, "/checkv2", r.URL.Path)
+		assert.Equal(t, "secret", r.Header.Get("Password"))
+		assert.Equal(t, "192.0.2.1", r.Header.Get("IP"))
+		assert.Equal(t, "mx.example.com", r.Header.Get("Helo"))
+		assert.Equal(t, "alice@example.com", r.Header.Get("From"))
+		assert.Equal(t, []string{"bob@example.org", "carol@example.org"}, r.Header["Rcpt"])
+		assert.Equal(t, "Subject: hello\r\n\r\n", string(body))
+
+		w.Write([]byte(`{
+			"action": "add header",
+			"score": 7.5,
+			"required_score": 15,
+			"milter": {
+				"add_headers": {
+					"X-Spamd-Bar": "+++++++",
+					"X-Rspamd-Server": { "value": "mx", "order": 0 }
+				}
+			}
+		}`)) // nolint:errcheck
+	}))
+
+	defer server.Close()
+
+	from, _ := model.ParseAddress("alice@example.com")
+	bob, _ := model.ParseAddress("bob@example.org")
+	carol, _ := model.ParseAddress("carol@example.org")
+
+	session := Session{
+		IP:   net.ParseIP("192.0.2.1"),
+		Helo: "mx.example.com",
+		From: from,
+		To:   []*model.Address{bob, carol},
+	}
+
+	response, err := checkRspamd(server.Client(), server.URL+"/checkv2", "secret",
+		&session, []byte("Subject: hello\r\n\r\n"))
+
+	assert.Nil(t, err)
+	assert.Equal(t, &Result{
+		Headers: []HeaderField{
+			{Key: "X-Spam-Score", Value: "7.50"},
+			{Key: "X-Spam-Status", Value: "Yes, score=7.50 required=15.00"},
+			{Key: "X-Rspamd-Server", Value: "mx"},
+			{Key: "X-Spamd-Bar", Value: "+++++++"},
+		},
+	}, response.result())
+}
+
+func TestRspamdActions(t *testing.T) {
+	for action, code := range map[string]int{
+		rspamdReject:     550,
+		rspamdSoftReject: 451,
+		rspamdGreylist:   451,
+		rspamdRewrite:    0,
+		rspamdAddHeader:  0,
+		"no action":      0,
+	} {
+		result := (&rspamdResponse{Action: action}).result()
+		assert.Equal(t, code != 0, result.Reject, action)
+		assert.Equal(t, code, result.Code, action)
+	}
+}
@@ -0,0 +1,110 @@
+// Copyright (C) 2020  Lukas Dietrich <lukas@lukasdietrich.com>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package hook
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// scanner holds the settings shared by hooks, which pass a mail to an
+// external scanner.
+type scanner struct {
+	name     string
+	timeout  time.Duration
+	failOpen bool
+	maxSize  int64
+}
+
+// read reads a mail for scanning. False is returned for mails larger than
+// the size limit, which are not scanned at all.
+func (s *scanner) read(r io.Reader) ([]byte, bool, error) {
+	if s.maxSize <= 0 {
+		b, err := ioutil.ReadAll(r)
+		return b, true, err
+	}
+
+	b, err := ioutil.ReadAll(io.LimitReader(r, s.maxSize+1))
+	if err != nil {
+		return nil, false, err
+	}
+
+	return b, int64(len(b)) <= s.maxSize, nil
+}
+
+// dial connects to an address, which is either "host:port" or "unix:"
+// followed by the path of a socket. The deadline covers the whole exchange.
+func (s *scanner) dial(address string) (net.Conn, error) {
+	network := "tcp"
+
+	if strings.HasPrefix(address, "unix:") {
+		network, address = "unix", strings.TrimPrefix(address, "unix:")
+	}
+
+	conn, err := net.DialTimeout(network, address, s.timeout)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := conn.SetDeadline(time.Now().Add(s.timeout)); err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	return conn, nil
+}
+
+// failure decides what happens to a mail, which could not be scanned. Fail
+// open accepts the mail unscanned, while fail closed asks the client to try
+// again later.
+func (s *scanner) failure(err error) (*Result, error) {
+	logrus.WithField("prefix", s.name).Warnf("could not scan mail: %v", err)
+
+	if s.failOpen {
+		return &Result{}, nil
+	}
+
+	return &Result{
+		Reject: true,
+		Code:   451,
+		Text:   "4.7.1 could not scan your mail, try again later",
+	}, nil
+}
+
+// spamHeaders describes the verdict of a spam filter.
+func spamHeaders(spam bool, score, required float64) []HeaderField {
+	status := "No"
+	if spam {
+		status = "Yes"
+	}
+
+	return []HeaderField{
+		{
+			Key:   "X-Spam-Score",
+			Value: fmt.Sprintf("%.2f", score),
+		},
+		{
+			Key:   "X-Spam-Status",
+			Value: fmt.Sprintf("%s, score=%.2f required=%.2f", status, score, required),
+		},
+	}
+}
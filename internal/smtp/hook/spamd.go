@@ -0,0 +1,192 @@
+// Copyright (C) 2020  Lukas Dietrich <lukas@lukasdietrich.com>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package hook
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"net/textproto"
+	"strconv"
+	"strings"
+
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+)
+
+var errSpamdResponse = errors.New("spamd: malformed response")
+
+// spamdVerdict is the result of a spamd check.
+type spamdVerdict struct {
+	spam     bool
+	score    float64
+	required float64
+	headers  []HeaderField
+}
+
+func makeSpamdHook() DataHook {
+	var (
+		address = viper.GetString("hook.spamd.address")
+		user    = viper.GetString("hook.spamd.user")
+		reject  = viper.GetFloat64("hook.spamd.reject")
+		s       = scanner{
+			name:     "spamd",
+			timeout:  viper.GetDuration("hook.spamd.timeout"),
+			failOpen: viper.GetBool("hook.spamd.failOpen"),
+			maxSize:  viper.GetInt64("hook.spamd.maxSize"),
+		}
+	)
+
+	logrus.Debugf("hook: registering spamd hook (address=%s)", address)
+
+	return func(session *Session, r io.Reader) (*Result, error) {
+		if session.Submission {
+			return &Result{}, nil
+		}
+
+		mail, ok, err := s.read(r)
+		if err != nil {
+			return nil, err
+		}
+
+		if !ok {
+			return &Result{}, nil
+		}
+
+		verdict, err := s.checkSpamd(address, user, mail)
+		if err != nil {
+			return s.failure(err)
+		}
+
+		logrus.WithField("prefix", "spamd").Debugf("mail scored %.2f/%.2f", verdict.score, verdict.required)
+
+		if verdict.spam && reject > 0 && verdict.score >= reject {
+			return &Result{
+				Reject: true,
+				Code:   550,
+				Text:   "5.7.1 that smells like spam",
+			}, nil
+		}
+
+		if len(verdict.headers) == 0 {
+			verdict.headers = spamHeaders(verdict.spam, verdict.score, verdict.required)
+		}
+
+		return &Result{Headers: verdict.headers}, nil
+	}
+}
+
+// checkSpamd sends a mail to spamd using the HEADERS command, which returns
+// the verdict and the headers spamassassin would add.
+//
+// see <https://spamassassin.apache.org/full/3.4.x/doc/spamd.html>
+func (s *scanner) checkSpamd(address, user string, mail []byte) (*spamdVerdict, error) {
+	conn, err := s.dial(address)
+	if err != nil {
+		return nil, err
+	}
+
+	defer conn.Close()
+
+	w := bufio.NewWriter(conn)
+
+	fmt.Fprintf(w, "HEADERS SPAMC/1.5\r\n")
+	fmt.Fprintf(w, "Content-length: %d\r\n", len(mail))
+
+	if user != "" {
+		fmt.Fprintf(w, "User: %s\r\n", user)
+	}
+
+	fmt.Fprintf(w, "\r\n")
+	w.Write(mail) // nolint:errcheck
+
+	if err := w.Flush(); err != nil {
+		return nil, err
+	}
+
+	tr := textproto.NewReader(bufio.NewReader(conn))
+
+	// e.g. "SPAMD/1.1 0 EX_OK"
+	status, err := tr.ReadLine()
+	if err != nil {
+		return nil, err
+	}
+
+	fields := strings.Fields(status)
+	if len(fields) < 2 || !strings.HasPrefix(fields[0], "SPAMD/") {
+		return nil, errSpamdResponse
+	}
+
+	if fields[1] != "0" {
+		return nil, fmt.Errorf("spamd: %s", strings.Join(fields[1:], " "))
+	}
+
+	header, err := tr.ReadMIMEHeader()
+	if err != nil && err != io.EOF {
+		return nil, err
+	}
+
+	verdict, err := parseSpamdVerdict(header.Get("Spam"))
+	if err != nil {
+		return nil, err
+	}
+
+	// the body is the header of the mail as modified by spamassassin
+	modified, err := tr.ReadMIMEHeader()
+	if err != nil && err != io.EOF {
+		return nil, err
+	}
+
+	for _, key := range []string{"X-Spam-Flag", "X-Spam-Level", "X-Spam-Status"} {
+		for _, value := range modified[key] {
+			verdict.headers = append(verdict.headers, HeaderField{Key: key, Value: value})
+		}
+	}
+
+	return verdict, nil
+}
+
+// parseSpamdVerdict parses a spam header, e.g. "True ; 15.0 / 5.0".
+func parseSpamdVerdict(value string) (*spamdVerdict, error) {
+	parts := strings.SplitN(value, ";", 2)
+	if len(parts) != 2 {
+		return nil, errSpamdResponse
+	}
+
+	scores := strings.SplitN(parts[1], "/", 2)
+	if len(scores) != 2 {
+		return nil, errSpamdResponse
+	}
+
+	score, err := strconv.ParseFloat(strings.TrimSpace(scores[0]), 64)
+	if err != nil {
+		return nil, errSpamdResponse
+	}
+
+	required, err := strconv.ParseFloat(strings.TrimSpace(scores[1]), 64)
+	if err != nil {
+		return nil, errSpamdResponse
+	}
+
+	spam := strings.TrimSpace(parts[0])
+
+	return &spamdVerdict{
+		spam:     strings.EqualFold(spam, "True") || strings.EqualFold(spam, "Yes"),
+		score:    score,
+		required: required,
+	}, nil
+}
@@ -0,0 +1,120 @@
+// Copyright (C) 2020  Lukas Dietrich <lukas@lukasdietrich.com>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package hook
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"net/textproto"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// serveSpamd answers a single HEADERS request with a spam header and returns
+// the received mail.
+func serveSpamd(l net.Listener, spam string) <-chan string {
+	var (
+		result = make(chan string, 1)
+		mail   []byte
+	)
+
+	serveOnce(l, func(conn net.Conn) {
+		tr := textproto.NewReader(bufio.NewReader(conn))
+		tr.ReadLine() // nolint:errcheck
+
+		header, _ := tr.ReadMIMEHeader()
+		length, _ := strconv.Atoi(header.Get("Content-Length"))
+
+		mail = make([]byte, length)
+		io.ReadFull(tr.R, mail) // nolint:errcheck
+
+		headers := "X-Spam-Flag: YES\r\nX-Spam-Status: Yes, score=15.0 required=5.0\r\n\ttests=PILLS\r\n\r\n"
+		fmt.Fprintf(conn, "SPAMD/1.1 0 EX_OK\r\nContent-length: %d\r\nSpam: %s\r\n\r\n%s",
+			len(headers), spam, headers)
+	}, func() {
+		result <- string(mail)
+	})
+
+	return result
+}
+
+func TestCheckSpamd(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(t, err)
+
+	defer l.Close()
+
+	s := scanner{name: "spamd", timeout: time.Second}
+	received := serveSpamd(l, "True ; 15.0 / 5.0")
+
+	verdict, err := s.checkSpamd(l.Addr().String(), "", []byte("Subject: pills\r\n\r\n"))
+	assert.Nil(t, err)
+	assert.Equal(t, "Subject: pills\r\n\r\n", <-received)
+	assert.Equal(t, &spamdVerdict{
+		spam:     true,
+		score:    15,
+		required: 5,
+		headers: []HeaderField{
+			{Key: "X-Spam-Flag", Value: "YES"},
+			{Key: "X-Spam-Status", Value: "Yes, score=15.0 required=5.0 tests=PILLS"},
+		},
+	}, verdict)
+}
+
+func TestParseSpamdVerdict(t *testing.T) {
+	verdict, err := parseSpamdVerdict("False ; 1.2 / 5.0")
+	assert.Nil(t, err)
+	assert.Equal(t, &spamdVerdict{score: 1.2, required: 5}, verdict)
+
+	for _, invalid := range []string{"", "True", "True ; 1.0", "True ; x / 5.0"} {
+		_, err := parseSpamdVerdict(invalid)
+		assert.Equal(t, errSpamdResponse, err, invalid)
+	}
+}
+
+func TestScannerFailure(t *testing.T) {
+	s := scanner{name: "test", failOpen: true}
+
+	result, err := s.failure(io.ErrUnexpectedEOF)
+	assert.Nil(t, err)
+	assert.False(t, result.Reject)
+
+	s.failOpen = false
+
+	result, err = s.failure(io.ErrUnexpectedEOF)
+	assert.Nil(t, err)
+	assert.True(t, result.Reject)
+	assert.Equal(t, 451, result.Code)
+}
+
+func TestScannerRead(t *testing.T) {
+	s := scanner{maxSize: 4}
+
+	b, ok, err := s.read(strings.NewReader("1234"))
+	assert.Nil(t, err)
+	assert.True(t, ok)
+	assert.Equal(t, "1234", string(b))
+
+	_, ok, err = s.read(strings.NewReader("12345"))
+	assert.Nil(t, err)
+	assert.False(t, ok)
+}
@@ -54,8 +54,14 @@ func makeSpfHook() FromHook {
 			}, nil
 		}
 
+		var authenticated []string
+		if result == spf.Pass {
+			authenticated = append(authenticated, from.Domain)
+		}
+
 		return &Result{
-			Reject: false,
+			Reject:        false,
+			Authenticated: authenticated,
 			Headers: []HeaderField{
 				{
 					Key: "Received-SPF",
@@ -0,0 +1,360 @@
+// Copyright (C) 2020  Lukas Dietrich <lukas@lukasdietrich.com>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package smtp
+
+import (
+	"crypto/tls"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"strconv"
+	"time"
+
+	"github.com/spf13/viper"
+
+	"github.com/lukasdietrich/briefmail/internal/addressbook"
+	"github.com/lukasdietrich/briefmail/internal/delivery"
+	"github.com/lukasdietrich/briefmail/internal/model"
+	"github.com/lukasdietrich/briefmail/internal/storage"
+)
+
+// LMTPProto is the protocol implementation of an lmtp server, which delivers
+// mails handed over by another mta to local mailboxes.
+//
+// see RFC#2033
+type LMTPProto struct {
+	Proto
+}
+
+// NewLMTP creates a new Protocol instance to be used with a textproto Server
+func NewLMTP(
+	mailman delivery.Mailman,
+	addressbook addressbook.Addressbook,
+	cache *storage.Cache,
+	tlsConfig *tls.Config,
+) *LMTPProto {
+	var (
+		hostname = viper.GetString("general.hostname")
+		maxSize  = viper.GetInt64("mail.size")
+	)
+
+	return &LMTPProto{
+		Proto: Proto{
+			handlerMap: map[string]handler{
+				"LHLO": lhlo(hostname, tlsConfig != nil,
+					fmt.Sprintf("SIZE %d", maxSize),
+				),
+
+				"MAIL": lmtpMail(maxSize),
+				"RCPT": lmtpRcpt(mailman, addressbook),
+				"DATA": lmtpData(mailman, cache, maxSize),
+
+				"NOOP": noop(),
+				"RSET": rset(),
+				"VRFY": vrfy(),
+				"QUIT": quit(),
+
+				"STARTTLS": starttls(tlsConfig),
+			},
+		},
+	}
+}
+
+// `LHLO` command as specified in RFC#2033 4.1
+//
+//     "LHLO" SP <Domain OR address-literal> CRLF
+func lhlo(hostname string, offerTLS bool, extensions ...string) handler {
+	extensions = append(extensions, "8BITMIME", "PIPELINING", "ENHANCEDSTATUSCODES")
+
+	// nolint:errcheck
+	return func(s *session, c *command) error {
+		s.state = sHelo
+		s.envelope.Helo = string(c.tail)
+
+		s.SetWriteTimeout(time.Minute * 5)
+
+		s.WriteString("250-")
+		s.WriteString(hostname)
+		s.Endline()
+
+		if offerTLS && !s.IsTLS() {
+			s.WriteString("250-STARTTLS")
+			s.Endline()
+		}
+
+		for i, ext := range extensions {
+			if i < len(extensions)-1 {
+				s.WriteString("250-")
+			} else {
+				s.WriteString("250 ")
+			}
+
+			s.WriteString(ext)
+			s.Endline()
+		}
+
+		return s.Flush()
+	}
+}
+
+// `MAIL` command as specified in RFC#2033 4.2. The mta handing over the mail
+// already checked the sender, so any sender is accepted.
+//
+//     "MAIL FROM:<" <Reverse-path> ">" [ SP Parameters ] CRLF
+func lmtpMail(maxSize int64) handler {
+	var (
+		rOk   = reply{250, "2.1.0 noted."}
+		rSize = reply{552, "5.3.4 bit too much"}
+	)
+
+	return func(s *session, c *command) error {
+		if !s.state.in(sHelo) {
+			return errBadSequence
+		}
+
+		arg, params, err := c.args("FROM")
+		if err != nil {
+			return err
+		}
+
+		from, err := model.ParseAddress(arg)
+		if err != nil {
+			return err
+		}
+
+		var declaredSize int64
+
+		if size, ok := params["SIZE"]; ok {
+			if declaredSize, err = strconv.ParseInt(size, 10, 64); err != nil {
+				return errCommandSyntax
+			}
+
+			if maxSize > 0 && declaredSize > maxSize {
+				return s.send(&rSize)
+			}
+		}
+
+		s.envelope.From = from
+		s.envelope.To = nil
+		s.size = declaredSize
+		s.state = sMail
+
+		return s.send(&rOk)
+	}
+}
+
+// `RCPT` command as specified in RFC#2033 4.2. Only local mailboxes are
+// accepted.
+//
+//     "RCPT TO:<" <Forward-path> ">" [ SP Parameters ] CRLF
+func lmtpRcpt(mailman delivery.Mailman, book addressbook.Addressbook) handler {
+	var (
+		rOk                = reply{250, "2.1.5 yup, another?"}
+		rTooManyRecipients = reply{452, "4.5.3 that is quite a crowd already!"}
+		rInvalidRecipient  = reply{550, "5.1.1 never heard of that person."}
+	)
+
+	return func(s *session, c *command) error {
+		if !s.state.in(sMail, sRcpt) {
+			return errBadSequence
+		}
+
+		if len(s.envelope.To) > 100 {
+			return s.send(&rTooManyRecipients)
+		}
+
+		arg, _, err := c.args("TO")
+		if err != nil {
+			return err
+		}
+
+		to, err := model.ParseAddress(arg)
+		if err != nil {
+			return err
+		}
+
+		if entry := book.Lookup(to); entry == nil || entry.Kind != addressbook.Local {
+			return s.send(&rInvalidRecipient)
+		}
+
+		if r, err := checkRecipient(mailman, to, s.size); r != nil || err != nil {
+			if err != nil {
+				return err
+			}
+
+			return s.send(r)
+		}
+
+		s.envelope.To = append(s.envelope.To, to)
+		s.state = sRcpt
+
+		return s.send(&rOk)
+	}
+}
+
+var (
+	rRecipientFull     = reply{452, "4.2.2 mailbox is full, try again later."}
+	rRecipientTooLarge = reply{552, "5.3.4 message too big for that domain."}
+)
+
+// checkRecipient returns a negative reply, if a mail of the given size cannot
+// be delivered to a local recipient.
+func checkRecipient(mailman delivery.Mailman, to *model.Address, size int64) (*reply, error) {
+	if err := mailman.CheckSize(to, size); err != nil {
+		if err == delivery.ErrMessageTooLarge {
+			return &rRecipientTooLarge, nil
+		}
+
+		return nil, err
+	}
+
+	if err := mailman.CheckQuota(to, size); err != nil {
+		if err == delivery.ErrQuotaExceeded {
+			return &rRecipientFull, nil
+		}
+
+		return nil, err
+	}
+
+	return nil, nil
+}
+
+// `DATA` command as specified in RFC#2033 4.2. After the mail is received, a
+// reply is sent for each recipient.
+//
+//     "DATA" CRLF
+func lmtpData(mailman delivery.Mailman, cache *storage.Cache, maxSize int64) handler {
+	var (
+		rData   = reply{354, "go ahead. period."}
+		rOk     = reply{250, "2.0.0 delivered."}
+		rSize   = reply{552, "5.3.4 I am already full, thanks"}
+		rFailed = reply{451, "4.3.0 local error in processing"}
+	)
+
+	return func(s *session, _ *command) error {
+		if !s.state.in(sRcpt) {
+			return errBadSequence
+		}
+
+		if err := s.send(&rData); err != nil {
+			return err
+		}
+
+		if err := s.SetReadTimeout(time.Minute * 10); err != nil {
+			return err
+		}
+
+		s.envelope.Date = time.Now()
+
+		var (
+			r       = s.DotReader()
+			lr      = r
+			to      = s.envelope.To
+			replies = make([]*reply, len(to))
+		)
+
+		// the next transaction starts from scratch, regardless of the
+		// outcome of this one
+		s.envelope.To = nil
+		s.state = sHelo
+
+		if maxSize > 0 {
+			// limit reader to the allowed size plus a little extra
+			lr = &limitedReader{r, maxSize + 1024}
+		}
+
+		body := model.Body{Reader: lr}
+		body.Prepend("Received", fmt.Sprintf("from %s by (briefmail) with LMTP; %s",
+			s.envelope.Helo,
+			s.envelope.Date.Format(time.RFC1123Z)))
+
+		entry, err := cache.Write(body)
+		if err != nil {
+			if err != errReaderLimitReached {
+				return err
+			}
+
+			// discard remaining bytes (but not forever) to flush the
+			// input stream
+			if _, err := io.Copy(ioutil.Discard, &limitedReader{r, maxSize}); err != nil {
+				return err
+			}
+
+			for i := range replies {
+				replies[i] = &rSize
+			}
+
+			return sendAll(s, replies)
+		}
+
+		defer entry.Release()
+
+		var accepted []*model.Address
+
+		for i, addr := range to {
+			if replies[i], err = checkRecipient(mailman, addr, entry.Size()); err != nil {
+				return err
+			}
+
+			if replies[i] == nil {
+				accepted = append(accepted, addr)
+			}
+		}
+
+		if len(accepted) > 0 {
+			r, err := entry.Reader()
+			if err != nil {
+				return err
+			}
+
+			envelope := s.envelope
+			envelope.To = accepted
+
+			failed, err := mailman.DeliverEach(&envelope, model.Body{Reader: r})
+			if err != nil {
+				log.WithField("from", envelope.From).Warnf("lmtp delivery failed: %v", err)
+			}
+
+			for i, addr := range to {
+				if replies[i] != nil {
+					continue
+				}
+
+				if err != nil || failed[addr.String()] != nil {
+					replies[i] = &rFailed
+				} else {
+					replies[i] = &rOk
+				}
+			}
+
+			log.WithField("from", envelope.From).
+				Debugf("mail received over lmtp, %d of %d recipients failed", len(failed), len(accepted))
+		}
+
+		return sendAll(s, replies)
+	}
+}
+
+// sendAll sends one reply after another.
+func sendAll(s *session, replies []*reply) error {
+	for _, r := range replies {
+		if err := s.send(r); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,227 @@
+// Copyright (C) 2020  Lukas Dietrich <lukas@lukasdietrich.com>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package smtp
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"net/textproto"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/lukasdietrich/briefmail/internal/addressbook"
+	"github.com/lukasdietrich/briefmail/internal/delivery"
+	"github.com/lukasdietrich/briefmail/internal/model"
+	"github.com/lukasdietrich/briefmail/internal/storage"
+	"github.com/lukasdietrich/briefmail/internal/storage/storagetest"
+	briefproto "github.com/lukasdietrich/briefmail/internal/textproto"
+)
+
+// lookupFunc is an addressbook backed by a function.
+type lookupFunc func(*model.Address) *addressbook.Entry
+
+func (f lookupFunc) Lookup(addr *model.Address) *addressbook.Entry {
+	return f(addr)
+}
+
+// failingStore fails to store mails for a single mailbox.
+type failingStore struct {
+	delivery.LocalStore
+	mailbox int64
+}
+
+func (s *failingStore) Store(mail *delivery.LocalMail) error {
+	if mail.Mailbox == s.mailbox {
+		return errors.New("disk full")
+	}
+
+	return s.LocalStore.Store(mail)
+}
+
+// fixture is a mailman delivering to local mailboxes named by the user part
+// of the address. Addresses of example.org are remote.
+type fixture struct {
+	dir       string
+	db        *storage.DB
+	cache     *storage.Cache
+	book      lookupFunc
+	mailboxes map[string]int64
+	mailman   delivery.Mailman
+}
+
+func newFixture(t *testing.T, names ...string) (*fixture, func()) {
+	dir, err := ioutil.TempDir("", "briefmail")
+	assert.Nil(t, err)
+
+	db, closeDB := storagetest.OpenDB(t)
+
+	blobs, err := storage.NewInMemoryBlobs()
+	assert.Nil(t, err)
+
+	cache, err := storage.NewMemoryCache()
+	assert.Nil(t, err)
+
+	mailboxes := make(map[string]int64)
+
+	for _, name := range names {
+		mailbox, err := db.AddMailbox(name, "secret")
+		assert.Nil(t, err)
+
+		mailboxes[name] = mailbox
+	}
+
+	book := lookupFunc(func(addr *model.Address) *addressbook.Entry {
+		if mailbox, ok := mailboxes[addr.User]; ok {
+			return &addressbook.Entry{Kind: addressbook.Local, Mailbox: &mailbox}
+		}
+
+		if addr.Domain == "example.org" {
+			return &addressbook.Entry{Kind: addressbook.Remote, Address: addr}
+		}
+
+		return nil
+	})
+
+	store, err := delivery.NewLocalStore(db, blobs)
+	assert.Nil(t, err)
+
+	// the worker is never started, so queued mails stay in the queue
+	queue := delivery.QueueWorker{
+		DB:          db,
+		Blobs:       blobs,
+		Addressbook: book,
+		Store:       store,
+	}
+
+	f := fixture{
+		dir:       dir,
+		db:        db,
+		cache:     cache,
+		book:      book,
+		mailboxes: mailboxes,
+		mailman: delivery.Mailman{
+			DB:          db,
+			Blobs:       blobs,
+			Addressbook: book,
+			Queue:       &queue,
+			Store:       store,
+		},
+	}
+
+	return &f, func() {
+		closeDB()
+		os.RemoveAll(dir)
+	}
+}
+
+// entries returns the number of mails in the mailbox of a user.
+func (f *fixture) entries(t *testing.T, name string) int {
+	entries, _, err := f.db.Entries(f.mailboxes[name])
+	assert.Nil(t, err)
+
+	return len(entries)
+}
+
+// dial starts a server on a unix socket and connects to it.
+func (f *fixture) dial(t *testing.T, proto briefproto.Protocol) (*textproto.Conn, func()) {
+	var (
+		socket = filepath.Join(f.dir, "server.sock")
+		server = briefproto.NewServer(proto, nil)
+	)
+
+	go server.Listen("unix:" + socket) // nolint:errcheck
+
+	var (
+		conn *textproto.Conn
+		err  error
+	)
+
+	for i := 0; i < 50; i++ {
+		if conn, err = textproto.Dial("unix", socket); err == nil {
+			break
+		}
+
+		time.Sleep(time.Millisecond * 20)
+	}
+
+	if !assert.Nil(t, err) {
+		t.FailNow()
+	}
+
+	return conn, func() {
+		conn.Close()
+		server.Shutdown(context.Background())
+	}
+}
+
+// expect sends a command and checks the code of the reply.
+func expect(t *testing.T, conn *textproto.Conn, code int, format string, args ...interface{}) {
+	if format != "" {
+		assert.Nil(t, conn.PrintfLine(format, args...))
+	}
+
+	actual, message, err := conn.ReadResponse(0)
+	assert.Nil(t, err)
+	assert.Equal(t, code, actual, "%s: %s", format, message)
+}
+
+// send writes a mail after the DATA command.
+func send(t *testing.T, conn *textproto.Conn, mail string) {
+	w := conn.DotWriter()
+
+	_, err := w.Write([]byte(mail))
+	assert.Nil(t, err)
+	assert.Nil(t, w.Close())
+}
+
+func TestLMTPRepliesPerRecipient(t *testing.T) {
+	f, cleanup := newFixture(t, "alice", "bob", "carol")
+	defer cleanup()
+
+	// bob has room for an empty mail only
+	assert.Nil(t, f.db.SetQuota("bob", &storage.Quota{Size: 1}))
+
+	f.mailman.Store = &failingStore{LocalStore: f.mailman.Store, mailbox: f.mailboxes["carol"]}
+
+	conn, closeConn := f.dial(t, NewLMTP(f.mailman, f.book, f.cache, nil))
+	defer closeConn()
+
+	expect(t, conn, 220, "")
+	expect(t, conn, 250, "LHLO localhost")
+	expect(t, conn, 250, "MAIL FROM:<sender@example.org>")
+	expect(t, conn, 250, "RCPT TO:<alice@example.com>")
+	expect(t, conn, 250, "RCPT TO:<bob@example.com>")
+	expect(t, conn, 250, "RCPT TO:<carol@example.com>")
+	expect(t, conn, 550, "RCPT TO:<dave@example.com>")
+	expect(t, conn, 354, "DATA")
+
+	send(t, conn, "Subject: hello\r\n\r\nbody\r\n")
+
+	expect(t, conn, 250, "") // alice
+	expect(t, conn, 452, "") // bob is full
+	expect(t, conn, 451, "") // carol failed
+
+	expect(t, conn, 221, "QUIT")
+
+	assert.Equal(t, 1, f.entries(t, "alice"))
+	assert.Equal(t, 0, f.entries(t, "bob"))
+	assert.Equal(t, 0, f.entries(t, "carol"))
+}
@@ -49,8 +49,9 @@ func New(
 	dataHooks []hook.DataHook,
 ) *Proto {
 	var (
-		hostname = viper.GetString("general.hostname")
-		maxSize  = viper.GetInt64("mail.size")
+		hostname  = viper.GetString("general.hostname")
+		maxSize   = viper.GetInt64("mail.size")
+		alignment = viper.GetString("alignment.action")
 	)
 
 	return &Proto{
@@ -59,12 +60,11 @@ func New(
 			"EHLO": ehlo(hostname,
 				fmt.Sprintf("SIZE %d", maxSize),
 				fmt.Sprintf("STARTTLS"),
-				fmt.Sprintf("AUTH %s %s", "PLAIN", "LOGIN"),
 			),
 
-			"MAIL": mail(addressbook, maxSize, fromHooks),
+			"MAIL": mail(mailman, addressbook, maxSize, fromHooks),
 			"RCPT": rcpt(mailman, addressbook),
-			"DATA": data(mailman, cache, maxSize, dataHooks),
+			"DATA": data(mailman, cache, maxSize, alignment, dataHooks),
 
 			"NOOP": noop(),
 			"RSET": rset(),
@@ -16,10 +16,12 @@
 package smtp
 
 import (
+	"net"
 	"time"
 
 	"github.com/lukasdietrich/briefmail/internal/model"
 	"github.com/lukasdietrich/briefmail/internal/smtp/hook"
+	"github.com/lukasdietrich/briefmail/internal/storage"
 	"github.com/lukasdietrich/briefmail/internal/textproto"
 )
 
@@ -58,12 +60,40 @@ type session struct {
 	envelope model.Envelope
 	headers  []hook.HeaderField
 	mailbox  *int64
+	size     int64
+
+	// authenticated are the domains the from hooks verified for the current
+	// envelope sender.
+	authenticated []string
 }
 
 func (s *session) isSubmission() bool {
 	return s.mailbox != nil
 }
 
+// hookSession describes the session for data hooks.
+func (s *session) hookSession(db *storage.DB) (*hook.Session, error) {
+	session := hook.Session{
+		Submission: s.isSubmission(),
+		IP:         net.ParseIP(s.envelope.Addr),
+		Helo:       s.envelope.Helo,
+		From:       s.envelope.From,
+		To:         s.envelope.To,
+		TLS:        s.IsTLS(),
+	}
+
+	if s.isSubmission() {
+		name, err := db.MailboxName(*s.mailbox)
+		if err != nil {
+			return nil, err
+		}
+
+		session.User = name
+	}
+
+	return &session, nil
+}
+
 func (s *session) send(r *reply) error {
 	if err := s.SetWriteTimeout(time.Minute * 5); err != nil {
 		return err
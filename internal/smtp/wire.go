@@ -19,4 +19,4 @@ import (
 	"github.com/google/wire"
 )
 
-var WireSet = wire.NewSet(New)
+var WireSet = wire.NewSet(New, NewLMTP)
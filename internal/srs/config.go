@@ -0,0 +1,45 @@
+// Copyright (C) 2020  Lukas Dietrich <lukas@lukasdietrich.com>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package srs
+
+import (
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+)
+
+func init() {
+	viper.SetDefault("srs.enable", false)
+	viper.SetDefault("srs.domain", "")
+	viper.SetDefault("srs.keys", []string{})
+	viper.SetDefault("srs.maxAge", 21)
+}
+
+// NewFromConfig creates a SRS from the configuration. If srs is disabled, nil
+// is returned. The domain defaults to the hostname.
+func NewFromConfig() (*SRS, error) {
+	if !viper.GetBool("srs.enable") {
+		return nil, nil
+	}
+
+	domain := viper.GetString("srs.domain")
+	if domain == "" {
+		domain = viper.GetString("general.hostname")
+	}
+
+	logrus.Debugf("srs: rewriting forwarded senders to %s", domain)
+
+	return New(domain, viper.GetStringSlice("srs.keys"), viper.GetInt("srs.maxAge"))
+}
@@ -0,0 +1,264 @@
+// Copyright (C) 2020  Lukas Dietrich <lukas@lukasdietrich.com>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+// Package srs implements the "Sender Rewriting Scheme" to forward mails
+// without breaking SPF at the final destination.
+//
+// see <https://www.libsrs2.org/srs/srs.pdf>
+package srs
+
+import (
+	"crypto/hmac"
+	"crypto/sha1"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/lukasdietrich/briefmail/internal/model"
+)
+
+const (
+	prefix0 = "SRS0"
+	prefix1 = "SRS1"
+
+	// hashLength is the number of base64 characters of the hmac, that are
+	// kept in a rewritten address.
+	hashLength = 4
+
+	// timestamps are days since the epoch encoded as two base32 characters
+	timestampPrecision = 60 * 60 * 24
+	timestampSlots     = 32 * 32
+	timestampAlphabet  = "ABCDEFGHIJKLMNOPQRSTUVWXYZ234567"
+)
+
+var (
+	// ErrNoSRS is returned when reversing an address, that was not rewritten.
+	ErrNoSRS = errors.New("srs: not a rewritten address")
+	// ErrInvalidHash is returned when the hash of a rewritten address does
+	// not match any of the keys.
+	ErrInvalidHash = errors.New("srs: invalid hash")
+	// ErrExpired is returned when a rewritten address is too old.
+	ErrExpired = errors.New("srs: address expired")
+	// ErrSyntax is returned when a rewritten address is malformed.
+	ErrSyntax = errors.New("srs: invalid syntax")
+)
+
+// SRS rewrites envelope senders to addresses within a local domain and
+// reverses such addresses.
+type SRS struct {
+	domain string
+	keys   [][]byte
+	maxAge int
+	now    func() time.Time
+}
+
+// New creates a new SRS using the given domain for rewritten addresses. The
+// first key is used to sign new addresses, while all keys are accepted when
+// verifying. maxAge is the number of days a rewritten address is valid.
+func New(domain string, keys []string, maxAge int) (*SRS, error) {
+	if domain == "" {
+		return nil, errors.New("srs: domain must not be empty")
+	}
+
+	if len(keys) == 0 {
+		return nil, errors.New("srs: at least one key is required")
+	}
+
+	s := SRS{
+		domain: domain,
+		maxAge: maxAge,
+		now:    time.Now,
+	}
+
+	for _, key := range keys {
+		if key == "" {
+			return nil, errors.New("srs: keys must not be empty")
+		}
+
+		s.keys = append(s.keys, []byte(key))
+	}
+
+	return &s, nil
+}
+
+// IsSRS checks if an address looks like a rewritten address.
+func IsSRS(addr *model.Address) bool {
+	local := localPart(addr)
+	return isPrefix(local, prefix0) || isPrefix(local, prefix1)
+}
+
+// Forward rewrites a sender address. Addresses, which are already rewritten
+// by another forwarder, are rewritten as SRS1 to keep them short.
+func (s *SRS) Forward(addr *model.Address) (*model.Address, error) {
+	local := localPart(addr)
+
+	var rewritten string
+
+	switch {
+	case isPrefix(local, prefix1):
+		// SRS1=HHHH=orighost=rest@host  =>  SRS1=HHHH=orighost=rest@domain
+		parts := strings.SplitN(local[len(prefix1)+1:], "=", 3)
+		if len(parts) != 3 {
+			return nil, ErrSyntax
+		}
+
+		origHost, rest := parts[1], parts[2]
+		rewritten = fmt.Sprintf("%s=%s=%s=%s",
+			prefix1, s.hash(s.keys[0], origHost, rest), origHost, rest)
+
+	case isPrefix(local, prefix0):
+		// SRS0=rest@host  =>  SRS1=HHHH=host==rest@domain
+		rest := local[len(prefix0):]
+		rewritten = fmt.Sprintf("%s=%s=%s=%s",
+			prefix1, s.hash(s.keys[0], addr.Domain, rest), addr.Domain, rest)
+
+	default:
+		// local@host  =>  SRS0=HHHH=TT=host=local@domain
+		timestamp := encodeTimestamp(s.now())
+		rewritten = fmt.Sprintf("%s=%s=%s=%s=%s",
+			prefix0, s.hash(s.keys[0], timestamp, addr.Domain, local),
+			timestamp, addr.Domain, local)
+	}
+
+	return model.ParseAddress(rewritten + "@" + s.domain)
+}
+
+// Reverse restores the address a rewritten address was created from. SRS1
+// addresses are reversed to the SRS0 address of the previous forwarder.
+func (s *SRS) Reverse(addr *model.Address) (*model.Address, error) {
+	local := localPart(addr)
+
+	switch {
+	case isPrefix(local, prefix0):
+		parts := strings.SplitN(local[len(prefix0)+1:], "=", 4)
+		if len(parts) != 4 {
+			return nil, ErrSyntax
+		}
+
+		hash, timestamp, host, user := parts[0], parts[1], parts[2], parts[3]
+
+		if !s.verify(hash, timestamp, host, user) {
+			return nil, ErrInvalidHash
+		}
+
+		if err := s.checkTimestamp(timestamp); err != nil {
+			return nil, err
+		}
+
+		return model.ParseAddress(user + "@" + host)
+
+	case isPrefix(local, prefix1):
+		parts := strings.SplitN(local[len(prefix1)+1:], "=", 3)
+		if len(parts) != 3 {
+			return nil, ErrSyntax
+		}
+
+		hash, host, rest := parts[0], parts[1], parts[2]
+
+		if !s.verify(hash, host, rest) {
+			return nil, ErrInvalidHash
+		}
+
+		return model.ParseAddress(prefix0 + rest + "@" + host)
+	}
+
+	return nil, ErrNoSRS
+}
+
+func (s *SRS) hash(key []byte, parts ...string) string {
+	mac := hmac.New(sha1.New, key)
+
+	for _, part := range parts {
+		// hashes are compared case-insensitive, because the local part of
+		// an address may be case-folded along the way
+		mac.Write([]byte(strings.ToLower(part))) // nolint:errcheck
+	}
+
+	return base64.StdEncoding.EncodeToString(mac.Sum(nil))[:hashLength]
+}
+
+func (s *SRS) verify(hash string, parts ...string) bool {
+	for _, key := range s.keys {
+		if strings.EqualFold(hash, s.hash(key, parts...)) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (s *SRS) checkTimestamp(timestamp string) error {
+	then, err := decodeTimestamp(timestamp)
+	if err != nil {
+		return err
+	}
+
+	now := int(s.now().Unix()/timestampPrecision) % timestampSlots
+	age := (now - then + timestampSlots) % timestampSlots
+
+	if s.maxAge > 0 && age > s.maxAge {
+		return ErrExpired
+	}
+
+	return nil
+}
+
+func encodeTimestamp(t time.Time) string {
+	days := int(t.Unix()/timestampPrecision) % timestampSlots
+
+	return string([]byte{
+		timestampAlphabet[days/32],
+		timestampAlphabet[days%32],
+	})
+}
+
+func decodeTimestamp(timestamp string) (int, error) {
+	if len(timestamp) != 2 {
+		return 0, ErrSyntax
+	}
+
+	var days int
+
+	for _, c := range strings.ToUpper(timestamp) {
+		i := strings.IndexRune(timestampAlphabet, c)
+		if i < 0 {
+			return 0, ErrSyntax
+		}
+
+		days = days*32 + i
+	}
+
+	return days, nil
+}
+
+// localPart returns the local part of an address as it was originally
+// written, because rewritten addresses are case-sensitive.
+func localPart(addr *model.Address) string {
+	raw := addr.String()
+
+	if i := strings.LastIndex(raw, "@"); i > -1 {
+		return raw[:i]
+	}
+
+	return raw
+}
+
+func isPrefix(local, prefix string) bool {
+	return len(local) > len(prefix) &&
+		strings.EqualFold(local[:len(prefix)], prefix) &&
+		strings.ContainsRune("=+-", rune(local[len(prefix)]))
+}
@@ -0,0 +1,128 @@
+// Copyright (C) 2020  Lukas Dietrich <lukas@lukasdietrich.com>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package srs
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/lukasdietrich/briefmail/internal/model"
+)
+
+func mustAddress(raw string) *model.Address {
+	addr, err := model.ParseAddress(raw)
+	if err != nil {
+		panic(err)
+	}
+
+	return addr
+}
+
+func makeSRS(t *testing.T, domain string, now time.Time, keys ...string) *SRS {
+	s, err := New(domain, keys, 21)
+	assert.Nil(t, err)
+
+	s.now = func() time.Time { return now }
+	return s
+}
+
+func TestSRS0(t *testing.T) {
+	var (
+		now = time.Date(2020, 7, 1, 12, 0, 0, 0, time.UTC)
+		s   = makeSRS(t, "forward.example", now, "secret")
+	)
+
+	rewritten, err := s.Forward(mustAddress("alice@origin.example"))
+	assert.Nil(t, err)
+	assert.True(t, IsSRS(rewritten))
+	assert.Equal(t, "forward.example", rewritten.Domain)
+	assert.True(t, strings.HasPrefix(rewritten.String(), "SRS0="))
+	assert.True(t, strings.HasSuffix(rewritten.String(), "=origin.example=alice@forward.example"))
+
+	reversed, err := s.Reverse(rewritten)
+	assert.Nil(t, err)
+	assert.Equal(t, "alice@origin.example", reversed.String())
+
+	// case-folded addresses are still accepted
+	reversed, err = s.Reverse(mustAddress(strings.ToLower(rewritten.String())))
+	assert.Nil(t, err)
+	assert.Equal(t, "alice@origin.example", reversed.String())
+}
+
+func TestSRS1(t *testing.T) {
+	var (
+		now    = time.Date(2020, 7, 1, 12, 0, 0, 0, time.UTC)
+		first  = makeSRS(t, "first.example", now, "key1")
+		second = makeSRS(t, "second.example", now, "key2")
+		third  = makeSRS(t, "third.example", now, "key3")
+	)
+
+	srs0, err := first.Forward(mustAddress("bob@origin.example"))
+	assert.Nil(t, err)
+
+	srs1, err := second.Forward(srs0)
+	assert.Nil(t, err)
+	assert.True(t, strings.HasPrefix(srs1.String(), "SRS1="))
+	assert.Equal(t, "second.example", srs1.Domain)
+
+	srs1again, err := third.Forward(srs1)
+	assert.Nil(t, err)
+	assert.True(t, strings.HasPrefix(srs1again.String(), "SRS1="))
+	assert.Equal(t, "third.example", srs1again.Domain)
+
+	reversed, err := third.Reverse(srs1again)
+	assert.Nil(t, err)
+	assert.Equal(t, srs0.String(), reversed.String())
+
+	reversed, err = second.Reverse(srs1)
+	assert.Nil(t, err)
+	assert.Equal(t, srs0.String(), reversed.String())
+
+	reversed, err = first.Reverse(reversed)
+	assert.Nil(t, err)
+	assert.Equal(t, "bob@origin.example", reversed.String())
+}
+
+func TestReverseErrors(t *testing.T) {
+	var (
+		now     = time.Date(2020, 7, 1, 12, 0, 0, 0, time.UTC)
+		s       = makeSRS(t, "forward.example", now, "secret")
+		other   = makeSRS(t, "forward.example", now, "other")
+		rotated = makeSRS(t, "forward.example", now, "new", "secret")
+		later   = makeSRS(t, "forward.example", now.Add(time.Hour*24*30), "secret")
+	)
+
+	rewritten, err := s.Forward(mustAddress("alice@origin.example"))
+	assert.Nil(t, err)
+
+	_, err = s.Reverse(mustAddress("alice@forward.example"))
+	assert.Equal(t, ErrNoSRS, err)
+
+	_, err = other.Reverse(rewritten)
+	assert.Equal(t, ErrInvalidHash, err)
+
+	_, err = rotated.Reverse(rewritten)
+	assert.Nil(t, err)
+
+	_, err = later.Reverse(rewritten)
+	assert.Equal(t, ErrExpired, err)
+
+	_, err = s.Reverse(mustAddress("SRS0=abc@forward.example"))
+	assert.Equal(t, ErrSyntax, err)
+}
@@ -0,0 +1,189 @@
+// Copyright (C) 2020  Lukas Dietrich <lukas@lukasdietrich.com>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package storage
+
+import (
+	"database/sql"
+
+	"github.com/lukasdietrich/briefmail/internal/model"
+)
+
+// AddressEntry is an address managed in the database. Either Mailbox or
+// Target is set.
+type AddressEntry struct {
+	Domain string
+	User   string
+	// Mailbox is the id of the mailbox receiving mails to the address.
+	Mailbox *int64
+	// MailboxName is only set when listing addresses.
+	MailboxName string
+	// Target is the address an alias resolves to.
+	Target *model.Address
+}
+
+func scanAddressEntry(row rowScanner) (*AddressEntry, error) {
+	var (
+		entry   AddressEntry
+		mailbox sql.NullInt64
+		name    sql.NullString
+		target  sql.NullString
+	)
+
+	if err := row.Scan(&entry.Domain, &entry.User, &mailbox, &name, &target); err != nil {
+		return nil, err
+	}
+
+	if mailbox.Valid {
+		entry.Mailbox = &mailbox.Int64
+		entry.MailboxName = name.String
+	}
+
+	if target.Valid {
+		addr, err := model.ParseAddress(target.String)
+		if err != nil {
+			return nil, err
+		}
+
+		entry.Target = addr
+	}
+
+	return &entry, nil
+}
+
+// AddressEntry returns the entry of a user in a domain. Both may be "*" for
+// catch-all entries.
+func (d *DB) AddressEntry(domain, user string) (*AddressEntry, error) {
+	var entry *AddressEntry
+
+	return entry, d.do(func(tx *sql.Tx) (err error) {
+		entry, err = scanAddressEntry(tx.QueryRow(
+			`
+			select "a"."domain", "a"."user", "a"."mailbox", "m"."name", "a"."target"
+			from "addresses" as "a"
+				left join "mailboxes" as "m"
+					on "m"."id" = "a"."mailbox"
+			where "a"."domain" = ?
+			  and "a"."user" = ? ;
+			`, domain, user))
+
+		return
+	})
+}
+
+// Addresses returns all addresses managed in the database.
+func (d *DB) Addresses() ([]*AddressEntry, error) {
+	var entries []*AddressEntry
+
+	return entries, d.do(func(tx *sql.Tx) error {
+		rows, err := tx.Query(
+			`
+			select "a"."domain", "a"."user", "a"."mailbox", "m"."name", "a"."target"
+			from "addresses" as "a"
+				left join "mailboxes" as "m"
+					on "m"."id" = "a"."mailbox"
+			order by "a"."domain", "a"."user" ;
+			`)
+
+		if err != nil {
+			return err
+		}
+
+		defer rows.Close() // nolint:errcheck
+
+		for rows.Next() {
+			entry, err := scanAddressEntry(rows)
+			if err != nil {
+				return err
+			}
+
+			entries = append(entries, entry)
+		}
+
+		return rows.Err()
+	})
+}
+
+// AddAddress assigns an address to a mailbox. sql.ErrNoRows is returned if
+// the mailbox does not exist.
+func (d *DB) AddAddress(addr *model.Address, mailbox string) error {
+	return d.do(func(tx *sql.Tx) error {
+		var id int64
+
+		err := tx.QueryRow(
+			`
+			select "id"
+			from "mailboxes"
+			where "name" = ? ;
+			`, mailbox).Scan(&id)
+
+		if err != nil {
+			return err
+		}
+
+		_, err = tx.Exec(
+			`
+			insert or replace into "addresses"
+			( "domain", "user", "mailbox", "target" )
+			values
+			( ?, ?, ?, null ) ;
+			`, addr.Domain, addr.User, id)
+
+		return err
+	})
+}
+
+// AddAlias makes an address an alias of another address.
+func (d *DB) AddAlias(addr, target *model.Address) error {
+	return d.do(func(tx *sql.Tx) error {
+		_, err := tx.Exec(
+			`
+			insert or replace into "addresses"
+			( "domain", "user", "mailbox", "target" )
+			values
+			( ?, ?, null, ? ) ;
+			`, addr.Domain, addr.User, target)
+
+		return err
+	})
+}
+
+// DeleteAddress removes an address or alias. sql.ErrNoRows is returned if the
+// address does not exist.
+func (d *DB) DeleteAddress(addr *model.Address) error {
+	return d.do(func(tx *sql.Tx) error {
+		result, err := tx.Exec(
+			`
+			delete from "addresses"
+			where "domain" = ?
+			  and "user" = ? ;
+			`, addr.Domain, addr.User)
+
+		if err != nil {
+			return err
+		}
+
+		ar, err := result.RowsAffected()
+		if err != nil {
+			return err
+		}
+
+		if ar < 1 {
+			return sql.ErrNoRows
+		}
+
+		return nil
+	})
+}
@@ -0,0 +1,59 @@
+// Copyright (C) 2020  Lukas Dietrich <lukas@lukasdietrich.com>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package storage
+
+import (
+	"database/sql"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAddresses(t *testing.T) {
+	db, cleanup := openTempDB(t)
+	defer cleanup()
+
+	mailbox, err := db.AddMailbox("user", "secret")
+	assert.Nil(t, err)
+
+	assert.Nil(t, db.AddAddress(mustAddress("user@example.com"), "user"))
+	assert.Nil(t, db.AddAlias(mustAddress("alias@example.com"), mustAddress("user@example.com")))
+	assert.Equal(t, sql.ErrNoRows, db.AddAddress(mustAddress("other@example.com"), "unknown"))
+
+	entry, err := db.AddressEntry("example.com", "user")
+	assert.Nil(t, err)
+	assert.Equal(t, &AddressEntry{
+		Domain:      "example.com",
+		User:        "user",
+		Mailbox:     &mailbox,
+		MailboxName: "user",
+	}, entry)
+
+	entry, err = db.AddressEntry("example.com", "alias")
+	assert.Nil(t, err)
+	assert.Nil(t, entry.Mailbox)
+	assert.Equal(t, mustAddress("user@example.com"), entry.Target)
+
+	_, err = db.AddressEntry("example.com", "other")
+	assert.Equal(t, sql.ErrNoRows, err)
+
+	entries, err := db.Addresses()
+	assert.Nil(t, err)
+	assert.Len(t, entries, 2)
+
+	assert.Nil(t, db.DeleteAddress(mustAddress("alias@example.com")))
+	assert.Equal(t, sql.ErrNoRows, db.DeleteAddress(mustAddress("alias@example.com")))
+}
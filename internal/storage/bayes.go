@@ -0,0 +1,172 @@
+// Copyright (C) 2020  Lukas Dietrich <lukas@lukasdietrich.com>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package storage
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+)
+
+// BayesCount is the number of spam and ham mails a token was seen in, or the
+// total number of trained mails.
+type BayesCount struct {
+	Spam int64
+	Ham  int64
+}
+
+// BayesTotals returns the number of trained spam and ham mails.
+func (d *DB) BayesTotals() (*BayesCount, error) {
+	var c BayesCount
+
+	return &c, d.do(func(tx *sql.Tx) error {
+		return tx.QueryRow(
+			`
+			select coalesce ( sum ( "spam" ), 0 ),
+			       coalesce ( sum ( 1 - "spam" ), 0 )
+			from "bayesTrained" ;
+			`).Scan(&c.Spam, &c.Ham)
+	})
+}
+
+// BayesTokens returns the counts of known tokens. Unknown tokens are
+// missing from the result.
+func (d *DB) BayesTokens(tokens []string) (map[string]BayesCount, error) {
+	counts := make(map[string]BayesCount)
+
+	return counts, d.do(func(tx *sql.Tx) error {
+		stmt, err := tx.Prepare(
+			`
+			select "spam", "ham"
+			from "bayesTokens"
+			where "token" = ? ;
+			`)
+
+		if err != nil {
+			return err
+		}
+
+		defer stmt.Close() // nolint:errcheck
+
+		for _, token := range tokens {
+			var c BayesCount
+
+			err := stmt.QueryRow(token).Scan(&c.Spam, &c.Ham)
+			if errors.Is(err, sql.ErrNoRows) {
+				continue
+			}
+
+			if err != nil {
+				return err
+			}
+
+			counts[token] = c
+		}
+
+		return nil
+	})
+}
+
+// TrainBayes counts the distinct tokens of a mail as spam or ham. A mail,
+// which was trained with the other class before, is moved to the new class.
+// False is returned if the mail was already trained with the same class.
+func (d *DB) TrainBayes(key string, tokens []string, spam bool) (bool, error) {
+	var trained bool
+
+	return trained, d.do(func(tx *sql.Tx) error {
+		var previous bool
+
+		err := tx.QueryRow(
+			`
+			select "spam"
+			from "bayesTrained"
+			where "key" = ? ;
+			`, key).Scan(&previous)
+
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			if err := countBayesTokens(tx, tokens, spam, 1); err != nil {
+				return err
+			}
+
+		case err != nil:
+			return err
+
+		case previous == spam:
+			return nil
+
+		default:
+			if err := countBayesTokens(tx, tokens, previous, -1); err != nil {
+				return err
+			}
+
+			if err := countBayesTokens(tx, tokens, spam, 1); err != nil {
+				return err
+			}
+		}
+
+		_, err = tx.Exec(
+			`
+			insert or replace into "bayesTrained"
+			( "key", "spam" )
+			values
+			( ?, ? ) ;
+			`, key, spam)
+
+		trained = err == nil
+		return err
+	})
+}
+
+// countBayesTokens adds delta to the spam or ham count of each token. Counts
+// never drop below zero and tokens without any count are removed.
+func countBayesTokens(tx *sql.Tx, tokens []string, spam bool, delta int64) error {
+	column := `"ham"`
+	if spam {
+		column = `"spam"`
+	}
+
+	// column names cannot be parameters
+	stmt, err := tx.Prepare(fmt.Sprintf(
+		`
+		insert into "bayesTokens"
+		( "token", %[1]s )
+		values
+		( ?, max ( ?, 0 ) )
+		on conflict ( "token" )
+		do update set %[1]s = max ( %[1]s + ?, 0 ) ;
+		`, column))
+
+	if err != nil {
+		return err
+	}
+
+	defer stmt.Close() // nolint:errcheck
+
+	for _, token := range tokens {
+		if _, err := stmt.Exec(token, delta, delta); err != nil {
+			return err
+		}
+	}
+
+	_, err = tx.Exec(
+		`
+		delete from "bayesTokens"
+		where "spam" = 0 and "ham" = 0 ;
+		`)
+
+	return err
+}
@@ -0,0 +1,67 @@
+// Copyright (C) 2020  Lukas Dietrich <lukas@lukasdietrich.com>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package storage
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBayes(t *testing.T) {
+	db, cleanup := openTempDB(t)
+	defer cleanup()
+
+	trained, err := db.TrainBayes("a", []string{"cheap", "pills"}, true)
+	assert.Nil(t, err)
+	assert.True(t, trained)
+
+	trained, err = db.TrainBayes("a", []string{"cheap", "pills"}, true)
+	assert.Nil(t, err)
+	assert.False(t, trained)
+
+	trained, err = db.TrainBayes("b", []string{"meeting", "cheap"}, false)
+	assert.Nil(t, err)
+	assert.True(t, trained)
+
+	totals, err := db.BayesTotals()
+	assert.Nil(t, err)
+	assert.Equal(t, &BayesCount{Spam: 1, Ham: 1}, totals)
+
+	counts, err := db.BayesTokens([]string{"cheap", "pills", "meeting", "unknown"})
+	assert.Nil(t, err)
+	assert.Equal(t, map[string]BayesCount{
+		"cheap":   {Spam: 1, Ham: 1},
+		"pills":   {Spam: 1},
+		"meeting": {Ham: 1},
+	}, counts)
+
+	// moving a mail to the other class removes its previous counts
+	trained, err = db.TrainBayes("b", []string{"meeting", "cheap"}, true)
+	assert.Nil(t, err)
+	assert.True(t, trained)
+
+	totals, err = db.BayesTotals()
+	assert.Nil(t, err)
+	assert.Equal(t, &BayesCount{Spam: 2}, totals)
+
+	counts, err = db.BayesTokens([]string{"cheap", "meeting"})
+	assert.Nil(t, err)
+	assert.Equal(t, map[string]BayesCount{
+		"cheap":   {Spam: 2},
+		"meeting": {Spam: 1},
+	}, counts)
+}
@@ -68,6 +68,7 @@ func (b *Cache) Write(r io.Reader) (*CacheEntry, error) {
 	if n < b.memoryLimit {
 		return &CacheEntry{
 			memory: memory,
+			size:   n,
 		}, nil
 	}
 
@@ -76,7 +77,8 @@ func (b *Cache) Write(r io.Reader) (*CacheEntry, error) {
 		return nil, err
 	}
 
-	if _, err := io.Copy(file, io.MultiReader(memory, r)); err != nil {
+	n, err = io.Copy(file, io.MultiReader(memory, r))
+	if err != nil {
 		file.Close()             // nolint:errcheck
 		b.fs.Remove(file.Name()) // nolint:errcheck
 		return nil, err
@@ -85,6 +87,7 @@ func (b *Cache) Write(r io.Reader) (*CacheEntry, error) {
 	return &CacheEntry{
 		file: file,
 		fs:   b.fs,
+		size: n,
 	}, nil
 }
 
@@ -92,6 +95,12 @@ type CacheEntry struct {
 	memory *bytes.Buffer
 	file   afero.File
 	fs     afero.Fs
+	size   int64
+}
+
+// Size returns the number of bytes written to the entry.
+func (e *CacheEntry) Size() int64 {
+	return e.size
 }
 
 func (e *CacheEntry) Release() error {
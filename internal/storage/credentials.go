@@ -0,0 +1,149 @@
+// Copyright (C) 2020  Lukas Dietrich <lukas@lukasdietrich.com>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package storage
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/json"
+
+	"golang.org/x/crypto/pbkdf2"
+)
+
+const (
+	scramSaltLength = 16
+	scramIterations = 4096
+)
+
+// ScramCredentials are the keys derived from a password to verify a
+// SCRAM-SHA-256 authentication without knowing the password itself.
+//
+// see RFC#5802 3 and RFC#7677
+type ScramCredentials struct {
+	Salt       []byte
+	Iterations int
+	StoredKey  []byte
+	ServerKey  []byte
+}
+
+func deriveScram(pass string) (*ScramCredentials, error) {
+	salt := make([]byte, scramSaltLength)
+	if _, err := rand.Read(salt); err != nil {
+		return nil, err
+	}
+
+	var (
+		salted    = pbkdf2.Key([]byte(pass), salt, scramIterations, sha256.Size, sha256.New)
+		clientKey = hmacSHA256(salted, []byte("Client Key"))
+		storedKey = sha256.Sum256(clientKey)
+	)
+
+	return &ScramCredentials{
+		Salt:       salt,
+		Iterations: scramIterations,
+		StoredKey:  storedKey[:],
+		ServerKey:  hmacSHA256(salted, []byte("Server Key")),
+	}, nil
+}
+
+func hmacSHA256(key, data []byte) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write(data) // nolint:errcheck
+	return mac.Sum(nil)
+}
+
+// Scram returns the scram credentials of a mailbox. If the password was set
+// before scram was supported, the credentials are nil until the password is
+// changed.
+func (d *DB) Scram(name string) (int64, *ScramCredentials, error) {
+	var (
+		id    int64
+		creds *ScramCredentials
+	)
+
+	return id, creds, d.do(func(tx *sql.Tx) error {
+		var _scram []byte
+
+		err := tx.QueryRow(
+			`
+			select "id", "scram"
+			from "mailboxes"
+			where "name" = ? ;
+			`, name).Scan(&id, &_scram)
+
+		if err != nil || len(_scram) == 0 {
+			return err
+		}
+
+		creds = new(ScramCredentials)
+		return json.Unmarshal(_scram, creds)
+	})
+}
+
+// APOPSecret returns the shared secret of a mailbox used for pop3 apop
+// authentication. The secret is empty, if apop is not enabled for the
+// mailbox.
+func (d *DB) APOPSecret(name string) (int64, string, error) {
+	var (
+		id     int64
+		secret sql.NullString
+	)
+
+	return id, secret.String, d.do(func(tx *sql.Tx) error {
+		return tx.QueryRow(
+			`
+			select "id", "apop"
+			from "mailboxes"
+			where "name" = ? ;
+			`, name).Scan(&id, &secret)
+	})
+}
+
+// SetAPOPSecret enables pop3 apop authentication for a mailbox. Since apop
+// requires the server to know the secret, it is stored in plain text and
+// should differ from the password. An empty secret disables apop.
+func (d *DB) SetAPOPSecret(name, secret string) error {
+	var _secret sql.NullString
+	if secret != "" {
+		_secret = sql.NullString{String: secret, Valid: true}
+	}
+
+	return d.do(func(tx *sql.Tx) error {
+		result, err := tx.Exec(
+			`
+			update "mailboxes"
+			set "apop" = ?
+			where "name" = ? ;
+			`, _secret, name)
+
+		if err != nil {
+			return err
+		}
+
+		ar, err := result.RowsAffected()
+		if err != nil {
+			return err
+		}
+
+		if ar < 1 {
+			return sql.ErrNoRows
+		}
+
+		return nil
+	})
+}
@@ -77,7 +77,16 @@ func NewDB() (*DB, error) {
 		) ;
 		`)
 
-	return &DB{conn: db}, err
+	if err != nil {
+		return nil, err
+	}
+
+	return &DB{conn: db}, migrate(db)
+}
+
+// Close closes the underlying database connection.
+func (d *DB) Close() error {
+	return d.conn.Close()
 }
 
 func (d *DB) do(fn func(*sql.Tx) error) error {
@@ -107,22 +116,41 @@ func (d *DB) Mailbox(name string) (int64, error) {
 	})
 }
 
+// MailboxName returns the name of a mailbox.
+func (d *DB) MailboxName(id int64) (string, error) {
+	var name string
+
+	return name, d.do(func(tx *sql.Tx) error {
+		return tx.QueryRow(
+			`
+			select "name"
+			from "mailboxes"
+			where "id" = ? ;
+			`, id).Scan(&name)
+	})
+}
+
 func (d *DB) AddMailbox(name, pass string) (int64, error) {
 	hash, err := hashPassword(pass)
 	if err != nil {
 		return -1, err
 	}
 
+	scram, err := scramPassword(pass)
+	if err != nil {
+		return -1, err
+	}
+
 	var id int64
 
 	return id, d.do(func(tx *sql.Tx) error {
 		result, err := tx.Exec(
 			`
 			insert into "mailboxes"
-			( "name", "hash" )
+			( "name", "hash", "scram" )
 			values
-			( ?, ? ) ;
-			`, name, hash)
+			( ?, ?, ? ) ;
+			`, name, hash, scram)
 
 		if err != nil {
 			return err
@@ -139,13 +167,19 @@ func (d *DB) SetPassword(name, pass string) error {
 		return err
 	}
 
+	scram, err := scramPassword(pass)
+	if err != nil {
+		return err
+	}
+
 	return d.do(func(tx *sql.Tx) error {
 		result, err := tx.Exec(
 			`
 			update "mailboxes"
-			set "hash" = ?
+			set "hash" = ? ,
+			    "scram" = ?
 			where "name" = ? ;
-			`, hash, name)
+			`, hash, scram, name)
 
 		if err != nil {
 			return err
@@ -169,6 +203,15 @@ func hashPassword(pass string) (string, error) {
 	return string(hash), err
 }
 
+func scramPassword(pass string) ([]byte, error) {
+	creds, err := deriveScram(pass)
+	if err != nil {
+		return nil, err
+	}
+
+	return json.Marshal(creds)
+}
+
 func (d *DB) Authenticate(name, pass string) (int64, bool, error) {
 	var (
 		id int64
@@ -233,20 +276,38 @@ func (d *DB) AddMail(id model.ID, size, offset int64, envelope *model.Envelope)
 		_, err := tx.Exec(
 			`
 			insert into "mails"
-			( "uuid", "date", "from", "size", "offset" )
+			( "uuid", "date", "from", "size", "offset", "pending" )
 			values
-			( ?, ?, ?, ?, ? ) ;
+			( ?, ?, ?, ?, ?, 1 ) ;
 			`, id, envelope.Date.Unix(), envelope.From.String(), size, offset)
 
 		return err
 	})
 }
 
+// Delivered marks a mail, which was added by AddMail, as handed to all its
+// recipients. Until then DeleteOrphans keeps the mail, even if it is neither
+// referenced by an entry nor queued.
+func (d *DB) Delivered(id model.ID) error {
+	return d.do(func(tx *sql.Tx) error {
+		_, err := tx.Exec(
+			`
+			update "mails"
+			set "pending" = 0
+			where "uuid" = ? ;
+			`, id)
+
+		return err
+	})
+}
+
 type Entry struct {
 	MailID model.ID
 	Size   int64
 }
 
+// Entries returns the mails of a mailbox across all folders. A mail filed
+// into several folders is only listed once.
 func (d *DB) Entries(mailbox int64) ([]Entry, int64, error) {
 	var (
 		list  []Entry
@@ -258,9 +319,11 @@ func (d *DB) Entries(mailbox int64) ([]Entry, int64, error) {
 			`
 			select "m"."uuid", "m"."size"
 			from "mails" as "m"
-				inner join "entries" as "e"
-					on "m"."uuid" = "e"."mail"
-			where "e"."mailbox" = ?
+			where "m"."uuid" in (
+					select "mail"
+					from "entries"
+					where "mailbox" = ?
+				  )
 			order by "m"."date" desc
 			limit 1000 ;
 			`, mailbox)
@@ -337,89 +400,13 @@ func (d *DB) DeleteEntries(mails []model.ID, mailbox int64) error {
 	})
 }
 
-type QueueElement struct {
-	MailID   model.ID
-	Date     time.Time
-	Attempts int
-	To       []*model.Address
-}
-
-func (d *DB) PeekQueue() (*QueueElement, error) {
-	var (
-		element QueueElement
-		_date   int64
-		_to     []byte
-	)
-
-	return &element, d.do(func(tx *sql.Tx) error {
-		err := tx.QueryRow(
-			`
-			select "mail", "date", "attempts", "to"
-			from "queue"
-			order by "date" asc
-			limit 1 ;
-			`).Scan(&element.MailID, &_date, &element.Attempts, &_to)
-
-		if err != nil {
-			return err
-		}
-
-		element.Date = time.Unix(_date, 0)
-		return json.Unmarshal(_to, &element.To)
-	})
-}
-
-func (d *DB) AddToQueue(mail model.ID, to []*model.Address) error {
-	_to, err := json.Marshal(to)
-	if err != nil {
-		return err
-	}
-
-	return d.do(func(tx *sql.Tx) error {
-		_, err := tx.Exec(
-			`
-			insert into "queue"
-			( "mail", "date", "attempts", "to" )
-			values
-			( ?, '0', '0', ? )
-			`, mail, _to)
-
-		return err
-	})
-}
-
-func (d *DB) UpdateQueue(mail model.ID, to []*model.Address, date time.Time) error {
-	_to, err := json.Marshal(to)
-	if err != nil {
-		return err
-	}
-
-	return d.do(func(tx *sql.Tx) error {
-		_, err := tx.Exec(
-			`
-			update "queue"
-			set "date" = ? ,
-			    "attempts" = "attempts" + 1 ,
-			    "to" = ?
-			where "mail" = ? ;
-			`, date.Unix(), _to, mail)
-
-		return err
-	})
-}
-
-func (d *DB) DeleteFromQueue(mail model.ID) error {
-	return d.do(func(tx *sql.Tx) error {
-		_, err := tx.Exec(
-			`
-			delete from "queue"
-			where "mail" = ? ;
-			`, mail)
-
-		return err
-	})
-}
+// pendingTimeout is the time after which a pending mail is considered
+// abandoned, e.g. because the server stopped during its delivery.
+const pendingTimeout = 24 * time.Hour
 
+// DeleteOrphans deletes all mails, which are neither referenced by an entry
+// nor queued. Pending mails are kept until they are older than
+// pendingTimeout.
 func (d *DB) DeleteOrphans() ([]model.ID, error) {
 	var orphans []model.ID
 
@@ -437,8 +424,12 @@ func (d *DB) DeleteOrphans() ([]model.ID, error) {
 			  		select count(*)
 			  		from "queue"
 			  		where "mail" = "uuid"
-			  	  ) = 0 ;
-			`)
+			  	  ) = 0
+			  and (
+			  		"pending" = 0
+			  		or "date" < ?
+			  	  ) ;
+			`, time.Now().Add(-pendingTimeout).Unix())
 
 		if err != nil {
 			return err
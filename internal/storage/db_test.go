@@ -0,0 +1,53 @@
+// Copyright (C) 2020  Lukas Dietrich <lukas@lukasdietrich.com>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package storage
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/lukasdietrich/briefmail/internal/model"
+)
+
+func TestDeleteOrphans(t *testing.T) {
+	db, cleanup := openTempDB(t)
+	defer cleanup()
+
+	var (
+		pending   = model.NewID()
+		abandoned = model.NewID()
+		delivered = model.NewID()
+		from      = mustAddress("sender@example.com")
+		now       = time.Now()
+	)
+
+	assert.Nil(t, db.AddMail(pending, 100, 0, &model.Envelope{Date: now, From: from}))
+	assert.Nil(t, db.AddMail(abandoned, 100, 0, &model.Envelope{Date: now.Add(-pendingTimeout * 2), From: from}))
+	assert.Nil(t, db.AddMail(delivered, 100, 0, &model.Envelope{Date: now, From: from}))
+	assert.Nil(t, db.Delivered(delivered))
+
+	orphans, err := db.DeleteOrphans()
+	assert.Nil(t, err)
+	assert.ElementsMatch(t, []model.ID{abandoned, delivered}, orphans)
+
+	assert.Nil(t, db.Delivered(pending))
+
+	orphans, err = db.DeleteOrphans()
+	assert.Nil(t, err)
+	assert.Equal(t, []model.ID{pending}, orphans)
+}
@@ -0,0 +1,213 @@
+// Copyright (C) 2020  Lukas Dietrich <lukas@lukasdietrich.com>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package storage
+
+import (
+	"database/sql"
+
+	"github.com/lukasdietrich/briefmail/internal/model"
+)
+
+// Domain is a domain managed in the database and its settings.
+type Domain struct {
+	Name string
+	// CatchAll receives mails to unknown users of the domain.
+	CatchAll *model.Address
+	// DKIMSelector is the selector of the key published for the domain. It is
+	// reserved for signing outbound mails, which is not implemented yet, and
+	// has no effect so far.
+	DKIMSelector string
+	// TLSCertificate and TLSKey are the files of a certificate presented to
+	// clients requesting the domain using SNI.
+	TLSCertificate string
+	TLSKey         string
+	// MaxSize limits the size of mails to the domain in bytes. 0 uses the
+	// global limit only.
+	MaxSize int64
+	// Backup is true, if this server is a backup mx of the domain. Mails are
+	// accepted and relayed to the primary mx instead of being delivered
+	// locally.
+	Backup bool
+}
+
+func scanDomain(row rowScanner) (*Domain, error) {
+	var (
+		domain   Domain
+		catchAll sql.NullString
+	)
+
+	err := row.Scan(
+		&domain.Name,
+		&catchAll,
+		&domain.DKIMSelector,
+		&domain.TLSCertificate,
+		&domain.TLSKey,
+		&domain.MaxSize,
+		&domain.Backup,
+	)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if catchAll.Valid {
+		addr, err := model.ParseAddress(catchAll.String)
+		if err != nil {
+			return nil, err
+		}
+
+		domain.CatchAll = addr
+	}
+
+	return &domain, nil
+}
+
+// Domain returns a domain and its settings. sql.ErrNoRows is returned if the
+// domain does not exist.
+func (d *DB) Domain(name string) (*Domain, error) {
+	var domain *Domain
+
+	return domain, d.do(func(tx *sql.Tx) (err error) {
+		domain, err = scanDomain(tx.QueryRow(
+			`
+			select "name", "catchAll", "dkimSelector", "tlsCertificate", "tlsKey",
+				"maxSize", "backup"
+			from "domains"
+			where "name" = ? ;
+			`, name))
+
+		return
+	})
+}
+
+// Domains returns all domains managed in the database.
+func (d *DB) Domains() ([]*Domain, error) {
+	var domains []*Domain
+
+	return domains, d.do(func(tx *sql.Tx) error {
+		rows, err := tx.Query(
+			`
+			select "name", "catchAll", "dkimSelector", "tlsCertificate", "tlsKey",
+				"maxSize", "backup"
+			from "domains"
+			order by "name" ;
+			`)
+
+		if err != nil {
+			return err
+		}
+
+		defer rows.Close() // nolint:errcheck
+
+		for rows.Next() {
+			domain, err := scanDomain(rows)
+			if err != nil {
+				return err
+			}
+
+			domains = append(domains, domain)
+		}
+
+		return rows.Err()
+	})
+}
+
+// AddDomain accepts mails to a domain. Adding a domain twice has no effect.
+func (d *DB) AddDomain(name string) error {
+	return d.do(func(tx *sql.Tx) error {
+		_, err := tx.Exec(
+			`
+			insert or ignore into "domains"
+			( "name" )
+			values
+			( ? ) ;
+			`, name)
+
+		return err
+	})
+}
+
+// UpdateDomain replaces the settings of a domain. sql.ErrNoRows is returned
+// if the domain does not exist.
+func (d *DB) UpdateDomain(domain *Domain) error {
+	var catchAll sql.NullString
+	if domain.CatchAll != nil {
+		catchAll = sql.NullString{String: domain.CatchAll.String(), Valid: true}
+	}
+
+	return d.do(func(tx *sql.Tx) error {
+		result, err := tx.Exec(
+			`
+			update "domains"
+			set "catchAll" = ? ,
+			    "dkimSelector" = ? ,
+			    "tlsCertificate" = ? ,
+			    "tlsKey" = ? ,
+			    "maxSize" = ? ,
+			    "backup" = ?
+			where "name" = ? ;
+			`,
+			catchAll,
+			domain.DKIMSelector,
+			domain.TLSCertificate,
+			domain.TLSKey,
+			domain.MaxSize,
+			domain.Backup,
+			domain.Name)
+
+		if err != nil {
+			return err
+		}
+
+		ar, err := result.RowsAffected()
+		if err != nil {
+			return err
+		}
+
+		if ar < 1 {
+			return sql.ErrNoRows
+		}
+
+		return nil
+	})
+}
+
+// DeleteDomain stops accepting mails to a domain. The addresses of the domain
+// are kept. sql.ErrNoRows is returned if the domain does not exist.
+func (d *DB) DeleteDomain(name string) error {
+	return d.do(func(tx *sql.Tx) error {
+		result, err := tx.Exec(
+			`
+			delete from "domains"
+			where "name" = ? ;
+			`, name)
+
+		if err != nil {
+			return err
+		}
+
+		ar, err := result.RowsAffected()
+		if err != nil {
+			return err
+		}
+
+		if ar < 1 {
+			return sql.ErrNoRows
+		}
+
+		return nil
+	})
+}
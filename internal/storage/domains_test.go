@@ -0,0 +1,61 @@
+// Copyright (C) 2020  Lukas Dietrich <lukas@lukasdietrich.com>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package storage
+
+import (
+	"database/sql"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDomains(t *testing.T) {
+	db, cleanup := openTempDB(t)
+	defer cleanup()
+
+	_, err := db.Domain("example.com")
+	assert.Equal(t, sql.ErrNoRows, err)
+
+	assert.Nil(t, db.AddDomain("example.com"))
+	assert.Nil(t, db.AddDomain("example.com"))
+	assert.Nil(t, db.AddDomain("example.org"))
+
+	domain, err := db.Domain("example.com")
+	assert.Nil(t, err)
+	assert.Equal(t, &Domain{Name: "example.com"}, domain)
+
+	domain.CatchAll = mustAddress("postmaster@example.com")
+	domain.DKIMSelector = "mail"
+	domain.MaxSize = 1000
+	domain.Backup = true
+	assert.Nil(t, db.UpdateDomain(domain))
+
+	updated, err := db.Domain("example.com")
+	assert.Nil(t, err)
+	assert.Equal(t, domain.CatchAll.String(), updated.CatchAll.String())
+	assert.Equal(t, "mail", updated.DKIMSelector)
+	assert.Equal(t, int64(1000), updated.MaxSize)
+	assert.True(t, updated.Backup)
+
+	domains, err := db.Domains()
+	assert.Nil(t, err)
+	assert.Len(t, domains, 2)
+	assert.Equal(t, "example.org", domains[1].Name)
+
+	assert.Nil(t, db.DeleteDomain("example.com"))
+	assert.Equal(t, sql.ErrNoRows, db.DeleteDomain("example.com"))
+	assert.Equal(t, sql.ErrNoRows, db.UpdateDomain(domain))
+}
@@ -0,0 +1,274 @@
+// Copyright (C) 2020  Lukas Dietrich <lukas@lukasdietrich.com>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package storage
+
+import (
+	"database/sql"
+	"time"
+
+	"github.com/lukasdietrich/briefmail/internal/model"
+)
+
+const (
+	// ListSubscribe is the action of a request to subscribe to a list.
+	ListSubscribe = "subscribe"
+	// ListUnsubscribe is the action of a request to unsubscribe from a list.
+	ListUnsubscribe = "unsubscribe"
+)
+
+// ListRequest is a pending subscription change, which needs to be confirmed
+// by the subscriber.
+type ListRequest struct {
+	Token   string
+	List    *model.Address
+	Address *model.Address
+	Action  string
+	Date    time.Time
+}
+
+// Subscription is an address subscribed to a list.
+type Subscription struct {
+	Address *model.Address
+	// Token identifies the subscription in one-click unsubscribe links.
+	Token string
+}
+
+// addressKey returns the normalized form of an address, so addresses are
+// found regardless of the case used in a mail.
+func addressKey(addr *model.Address) string {
+	return addr.User + "@" + addr.Domain
+}
+
+// Subscribers returns all subscribers of a list.
+func (d *DB) Subscribers(list *model.Address) ([]*model.Address, error) {
+	var subscribers []*model.Address
+
+	return subscribers, d.do(func(tx *sql.Tx) error {
+		rows, err := tx.Query(
+			`
+			select "address"
+			from "subscribers"
+			where "list" = ?
+			order by "address" asc ;
+			`, addressKey(list))
+
+		if err != nil {
+			return err
+		}
+
+		defer rows.Close() // nolint:errcheck
+
+		for rows.Next() {
+			var addr model.Address
+
+			if err := rows.Scan(&addr); err != nil {
+				return err
+			}
+
+			subscribers = append(subscribers, &addr)
+		}
+
+		return rows.Err()
+	})
+}
+
+// Subscriptions returns all subscriptions of a list.
+func (d *DB) Subscriptions(list *model.Address) ([]*Subscription, error) {
+	var subscriptions []*Subscription
+
+	return subscriptions, d.do(func(tx *sql.Tx) error {
+		rows, err := tx.Query(
+			`
+			select "address", "token"
+			from "subscribers"
+			where "list" = ?
+			order by "address" asc ;
+			`, addressKey(list))
+
+		if err != nil {
+			return err
+		}
+
+		defer rows.Close() // nolint:errcheck
+
+		for rows.Next() {
+			var (
+				addr         model.Address
+				subscription = Subscription{Address: &addr}
+			)
+
+			if err := rows.Scan(&addr, &subscription.Token); err != nil {
+				return err
+			}
+
+			subscriptions = append(subscriptions, &subscription)
+		}
+
+		return rows.Err()
+	})
+}
+
+// IsSubscribed returns true if an address is subscribed to a list.
+func (d *DB) IsSubscribed(list, addr *model.Address) (bool, error) {
+	var count int
+
+	return count > 0, d.do(func(tx *sql.Tx) error {
+		return tx.QueryRow(
+			`
+			select count ( * )
+			from "subscribers"
+			where "list" = ?
+			  and "address" = ? ;
+			`, addressKey(list), addressKey(addr)).Scan(&count)
+	})
+}
+
+// Subscribe adds an address to a list. Subscribing twice has no effect.
+func (d *DB) Subscribe(list, addr *model.Address) error {
+	return d.do(func(tx *sql.Tx) error {
+		_, err := tx.Exec(
+			`
+			insert or ignore into "subscribers"
+			( "list", "address", "date", "token" )
+			values
+			( ?, ?, ?, lower ( hex ( randomblob ( 16 ) ) ) ) ;
+			`, addressKey(list), addressKey(addr), time.Now().Unix())
+
+		return err
+	})
+}
+
+// Unsubscribe removes an address from a list. sql.ErrNoRows is returned if
+// the address was not subscribed.
+func (d *DB) Unsubscribe(list, addr *model.Address) error {
+	return d.do(func(tx *sql.Tx) error {
+		result, err := tx.Exec(
+			`
+			delete from "subscribers"
+			where "list" = ?
+			  and "address" = ? ;
+			`, addressKey(list), addressKey(addr))
+
+		if err != nil {
+			return err
+		}
+
+		ar, err := result.RowsAffected()
+		if err != nil {
+			return err
+		}
+
+		if ar == 0 {
+			return sql.ErrNoRows
+		}
+
+		return nil
+	})
+}
+
+// UnsubscribeToken removes the subscription identified by a token and returns
+// it along with its list. sql.ErrNoRows is returned if no subscription has the
+// token.
+func (d *DB) UnsubscribeToken(token string) (*model.Address, *Subscription, error) {
+	var (
+		list         model.Address
+		addr         model.Address
+		subscription = Subscription{Address: &addr, Token: token}
+	)
+
+	return &list, &subscription, d.do(func(tx *sql.Tx) error {
+		err := tx.QueryRow(
+			`
+			select "list", "address"
+			from "subscribers"
+			where "token" = ? ;
+			`, token).Scan(&list, &addr)
+
+		if err != nil {
+			return err
+		}
+
+		_, err = tx.Exec(
+			`
+			delete from "subscribers"
+			where "token" = ? ;
+			`, token)
+
+		return err
+	})
+}
+
+// AddListRequest stores a pending subscription change.
+func (d *DB) AddListRequest(r *ListRequest) error {
+	return d.do(func(tx *sql.Tx) error {
+		_, err := tx.Exec(
+			`
+			insert into "listRequests"
+			( "token", "list", "address", "action", "date" )
+			values
+			( ?, ?, ?, ?, ? ) ;
+			`, r.Token, addressKey(r.List), addressKey(r.Address), r.Action, r.Date.Unix())
+
+		return err
+	})
+}
+
+// TakeListRequest removes a pending subscription change and returns it.
+// Requests older than maxAge are discarded and sql.ErrNoRows is returned.
+func (d *DB) TakeListRequest(token string, maxAge time.Duration) (*ListRequest, error) {
+	var (
+		r = ListRequest{
+			Token:   token,
+			List:    new(model.Address),
+			Address: new(model.Address),
+		}
+		expired bool
+	)
+
+	err := d.do(func(tx *sql.Tx) error {
+		var _date int64
+
+		err := tx.QueryRow(
+			`
+			select "list", "address", "action", "date"
+			from "listRequests"
+			where "token" = ? ;
+			`, token).Scan(r.List, r.Address, &r.Action, &_date)
+
+		if err != nil {
+			return err
+		}
+
+		r.Date = time.Unix(_date, 0)
+
+		_, err = tx.Exec(
+			`
+			delete from "listRequests"
+			where "token" = ?
+			   or "date" < ? ;
+			`, token, time.Now().Add(-maxAge).Unix())
+
+		expired = time.Since(r.Date) > maxAge
+		return err
+	})
+
+	if err == nil && expired {
+		// the expired request is deleted anyway
+		err = sql.ErrNoRows
+	}
+
+	return &r, err
+}
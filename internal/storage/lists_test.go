@@ -0,0 +1,125 @@
+// Copyright (C) 2020  Lukas Dietrich <lukas@lukasdietrich.com>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package storage
+
+import (
+	"database/sql"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSubscribers(t *testing.T) {
+	db, cleanup := openTempDB(t)
+	defer cleanup()
+
+	var (
+		list  = mustAddress("dev@example.com")
+		alice = mustAddress("Alice@example.org")
+		bob   = mustAddress("bob@example.org")
+	)
+
+	assert.Nil(t, db.Subscribe(list, alice))
+	assert.Nil(t, db.Subscribe(list, alice))
+	assert.Nil(t, db.Subscribe(list, bob))
+
+	subscribers, err := db.Subscribers(mustAddress("DEV@example.com"))
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"alice@example.org", "bob@example.org"},
+		[]string{subscribers[0].String(), subscribers[1].String()})
+
+	ok, err := db.IsSubscribed(list, mustAddress("alice@example.org"))
+	assert.Nil(t, err)
+	assert.True(t, ok)
+
+	assert.Nil(t, db.Unsubscribe(list, bob))
+	assert.Equal(t, sql.ErrNoRows, db.Unsubscribe(list, bob))
+
+	ok, err = db.IsSubscribed(list, bob)
+	assert.Nil(t, err)
+	assert.False(t, ok)
+}
+
+func TestListRequests(t *testing.T) {
+	db, cleanup := openTempDB(t)
+	defer cleanup()
+
+	var (
+		list  = mustAddress("dev@example.com")
+		alice = mustAddress("alice@example.org")
+	)
+
+	assert.Nil(t, db.AddListRequest(&ListRequest{
+		Token:   "fresh",
+		List:    list,
+		Address: alice,
+		Action:  ListSubscribe,
+		Date:    time.Now(),
+	}))
+
+	assert.Nil(t, db.AddListRequest(&ListRequest{
+		Token:   "stale",
+		List:    list,
+		Address: alice,
+		Action:  ListUnsubscribe,
+		Date:    time.Now().Add(-time.Hour * 48),
+	}))
+
+	_, err := db.TakeListRequest("stale", time.Hour*24)
+	assert.Equal(t, sql.ErrNoRows, err)
+
+	r, err := db.TakeListRequest("fresh", time.Hour*24)
+	assert.Nil(t, err)
+	assert.Equal(t, ListSubscribe, r.Action)
+	assert.Equal(t, "alice@example.org", r.Address.String())
+
+	// requests can only be confirmed once
+	_, err = db.TakeListRequest("fresh", time.Hour*24)
+	assert.Equal(t, sql.ErrNoRows, err)
+}
+
+func TestUnsubscribeToken(t *testing.T) {
+	db, cleanup := openTempDB(t)
+	defer cleanup()
+
+	var (
+		list  = mustAddress("dev@example.com")
+		alice = mustAddress("alice@example.org")
+		bob   = mustAddress("bob@example.org")
+	)
+
+	assert.Nil(t, db.Subscribe(list, alice))
+	assert.Nil(t, db.Subscribe(list, bob))
+
+	subscriptions, err := db.Subscriptions(list)
+	assert.Nil(t, err)
+	assert.Len(t, subscriptions, 2)
+	assert.Len(t, subscriptions[0].Token, 32)
+	assert.NotEqual(t, subscriptions[0].Token, subscriptions[1].Token)
+
+	l, subscription, err := db.UnsubscribeToken(subscriptions[0].Token)
+	assert.Nil(t, err)
+	assert.Equal(t, "dev@example.com", l.String())
+	assert.Equal(t, "alice@example.org", subscription.Address.String())
+
+	_, _, err = db.UnsubscribeToken(subscriptions[0].Token)
+	assert.Equal(t, sql.ErrNoRows, err)
+
+	ok, err := db.IsSubscribed(list, alice)
+	assert.Nil(t, err)
+	assert.False(t, ok)
+}
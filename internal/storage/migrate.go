@@ -0,0 +1,305 @@
+// Copyright (C) 2020  Lukas Dietrich <lukas@lukasdietrich.com>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package storage
+
+import (
+	"database/sql"
+	"fmt"
+)
+
+// migrations is an append-only list of schema changes applied on top of the
+// initial schema. The index of the last applied migration plus one is stored
+// as the "user_version" of the database. Never edit or reorder existing
+// entries, only append new ones.
+var migrations = []string{
+	// 1: track whether a delay warning was sent for a queued mail
+	`
+	alter table "queue"
+	add column "warned" integer not null default 0 ;
+	`,
+
+	// 2: allow administrators to hold queued mails and keep the last error
+	// of each recipient
+	`
+	alter table "queue"
+	add column "held" integer not null default 0 ;
+
+	alter table "queue"
+	add column "errors" blob not null default '{}' ;
+	`,
+
+	// 3: allow a rewritten envelope sender for forwarded mails
+	`
+	alter table "queue"
+	add column "from" varchar ( 256 ) not null default '' ;
+	`,
+
+	// 4: lease queue elements during delivery, so an interrupted attempt is
+	// picked up again once the lease expires
+	`
+	alter table "queue"
+	add column "lease" integer not null default 0 ;
+	`,
+
+	// 5: keep derived keys for sasl scram authentication and an optional
+	// shared secret for pop3 apop authentication
+	`
+	alter table "mailboxes"
+	add column "scram" blob ;
+
+	alter table "mailboxes"
+	add column "apop" varchar ( 256 ) ;
+	`,
+
+	// 6: per mailbox retention policies, which need to know when an entry
+	// was first retrieved
+	`
+	alter table "mailboxes"
+	add column "retention" integer not null default 0 ;
+
+	alter table "mailboxes"
+	add column "expiry" varchar ( 16 ) not null default 'received' ;
+
+	alter table "entries"
+	add column "retrieved" integer not null default 0 ;
+	`,
+
+	// 7: per mailbox quotas and whether the owner was warned about reaching
+	// the soft limit
+	`
+	alter table "mailboxes"
+	add column "quota" integer not null default 0 ;
+
+	alter table "mailboxes"
+	add column "quotaMessages" integer not null default 0 ;
+
+	alter table "mailboxes"
+	add column "quotaWarned" integer not null default 0 ;
+	`,
+
+	// 8: mailing list subscribers and pending subscription requests, which
+	// need to be confirmed by the subscriber
+	`
+	create table "subscribers" (
+		"list"     varchar ( 256 ) not null ,
+		"address"  varchar ( 256 ) not null ,
+		"date"     integer         not null ,
+
+		primary key ( "list", "address" )
+	) ;
+
+	create table "listRequests" (
+		"token"    char ( 36 )     primary key ,
+		"list"     varchar ( 256 ) not null ,
+		"address"  varchar ( 256 ) not null ,
+		"action"   varchar ( 16 )  not null ,
+		"date"     integer         not null
+	) ;
+	`,
+
+	// 9: addresses and domains managed in the database in addition to the
+	// addressbook file. An address either belongs to a mailbox or is an
+	// alias of another address.
+	`
+	create table "domains" (
+		"name"     varchar ( 256 ) primary key
+	) ;
+
+	create table "addresses" (
+		"domain"   varchar ( 256 ) not null ,
+		"user"     varchar ( 64 )  not null ,
+		"mailbox"  integer ,
+		"target"   varchar ( 256 ) ,
+
+		primary key ( "domain", "user" ) ,
+		foreign key ( "mailbox" ) references "mailboxes" ( "id" )
+	) ;
+	`,
+
+	// 10: per domain settings
+	`
+	alter table "domains"
+	add column "catchAll" varchar ( 256 ) ;
+
+	alter table "domains"
+	add column "dkimSelector" varchar ( 64 ) not null default '' ;
+
+	alter table "domains"
+	add column "tlsCertificate" varchar ( 256 ) not null default '' ;
+
+	alter table "domains"
+	add column "tlsKey" varchar ( 256 ) not null default '' ;
+
+	alter table "domains"
+	add column "maxSize" integer not null default 0 ;
+
+	alter table "domains"
+	add column "backup" integer not null default 0 ;
+	`,
+
+	// 11: addresses besides their own, which mailboxes may send as. A pattern
+	// is either an address or "*@domain" for any address of a domain.
+	`
+	create table "sendAs" (
+		"mailbox"  integer         not null ,
+		"pattern"  varchar ( 256 ) not null ,
+
+		primary key ( "mailbox", "pattern" ) ,
+		foreign key ( "mailbox" ) references "mailboxes" ( "id" )
+	) ;
+	`,
+
+	// 12: sieve scripts of mailboxes, of which at most one is active, the
+	// folder and flags an entry was filed with and the senders a vacation
+	// response was sent to
+	`
+	create table "sieveScripts" (
+		"mailbox"  integer         not null ,
+		"name"     varchar ( 256 ) not null ,
+		"script"   text            not null ,
+		"active"   integer         not null default 0 ,
+
+		primary key ( "mailbox", "name" ) ,
+		foreign key ( "mailbox" ) references "mailboxes" ( "id" )
+	) ;
+
+	alter table "entries"
+	add column "folder" varchar ( 256 ) not null default 'INBOX' ;
+
+	alter table "entries"
+	add column "flags" varchar ( 256 ) not null default '' ;
+
+	create table "vacationResponses" (
+		"mailbox"  integer         not null ,
+		"sender"   varchar ( 256 ) not null ,
+		"handle"   varchar ( 256 ) not null ,
+		"date"     integer         not null ,
+
+		primary key ( "mailbox", "sender", "handle" ) ,
+		foreign key ( "mailbox" ) references "mailboxes" ( "id" )
+	) ;
+	`,
+
+	// 13: out of office replies managed without sieve. A date of 0 leaves
+	// the period open.
+	`
+	create table "vacations" (
+		"mailbox"   integer         primary key ,
+		"enabled"   integer         not null default 0 ,
+		"subject"   varchar ( 256 ) not null default '' ,
+		"body"      text            not null default '' ,
+		"start"     integer         not null default 0 ,
+		"end"       integer         not null default 0 ,
+		"days"      integer         not null default 7 ,
+		"addresses" varchar ( 1024 ) not null default '' ,
+
+		foreign key ( "mailbox" ) references "mailboxes" ( "id" )
+	) ;
+	`,
+
+	// 14: token statistics of the bayesian spam classifier. Trained mails
+	// are remembered by a key, so training a mail again only changes its
+	// class.
+	`
+	create table "bayesTokens" (
+		"token"     varchar ( 64 )  primary key ,
+		"spam"      integer         not null default 0 ,
+		"ham"       integer         not null default 0
+	) ;
+
+	create table "bayesTrained" (
+		"key"       varchar ( 256 ) primary key ,
+		"spam"      integer         not null
+	) ;
+	`,
+
+	// 15: a mailbox holds one entry of a mail per folder it was filed into
+	`
+	create table "folderEntries" (
+		"mailbox"   integer         not null ,
+		"mail"      char ( 36 )     not null ,
+		"folder"    varchar ( 256 ) not null default 'INBOX' ,
+		"flags"     varchar ( 256 ) not null default '' ,
+		"retrieved" integer         not null default 0 ,
+
+		primary key ( "mailbox", "mail", "folder" ) ,
+		foreign key ( "mailbox" ) references "mailboxes" ( "id"   ) ,
+		foreign key ( "mail"    ) references "mails"     ( "uuid" )
+	) ;
+
+	insert into "folderEntries"
+	( "mailbox", "mail", "folder", "flags", "retrieved" )
+	select "mailbox", "mail", "folder", "flags", "retrieved"
+	from "entries" ;
+
+	drop table "entries" ;
+
+	alter table "folderEntries"
+	rename to "entries" ;
+	`,
+
+	// 16: mails are pending until they were handed to all recipients
+	`
+	alter table "mails"
+	add column "pending" integer not null default 0 ;
+	`,
+
+	// 17: subscriptions carry a token for one-click unsubscribe links
+	`
+	alter table "subscribers"
+	add column "token" char ( 32 ) not null default '' ;
+
+	update "subscribers"
+	set "token" = lower ( hex ( randomblob ( 16 ) ) ) ;
+
+	create unique index "subscribersToken"
+	on "subscribers" ( "token" ) ;
+	`,
+}
+
+// migrate applies all migrations, which are newer than the current schema
+// version of the database.
+func migrate(conn *sql.DB) error {
+	var version int
+
+	if err := conn.QueryRow(`pragma user_version ;`).Scan(&version); err != nil {
+		return err
+	}
+
+	for i := version; i < len(migrations); i++ {
+		tx, err := conn.Begin()
+		if err != nil {
+			return err
+		}
+
+		if _, err := tx.Exec(migrations[i]); err != nil {
+			tx.Rollback() // nolint:errcheck
+			return fmt.Errorf("could not apply migration %d: %w", i+1, err)
+		}
+
+		// pragma statements do not support parameters
+		if _, err := tx.Exec(fmt.Sprintf(`pragma user_version = %d ;`, i+1)); err != nil {
+			tx.Rollback() // nolint:errcheck
+			return err
+		}
+
+		if err := tx.Commit(); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
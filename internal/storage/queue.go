@@ -0,0 +1,353 @@
+// Copyright (C) 2020  Lukas Dietrich <lukas@lukasdietrich.com>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package storage
+
+import (
+	"database/sql"
+	"encoding/json"
+	"time"
+
+	"github.com/lukasdietrich/briefmail/internal/model"
+)
+
+type QueueElement struct {
+	MailID   model.ID
+	Date     time.Time
+	Attempts int
+	Warned   bool
+	Held     bool
+	// Lease is the time until which the element is reserved for a delivery
+	// attempt in progress.
+	Lease time.Time
+	// From is the envelope sender used for delivery. It is nil, if the
+	// sender of the mail is used unchanged.
+	From *model.Address
+	To   []*model.Address
+	// Errors maps recipients to the last error encountered while trying to
+	// deliver to them.
+	Errors map[string]string
+}
+
+type rowScanner interface {
+	Scan(...interface{}) error
+}
+
+func scanQueueElement(row rowScanner) (*QueueElement, error) {
+	var (
+		element QueueElement
+		_date   int64
+		_lease  int64
+		_from   string
+		_to     []byte
+		_errors []byte
+	)
+
+	err := row.Scan(
+		&element.MailID,
+		&_date,
+		&element.Attempts,
+		&element.Warned,
+		&element.Held,
+		&_lease,
+		&_from,
+		&_to,
+		&_errors)
+
+	if err != nil {
+		return nil, err
+	}
+
+	element.Date = time.Unix(_date, 0)
+	element.Lease = time.Unix(_lease, 0)
+
+	if _from != "" {
+		if element.From, err = model.ParseAddress(_from); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := json.Unmarshal(_to, &element.To); err != nil {
+		return nil, err
+	}
+
+	return &element, json.Unmarshal(_errors, &element.Errors)
+}
+
+// PeekQueue returns the queue element, which is due next. Held elements are
+// skipped and leased elements are due once their lease expires.
+func (d *DB) PeekQueue() (*QueueElement, error) {
+	var element *QueueElement
+
+	return element, d.do(func(tx *sql.Tx) error {
+		var err error
+
+		element, err = scanQueueElement(tx.QueryRow(
+			`
+			select "mail", "date", "attempts", "warned", "held", "lease", "from", "to", "errors"
+			from "queue"
+			where "held" = 0
+			order by max ( "date", "lease" ) asc
+			limit 1 ;
+			`))
+
+		return err
+	})
+}
+
+// Queue returns all queue elements ordered by their next attempt.
+func (d *DB) Queue() ([]*QueueElement, error) {
+	var list []*QueueElement
+
+	return list, d.do(func(tx *sql.Tx) error {
+		rows, err := tx.Query(
+			`
+			select "mail", "date", "attempts", "warned", "held", "lease", "from", "to", "errors"
+			from "queue"
+			order by "date" asc ;
+			`)
+
+		if err != nil {
+			return err
+		}
+
+		defer rows.Close() // nolint:errcheck
+
+		for rows.Next() {
+			element, err := scanQueueElement(rows)
+			if err != nil {
+				return err
+			}
+
+			list = append(list, element)
+		}
+
+		return rows.Err()
+	})
+}
+
+// QueueElement returns the queue element of a single mail.
+func (d *DB) QueueElement(mail model.ID) (*QueueElement, error) {
+	var element *QueueElement
+
+	return element, d.do(func(tx *sql.Tx) error {
+		var err error
+
+		element, err = scanQueueElement(tx.QueryRow(
+			`
+			select "mail", "date", "attempts", "warned", "held", "lease", "from", "to", "errors"
+			from "queue"
+			where "mail" = ? ;
+			`, mail))
+
+		return err
+	})
+}
+
+// AddToQueue queues a mail for outbound delivery. If from is non-nil, it
+// replaces the envelope sender of the mail.
+func (d *DB) AddToQueue(mail model.ID, from *model.Address, to []*model.Address) error {
+	_to, err := json.Marshal(to)
+	if err != nil {
+		return err
+	}
+
+	var _from string
+	if from != nil {
+		_from = from.String()
+	}
+
+	return d.do(func(tx *sql.Tx) error {
+		_, err := tx.Exec(
+			`
+			insert into "queue"
+			( "mail", "date", "attempts", "from", "to" )
+			values
+			( ?, '0', '0', ?, ? )
+			`, mail, _from, _to)
+
+		return err
+	})
+}
+
+func (d *DB) UpdateQueue(mail model.ID, to []*model.Address, date time.Time, errors map[string]string) error {
+	_to, err := json.Marshal(to)
+	if err != nil {
+		return err
+	}
+
+	_errors, err := json.Marshal(errors)
+	if err != nil {
+		return err
+	}
+
+	return d.do(func(tx *sql.Tx) error {
+		_, err := tx.Exec(
+			`
+			update "queue"
+			set "date" = ? ,
+			    "attempts" = "attempts" + 1 ,
+			    "lease" = 0 ,
+			    "to" = ? ,
+			    "errors" = ?
+			where "mail" = ? ;
+			`, date.Unix(), _to, _errors, mail)
+
+		return err
+	})
+}
+
+// LeaseQueue reserves a queue element until the given time. The lease is only
+// acquired, if the element is still leased until previous, so concurrent
+// workers cannot acquire the same element. False is returned if the lease
+// could not be acquired.
+func (d *DB) LeaseQueue(mail model.ID, previous, until time.Time) (bool, error) {
+	err := d.updateQueue(
+		`
+		update "queue"
+		set "lease" = ?
+		where "mail" = ?
+		  and "lease" = ? ;
+		`, until.Unix(), mail, previous.Unix())
+
+	if err == sql.ErrNoRows {
+		return false, nil
+	}
+
+	return err == nil, err
+}
+
+// ReleaseQueue gives up the lease of a queue element without counting the
+// delivery attempt.
+func (d *DB) ReleaseQueue(mail model.ID) error {
+	return d.do(func(tx *sql.Tx) error {
+		_, err := tx.Exec(
+			`
+			update "queue"
+			set "lease" = 0
+			where "mail" = ? ;
+			`, mail)
+
+		return err
+	})
+}
+
+// SetQueueRecipients replaces the recipients of a queue element, e.g. to
+// remove recipients as soon as the mail was delivered to them.
+func (d *DB) SetQueueRecipients(mail model.ID, to []*model.Address) error {
+	_to, err := json.Marshal(to)
+	if err != nil {
+		return err
+	}
+
+	return d.do(func(tx *sql.Tx) error {
+		_, err := tx.Exec(
+			`
+			update "queue"
+			set "to" = ?
+			where "mail" = ? ;
+			`, _to, mail)
+
+		return err
+	})
+}
+
+// ResetQueue replaces the recipients of a queued mail and schedules it for
+// immediate delivery as if it was just queued.
+func (d *DB) ResetQueue(mail model.ID, to []*model.Address) error {
+	_to, err := json.Marshal(to)
+	if err != nil {
+		return err
+	}
+
+	return d.updateQueue(
+		`
+		update "queue"
+		set "date" = 0 ,
+		    "attempts" = 0 ,
+		    "warned" = 0 ,
+		    "held" = 0 ,
+		    "to" = ? ,
+		    "errors" = '{}'
+		where "mail" = ? ;
+		`, _to, mail)
+}
+
+// RescheduleQueue sets the time of the next attempt of a queued mail.
+func (d *DB) RescheduleQueue(mail model.ID, date time.Time) error {
+	return d.updateQueue(
+		`
+		update "queue"
+		set "date" = ?
+		where "mail" = ? ;
+		`, date.Unix(), mail)
+}
+
+// HoldQueue excludes a queued mail from delivery until it is released again.
+func (d *DB) HoldQueue(mail model.ID, held bool) error {
+	return d.updateQueue(
+		`
+		update "queue"
+		set "held" = ?
+		where "mail" = ? ;
+		`, held, mail)
+}
+
+func (d *DB) MarkQueueWarned(mail model.ID) error {
+	return d.do(func(tx *sql.Tx) error {
+		_, err := tx.Exec(
+			`
+			update "queue"
+			set "warned" = 1
+			where "mail" = ? ;
+			`, mail)
+
+		return err
+	})
+}
+
+func (d *DB) DeleteFromQueue(mail model.ID) error {
+	return d.do(func(tx *sql.Tx) error {
+		_, err := tx.Exec(
+			`
+			delete from "queue"
+			where "mail" = ? ;
+			`, mail)
+
+		return err
+	})
+}
+
+// updateQueue executes a single update statement and returns sql.ErrNoRows
+// if no queue element was affected.
+func (d *DB) updateQueue(query string, args ...interface{}) error {
+	return d.do(func(tx *sql.Tx) error {
+		result, err := tx.Exec(query, args...)
+		if err != nil {
+			return err
+		}
+
+		ar, err := result.RowsAffected()
+		if err != nil {
+			return err
+		}
+
+		if ar < 1 {
+			return sql.ErrNoRows
+		}
+
+		return nil
+	})
+}
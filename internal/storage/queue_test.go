@@ -0,0 +1,128 @@
+// Copyright (C) 2020  Lukas Dietrich <lukas@lukasdietrich.com>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package storage
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/lukasdietrich/briefmail/internal/model"
+)
+
+func openTempDB(t *testing.T) (*DB, func()) {
+	dir, err := ioutil.TempDir("", "briefmail")
+	assert.Nil(t, err)
+
+	viper.Set("storage.database.filename", filepath.Join(dir, "db.sqlite"))
+
+	db, err := NewDB()
+	assert.Nil(t, err)
+
+	return db, func() {
+		db.Close()
+		os.RemoveAll(dir)
+	}
+}
+
+func mustAddress(raw string) *model.Address {
+	addr, err := model.ParseAddress(raw)
+	if err != nil {
+		panic(err)
+	}
+
+	return addr
+}
+
+func TestQueueLease(t *testing.T) {
+	db, cleanup := openTempDB(t)
+	defer cleanup()
+
+	var (
+		id       = model.NewID()
+		from     = mustAddress("sender@example.com")
+		to       = []*model.Address{mustAddress("a@example.com"), mustAddress("b@example.org")}
+		envelope = model.Envelope{Date: time.Now(), From: from}
+		now      = time.Now().Truncate(time.Second)
+	)
+
+	assert.Nil(t, db.AddMail(id, 100, 0, &envelope))
+	assert.Nil(t, db.AddToQueue(id, nil, to))
+
+	elem, err := db.PeekQueue()
+	assert.Nil(t, err)
+	assert.Equal(t, id, elem.MailID)
+	assert.Nil(t, elem.From)
+	assert.Len(t, elem.To, 2)
+
+	ok, err := db.LeaseQueue(id, elem.Lease, now.Add(time.Minute))
+	assert.Nil(t, err)
+	assert.True(t, ok)
+
+	// a second worker holding the stale element cannot acquire the lease
+	ok, err = db.LeaseQueue(id, elem.Lease, now.Add(time.Minute))
+	assert.Nil(t, err)
+	assert.False(t, ok)
+
+	elem, err = db.PeekQueue()
+	assert.Nil(t, err)
+	assert.Equal(t, now.Add(time.Minute), elem.Lease)
+
+	assert.Nil(t, db.SetQueueRecipients(id, to[1:]))
+	assert.Nil(t, db.UpdateQueue(id, to[1:], now.Add(time.Hour), map[string]string{
+		"b@example.org": "451 try again later",
+	}))
+
+	elem, err = db.QueueElement(id)
+	assert.Nil(t, err)
+	assert.Equal(t, 1, elem.Attempts)
+	assert.Equal(t, time.Unix(0, 0), elem.Lease)
+	assert.Equal(t, now.Add(time.Hour), elem.Date)
+	assert.Equal(t, "451 try again later", elem.Errors["b@example.org"])
+	assert.Len(t, elem.To, 1)
+}
+
+func TestQueueHold(t *testing.T) {
+	db, cleanup := openTempDB(t)
+	defer cleanup()
+
+	var (
+		id       = model.NewID()
+		from     = mustAddress("sender@example.com")
+		envelope = model.Envelope{Date: time.Now(), From: from}
+	)
+
+	assert.Nil(t, db.AddMail(id, 100, 0, &envelope))
+	assert.Nil(t, db.AddToQueue(id, from, []*model.Address{from}))
+
+	assert.Nil(t, db.HoldQueue(id, true))
+
+	_, err := db.PeekQueue()
+	assert.Error(t, err)
+
+	assert.Nil(t, db.HoldQueue(id, false))
+
+	elem, err := db.PeekQueue()
+	assert.Nil(t, err)
+	assert.Equal(t, from.String(), elem.From.String())
+
+	assert.Error(t, db.HoldQueue(model.NewID(), true))
+}
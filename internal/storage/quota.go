@@ -0,0 +1,120 @@
+// Copyright (C) 2020  Lukas Dietrich <lukas@lukasdietrich.com>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package storage
+
+import (
+	"database/sql"
+)
+
+// Quota limits the storage used by a mailbox. A value of 0 is unlimited.
+type Quota struct {
+	// Size is the maximum total size of all mails in bytes.
+	Size int64
+	// Messages is the maximum number of mails.
+	Messages int64
+}
+
+// Usage is the storage currently used by a mailbox.
+type Usage struct {
+	Size     int64
+	Messages int64
+	// Warned is true if the owner was warned about reaching the soft limit.
+	Warned bool
+}
+
+// Exceeded returns true if adding a mail of the given size exceeds the quota.
+func (q *Quota) Exceeded(u *Usage, size int64) bool {
+	return (q.Size > 0 && u.Size+size > q.Size) ||
+		(q.Messages > 0 && u.Messages+1 > q.Messages)
+}
+
+// Reached returns true if the usage reached the given fraction of the quota.
+func (q *Quota) Reached(u *Usage, fraction float64) bool {
+	return (q.Size > 0 && float64(u.Size) >= float64(q.Size)*fraction) ||
+		(q.Messages > 0 && float64(u.Messages) >= float64(q.Messages)*fraction)
+}
+
+// Quota returns the quota and current usage of a mailbox.
+func (d *DB) Quota(mailbox int64) (*Quota, *Usage, error) {
+	var (
+		q Quota
+		u Usage
+	)
+
+	return &q, &u, d.do(func(tx *sql.Tx) error {
+		return tx.QueryRow(
+			`
+			select "b"."quota",
+			       "b"."quotaMessages",
+			       "b"."quotaWarned",
+			       count ( "m"."uuid" ),
+			       coalesce ( sum ( "m"."size" ), 0 )
+			from "mailboxes" as "b"
+				left join (
+						select distinct "mailbox", "mail"
+						from "entries"
+					) as "e"
+					on "e"."mailbox" = "b"."id"
+				left join "mails" as "m"
+					on "m"."uuid" = "e"."mail"
+			where "b"."id" = ?
+			group by "b"."id" ;
+			`, mailbox).Scan(&q.Size, &q.Messages, &u.Warned, &u.Messages, &u.Size)
+	})
+}
+
+// SetQuota updates the quota of a mailbox.
+func (d *DB) SetQuota(name string, q *Quota) error {
+	return d.do(func(tx *sql.Tx) error {
+		result, err := tx.Exec(
+			`
+			update "mailboxes"
+			set "quota" = ? ,
+			    "quotaMessages" = ?
+			where "name" = ? ;
+			`, q.Size, q.Messages, name)
+
+		if err != nil {
+			return err
+		}
+
+		ar, err := result.RowsAffected()
+		if err != nil {
+			return err
+		}
+
+		if ar == 0 {
+			return sql.ErrNoRows
+		}
+
+		return nil
+	})
+}
+
+// SetQuotaWarned remembers whether the owner of a mailbox was warned about
+// reaching the soft limit.
+func (d *DB) SetQuotaWarned(mailbox int64, warned bool) error {
+	return d.do(func(tx *sql.Tx) error {
+		_, err := tx.Exec(
+			`
+			update "mailboxes"
+			set "quotaWarned" = ?
+			where "id" = ? ;
+			`, warned, mailbox)
+
+		return err
+	})
+}
@@ -0,0 +1,69 @@
+// Copyright (C) 2020  Lukas Dietrich <lukas@lukasdietrich.com>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package storage
+
+import (
+	"database/sql"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/lukasdietrich/briefmail/internal/model"
+)
+
+func TestQuota(t *testing.T) {
+	db, cleanup := openTempDB(t)
+	defer cleanup()
+
+	mailbox, err := db.AddMailbox("user", "secret")
+	assert.Nil(t, err)
+
+	q, u, err := db.Quota(mailbox)
+	assert.Nil(t, err)
+	assert.Equal(t, &Quota{}, q)
+	assert.Equal(t, &Usage{}, u)
+	assert.False(t, q.Exceeded(u, 1<<30))
+
+	assert.Nil(t, db.SetQuota("user", &Quota{Size: 1000, Messages: 2}))
+
+	for i := 0; i < 2; i++ {
+		id := model.NewID()
+		envelope := model.Envelope{Date: time.Now(), From: mustAddress("sender@example.com")}
+
+		assert.Nil(t, db.AddMail(id, 400, 0, &envelope))
+		assert.Nil(t, db.AddEntries(id, []int64{mailbox}))
+	}
+
+	assert.Nil(t, db.SetQuotaWarned(mailbox, true))
+
+	q, u, err = db.Quota(mailbox)
+	assert.Nil(t, err)
+	assert.Equal(t, &Usage{Size: 800, Messages: 2, Warned: true}, u)
+	assert.True(t, q.Exceeded(u, 0))
+	assert.True(t, q.Reached(u, 0.9))
+
+	assert.Nil(t, db.SetQuota("user", &Quota{Size: 1000}))
+
+	q, u, err = db.Quota(mailbox)
+	assert.Nil(t, err)
+	assert.False(t, q.Exceeded(u, 200))
+	assert.True(t, q.Exceeded(u, 201))
+	assert.True(t, q.Reached(u, 0.8))
+	assert.False(t, q.Reached(u, 0.9))
+
+	assert.Equal(t, sql.ErrNoRows, db.SetQuota("unknown", q))
+}
@@ -0,0 +1,188 @@
+// Copyright (C) 2020  Lukas Dietrich <lukas@lukasdietrich.com>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package storage
+
+import (
+	"database/sql"
+	"errors"
+	"time"
+
+	"github.com/lukasdietrich/briefmail/internal/model"
+)
+
+const (
+	// ExpireReceived deletes mails a number of days after they were received.
+	ExpireReceived = "received"
+	// ExpireRetrieved deletes mails a number of days after they were first
+	// retrieved. Mails that were never retrieved are kept.
+	ExpireRetrieved = "retrieved"
+
+	day = int64(time.Hour * 24 / time.Second)
+)
+
+// ErrInvalidExpiry is returned for unknown expiry modes.
+var ErrInvalidExpiry = errors.New("storage: invalid expiry mode")
+
+// Retention is the retention policy of a mailbox.
+type Retention struct {
+	// Days is the number of days mails are retained. A value of 0 retains
+	// mails forever.
+	Days int
+	// Expiry is either ExpireReceived or ExpireRetrieved.
+	Expiry string
+}
+
+// Retention returns the retention policy of a mailbox.
+func (d *DB) Retention(mailbox int64) (*Retention, error) {
+	var r Retention
+
+	return &r, d.do(func(tx *sql.Tx) error {
+		return tx.QueryRow(
+			`
+			select "retention", "expiry"
+			from "mailboxes"
+			where "id" = ? ;
+			`, mailbox).Scan(&r.Days, &r.Expiry)
+	})
+}
+
+// SetRetention updates the retention policy of a mailbox.
+func (d *DB) SetRetention(name string, r *Retention) error {
+	if r.Expiry != ExpireReceived && r.Expiry != ExpireRetrieved {
+		return ErrInvalidExpiry
+	}
+
+	if r.Days < 0 {
+		r.Days = 0
+	}
+
+	return d.do(func(tx *sql.Tx) error {
+		result, err := tx.Exec(
+			`
+			update "mailboxes"
+			set "retention" = ? ,
+			    "expiry" = ?
+			where "name" = ? ;
+			`, r.Days, r.Expiry, name)
+
+		if err != nil {
+			return err
+		}
+
+		ar, err := result.RowsAffected()
+		if err != nil {
+			return err
+		}
+
+		if ar == 0 {
+			return sql.ErrNoRows
+		}
+
+		return nil
+	})
+}
+
+// ShortestRetention returns the shortest retention of all mailboxes in days,
+// or 0 if all mailboxes retain mails forever.
+func (d *DB) ShortestRetention() (int, error) {
+	var days sql.NullInt64
+
+	return int(days.Int64), d.do(func(tx *sql.Tx) error {
+		return tx.QueryRow(
+			`
+			select min ( "retention" )
+			from "mailboxes"
+			where "retention" > 0 ;
+			`).Scan(&days)
+	})
+}
+
+// MarkRetrieved remembers when mails of a mailbox were first retrieved.
+func (d *DB) MarkRetrieved(mails []model.ID, mailbox int64, date time.Time) error {
+	return d.do(func(tx *sql.Tx) error {
+		stmt, err := tx.Prepare(
+			`
+			update "entries"
+			set "retrieved" = ?
+			where "mailbox" = ?
+			  and "mail" = ?
+			  and "retrieved" = 0 ;
+			`)
+
+		if err != nil {
+			return err
+		}
+
+		defer stmt.Close() // nolint:errcheck
+
+		for _, mail := range mails {
+			if _, err := stmt.Exec(date.Unix(), mailbox, mail); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+}
+
+// ExpiredEntries returns all entries, which exceed the retention policy of
+// their mailbox at the given time, grouped by mailbox.
+func (d *DB) ExpiredEntries(now time.Time) (map[int64][]model.ID, error) {
+	expired := make(map[int64][]model.ID)
+
+	return expired, d.do(func(tx *sql.Tx) error {
+		rows, err := tx.Query(
+			`
+			select distinct "e"."mailbox", "e"."mail"
+			from "entries" as "e"
+				inner join "mailboxes" as "b"
+					on "b"."id" = "e"."mailbox"
+				inner join "mails" as "m"
+					on "m"."uuid" = "e"."mail"
+			where "b"."retention" > 0
+			  and (
+					( "b"."expiry" = ?
+					  and "m"."date" <= ? - "b"."retention" * ? )
+				 or ( "b"."expiry" = ?
+					  and "e"."retrieved" > 0
+					  and "e"."retrieved" <= ? - "b"."retention" * ? )
+				  ) ;
+			`,
+			ExpireReceived, now.Unix(), day,
+			ExpireRetrieved, now.Unix(), day)
+
+		if err != nil {
+			return err
+		}
+
+		defer rows.Close() // nolint:errcheck
+
+		var (
+			mailbox int64
+			mail    model.ID
+		)
+
+		for rows.Next() {
+			if err := rows.Scan(&mailbox, &mail); err != nil {
+				return err
+			}
+
+			expired[mailbox] = append(expired[mailbox], mail)
+		}
+
+		return rows.Err()
+	})
+}
@@ -0,0 +1,77 @@
+// Copyright (C) 2020  Lukas Dietrich <lukas@lukasdietrich.com>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package storage
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/lukasdietrich/briefmail/internal/model"
+)
+
+func TestExpiredEntries(t *testing.T) {
+	db, cleanup := openTempDB(t)
+	defer cleanup()
+
+	var (
+		now    = time.Now().Truncate(time.Second)
+		from   = mustAddress("sender@example.com")
+		old    = model.NewID()
+		recent = model.NewID()
+	)
+
+	received, err := db.AddMailbox("received", "secret")
+	assert.Nil(t, err)
+
+	retrieved, err := db.AddMailbox("retrieved", "secret")
+	assert.Nil(t, err)
+
+	forever, err := db.AddMailbox("forever", "secret")
+	assert.Nil(t, err)
+
+	assert.Nil(t, db.SetRetention("received", &Retention{Days: 7, Expiry: ExpireReceived}))
+	assert.Nil(t, db.SetRetention("retrieved", &Retention{Days: 1, Expiry: ExpireRetrieved}))
+	assert.Equal(t, ErrInvalidExpiry, db.SetRetention("forever", &Retention{Days: 1, Expiry: "never"}))
+
+	days, err := db.ShortestRetention()
+	assert.Nil(t, err)
+	assert.Equal(t, 1, days)
+
+	assert.Nil(t, db.AddMail(old, 100, 0, &model.Envelope{Date: now.Add(-time.Hour * 24 * 10), From: from}))
+	assert.Nil(t, db.AddMail(recent, 100, 0, &model.Envelope{Date: now, From: from}))
+
+	for _, id := range []model.ID{old, recent} {
+		assert.Nil(t, db.AddEntries(id, []int64{received, retrieved, forever}))
+	}
+
+	expired, err := db.ExpiredEntries(now)
+	assert.Nil(t, err)
+	assert.Equal(t, map[int64][]model.ID{received: {old}}, expired)
+
+	// only the first retrieval counts
+	assert.Nil(t, db.MarkRetrieved([]model.ID{old}, retrieved, now.Add(-time.Hour*48)))
+	assert.Nil(t, db.MarkRetrieved([]model.ID{old, recent}, retrieved, now))
+
+	expired, err = db.ExpiredEntries(now)
+	assert.Nil(t, err)
+	assert.Equal(t, map[int64][]model.ID{received: {old}, retrieved: {old}}, expired)
+
+	r, err := db.Retention(forever)
+	assert.Nil(t, err)
+	assert.Equal(t, &Retention{Days: 0, Expiry: ExpireReceived}, r)
+}
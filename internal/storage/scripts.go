@@ -0,0 +1,311 @@
+// Copyright (C) 2020  Lukas Dietrich <lukas@lukasdietrich.com>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package storage
+
+import (
+	"database/sql"
+	"errors"
+	"strings"
+	"time"
+
+	"github.com/lukasdietrich/briefmail/internal/model"
+)
+
+var (
+	// ErrScriptExists is returned if a script is renamed to the name of
+	// another script.
+	ErrScriptExists = errors.New("storage: script already exists")
+)
+
+// SieveScript is a sieve script of a mailbox.
+type SieveScript struct {
+	Name   string
+	Active bool
+}
+
+// Scripts returns the sieve scripts of a mailbox ordered by name.
+func (d *DB) Scripts(mailbox int64) ([]SieveScript, error) {
+	var scripts []SieveScript
+
+	return scripts, d.do(func(tx *sql.Tx) error {
+		rows, err := tx.Query(
+			`
+			select "name", "active"
+			from "sieveScripts"
+			where "mailbox" = ?
+			order by "name" ;
+			`, mailbox)
+
+		if err != nil {
+			return err
+		}
+
+		defer rows.Close() // nolint:errcheck
+
+		for rows.Next() {
+			var script SieveScript
+
+			if err := rows.Scan(&script.Name, &script.Active); err != nil {
+				return err
+			}
+
+			scripts = append(scripts, script)
+		}
+
+		return rows.Err()
+	})
+}
+
+// Script returns the source of a sieve script.
+func (d *DB) Script(mailbox int64, name string) (string, error) {
+	var script string
+
+	return script, d.do(func(tx *sql.Tx) error {
+		return tx.QueryRow(
+			`
+			select "script"
+			from "sieveScripts"
+			where "mailbox" = ?
+			  and "name" = ? ;
+			`, mailbox, name).Scan(&script)
+	})
+}
+
+// ActiveScript returns the source of the active sieve script of a mailbox.
+// sql.ErrNoRows is returned if no script is active.
+func (d *DB) ActiveScript(mailbox int64) (string, error) {
+	var script string
+
+	return script, d.do(func(tx *sql.Tx) error {
+		return tx.QueryRow(
+			`
+			select "script"
+			from "sieveScripts"
+			where "mailbox" = ?
+			  and "active" = 1 ;
+			`, mailbox).Scan(&script)
+	})
+}
+
+// PutScript creates or replaces a sieve script. Replacing a script keeps it
+// active.
+func (d *DB) PutScript(mailbox int64, name, script string) error {
+	return d.do(func(tx *sql.Tx) error {
+		_, err := tx.Exec(
+			`
+			insert into "sieveScripts"
+			( "mailbox", "name", "script" )
+			values
+			( ?, ?, ? )
+			on conflict ( "mailbox", "name" )
+			do update set "script" = excluded."script" ;
+			`, mailbox, name, script)
+
+		return err
+	})
+}
+
+// SetActiveScript activates a sieve script and deactivates all others. An
+// empty name deactivates all scripts. sql.ErrNoRows is returned if the script
+// does not exist.
+func (d *DB) SetActiveScript(mailbox int64, name string) error {
+	return d.do(func(tx *sql.Tx) error {
+		if name != "" {
+			var exists int
+
+			err := tx.QueryRow(
+				`
+				select 1
+				from "sieveScripts"
+				where "mailbox" = ?
+				  and "name" = ? ;
+				`, mailbox, name).Scan(&exists)
+
+			if err != nil {
+				return err
+			}
+		}
+
+		_, err := tx.Exec(
+			`
+			update "sieveScripts"
+			set "active" = ( "name" = ? )
+			where "mailbox" = ? ;
+			`, name, mailbox)
+
+		return err
+	})
+}
+
+// RenameScript renames a sieve script. sql.ErrNoRows is returned if the
+// script does not exist and ErrScriptExists if the new name is taken.
+func (d *DB) RenameScript(mailbox int64, name, newName string) error {
+	return d.do(func(tx *sql.Tx) error {
+		var count int
+
+		err := tx.QueryRow(
+			`
+			select count ( * )
+			from "sieveScripts"
+			where "mailbox" = ?
+			  and "name" = ? ;
+			`, mailbox, newName).Scan(&count)
+
+		if err != nil {
+			return err
+		}
+
+		if count > 0 {
+			return ErrScriptExists
+		}
+
+		result, err := tx.Exec(
+			`
+			update "sieveScripts"
+			set "name" = ?
+			where "mailbox" = ?
+			  and "name" = ? ;
+			`, newName, mailbox, name)
+
+		if err != nil {
+			return err
+		}
+
+		ar, err := result.RowsAffected()
+		if err != nil {
+			return err
+		}
+
+		if ar < 1 {
+			return sql.ErrNoRows
+		}
+
+		return nil
+	})
+}
+
+// DeleteScript deletes a sieve script. sql.ErrNoRows is returned if the
+// script does not exist.
+func (d *DB) DeleteScript(mailbox int64, name string) error {
+	return d.do(func(tx *sql.Tx) error {
+		result, err := tx.Exec(
+			`
+			delete from "sieveScripts"
+			where "mailbox" = ?
+			  and "name" = ? ;
+			`, mailbox, name)
+
+		if err != nil {
+			return err
+		}
+
+		ar, err := result.RowsAffected()
+		if err != nil {
+			return err
+		}
+
+		if ar < 1 {
+			return sql.ErrNoRows
+		}
+
+		return nil
+	})
+}
+
+// AddEntry delivers a mail to a folder of a mailbox with a set of flags. A
+// mail already delivered to the folder is left unchanged.
+func (d *DB) AddEntry(mail model.ID, mailbox int64, folder string, flags []string) error {
+	return d.do(func(tx *sql.Tx) error {
+		_, err := tx.Exec(
+			`
+			insert or ignore into "entries"
+			( "mailbox", "mail", "folder", "flags" )
+			values
+			( ?, ?, ?, ? ) ;
+			`, mailbox, mail, folder, strings.Join(flags, " "))
+
+		return err
+	})
+}
+
+// VacationReplied returns true if a vacation response with the handle was
+// sent to a sender after the given date.
+func (d *DB) VacationReplied(mailbox int64, sender *model.Address, handle string, since time.Time) (bool, error) {
+	var count int
+
+	return count > 0, d.do(func(tx *sql.Tx) error {
+		return tx.QueryRow(
+			`
+			select count ( * )
+			from "vacationResponses"
+			where "mailbox" = ?
+			  and "sender" = ?
+			  and "handle" = ?
+			  and "date" > ? ;
+			`, mailbox, addressKey(sender), handle, since.Unix()).Scan(&count)
+	})
+}
+
+// AddVacationReply remembers that a vacation response was sent to a sender.
+func (d *DB) AddVacationReply(mailbox int64, sender *model.Address, handle string, date time.Time) error {
+	return d.do(func(tx *sql.Tx) error {
+		_, err := tx.Exec(
+			`
+			insert or replace into "vacationResponses"
+			( "mailbox", "sender", "handle", "date" )
+			values
+			( ?, ?, ?, ? ) ;
+			`, mailbox, addressKey(sender), handle, date.Unix())
+
+		return err
+	})
+}
+
+// FolderEntries returns the mails of a mailbox, which are filed into a
+// folder.
+func (d *DB) FolderEntries(mailbox int64, folder string) ([]Entry, error) {
+	var list []Entry
+
+	return list, d.do(func(tx *sql.Tx) error {
+		rows, err := tx.Query(
+			`
+			select "m"."uuid", "m"."size"
+			from "mails" as "m"
+				inner join "entries" as "e"
+					on "m"."uuid" = "e"."mail"
+			where "e"."mailbox" = ? and "e"."folder" = ?
+			order by "m"."date" desc ;
+			`, mailbox, folder)
+
+		if err != nil {
+			return err
+		}
+
+		defer rows.Close() // nolint:errcheck
+
+		var entry Entry
+
+		for rows.Next() {
+			if err := rows.Scan(&entry.MailID, &entry.Size); err != nil {
+				return err
+			}
+
+			list = append(list, entry)
+		}
+
+		return rows.Err()
+	})
+}
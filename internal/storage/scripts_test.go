@@ -0,0 +1,133 @@
+// Copyright (C) 2020  Lukas Dietrich <lukas@lukasdietrich.com>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package storage
+
+import (
+	"database/sql"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/lukasdietrich/briefmail/internal/model"
+)
+
+func TestScripts(t *testing.T) {
+	db, cleanup := openTempDB(t)
+	defer cleanup()
+
+	mailbox, err := db.AddMailbox("user", "secret")
+	assert.Nil(t, err)
+
+	_, err = db.ActiveScript(mailbox)
+	assert.Equal(t, sql.ErrNoRows, err)
+
+	assert.Nil(t, db.PutScript(mailbox, "main", "keep;"))
+	assert.Nil(t, db.PutScript(mailbox, "other", "discard;"))
+	assert.Equal(t, sql.ErrNoRows, db.SetActiveScript(mailbox, "unknown"))
+	assert.Nil(t, db.SetActiveScript(mailbox, "main"))
+	assert.Nil(t, db.PutScript(mailbox, "main", "stop;"))
+
+	script, err := db.ActiveScript(mailbox)
+	assert.Nil(t, err)
+	assert.Equal(t, "stop;", script)
+
+	script, err = db.Script(mailbox, "other")
+	assert.Nil(t, err)
+	assert.Equal(t, "discard;", script)
+
+	assert.Nil(t, db.SetActiveScript(mailbox, "other"))
+
+	scripts, err := db.Scripts(mailbox)
+	assert.Nil(t, err)
+	assert.Equal(t, []SieveScript{{Name: "main"}, {Name: "other", Active: true}}, scripts)
+
+	assert.Nil(t, db.SetActiveScript(mailbox, ""))
+	_, err = db.ActiveScript(mailbox)
+	assert.Equal(t, sql.ErrNoRows, err)
+
+	assert.Equal(t, ErrScriptExists, db.RenameScript(mailbox, "main", "other"))
+	assert.Equal(t, sql.ErrNoRows, db.RenameScript(mailbox, "unknown", "new"))
+	assert.Nil(t, db.RenameScript(mailbox, "other", "renamed"))
+
+	assert.Nil(t, db.DeleteScript(mailbox, "main"))
+	assert.Equal(t, sql.ErrNoRows, db.DeleteScript(mailbox, "main"))
+}
+
+func TestVacationReplies(t *testing.T) {
+	db, cleanup := openTempDB(t)
+	defer cleanup()
+
+	var (
+		sender = mustAddress("Sender@example.com")
+		now    = time.Now()
+	)
+
+	replied, err := db.VacationReplied(1, sender, "away", now.Add(-time.Hour))
+	assert.Nil(t, err)
+	assert.False(t, replied)
+
+	assert.Nil(t, db.AddVacationReply(1, sender, "away", now))
+
+	replied, err = db.VacationReplied(1, mustAddress("sender@example.com"), "away", now.Add(-time.Hour))
+	assert.Nil(t, err)
+	assert.True(t, replied)
+
+	replied, err = db.VacationReplied(1, sender, "other", now.Add(-time.Hour))
+	assert.Nil(t, err)
+	assert.False(t, replied)
+
+	replied, err = db.VacationReplied(1, sender, "away", now.Add(time.Hour))
+	assert.Nil(t, err)
+	assert.False(t, replied)
+}
+
+func TestFolderEntries(t *testing.T) {
+	db, cleanup := openTempDB(t)
+	defer cleanup()
+
+	mailbox, err := db.AddMailbox("user", "secret")
+	assert.Nil(t, err)
+
+	id := model.NewID()
+	envelope := model.Envelope{Date: time.Now(), From: mustAddress("sender@example.com")}
+
+	assert.Nil(t, db.AddMail(id, 400, 0, &envelope))
+	assert.Nil(t, db.AddEntry(id, mailbox, "INBOX", nil))
+	assert.Nil(t, db.AddEntry(id, mailbox, "Archive", []string{"\\Seen"}))
+	assert.Nil(t, db.AddEntry(id, mailbox, "INBOX", []string{"\\Flagged"}))
+
+	for _, folder := range []string{"INBOX", "Archive"} {
+		entries, err := db.FolderEntries(mailbox, folder)
+		assert.Nil(t, err)
+		assert.Equal(t, []Entry{{MailID: id, Size: 400}}, entries, folder)
+	}
+
+	entries, size, err := db.Entries(mailbox)
+	assert.Nil(t, err)
+	assert.Equal(t, []Entry{{MailID: id, Size: 400}}, entries)
+	assert.Equal(t, int64(400), size)
+
+	_, u, err := db.Quota(mailbox)
+	assert.Nil(t, err)
+	assert.Equal(t, &Usage{Size: 400, Messages: 1}, u)
+
+	assert.Nil(t, db.DeleteEntries([]model.ID{id}, mailbox))
+
+	entries, _, err = db.Entries(mailbox)
+	assert.Nil(t, err)
+	assert.Empty(t, entries)
+}
@@ -0,0 +1,135 @@
+// Copyright (C) 2020  Lukas Dietrich <lukas@lukasdietrich.com>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package storage
+
+import (
+	"database/sql"
+
+	"github.com/lukasdietrich/briefmail/internal/model"
+)
+
+// SendAs returns the patterns of addresses a mailbox was granted to send as.
+func (d *DB) SendAs(name string) ([]string, error) {
+	var patterns []string
+
+	return patterns, d.do(func(tx *sql.Tx) error {
+		rows, err := tx.Query(
+			`
+			select "s"."pattern"
+			from "sendAs" as "s"
+				inner join "mailboxes" as "m"
+					on "m"."id" = "s"."mailbox"
+			where "m"."name" = ?
+			order by "s"."pattern" ;
+			`, name)
+
+		if err != nil {
+			return err
+		}
+
+		defer rows.Close() // nolint:errcheck
+
+		for rows.Next() {
+			var pattern string
+
+			if err := rows.Scan(&pattern); err != nil {
+				return err
+			}
+
+			patterns = append(patterns, pattern)
+		}
+
+		return rows.Err()
+	})
+}
+
+// GrantSendAs allows a mailbox to send as an address. A pattern with the user
+// "*" grants all addresses of the domain. sql.ErrNoRows is returned if the
+// mailbox does not exist.
+func (d *DB) GrantSendAs(name string, pattern *model.Address) error {
+	return d.do(func(tx *sql.Tx) error {
+		var id int64
+
+		err := tx.QueryRow(
+			`
+			select "id"
+			from "mailboxes"
+			where "name" = ? ;
+			`, name).Scan(&id)
+
+		if err != nil {
+			return err
+		}
+
+		_, err = tx.Exec(
+			`
+			insert or ignore into "sendAs"
+			( "mailbox", "pattern" )
+			values
+			( ?, ? ) ;
+			`, id, addressKey(pattern))
+
+		return err
+	})
+}
+
+// RevokeSendAs removes a grant. sql.ErrNoRows is returned if the mailbox was
+// not granted the pattern.
+func (d *DB) RevokeSendAs(name string, pattern *model.Address) error {
+	return d.do(func(tx *sql.Tx) error {
+		result, err := tx.Exec(
+			`
+			delete from "sendAs"
+			where "pattern" = ?
+			  and "mailbox" = (
+					select "id"
+					from "mailboxes"
+					where "name" = ?
+				  ) ;
+			`, addressKey(pattern), name)
+
+		if err != nil {
+			return err
+		}
+
+		ar, err := result.RowsAffected()
+		if err != nil {
+			return err
+		}
+
+		if ar < 1 {
+			return sql.ErrNoRows
+		}
+
+		return nil
+	})
+}
+
+// MaySendAs returns true if a mailbox was granted to send as an address,
+// either explicitly or by its domain.
+func (d *DB) MaySendAs(mailbox int64, addr *model.Address) (bool, error) {
+	var count int
+
+	return count > 0, d.do(func(tx *sql.Tx) error {
+		return tx.QueryRow(
+			`
+			select count ( * )
+			from "sendAs"
+			where "mailbox" = ?
+			  and "pattern" in ( ?, ? ) ;
+			`, mailbox, addressKey(addr), "*@"+addr.Domain).Scan(&count)
+	})
+}
@@ -0,0 +1,57 @@
+// Copyright (C) 2020  Lukas Dietrich <lukas@lukasdietrich.com>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package storage
+
+import (
+	"database/sql"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSendAs(t *testing.T) {
+	db, cleanup := openTempDB(t)
+	defer cleanup()
+
+	mailbox, err := db.AddMailbox("user", "secret")
+	assert.Nil(t, err)
+
+	assert.Nil(t, db.GrantSendAs("user", mustAddress("Sales@example.com")))
+	assert.Nil(t, db.GrantSendAs("user", mustAddress("*@example.org")))
+	assert.Equal(t, sql.ErrNoRows, db.GrantSendAs("unknown", mustAddress("sales@example.com")))
+
+	patterns, err := db.SendAs("user")
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"*@example.org", "sales@example.com"}, patterns)
+
+	for addr, expected := range map[string]bool{
+		"sales@example.com":   true,
+		"SALES@example.com":   true,
+		"support@example.com": false,
+		"anyone@example.org":  true,
+	} {
+		ok, err := db.MaySendAs(mailbox, mustAddress(addr))
+		assert.Nil(t, err)
+		assert.Equal(t, expected, ok, addr)
+	}
+
+	assert.Nil(t, db.RevokeSendAs("user", mustAddress("sales@example.com")))
+	assert.Equal(t, sql.ErrNoRows, db.RevokeSendAs("user", mustAddress("sales@example.com")))
+
+	ok, err := db.MaySendAs(mailbox, mustAddress("sales@example.com"))
+	assert.Nil(t, err)
+	assert.False(t, ok)
+}
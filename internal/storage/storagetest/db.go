@@ -0,0 +1,46 @@
+// Copyright (C) 2020  Lukas Dietrich <lukas@lukasdietrich.com>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+// Package storagetest provides helpers for tests, which need a database.
+package storagetest
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/lukasdietrich/briefmail/internal/storage"
+)
+
+// OpenDB opens an empty database in a temporary directory. The returned
+// function closes the database and removes the directory.
+func OpenDB(t *testing.T) (*storage.DB, func()) {
+	dir, err := ioutil.TempDir("", "briefmail")
+	assert.Nil(t, err)
+
+	viper.Set("storage.database.filename", filepath.Join(dir, "db.sqlite"))
+
+	db, err := storage.NewDB()
+	assert.Nil(t, err)
+
+	return db, func() {
+		db.Close()
+		os.RemoveAll(dir)
+	}
+}
@@ -0,0 +1,141 @@
+// Copyright (C) 2020  Lukas Dietrich <lukas@lukasdietrich.com>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package storage
+
+import (
+	"database/sql"
+	"strings"
+	"time"
+)
+
+// Vacation are the out of office settings of a mailbox.
+type Vacation struct {
+	Enabled bool
+	Subject string
+	Body    string
+	// Start and End limit the period, in which replies are sent. A zero time
+	// leaves the period open.
+	Start time.Time
+	End   time.Time
+	// Days is the number of days before the same sender is answered again.
+	Days int64
+	// Addresses are alternative addresses of the owner, which count as
+	// addressed directly.
+	Addresses []string
+}
+
+// Active returns true if replies are sent at the given time.
+func (v *Vacation) Active(now time.Time) bool {
+	return v.Enabled &&
+		(v.Start.IsZero() || !now.Before(v.Start)) &&
+		(v.End.IsZero() || now.Before(v.End))
+}
+
+func unixOrZero(t time.Time) int64 {
+	if t.IsZero() {
+		return 0
+	}
+
+	return t.Unix()
+}
+
+func timeOrZero(unix int64) time.Time {
+	if unix == 0 {
+		return time.Time{}
+	}
+
+	return time.Unix(unix, 0)
+}
+
+// Vacation returns the out of office settings of a mailbox. sql.ErrNoRows is
+// returned if none were set.
+func (d *DB) Vacation(mailbox int64) (*Vacation, error) {
+	var v Vacation
+
+	return &v, d.do(func(tx *sql.Tx) error {
+		var (
+			start, end int64
+			addresses  string
+		)
+
+		err := tx.QueryRow(
+			`
+			select "enabled", "subject", "body", "start", "end", "days", "addresses"
+			from "vacations"
+			where "mailbox" = ? ;
+			`, mailbox).Scan(&v.Enabled, &v.Subject, &v.Body, &start, &end, &v.Days, &addresses)
+
+		if err != nil {
+			return err
+		}
+
+		v.Start = timeOrZero(start)
+		v.End = timeOrZero(end)
+		v.Addresses = strings.Fields(addresses)
+
+		return nil
+	})
+}
+
+// SetVacation creates or replaces the out of office settings of a mailbox.
+func (d *DB) SetVacation(mailbox int64, v *Vacation) error {
+	return d.do(func(tx *sql.Tx) error {
+		_, err := tx.Exec(
+			`
+			insert or replace into "vacations"
+			( "mailbox", "enabled", "subject", "body", "start", "end", "days", "addresses" )
+			values
+			( ?, ?, ?, ?, ?, ?, ?, ? ) ;
+			`,
+			mailbox,
+			v.Enabled,
+			v.Subject,
+			v.Body,
+			unixOrZero(v.Start),
+			unixOrZero(v.End),
+			v.Days,
+			strings.Join(v.Addresses, " "))
+
+		return err
+	})
+}
+
+// DeleteVacation removes the out of office settings of a mailbox.
+// sql.ErrNoRows is returned if none were set.
+func (d *DB) DeleteVacation(mailbox int64) error {
+	return d.do(func(tx *sql.Tx) error {
+		result, err := tx.Exec(
+			`
+			delete from "vacations"
+			where "mailbox" = ? ;
+			`, mailbox)
+
+		if err != nil {
+			return err
+		}
+
+		ar, err := result.RowsAffected()
+		if err != nil {
+			return err
+		}
+
+		if ar < 1 {
+			return sql.ErrNoRows
+		}
+
+		return nil
+	})
+}
@@ -0,0 +1,75 @@
+// Copyright (C) 2020  Lukas Dietrich <lukas@lukasdietrich.com>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package storage
+
+import (
+	"database/sql"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestVacation(t *testing.T) {
+	db, cleanup := openTempDB(t)
+	defer cleanup()
+
+	mailbox, err := db.AddMailbox("user", "secret")
+	assert.Nil(t, err)
+
+	_, err = db.Vacation(mailbox)
+	assert.Equal(t, sql.ErrNoRows, err)
+
+	var (
+		start = time.Date(2020, 7, 1, 0, 0, 0, 0, time.UTC)
+		end   = time.Date(2020, 7, 15, 0, 0, 0, 0, time.UTC)
+	)
+
+	v := Vacation{
+		Enabled:   true,
+		Subject:   "Out of office",
+		Body:      "I am on vacation.",
+		Start:     start,
+		Days:      3,
+		Addresses: []string{"team@example.com", "info@example.com"},
+	}
+
+	assert.Nil(t, db.SetVacation(mailbox, &v))
+
+	stored, err := db.Vacation(mailbox)
+	assert.Nil(t, err)
+	assert.Equal(t, "I am on vacation.", stored.Body)
+	assert.True(t, stored.Start.Equal(start))
+	assert.True(t, stored.End.IsZero())
+	assert.Equal(t, v.Addresses, stored.Addresses)
+
+	assert.False(t, stored.Active(start.Add(-time.Second)))
+	assert.True(t, stored.Active(end.AddDate(1, 0, 0)))
+
+	stored.End = end
+	assert.Nil(t, db.SetVacation(mailbox, stored))
+
+	stored, err = db.Vacation(mailbox)
+	assert.Nil(t, err)
+	assert.True(t, stored.Active(start))
+	assert.False(t, stored.Active(end))
+
+	stored.Enabled = false
+	assert.False(t, stored.Active(start))
+
+	assert.Nil(t, db.DeleteVacation(mailbox))
+	assert.Equal(t, sql.ErrNoRows, db.DeleteVacation(mailbox))
+}
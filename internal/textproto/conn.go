@@ -113,5 +113,10 @@ func (c *conn) RemoteAddr() string {
 		return "127.0.0.1"
 	}
 
+	if c.raw.RemoteAddr().Network() == "unix" {
+		// clients of unix domain sockets are local by definition
+		return "127.0.0.1"
+	}
+
 	return remote[:strings.Index(remote, ":")]
 }
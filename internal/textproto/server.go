@@ -20,6 +20,8 @@ import (
 	"crypto/tls"
 	"errors"
 	"net"
+	"os"
+	"strings"
 	"sync"
 )
 
@@ -33,7 +35,8 @@ var (
 type Server interface {
 	// Listen will open a new tcp listener and block until an error occurs.
 	// An error is either returned when trying to bind the given address or
-	// whenever accepting a new connection fails.
+	// whenever accepting a new connection fails. Addresses prefixed with
+	// "unix:" are paths of unix domain sockets instead.
 	Listen(addr string) error
 
 	// Shutdown gracefully shuts down the Server. Repeated calls are not supported
@@ -95,7 +98,19 @@ func (s *server) waitForClients(callback func()) {
 }
 
 func (s *server) Listen(addr string) error {
-	l, err := net.Listen("tcp", addr)
+	network := "tcp"
+
+	if strings.HasPrefix(addr, "unix:") {
+		network, addr = "unix", strings.TrimPrefix(addr, "unix:")
+
+		// remove the socket left behind by a previous process, but never
+		// anything else
+		if info, err := os.Lstat(addr); err == nil && info.Mode()&os.ModeSocket != 0 {
+			os.Remove(addr) // nolint:errcheck
+		}
+	}
+
+	l, err := net.Listen(network, addr)
 	if err != nil {
 		return err
 	}
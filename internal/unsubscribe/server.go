@@ -0,0 +1,147 @@
+// Copyright (C) 2020  Lukas Dietrich <lukas@lukasdietrich.com>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+// Package unsubscribe serves the one-click unsubscribe links of mailing lists
+// as specified in RFC#8058.
+package unsubscribe
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"html"
+	"net/http"
+	"path"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+
+	"github.com/lukasdietrich/briefmail/internal/storage"
+)
+
+var log = logrus.WithField("prefix", "unsubscribe")
+
+func init() {
+	viper.SetDefault("lists.unsubscribe.address", "")
+}
+
+// maxRequestSize limits the body of unsubscribe requests, which only consist
+// of a single form field.
+const maxRequestSize = 4096
+
+// Server answers requests to the unsubscribe links of list mails. It does not
+// speak tls itself, so it is meant to run behind a reverse proxy.
+type Server struct {
+	DB *storage.DB
+
+	server *http.Server `wire:"-"`
+}
+
+// Start serves unsubscribe links in the background until Shutdown is called.
+func (s *Server) Start() {
+	addr := viper.GetString("lists.unsubscribe.address")
+	if addr == "" {
+		log.Info("one-click unsubscribe is not served")
+		return
+	}
+
+	log.Infof("serving one-click unsubscribe on %q", addr)
+
+	s.server = &http.Server{
+		Addr:         addr,
+		Handler:      s,
+		ReadTimeout:  time.Second * 30,
+		WriteTimeout: time.Second * 30,
+	}
+
+	go func() {
+		if err := s.server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+			log.Fatal(err)
+		}
+	}()
+}
+
+// Shutdown stops serving and waits for requests in progress to finish or the
+// context to be done.
+func (s *Server) Shutdown(ctx context.Context) {
+	if s.server == nil {
+		return
+	}
+
+	if err := s.server.Shutdown(ctx); err != nil {
+		log.Warn(err)
+	}
+}
+
+// ServeHTTP unsubscribes on POST requests only. Links opened in a browser or
+// fetched by scanners just show a form to confirm the request.
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	token := path.Base(r.URL.Path)
+
+	switch r.Method {
+	case http.MethodGet, http.MethodHead:
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		fmt.Fprintf(w, confirmForm, html.EscapeString(token)) // nolint:errcheck
+
+	case http.MethodPost:
+		s.unsubscribe(w, r, token)
+
+	default:
+		w.Header().Set("Allow", "GET, HEAD, POST")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+func (s *Server) unsubscribe(w http.ResponseWriter, r *http.Request, token string) {
+	r.Body = http.MaxBytesReader(w, r.Body, maxRequestSize)
+
+	if r.PostFormValue("List-Unsubscribe") != "One-Click" {
+		http.Error(w, "expected List-Unsubscribe=One-Click", http.StatusBadRequest)
+		return
+	}
+
+	list, subscription, err := s.DB.UnsubscribeToken(token)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			http.Error(w, "no such subscription", http.StatusNotFound)
+			return
+		}
+
+		log.Warnf("could not unsubscribe: %v", err)
+		http.Error(w, "internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	log.WithField("list", list).
+		WithField("address", subscription.Address).
+		Info("unsubscribed with one click")
+
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	fmt.Fprintf(w, "<%s> was unsubscribed from %s.\n", subscription.Address, list) // nolint:errcheck
+}
+
+const confirmForm = `<!DOCTYPE html>
+<html>
+<head><title>Unsubscribe</title></head>
+<body>
+<form method="post" action="%s">
+<input type="hidden" name="List-Unsubscribe" value="One-Click">
+<button type="submit">Unsubscribe</button>
+</form>
+</body>
+</html>
+`
@@ -0,0 +1,76 @@
+// Copyright (C) 2020  Lukas Dietrich <lukas@lukasdietrich.com>
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package unsubscribe
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/lukasdietrich/briefmail/internal/model"
+	"github.com/lukasdietrich/briefmail/internal/storage/storagetest"
+)
+
+func TestServeHTTP(t *testing.T) {
+	db, cleanup := storagetest.OpenDB(t)
+	defer cleanup()
+
+	list, err := model.ParseAddress("dev@example.com")
+	assert.Nil(t, err)
+
+	alice, err := model.ParseAddress("alice@example.org")
+	assert.Nil(t, err)
+
+	assert.Nil(t, db.Subscribe(list, alice))
+
+	subscriptions, err := db.Subscriptions(list)
+	assert.Nil(t, err)
+	assert.Len(t, subscriptions, 1)
+
+	var (
+		server = Server{DB: db}
+		link   = "/unsubscribe/" + subscriptions[0].Token
+	)
+
+	serve := func(method, target, body string) int {
+		r := httptest.NewRequest(method, target, strings.NewReader(body))
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+		w := httptest.NewRecorder()
+		server.ServeHTTP(w, r)
+
+		return w.Code
+	}
+
+	// opening the link must not unsubscribe
+	assert.Equal(t, http.StatusOK, serve(http.MethodGet, link, ""))
+	assert.Equal(t, http.StatusBadRequest, serve(http.MethodPost, link, ""))
+	assert.Equal(t, http.StatusMethodNotAllowed, serve(http.MethodDelete, link, ""))
+
+	ok, err := db.IsSubscribed(list, alice)
+	assert.Nil(t, err)
+	assert.True(t, ok)
+
+	assert.Equal(t, http.StatusOK, serve(http.MethodPost, link, "List-Unsubscribe=One-Click"))
+	assert.Equal(t, http.StatusNotFound, serve(http.MethodPost, link, "List-Unsubscribe=One-Click"))
+
+	ok, err = db.IsSubscribed(list, alice)
+	assert.Nil(t, err)
+	assert.False(t, ok)
+}